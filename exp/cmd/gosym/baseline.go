@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// declKey identifies a declaration independently of its
+// position, so that declarations can be matched between
+// two versions of the source.
+type declKey struct {
+	pkg  string
+	name string
+}
+
+// declLines returns the global declarations in lines,
+// as printed by list, keyed by package and name.
+// If a declaration appears more than once, as it
+// may when several platforms are listed, the
+// first line is used.
+func declLines(lines []*symLine) map[declKey]*symLine {
+	decls := make(map[declKey]*symLine)
+	for _, sl := range lines {
+		if !sl.long || !sl.plus || sl.local {
+			continue
+		}
+		k := declKey{sl.referPkg, sl.expr}
+		if decls[k] == nil {
+			decls[k] = sl
+		}
+	}
+	return decls
+}
+
+// readBaseline reads the lines of a symbol listing
+// previously saved in the named file.
+func readBaseline(file string) ([]*symLine, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readListing(f, file)
+}
+
+// readListing reads the lines of a symbol listing from rd;
+// name is used in error messages. Unlike readLines, it does
+// not resolve byte offsets, as the files they refer to
+// may since have changed or gone.
+func readListing(rd io.Reader, name string) ([]*symLine, error) {
+	var lines []*symLine
+	r := bufio.NewReader(rd)
+	for n := 1; ; n++ {
+		line, err := readLine(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %v", name, err)
+		}
+		if n == 1 {
+			line = strings.TrimPrefix(line, byteOrderMark)
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		sl, err := parseSymLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: cannot parse %q: %v", name, n, line, err)
+		}
+		// Print the line again as it was given.
+		sl.offsets = sl.pos.Line == 0
+		lines = append(lines, sl)
+	}
+	return lines, nil
+}
+
+// printBaselineDiff prints to w the differences between the
+// declarations in the baseline listing, old, and those in the
+// current one, cur. It returns the number of declarations that
+// were removed or changed.
+func printBaselineDiff(w io.Writer, old, cur map[declKey]*symLine) int {
+	var lines []listedLine
+	add := func(sl *symLine, text string) {
+		lines = append(lines, listedLine{sl, text})
+	}
+	nbroken := 0
+	for k, osl := range old {
+		nsl := cur[k]
+		switch {
+		case nsl == nil:
+			add(osl, fmt.Sprintf("removed %s\n", osl))
+			nbroken++
+		case declChanged(osl, nsl):
+			add(nsl, fmt.Sprintf("changed %s; was %s\n", nsl, strings.TrimSpace(osl.kind.String()+" "+osl.exprType)))
+			nbroken++
+		}
+	}
+	for k, nsl := range cur {
+		if old[k] == nil {
+			add(nsl, fmt.Sprintf("added %s\n", nsl))
+		}
+	}
+	sort.Stable(listedLines(lines))
+	for _, l := range lines {
+		io.WriteString(w, l.text)
+	}
+	return nbroken
+}
+
+// declChanged reports whether the declaration in cur
+// differs in kind or type from that in old. The types are
+// compared only if both are known.
+func declChanged(old, cur *symLine) bool {
+	if old.kind != cur.kind {
+		return true
+	}
+	return old.exprType != "" && cur.exprType != "" && old.exprType != cur.exprType
+}
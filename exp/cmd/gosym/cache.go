@@ -0,0 +1,187 @@
+package main
+
+import (
+	"code.google.com/p/rog-go/exp/go/token"
+	"crypto/sha1"
+	"fmt"
+	"go/build"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// cacheVersion should be changed whenever the
+// output of the list command changes.
+const cacheVersion = "gosym-list-10"
+
+// defaultCacheDir returns the directory used to hold
+// the on-disk cache, or the empty string if there is none.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gosym")
+}
+
+// cacheKey returns the key under which the listing of the package
+// with the given path is cached, or the empty string if it
+// should not be cached. The key depends on the given parameters,
+// on the build context (target platform, build tags, cgo, GOROOT
+// and GOPATH), on the global flags that change the listing
+// (-tests, -generated, -runes and -predeclared),
+// on the name, modification time and contents of every
+// source file in the package, and on the stamps of all the
+// packages it imports (see importStamp), so an entry is never
+// used after any of those files has changed.
+func (ctxt *context) cacheKey(path string, params ...interface{}) string {
+	if ctxt.cacheDir == "" {
+		return ""
+	}
+	cwd, _ := os.Getwd()
+	bpkg, err := ctxt.FindPackage(path, cwd, 0)
+	if err != nil {
+		return ""
+	}
+	h := sha1.New()
+	bctxt := ctxt.BuildContext
+	fmt.Fprintf(h, "%s %s %q %v %q %q\n", cacheVersion, ctxt.platform, bctxt.BuildTags, bctxt.CgoEnabled, bctxt.GOROOT, bctxt.GOPATH)
+	fmt.Fprintf(h, "%v %v %v %q\n", ctxt.ImportTests, ctxt.Generated, *runes, *predeclared)
+	// Each parameter is printed as Go syntax on a line of its
+	// own, so that different parameters never give the same key,
+	// as -match '. F' -exclude Z and -match . -exclude 'F Z'
+	// would if they were separated by spaces.
+	for _, p := range params {
+		fmt.Fprintf(h, "%#v\n", p)
+	}
+	files := append(append([]string(nil), bpkg.GoFiles...), bpkg.CgoFiles...)
+	files = append(files, bpkg.TestGoFiles...)
+	imports := append([]string(nil), bpkg.Imports...)
+	imports = append(imports, bpkg.TestImports...)
+	if ctxt.ImportTests {
+		files = append(files, bpkg.XTestGoFiles...)
+		imports = append(imports, bpkg.XTestImports...)
+	}
+	if err := hashFiles(h, bpkg.Dir, files, true); err != nil {
+		return ""
+	}
+	sort.Strings(imports)
+	for _, path := range imports {
+		stamp, err := ctxt.importStamp(path, bpkg.Dir)
+		if err != nil {
+			return ""
+		}
+		fmt.Fprintf(h, "import %s %s\n", path, stamp)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// importStamp returns a string that changes whenever any
+// source file in the imported package with the given path,
+// or any package it imports, changes.
+// Reading the contents of all those files would take
+// longer than parsing the few declarations that are
+// needed from them, so only their names and
+// modification times are used.
+func (ctxt *context) importStamp(path, srcDir string) (string, error) {
+	if path == "C" || path == "unsafe" {
+		return "", nil
+	}
+	ctxt.mu.Lock()
+	stamp, ok := ctxt.stamps[path]
+	ctxt.mu.Unlock()
+	if ok {
+		return stamp, nil
+	}
+	bpkg, err := ctxt.FindPackage(path, srcDir, 0)
+	if err != nil {
+		return "", err
+	}
+	h := sha1.New()
+	files := append(append([]string(nil), bpkg.GoFiles...), bpkg.CgoFiles...)
+	if err := hashFiles(h, bpkg.Dir, files, false); err != nil {
+		return "", err
+	}
+	for _, imp := range bpkg.Imports {
+		stamp, err := ctxt.importStamp(imp, bpkg.Dir)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "import %s %s\n", imp, stamp)
+	}
+	stamp = fmt.Sprintf("%x", h.Sum(nil))
+	if !build.IsLocalImport(path) {
+		ctxt.mu.Lock()
+		ctxt.stamps[path] = stamp
+		ctxt.mu.Unlock()
+	}
+	return stamp, nil
+}
+
+// hashFiles adds the name and modification time of each
+// of the given files in dir to h, and its contents too
+// if contents is true.
+func hashFiles(h hash.Hash, dir string, files []string, contents bool) error {
+	sort.Strings(files)
+	for _, name := range files {
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "file %s %d %d\n", path, info.ModTime().UnixNano(), info.Size())
+		if !contents {
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readCache returns the data cached under the given key.
+func (ctxt *context) readCache(key string) ([]byte, bool) {
+	data, err := ioutil.ReadFile(filepath.Join(ctxt.cacheDir, key))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// writeCache caches the given data under the given key.
+// Failure to write the cache is not an error, but
+// is logged if verbose messages are enabled.
+func (ctxt *context) writeCache(key string, data []byte) {
+	err := os.MkdirAll(ctxt.cacheDir, 0777)
+	if err == nil {
+		// Write to a temporary file first so that concurrent
+		// readers never see a partially written entry.
+		var f *os.File
+		f, err = ioutil.TempFile(ctxt.cacheDir, key+".tmp")
+		if err == nil {
+			_, err = f.Write(data)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err == nil {
+				err = os.Rename(f.Name(), filepath.Join(ctxt.cacheDir, key))
+			}
+			if err != nil {
+				os.Remove(f.Name())
+			}
+		}
+	}
+	if err != nil && *verbose {
+		ctxt.warnf(token.Position{}, warnCache, "cannot write cache: %v", err)
+	}
+}
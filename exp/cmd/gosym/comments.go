@@ -0,0 +1,62 @@
+package main
+
+import (
+	"code.google.com/p/rog-go/exp/go/ast"
+	"strings"
+)
+
+// specGroups returns a map from each spec declared in the
+// given packages to the declaration that holds it.
+func specGroups(pkgs []*ast.Package) map[ast.Spec]*ast.GenDecl {
+	groups := make(map[ast.Spec]*ast.GenDecl)
+	for _, pkg := range pkgs {
+		for _, f := range pkg.Files {
+			for _, d := range f.Decls {
+				if gd, ok := d.(*ast.GenDecl); ok {
+					for _, spec := range gd.Specs {
+						groups[spec] = gd
+					}
+				}
+			}
+		}
+	}
+	return groups
+}
+
+// docInfo reports whether the declaration of obj has a doc
+// comment, and whether the comment marks it as deprecated
+// with a line starting "Deprecated:". A type, constant or
+// variable without a comment of its own has that of the
+// declaration holding it, found in groups (see specGroups).
+func docInfo(obj *ast.Object, groups map[ast.Spec]*ast.GenDecl) (documented, deprecated bool) {
+	var doc *ast.CommentGroup
+	switch d := obj.Decl.(type) {
+	case *ast.FuncDecl:
+		doc = d.Doc
+	case *ast.Field:
+		doc = d.Doc
+	case *ast.TypeSpec:
+		doc = d.Doc
+		if doc == nil && groups[d] != nil {
+			doc = groups[d].Doc
+		}
+	case *ast.ValueSpec:
+		doc = d.Doc
+		if doc == nil && groups[d] != nil {
+			doc = groups[d].Doc
+		}
+	}
+	if doc == nil {
+		return false, false
+	}
+	for _, c := range doc.List {
+		text := strings.TrimPrefix(c.Text, "//")
+		text = strings.TrimSuffix(strings.TrimPrefix(text, "/*"), "*/")
+		for _, line := range strings.Split(text, "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "Deprecated:") {
+				return true, true
+			}
+		}
+	}
+	return true, false
+}
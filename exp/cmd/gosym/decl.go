@@ -0,0 +1,107 @@
+package main
+
+import (
+	"code.google.com/p/rog-go/exp/go/ast"
+	"code.google.com/p/rog-go/exp/go/sym"
+	"code.google.com/p/rog-go/exp/go/token"
+	"code.google.com/p/rog-go/exp/go/types"
+	"fmt"
+	"strings"
+)
+
+// lookupDecl returns the object named by name, which is in
+// pkg.Name, pkg.T.M or pkg.(*T).M format, where pkg is an
+// import path, and its type. The package is imported from
+// ctxt, and the object is resolved as if it were named in
+// an expression.
+func lookupDecl(ctxt *context, name string) (*ast.Object, types.Type, error) {
+	pkg, rest := splitDeclName(ctxt, name)
+	if pkg == nil {
+		return nil, types.Type{}, withCode(exitNotFound, fmt.Errorf("cannot find package for %q", name))
+	}
+	var typeName, member string
+	ptr := strings.HasPrefix(rest, "(*")
+	if ptr {
+		i := strings.Index(rest, ").")
+		if i < 0 {
+			return nil, types.Type{}, fmt.Errorf("invalid method name %q", name)
+		}
+		typeName, member = rest[2:i], rest[i+2:]
+	} else if i := strings.Index(rest, "."); i >= 0 {
+		typeName, member = rest[0:i], rest[i+1:]
+	} else {
+		typeName = rest
+	}
+	if typeName == "" || strings.Contains(member, ".") || (member == "" && rest != typeName) {
+		return nil, types.Type{}, fmt.Errorf("invalid name %q", name)
+	}
+	obj := pkg.Scope.Lookup(typeName)
+	if obj == nil {
+		return nil, types.Type{}, fmt.Errorf("%s not found in package %s", typeName, pkg.Name)
+	}
+	var e ast.Expr = &ast.Ident{Name: obj.Name, Obj: obj}
+	if member != "" {
+		if obj.Kind != ast.Typ {
+			return nil, types.Type{}, fmt.Errorf("%s is not a type", typeName)
+		}
+		if ptr {
+			e = &ast.ParenExpr{X: &ast.StarExpr{X: e}}
+		}
+		e = &ast.SelectorExpr{X: e, Sel: &ast.Ident{Name: member}}
+	}
+	obj, t := types.ExprType(e, ctxt.Import)
+	if obj == nil {
+		return nil, types.Type{}, fmt.Errorf("cannot resolve %s", name)
+	}
+	if types.DeclPos(obj) == token.NoPos {
+		return nil, types.Type{}, fmt.Errorf("no declaration for %s", name)
+	}
+	return obj, t, nil
+}
+
+// splitDeclName splits name, as given to lookupDecl, into the
+// package it names and the rest of the name. As the last element
+// of an import path may itself contain dots (as in gopkg.in/yaml.v2),
+// the path is taken to end at the first dot after which a package
+// can be imported. It returns a nil package if there is none.
+func splitDeclName(ctxt *context, name string) (*ast.Package, string) {
+	start := strings.LastIndex(name, "/") + 1
+	for i := start; i < len(name); i++ {
+		if name[i] != '.' || i == 0 {
+			continue
+		}
+		if pkg := ctxt.Import(name[0:i]); pkg != nil {
+			return pkg, name[i+1:]
+		}
+	}
+	return nil, ""
+}
+
+// printDecl prints the declaration position of the
+// symbol named by the -decl flag, and its type if the
+// -t flag is given.
+func (c *listCmd) printDecl(ctxt *context) error {
+	obj, t, err := lookupDecl(ctxt, c.decl)
+	if err != nil {
+		return err
+	}
+	return c.printDeclOf(ctxt, obj, t)
+}
+
+// printDeclOf prints the declaration position of obj,
+// and its type, t, if the -t flag is given.
+func (c *listCmd) printDeclOf(ctxt *context, obj *ast.Object, t types.Type) error {
+	p := ctxt.position(types.DeclPos(obj))
+	var err error
+	if *runes && !c.offset {
+		if p, err = make(lineTables).runeColumn(p); err != nil {
+			return err
+		}
+	}
+	ctxt.printf("%s", formatPosition(p, c.offset))
+	if c.printType {
+		ctxt.printf(" %s", c.exprTypeString(&sym.Info{ReferObj: obj, ExprType: t}))
+	}
+	ctxt.printf("\n")
+	return nil
+}
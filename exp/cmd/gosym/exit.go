@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+)
+
+// The codes that gosym exits with. When more than one
+// outcome applies, the highest code is used.
+const (
+	exitError      = 1 // the command failed.
+	exitUsage      = 2 // the command line is invalid.
+	exitNotFound   = 3 // a named package could not be found.
+	exitUnresolved = 4 // too many symbols were unresolved (see -maxunresolved).
+	exitWrite      = 5 // the requested changes could not all be made.
+)
+
+// exitStatus holds the code that gosym will exit with,
+// as raised by setExitStatus.
+var exitStatus struct {
+	mu   sync.Mutex
+	code int
+}
+
+// setExitStatus raises the code that gosym
+// will exit with to code if it is higher.
+func setExitStatus(code int) {
+	exitStatus.mu.Lock()
+	defer exitStatus.mu.Unlock()
+	if code > exitStatus.code {
+		exitStatus.code = code
+	}
+}
+
+// exitCode returns the code that gosym will exit with.
+func exitCode() int {
+	exitStatus.mu.Lock()
+	defer exitStatus.mu.Unlock()
+	return exitStatus.code
+}
+
+// codeError is an error that makes
+// gosym exit with the given code.
+type codeError struct {
+	code int
+	err  error
+}
+
+func (e *codeError) Error() string {
+	return e.err.Error()
+}
+
+// withCode returns err as a codeError with the
+// given code, or nil if err is nil.
+func withCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codeError{code, err}
+}
@@ -5,45 +5,118 @@ import (
 	"code.google.com/p/rog-go/exp/go/token"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"strings"
 	"unicode"
 )
 
-func readLines(f func(sl *symLine) error) error {
-	r := bufio.NewReader(os.Stdin)
-	for {
-		line, isPrefix, err := r.ReadLine()
+// readLines calls f for each line read from the standard input.
+// Lines that cannot be parsed, or for which f returns an error,
+// are logged with their line numbers and skipped; if there were
+// any such lines, readLines returns an error after all the
+// input has been read. Blank lines are ignored. Positions
+// given as byte offsets are converted to line:column form, and
+// if the gosym -runes flag is given, columns are converted
+// from runes to bytes.
+func (ctxt *context) readLines(f func(sl *symLine) error) error {
+	return ctxt.readLinesFrom(os.Stdin, f)
+}
+
+// readLinesFrom is like readLines but reads from rd.
+func (ctxt *context) readLinesFrom(rd io.Reader, f func(sl *symLine) error) error {
+	r := bufio.NewReader(rd)
+	lines := make(lineTables)
+	nbad, firstBad := 0, 0
+	for n := 1; ; n++ {
+		line, err := readLine(r)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("read error: %v", err)
+			return fmt.Errorf("read error at input line %d: %v", n, err)
+		}
+		if n == 1 {
+			line = strings.TrimPrefix(line, byteOrderMark)
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		sl, err := parseSymLine(line)
+		if err != nil {
+			err = fmt.Errorf("cannot parse %q: %v", line, err)
+		} else if *runes {
+			err = sl.byteColumns(lines)
 		}
-		if isPrefix {
-			return fmt.Errorf("line too long")
+		if err == nil {
+			if err = sl.resolveOffsets(lines); err == nil {
+				err = f(sl)
+			}
+		}
+		if err != nil {
+			ctxt.warnf(token.Position{}, warnInput, "input line %d: %v", n, err)
+			if nbad == 0 {
+				firstBad = n
+			}
+			nbad++
 		}
-		sl, err := parseSymLine(string(line))
+	}
+	switch nbad {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("bad input at line %d", firstBad)
+	}
+	return fmt.Errorf("%d bad input lines, the first at line %d", nbad, firstBad)
+}
+
+// byteOrderMark is the UTF-8 byte order mark, which some
+// Windows tools put at the start of a text file.
+const byteOrderMark = "\ufeff"
+
+// readLine reads a line from r, without its line terminator
+// ("\n" or "\r\n"), however long it is.
+func readLine(r *bufio.Reader) (string, error) {
+	var buf []byte
+	for {
+		data, isPrefix, err := r.ReadLine()
 		if err != nil {
-			return fmt.Errorf("cannot parse line %q: %v", line, err)
+			if err == io.EOF && len(buf) > 0 {
+				break
+			}
+			return "", err
+		}
+		buf = append(buf, data...)
+		if !isPrefix {
+			break
 		}
-		if err := f(sl); err != nil {
+	}
+	// ReadLine removes a trailing "\r" only when it is
+	// followed by a newline, so remove it from a final
+	// unterminated line too.
+	return strings.TrimSuffix(string(buf), "\r"), nil
+}
+
+// printLine prints sl. If the gosym -runes flag is given,
+// lines is used to convert its columns back to runes.
+func printLine(ctxt *context, lines lineTables, sl *symLine) error {
+	if *runes {
+		if err := sl.runeColumns(lines); err != nil {
 			return err
 		}
 	}
+	ctxt.printf("%s\n", sl)
 	return nil
 }
 
 func runSimpleFilter(ctxt *context, f func(string) string) error {
-	return readLines(func(sl *symLine) error {
+	lines := make(lineTables)
+	return ctxt.readLines(func(sl *symLine) error {
 		if sl.long {
 			sl.newExpr = sl.symName()
 		}
 		sl.newExpr = f(sl.newExpr)
 		sl.long = false
-		ctxt.printf("%s\n", sl)
-		return nil
+		return printLine(ctxt, lines, sl)
 	})
 }
 
@@ -56,22 +129,24 @@ gosym short
 The short command reads lines from standard input
 in short or long format (see the list command) and
 prints them in short format:
-	file-position name new-name
+	file-position name new-name [local]
 The file-position field holds the location of the identifier.
 The name field holds the name of the identifier (in X.Y format if
 it is defined as a member of another type X).
 The new-name field holds the desired new name for the identifier.
+The word local follows if the identifier refers to a
+function-local object.
 `[1:])
 }
 
 func (c *shortCmd) run(ctxt *context, args []string) error {
-	return readLines(func(sl *symLine) error {
+	lines := make(lineTables)
+	return ctxt.readLines(func(sl *symLine) error {
 		if sl.long {
 			sl.newExpr = sl.symName()
 		}
 		sl.long = false
-		ctxt.printf("%s\n", sl)
-		return nil
+		return printLine(ctxt, lines, sl)
 	})
 }
 
@@ -169,7 +244,7 @@ func (c *renameCmd) run(ctxt *context, args []string) error {
 	})
 }
 
-func readUses(pkgArgs []string) (defs map[token.Position]*symLine, uses map[token.Position]*symLine, err error) {
+func (ctxt *context) readUses(pkgArgs []string) (defs map[token.Position]*symLine, uses map[token.Position]*symLine, err error) {
 	if len(pkgArgs) == 0 {
 		return nil, nil, fmt.Errorf("at least one package argument required")
 	}
@@ -179,7 +254,7 @@ func readUses(pkgArgs []string) (defs map[token.Position]*symLine, uses map[toke
 	}
 	defs = make(map[token.Position]*symLine)
 	uses = make(map[token.Position]*symLine)
-	err = readLines(func(sl *symLine) error {
+	err = ctxt.readLines(func(sl *symLine) error {
 		if !sl.long {
 			return fmt.Errorf("input must be in long format")
 		}
@@ -210,15 +285,18 @@ have references to them from any other package.
 }
 
 func (c *usedCmd) run(ctxt *context, args []string) error {
-	defs, uses, err := readUses(args)
+	defs, uses, err := ctxt.readUses(args)
 	if err != nil {
 		return err
 	}
+	lines := make(lineTables)
 	for use, usl := range uses {
 		if sl := defs[use]; sl != nil {
-			ctxt.printf("%s\n", sl)
+			if err := printLine(ctxt, lines, sl); err != nil {
+				return err
+			}
 		} else {
-			log.Printf("definition for %v not found; used at %v", use, usl.pos)
+			ctxt.warnf(usl.pos, warnInput, "definition for %v not found", use)
 		}
 	}
 	return nil
@@ -239,7 +317,7 @@ have no references to them from any other package.
 }
 
 func (c *unusedCmd) run(ctxt *context, args []string) error {
-	defs, uses, err := readUses(args)
+	defs, uses, err := ctxt.readUses(args)
 	if err != nil {
 		return err
 	}
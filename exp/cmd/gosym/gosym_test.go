@@ -1,10 +1,28 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"code.google.com/p/rog-go/exp/go/ast"
+	"code.google.com/p/rog-go/exp/go/parser"
+	"code.google.com/p/rog-go/exp/go/printer"
+	"code.google.com/p/rog-go/exp/go/sym"
 	"code.google.com/p/rog-go/exp/go/token"
+	"code.google.com/p/rog-go/exp/go/types"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"os"
 	. "launchpad.net/gocheck"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
 	"testing"
+	"text/template"
+	"time"
 )
 
 type suite struct{}
@@ -15,6 +33,62 @@ func TestAll(t *testing.T) {
 	TestingT(t)
 }
 
+// testGoPath creates a GOPATH directory holding the given
+// files, keyed by their slash-separated paths below its
+// src directory, and returns the directory.
+func testGoPath(c *C, files map[string]string) string {
+	gopath := c.MkDir()
+	for name, data := range files {
+		path := filepath.Join(gopath, "src", filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(path), 0777)
+		c.Assert(err, IsNil)
+		err = ioutil.WriteFile(path, []byte(data), 0666)
+		c.Assert(err, IsNil)
+	}
+	return gopath
+}
+
+// testContext returns a context that finds packages in
+// the given GOPATH directory and does not use the cache.
+func testContext(gopath string) *context {
+	bctxt := build.Default
+	bctxt.GOPATH = gopath
+	ctxt := newContext(&bctxt, nil)
+	ctxt.cacheDir = ""
+	return ctxt
+}
+
+// newWriteCmd returns a write command that makes
+// changes in ctxt, with no input lines read.
+func newWriteCmd(ctxt *context) *writeCmd {
+	w := &writeCmd{}
+	w.reset(ctxt)
+	return w
+}
+
+// listPackage returns the listing of the package with the
+// given path made by cmd, which must not fail.
+func listPackage(c *C, cmd *listCmd, path string, mask uint) string {
+	data, err := cmd.listPackage(path, mask)
+	c.Assert(err, IsNil)
+	return string(data)
+}
+
+// addLines adds input lines to w as readSymbols does.
+// Each line is given without the name of the file
+// holding its position, which is filename.
+func addLines(c *C, w *writeCmd, filename string, lines ...string) {
+	for _, line := range lines {
+		sl, err := parseSymLine(filename + ":" + line)
+		c.Assert(err, IsNil)
+		path, err := w.positionToImportPath(sl.pos)
+		c.Assert(err, IsNil)
+		if w.addLine(sl) {
+			w.symPkgs[path] = true
+		}
+	}
+}
+
 var parseSymLineTests = []struct {
 	in     string
 	expect symLine
@@ -63,6 +137,45 @@ var parseSymLineTests = []struct {
 		expr:     "z",
 		exprType: "",
 	},
+}, {
+	in: "a.go:3:2: a.go:3:2 p p Mode const+ Mode = 1",
+	expect: symLine{
+		long:     true,
+		pos:      token.Position{Filename: "a.go", Line: 3, Column: 2},
+		referPos: token.Position{Filename: "a.go", Line: 3, Column: 2},
+		exprPkg:  "p",
+		referPkg: "p",
+		kind:     ast.Con,
+		plus:     true,
+		expr:     "Mode",
+		exprType: "Mode",
+		value:    "1",
+	},
+}, {
+	in: `a.go:4:2: a.go:4:2 p p S const+ = "x = y"`,
+	expect: symLine{
+		long:     true,
+		pos:      token.Position{Filename: "a.go", Line: 4, Column: 2},
+		referPos: token.Position{Filename: "a.go", Line: 4, Column: 2},
+		exprPkg:  "p",
+		referPkg: "p",
+		kind:     ast.Con,
+		plus:     true,
+		expr:     "S",
+		value:    `"x = y"`,
+	},
+}, {
+	// An unresolved reference.
+	in: "a.go:7:15: a.go:5:8 p ? Y bad",
+	expect: symLine{
+		long:     true,
+		pos:      token.Position{Filename: "a.go", Line: 7, Column: 15},
+		referPos: token.Position{Filename: "a.go", Line: 5, Column: 8},
+		exprPkg:  "p",
+		referPkg: "?",
+		kind:     ast.Bad,
+		expr:     "Y",
+	},
 }, {
 	in: "x.go:2:4: old new",
 	expect: symLine{
@@ -75,6 +188,22 @@ var parseSymLineTests = []struct {
 		expr:    "old",
 		newExpr: "new",
 	},
+}, {
+	in: "x.go:2:4: old new local",
+	expect: symLine{
+		long: false,
+		pos: token.Position{
+			Filename: "x.go",
+			Line:     2,
+			Column:   4,
+		},
+		expr:    "old",
+		newExpr: "new",
+		local:   true,
+	},
+}, {
+	in:  "x.go:2:4: old new global",
+	err: "invalid line",
 }, {
 	in:  "x/y/z:1:0: f.go:3:4 x y z xxx",
 	err: `invalid kind "xxx"`,
@@ -100,6 +229,3248 @@ func (suite) TestParseSymLine(c *C) {
 	}
 }
 
+func (suite) TestJSONSymLine(c *C) {
+	for i, test := range parseSymLineTests {
+		if test.err != "" {
+			continue
+		}
+		c.Logf("test %d", i)
+		data, err := json.Marshal(test.expect.toJSON())
+		c.Assert(err, IsNil)
+		sl, err := parseSymLine(string(data))
+		c.Assert(err, IsNil)
+		c.Assert(sl, DeepEquals, &test.expect)
+	}
+}
+
+// longFormat prints a line in long format with list -format.
+const longFormat = `{{.Pos}}: {{.ReferPos}} {{.ExprPkg}} {{.ReferPkg}} {{.Expr}} {{if .Local}}local{{end}}{{.Kind}}{{if .Plus}}+{{end}}{{with .ExprType}} {{.}}{{end}}{{with .Value}} = {{.}}{{end}}`
+
+func (suite) TestTemplateSymLine(c *C) {
+	tmpl := template.Must(template.New("").Parse(longFormat))
+	for i, test := range parseSymLineTests {
+		if test.err != "" || !test.expect.long {
+			continue
+		}
+		c.Logf("test %d", i)
+		var buf bytes.Buffer
+		err := tmpl.Execute(&buf, test.expect.templateData())
+		c.Assert(err, IsNil)
+		c.Assert(buf.String(), Equals, test.expect.String())
+	}
+}
+
+func (suite) TestJSONSymLineError(c *C) {
+	_, err := parseSymLine(`{"pos":{"filename":"x.go","line":1,"column":2},"expr":"x","kind":"xxx"}`)
+	c.Assert(err, ErrorMatches, `invalid kind "xxx"`)
+	_, err = parseSymLine(`{"pos":`)
+	c.Assert(err, ErrorMatches, "invalid JSON line: .*")
+}
+
+var parsePositionTests = []struct {
+	in     string
+	expect token.Position
+	err    string
+}{{
+	in:     "foo/bar.go:23:45",
+	expect: token.Position{Filename: "foo/bar.go", Line: 23, Column: 45},
+}, {
+	in:     "foo.go:1:2:",
+	expect: token.Position{Filename: "foo.go", Line: 1, Column: 2},
+}, {
+	in:     "foo.go:#123",
+	expect: token.Position{Filename: "foo.go", Offset: 123},
+}, {
+	in:  "foo.go:1",
+	err: `invalid position "foo.go:1"`,
+}, {
+	in:  "foo.go:#1:2",
+	err: `invalid position "foo.go:#1:2"`,
+}}
+
+func (suite) TestParsePosition(c *C) {
+	for i, test := range parsePositionTests {
+		c.Logf("test %d: %q", i, test.in)
+		p, err := parsePosition(test.in)
+		if test.err != "" {
+			c.Assert(err, ErrorMatches, test.err)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(p, Equals, test.expect)
+	}
+}
+
+var offsetSource = `package p
+
+import "fmt"
+
+// Ünïcode comment.
+func F(a, b int) {
+	fmt.Println(a, "ß", b)
+}
+`
+
+func (suite) TestOffsetRoundTrip(c *C) {
+	path := filepath.Join(c.MkDir(), "p.go")
+	err := ioutil.WriteFile(path, []byte(offsetSource), 0666)
+	c.Assert(err, IsNil)
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, offsetSource, 0, ast.NewScope(parser.Universe))
+	c.Assert(err, IsNil)
+	tables := make(lineTables)
+	n := 0
+	ast.Inspect(f, func(node ast.Node) bool {
+		id, ok := node.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		n++
+		p := fset.Position(id.Pos())
+		want := token.Position{Filename: path, Line: p.Line, Column: p.Column}
+		for _, offsets := range []bool{false, true} {
+			text := (&symLine{pos: p, expr: id.Name, newExpr: "X", offsets: offsets}).String()
+			c.Logf("%s", text)
+			sl, err := parseSymLine(text)
+			c.Assert(err, IsNil)
+			c.Assert(sl.resolveOffsets(tables), IsNil)
+			c.Assert(sl.pos, Equals, want)
+		}
+		return true
+	})
+	c.Assert(n > 5, Equals, true)
+	_, err = tables.resolve(token.Position{Filename: path, Offset: len(offsetSource)})
+	c.Assert(err, ErrorMatches, "offset .* out of range in .*")
+}
+
+func (suite) TestSortLines(c *C) {
+	in := `b.go:3:1: b.go:1:1 p q Y var
+a.go:9:1: b.go:1:1 p q Y var
+a.go:2:1: b.go:1:1 p q Y func
+a.go:1:1: a.go:1:1 p p Z type+
+c.go:1:1: a.go:4:1 p a X const
+`
+	out, err := sortLines([]byte(in))
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, `c.go:1:1: a.go:4:1 p a X const
+a.go:1:1: a.go:1:1 p p Z type+
+a.go:9:1: b.go:1:1 p q Y var
+b.go:3:1: b.go:1:1 p q Y var
+a.go:2:1: b.go:1:1 p q Y func
+`)
+}
+
+func (suite) TestUnusedLines(c *C) {
+	in := `a.go:1:7: a.go:1:7 p p C const+
+a.go:3:6: a.go:3:6 p p F func+
+a.go:4:9: a.go:1:7 p p C const
+b.go:2:5: b.go:2:5 q q V var+
+b.go:3:6: b.go:3:6 q q G func+
+b.go:4:2: a.go:3:6 q p F func
+`
+	out, err := unusedLines([]byte(in))
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, `b.go:2:5: b.go:2:5 q q V var+
+b.go:3:6: b.go:3:6 q q G func+
+`)
+}
+
+func (suite) TestUniqueLines(c *C) {
+	in := `a.go:4:9: a.go:1:7 p p C const	F
+a.go:1:7: a.go:1:7 p p C const+	-
+a.go:3:6: a.go:3:6 p p F func+	F
+a.go:5:2: a.go:1:7 p p C const	F
+b.go:4:2: a.go:3:6 q p F func	G
+b.go:5:2: c.go:2:6 q r H func	G
+b.go:6:2: c.go:2:6 q r H func	G
+`
+	out, err := uniqueLines([]byte(in))
+	c.Assert(err, IsNil)
+
+	// A declaration is kept in preference to a use before it.
+	c.Assert(string(out), Equals, `a.go:1:7: a.go:1:7 p p C const+	-
+a.go:3:6: a.go:3:6 p p F func+	F
+b.go:5:2: c.go:2:6 q r H func	G
+`)
+
+	_, err = uniqueLines([]byte("bad line\n"))
+	c.Assert(err, ErrorMatches, `cannot parse line "bad line\\n": .*`)
+}
+
+func (suite) TestGraphFile(c *C) {
+	in := `a.go:1:7: a.go:1:7 p p C const+	C
+a.go:4:9: a.go:1:7 p p C const	F
+a.go:5:2: b.go:3:6 p q G func	F
+a.go:6:2: b.go:3:6 p q G func	F
+a.go:7:6: x.go:1:1 p universe int type	F
+b.go:4:2: a.go:3:6 q p F func	G
+b.go:5:2: c.go:2:6 q r H func	G
+`
+	out, err := graphFile("edges", false, []byte(in))
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, `p q 2
+q p 1
+q r 1
+`)
+
+	out, err = graphFile("dot", true, []byte(in))
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, `digraph gosym {
+	"p" -> "p" [weight=1, label="1"];
+	"p" -> "q" [weight=2, label="2"];
+	"q" -> "p" [weight=1, label="1"];
+	"q" -> "r" [weight=1, label="1"];
+}
+`)
+
+	_, err = graphFile("edges", false, []byte("bad line\n"))
+	c.Assert(err, ErrorMatches, `cannot parse line "bad line\\n": .*`)
+}
+
+func (suite) TestListDefsUses(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": "package p\n\nvar X = 1\n\nfunc F() int { return X }\n"})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	ctxt := testContext(gopath)
+	mask, err := parseKindMask(allKinds())
+	c.Assert(err, IsNil)
+	defs := pfile + ":3:5: " + pfile + ":3:5 p p X var+\n" +
+		pfile + ":5:6: " + pfile + ":5:6 p p F func+\n"
+	uses := pfile + ":5:23: " + pfile + ":3:5 p p X var\n"
+	cmd := &listCmd{ctxt: ctxt, init: true, defs: true}
+	c.Assert(listPackage(c, cmd, "p", mask), Equals, defs)
+	cmd = &listCmd{ctxt: ctxt, init: true, uses: true}
+	c.Assert(listPackage(c, cmd, "p", mask), Equals, uses)
+}
+
+func (suite) TestDotImport(c *C) {
+	files := map[string]string{
+		"p/p.go": "package p\n\nimport . \"q\"\n\nfunc G() { F() }\n",
+		"q/q.go": "package q\n\nfunc F() {}\n",
+	}
+	gopath := testGoPath(c, files)
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	qfile := filepath.Join(gopath, "src", "q", "q.go")
+	ctxt := testContext(gopath)
+	mask, err := parseKindMask(allKinds())
+	c.Assert(err, IsNil)
+
+	// An identifier imported to . refers to the
+	// symbol in the imported package.
+	cmd := &listCmd{ctxt: ctxt, init: true, uses: true}
+	c.Assert(listPackage(c, cmd, "p", mask), Equals, pfile+":5:12: "+qfile+":3:6 p q F func\n")
+
+	// It is renamed without qualification, with a warning.
+	var got []sym.Warning
+	ctxt = testContext(gopath)
+	ctxt.stdout = bufio.NewWriter(ioutil.Discard)
+	ctxt.Warn = func(w sym.Warning) {
+		got = append(got, w)
+	}
+	w := &writeCmd{renames: fileList{"q.F=H"}, strict: true}
+	err = w.run(ctxt, []string{"p", "q"})
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(pfile)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "package p\n\nimport . \"q\"\n\nfunc G() { H() }\n")
+	c.Assert(got, HasLen, 1)
+	c.Assert(got[0].Category, Equals, warnSkipped)
+	c.Assert(got[0].Msg, Equals, `renaming "F" imported to .; leaving it unqualified`)
+}
+
+func (suite) TestListPackagesParallel(c *C) {
+	files := map[string]string{
+		"common/common.go": "package common\n\ntype T int\n",
+	}
+	var pkgs []string
+	for i := 9; i >= 0; i-- {
+		path := fmt.Sprintf("p%d", i)
+		files[path+"/p.go"] = fmt.Sprintf("package %s\n\nimport \"common\"\n\nvar X common.T = %d\n", path, i)
+		pkgs = append(pkgs, path)
+	}
+	gopath := testGoPath(c, files)
+	mask, err := parseKindMask(allKinds())
+	c.Assert(err, IsNil)
+	list := func(jobs int) string {
+		cmd := &listCmd{ctxt: testContext(gopath), init: true, uses: true, jobs: jobs}
+		var buf bytes.Buffer
+		err := cmd.listPackages(&buf, pkgs, mask)
+		c.Assert(err, IsNil)
+		return buf.String()
+	}
+
+	// The packages are listed in the order they
+	// are named, however many are listed at once.
+	want := list(1)
+	c.Assert(want, Matches, `(?s).*/p9/p.go:5:.*/p0/p.go:5:.*`)
+	for _, jobs := range []int{0, 2, 4, 20} {
+		c.Assert(list(jobs), Equals, want)
+	}
+}
+
+func (suite) TestListInit(c *C) {
+	gopath := testGoPath(c, map[string]string{
+		"p/p.go": "package p\n\nfunc init() {}\n\nfunc init() { f() }\n\nfunc f() {}\n",
+	})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	ctxt := testContext(gopath)
+	mask, err := parseKindMask(allKinds())
+	c.Assert(err, IsNil)
+
+	// Each init function is a func symbol
+	// of its own, at its own position.
+	cmd := &listCmd{ctxt: ctxt, all: true, init: true, defs: true}
+	def := func(pos, name string) string {
+		return pfile + ":" + pos + ": " + pfile + ":" + pos + " p p " + name + " func+\n"
+	}
+	c.Assert(listPackage(c, cmd, "p", mask), Equals, def("3:6", "init")+def("5:6", "init")+def("7:6", "f"))
+
+	// They are left out with -init=false.
+	cmd = &listCmd{ctxt: ctxt, all: true, defs: true}
+	c.Assert(listPackage(c, cmd, "p", mask), Equals, def("7:6", "f"))
+}
+
+func (suite) TestListTypeKinds(c *C) {
+	gopath := testGoPath(c, map[string]string{
+		"p/p.go": `package p
+
+type I interface{ M() }
+
+type J I
+
+type A = I
+
+type S struct{ F int }
+
+type T int
+`,
+	})
+	ctxt := testContext(gopath)
+	for _, t := range []struct {
+		kinds string
+		names []string
+	}{
+		{"interface", []string{"I", "J", "I", "A", "I"}},
+		{"struct", []string{"S"}},
+		{"othertype", []string{"T"}},
+		{"struct,othertype", []string{"S", "T"}},
+		{"type", []string{"I", "J", "I", "A", "I", "S", "T"}},
+	} {
+		mask, err := parseKindMask(t.kinds)
+		c.Assert(err, IsNil)
+		cmd := &listCmd{ctxt: ctxt, init: true}
+		var names []string
+		for _, line := range strings.SplitAfter(listPackage(c, cmd, "p", mask), "\n") {
+			if line == "" {
+				continue
+			}
+			sl, err := parseSymLine(strings.TrimSuffix(line, "\n"))
+			c.Assert(err, IsNil)
+			c.Assert(sl.kind, Equals, ast.Typ)
+			names = append(names, sl.expr)
+		}
+		c.Assert(names, DeepEquals, t.names)
+	}
+	_, err := parseKindMask("type,union")
+	c.Assert(err, ErrorMatches, `unknown type kind "union"`)
+}
+
+func (suite) TestListTypeCycle(c *C) {
+	// The types are invalid, being defined in terms of
+	// each other, but listing them must still finish.
+	gopath := testGoPath(c, map[string]string{"p/p.go": "package p\n\ntype A B\n\ntype B A\n\nvar V A\n"})
+	ctxt := testContext(gopath)
+	mask, err := parseKindMask(allKinds())
+	c.Assert(err, IsNil)
+	cmd := &listCmd{ctxt: ctxt, init: true}
+	var names []string
+	for _, line := range strings.SplitAfter(listPackage(c, cmd, "p", mask), "\n") {
+		if line == "" {
+			continue
+		}
+		sl, err := parseSymLine(strings.TrimSuffix(line, "\n"))
+		c.Assert(err, IsNil)
+		names = append(names, sl.expr)
+	}
+	c.Assert(names, DeepEquals, []string{"A", "B", "B", "A", "V", "A"})
+}
+
+func (suite) TestParseKindMaskAllAndNegation(c *C) {
+	mask := func(kinds string) uint {
+		m, err := parseKindMask(kinds)
+		c.Assert(err, IsNil)
+		return m
+	}
+	c.Assert(mask("all"), Equals, mask(allKinds()))
+	c.Assert(mask("all,-var"), Equals, mask("const,type,func"))
+	c.Assert(mask("-var"), Equals, mask("const,type,func"))
+	c.Assert(mask("all,-type,struct"), Equals, mask("const,var,func,struct"))
+	c.Assert(mask("type,-interface"), Equals, mask("struct,othertype"))
+	c.Assert(mask("all,package"), Equals, mask("const,type,var,func,package"))
+	_, err := parseKindMask("all,-union")
+	c.Assert(err, ErrorMatches, `unknown type kind "union"`)
+
+	var kinds kindList
+	fset := flag.NewFlagSet("list", flag.ContinueOnError)
+	fset.Var(&kinds, "k", "")
+	err = fset.Parse([]string{"-k", "all", "-k", "-var,-func"})
+	c.Assert(err, IsNil)
+	c.Assert(mask(kinds.String()), Equals, mask("const,type"))
+}
+
+func (suite) TestListKindMaskExclude(c *C) {
+	mask := func(kinds string) uint {
+		m, err := parseKindMask(kinds)
+		c.Assert(err, IsNil)
+		return m
+	}
+	for _, t := range []struct {
+		kinds, excluded kindList
+		want            string
+	}{
+		{nil, kindList{"func"}, "const,type,var"},
+		{nil, kindList{"func", "var"}, "const,type"},
+		{kindList{"type"}, kindList{"interface"}, "struct,othertype"},
+		{kindList{"all,package"}, kindList{"all"}, "package"},
+		{kindList{"const"}, kindList{"var"}, "const"},
+	} {
+		cmd := &listCmd{kinds: t.kinds, excluded: t.excluded}
+		m, err := cmd.kindMask()
+		c.Assert(err, IsNil)
+		c.Assert(m, Equals, mask(t.want))
+	}
+	for _, t := range []struct {
+		excluded kindList
+		err      string
+	}{
+		{kindList{""}, `no type kinds specified to exclude`},
+		{kindList{"const,-var"}, `cannot exclude negated type kind "-var"`},
+		{kindList{"union"}, `unknown type kind "union"`},
+	} {
+		cmd := &listCmd{excluded: t.excluded}
+		_, err := cmd.kindMask()
+		c.Assert(err, ErrorMatches, t.err)
+	}
+}
+
+func (suite) TestListContext(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": "package p\n\nvar Xyz = 1\n\nfunc F() int {\r\n\treturn Xyz\r\n}\n"})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	ctxt := testContext(gopath)
+	mask, err := parseKindMask(allKinds())
+	c.Assert(err, IsNil)
+	cmd := &listCmd{ctxt: ctxt, init: true, context: true}
+	c.Assert(listPackage(c, cmd, "p", mask), Equals, strings.NewReplacer("$pfile", pfile).Replace(`$pfile:3:5: $pfile:3:5 p p Xyz var+	var «Xyz» = 1
+$pfile:5:6: $pfile:5:6 p p F func+	func «F»() int {
+$pfile:6:9: $pfile:3:5 p p Xyz var	return «Xyz»
+`))
+}
+
+func (suite) TestListEnclosing(c *C) {
+	gopath := testGoPath(c, map[string]string{
+		"p/p.go": `package p
+
+var X = 1
+
+type T struct {
+	F int
+}
+
+func (t *T) M() {
+	func() {
+		t.F = X
+	}()
+}
+`,
+	})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	ctxt := testContext(gopath)
+	mask, err := parseKindMask(allKinds())
+	c.Assert(err, IsNil)
+	cmd := &listCmd{ctxt: ctxt, init: true, enclosing: true}
+	c.Assert(listPackage(c, cmd, "p", mask), Equals, strings.NewReplacer("$pfile", pfile).Replace(`$pfile:3:5: $pfile:3:5 p p X var+	-
+$pfile:5:6: $pfile:5:6 p p T type+	T
+$pfile:6:2: $pfile:6:2 p p T.F var+	T
+$pfile:9:10: $pfile:5:6 p p T type	(*T).M
+$pfile:9:13: $pfile:9:13 p p (*T).M func+	(*T).M
+$pfile:11:5: $pfile:6:2 p p T.F var	(*T).M
+$pfile:11:9: $pfile:3:5 p p X var	(*T).M
+`))
+
+	cmd = &listCmd{ctxt: ctxt, init: true, enclosing: true, json: true}
+	var sl jsonSymLine
+	data := []byte(listPackage(c, cmd, "p", mask))
+	err = json.Unmarshal(data[bytes.LastIndex(data[:len(data)-1], []byte("\n"))+1:], &sl)
+	c.Assert(err, IsNil)
+	c.Assert(sl.Expr, Equals, "X")
+	c.Assert(sl.Enclosing, Equals, "(*T).M")
+}
+
+func (suite) TestListDoc(c *C) {
+	gopath := testGoPath(c, map[string]string{
+		"p/p.go": `package p
+
+// F is documented.
+func F() {}
+
+func G() {}
+
+// T is old.
+//
+// Deprecated: use F.
+type T struct {
+	// A is documented.
+	A int
+	B int
+}
+
+// The constants are documented together.
+const (
+	C = 1
+	/* D is documented too. */
+	D = C
+)
+`,
+	})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	ctxt := testContext(gopath)
+	mask, err := parseKindMask(allKinds())
+	c.Assert(err, IsNil)
+	cmd := &listCmd{ctxt: ctxt, init: true, doc: true}
+	c.Assert(listPackage(c, cmd, "p", mask), Equals, strings.NewReplacer("$pfile", pfile).Replace(`$pfile:4:6: $pfile:4:6 p p F func+	doc
+$pfile:6:6: $pfile:6:6 p p G func+	nodoc
+$pfile:11:6: $pfile:11:6 p p T type+	deprecated
+$pfile:13:2: $pfile:13:2 p p T.A var+	doc
+$pfile:14:2: $pfile:14:2 p p T.B var+	nodoc
+$pfile:19:2: $pfile:19:2 p p C const+	doc
+$pfile:21:2: $pfile:21:2 p p D const+	doc
+$pfile:21:6: $pfile:19:2 p p C const	-
+`))
+}
+
+var platformFiles = map[string]string{
+	"p/p.go":         "package p\n\nvar X = 1\n",
+	"p/p_linux.go":   "package p\n\nvar L = X\n",
+	"p/p_windows.go": "package p\n\nvar W = X\n",
+	"p/p_arm64.go":   "package p\n\nvar A = X\n",
+	"p/tagged.go":    "// +build extra\n\npackage p\n\nvar T = X\n",
+}
+
+// platformContext returns a context for the platforms named by
+// the given values of the -os, -arch and -tags flags, which it
+// sets, as it does build.Default.GOPATH, until restore is called.
+// The warnings reported by the context are added to *warnings.
+func platformContext(gopath, goos, goarch, tags string, warnings *[]sym.Warning) (ctxt *context, restore func()) {
+	oldOS, oldArch, oldTags, oldGoPath := *buildOS, *buildArch, *buildTags, build.Default.GOPATH
+	*buildOS, *buildArch, *buildTags, build.Default.GOPATH = goos, goarch, tags, gopath
+	ctxt = newContext(buildContexts()[0], nil)
+	ctxt.cacheDir = ""
+	ctxt.Warn = func(w sym.Warning) {
+		*warnings = append(*warnings, w)
+	}
+	return ctxt, func() {
+		*buildOS, *buildArch, *buildTags, build.Default.GOPATH = oldOS, oldArch, oldTags, oldGoPath
+	}
+}
+
+func (suite) TestListPlatforms(c *C) {
+	gopath := testGoPath(c, platformFiles)
+	list := func(goos, goarch, tags string) (names, excluded []string) {
+		var warnings []sym.Warning
+		ctxt, restore := platformContext(gopath, goos, goarch, tags, &warnings)
+		defer restore()
+		var out bytes.Buffer
+		ctxt.stdout = bufio.NewWriter(&out)
+		cmd := &listCmd{kinds: kindList{"var"}, defs: true}
+		err := cmd.run(ctxt, []string{"p"})
+		c.Assert(err, IsNil)
+		ctxt.stdout.Flush()
+		for _, line := range strings.SplitAfter(out.String(), "\n") {
+			if line == "" {
+				continue
+			}
+			sl, err := parseSymLine(strings.TrimSuffix(line, "\n"))
+			c.Assert(err, IsNil)
+			names = append(names, filepath.Base(sl.pos.Filename)+" "+sl.expr)
+		}
+		for _, w := range warnings {
+			c.Assert(w.Category, Equals, warnExcluded)
+			excluded = append(excluded, strings.TrimPrefix(w.Msg, filepath.Join(gopath, "src", "p")+string(filepath.Separator)))
+		}
+		return names, excluded
+	}
+
+	// The files for other platforms, and those needing
+	// other tags, are left out and reported.
+	names, excluded := list("linux", "amd64", "")
+	c.Assert(names, DeepEquals, []string{"p.go X", "p_linux.go L"})
+	c.Assert(excluded, DeepEquals, []string{
+		"p_arm64.go is excluded by the build constraints for linux/amd64; its symbols are left out",
+		"p_windows.go is excluded by the build constraints for linux/amd64; its symbols are left out",
+		"tagged.go is excluded by the build constraints for linux/amd64; its symbols are left out",
+	})
+
+	// Each symbol is listed once, whichever platforms
+	// include its file, and only the files that no
+	// platform includes are reported.
+	names, excluded = list("linux,windows", "amd64", "")
+	c.Assert(names, DeepEquals, []string{"p.go X", "p_linux.go L", "p_windows.go W"})
+	c.Assert(excluded, DeepEquals, []string{
+		"p_arm64.go is excluded by the build constraints for linux/amd64, windows/amd64; its symbols are left out",
+		"tagged.go is excluded by the build constraints for linux/amd64, windows/amd64; its symbols are left out",
+	})
+
+	names, excluded = list("linux", "amd64,arm64", "extra")
+	c.Assert(names, DeepEquals, []string{"p.go X", "p_linux.go L", "tagged.go T", "p_arm64.go A"})
+	c.Assert(excluded, DeepEquals, []string{
+		"p_windows.go is excluded by the build constraints for linux/amd64, linux/arm64; its symbols are left out",
+	})
+}
+
+func (suite) TestWritePlatforms(c *C) {
+	gopath := testGoPath(c, platformFiles)
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	input := filepath.Join(gopath, "renames.txt")
+	err := ioutil.WriteFile(input, []byte(pfile+":3:5: X Y\n"), 0666)
+	c.Assert(err, IsNil)
+	var warnings []sym.Warning
+	ctxt, restore := platformContext(gopath, "linux,windows", "amd64", "", &warnings)
+	defer restore()
+	ctxt.stdout = bufio.NewWriter(ioutil.Discard)
+	w := &writeCmd{input: input}
+	err = w.run(ctxt, []string{"p"})
+	c.Assert(err, IsNil)
+
+	// The references in the files for each platform
+	// are changed, but not those in the files that
+	// no platform includes, which are reported.
+	for name, src := range platformFiles {
+		data, err := ioutil.ReadFile(filepath.Join(gopath, "src", name))
+		c.Assert(err, IsNil)
+		switch filepath.Base(name) {
+		case "p.go", "p_linux.go", "p_windows.go":
+			src = strings.Replace(src, "X", "Y", 1)
+		}
+		c.Assert(string(data), Equals, src)
+	}
+	c.Assert(warnings, HasLen, 2)
+	c.Assert(warnings[0].Msg, Matches, ".*p_arm64.go is excluded .*")
+	c.Assert(warnings[1].Msg, Matches, ".*tagged.go is excluded .*")
+}
+
+func (suite) TestListMatch(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": "package p\n\nfunc TestA() {}\n\nfunc TestSlow() {}\n\nfunc Other() {}\n"})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	ctxt := testContext(gopath)
+	mask, err := parseKindMask(allKinds())
+	c.Assert(err, IsNil)
+	cmd := &listCmd{ctxt: ctxt, init: true, matchPat: regexp.MustCompile("^Test"), excludePat: regexp.MustCompile("Slow$")}
+	c.Assert(listPackage(c, cmd, "p", mask), Equals, pfile+":3:6: "+pfile+":3:6 p p TestA func+\n")
+
+	cmd = &listCmd{kinds: kindList{"all"}, match: "("}
+	err = cmd.run(ctxt, []string{"p"})
+	c.Assert(err, ErrorMatches, `invalid -match regexp: .*`)
+}
+
+func (suite) TestBaselineDiff(c *C) {
+	old := `a.go:1:7: a.go:1:7 p p C const+ int = 1
+a.go:3:6: a.go:3:6 p p F func+ func(x int)
+a.go:5:6: a.go:5:6 p p G func+ func()
+a.go:7:6: a.go:7:6 p p T type+ T
+a.go:9:6: a.go:7:6 p p T type T
+b.go:2:5: b.go:2:5 q q V var+
+`
+	cur := `a.go:#6: a.go:#6 p p C var+ int
+a.go:3:6: a.go:3:6 p p F func+ func(x string)
+a.go:5:6: a.go:5:6 p p H func+ func()
+a.go:8:6: a.go:8:6 p p T type+ T
+a.go:9:2: a.go:9:2 p p x localvar+ int
+b.go:2:5: b.go:2:5 q q V var+ int
+`
+	oldLines, err := readListing(strings.NewReader(old), "old")
+	c.Assert(err, IsNil)
+	curLines, err := readListing(strings.NewReader(cur), "cur")
+	c.Assert(err, IsNil)
+	var buf bytes.Buffer
+	n := printBaselineDiff(&buf, declLines(oldLines), declLines(curLines))
+	c.Assert(n, Equals, 3)
+	c.Assert(buf.String(), Equals, `changed a.go:#6: a.go:#6 p p C var+ int; was const int
+changed a.go:3:6: a.go:3:6 p p F func+ func(x string); was func func(x int)
+removed a.go:5:6: a.go:5:6 p p G func+ func()
+added a.go:5:6: a.go:5:6 p p H func+ func()
+`)
+
+	_, err = readListing(strings.NewReader("a.go:1:1: a.go:1:1 p p X var+\nbad line\n"), "api.txt")
+	c.Assert(err, ErrorMatches, `api.txt:2: cannot parse "bad line": invalid line`)
+}
+
+func (suite) TestReadLines(c *C) {
+	longType := strings.Repeat("x", 10000)
+	in := strings.NewReplacer("$longType", longType).Replace(`foo.go:1:2: X Y
+bad line
+
+foo.go:3:4: bar.go:1:1 p q X var $longType
+foo.go:5:6: X
+foo.go:99999999999999999999:1: X Y
+foo.go:1:1: bar.go:#99999999999999999999 p q X var`)
+	var lines []*symLine
+	var warnings []sym.Warning
+	ctxt := &context{Context: sym.NewContext()}
+	ctxt.Warn = func(w sym.Warning) {
+		warnings = append(warnings, w)
+	}
+	err := ctxt.readLinesFrom(strings.NewReader(in), func(sl *symLine) error {
+		lines = append(lines, sl)
+		return nil
+	})
+	c.Assert(err, ErrorMatches, "4 bad input lines, the first at line 2")
+	c.Assert(lines, HasLen, 2)
+	c.Assert(lines[0].newExpr, Equals, "Y")
+	c.Assert(lines[1].exprType, Equals, longType)
+	c.Assert(warnings, HasLen, 4)
+	c.Assert(warnings[0].Category, Equals, warnInput)
+	c.Assert(warnings[0].String(), Equals, `input line 2: cannot parse "bad line": invalid line`)
+
+	// A number too large for an int is reported
+	// as a bad line, as is any other.
+	c.Assert(warnings[2].String(), Equals, `input line 6: cannot parse "foo.go:99999999999999999999:1: X Y": strconv.Atoi: parsing "99999999999999999999": value out of range`)
+	c.Assert(warnings[3].String(), Equals, `input line 7: cannot parse "foo.go:1:1: bar.go:#99999999999999999999 p q X var": strconv.Atoi: parsing "99999999999999999999": value out of range`)
+}
+
+func (suite) TestReadLinesCRLF(c *C) {
+	in := "\ufefffoo.go:1:2: X Y\r\n" +
+		"foo.go:3:4: bar.go:1:1 p q X var func(int) bool\r\n" +
+		"foo.go:5:6: Z W\r"
+	var lines []*symLine
+	err := new(context).readLinesFrom(strings.NewReader(in), func(sl *symLine) error {
+		lines = append(lines, sl)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(lines, HasLen, 3)
+	c.Assert(lines[0].pos.Filename, Equals, "foo.go")
+	c.Assert(lines[0].newExpr, Equals, "Y")
+	c.Assert(lines[1].exprType, Equals, "func(int) bool")
+	c.Assert(lines[2].newExpr, Equals, "W")
+}
+
+func (suite) TestRuneColumns(c *C) {
+	file := filepath.Join(c.MkDir(), "p.go")
+	err := ioutil.WriteFile(file, []byte("package p\n\nvar héllo, wörld, x = 1, 2, 3\n"), 0666)
+	c.Assert(err, IsNil)
+	lines := make(lineTables)
+	for _, t := range []struct{ byteCol, runeCol int }{
+		{1, 1},
+		{5, 5},
+		{13, 12},
+		{21, 19},
+	} {
+		p, err := lines.runeColumn(token.Position{Filename: file, Line: 3, Column: t.byteCol})
+		c.Assert(err, IsNil)
+		c.Assert(p.Column, Equals, t.runeCol)
+		p, err = lines.byteColumn(p)
+		c.Assert(err, IsNil)
+		c.Assert(p.Column, Equals, t.byteCol)
+	}
+	_, err = lines.byteColumn(token.Position{Filename: file, Line: 3, Column: 40})
+	c.Assert(err, ErrorMatches, "column 40 out of range at .*p.go:3")
+	_, err = lines.runeColumn(token.Position{Filename: file, Line: 5, Column: 1})
+	c.Assert(err, ErrorMatches, "line 5 out of range in .*p.go")
+
+	// Lines read with -runes address the same identifiers
+	// and print as they were given.
+	defer func(old bool) { *runes = old }(*runes)
+	*runes = true
+	in := file + ":3:12: wörld world\n" +
+		file + ":3:19: " + file + ":3:12 p p x var int\n" +
+		file + ":#11: var v\n"
+	var got []string
+	err = new(context).readLinesFrom(strings.NewReader(in), func(sl *symLine) error {
+		got = append(got, sl.pos.String())
+		if err := sl.runeColumns(lines); err != nil {
+			return err
+		}
+		got = append(got, sl.String())
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, []string{
+		file + ":3:13",
+		file + ":3:12: wörld world",
+		file + ":3:21",
+		file + ":3:19: " + file + ":3:12 p p x var int",
+		file + ":3:1",
+		file + ":3:1: var v",
+	})
+}
+
+var splitNewExprTests = []struct {
+	newExpr    string
+	path, name string
+}{
+	{"Foo", "", "Foo"},
+	{"fmt.Println", "fmt", "Println"},
+	{"example.com/foo/bar.Baz", "example.com/foo/bar", "Baz"},
+	{"gopkg.in/yaml.v2.Marshal", "gopkg.in/yaml.v2", "Marshal"},
+}
+
+func (suite) TestSplitNewExpr(c *C) {
+	for i, test := range splitNewExprTests {
+		c.Logf("test %d: %q", i, test.newExpr)
+		path, name := splitNewExpr(test.newExpr)
+		c.Assert(path, Equals, test.path)
+		c.Assert(name, Equals, test.name)
+	}
+}
+
+func (suite) TestWriteRequalifyImported(c *C) {
+	files := map[string]string{
+		"a/a.go": "package a\n\nfunc Foo() {}\n",
+		"b/b.go": "package b\n\nfunc Foo() {}\n",
+		"p/p.go": "package p\n\nimport (\n\t\"a\"\n\t\"b\"\n)\n\nvar _ = a.Foo\nvar _ = b.Foo\n",
+	}
+	gopath := testGoPath(c, files)
+	ctxt := testContext(gopath)
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	w := newWriteCmd(ctxt)
+	addLines(c, w, pfile, "8:11: a.Foo b.Foo")
+	w.addGlobals()
+	w.replace([]string{"p"})
+	c.Assert(w.conflicts, HasLen, 0)
+
+	// The file already imports b, so no import is added.
+	f := ctxt.ChangedFiles[pfile]
+	c.Assert(f, NotNil)
+	var paths []string
+	for _, imp := range sym.FileImports(f) {
+		paths = append(paths, importPath(imp))
+	}
+	c.Assert(paths, DeepEquals, []string{"a", "b"})
+	err := ctxt.WriteFiles(ctxt.ChangedFiles)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(pfile)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "package p\n\nimport (\n\t\"a\"\n\t\"b\"\n)\n\nvar _ = b.Foo\nvar _ = b.Foo\n")
+}
+
+func (suite) TestExprTypeStringMethod(c *C) {
+	src := "package p\ntype T struct{}\nfunc (t *T) M(a, b int, rest ...string) (n int, err error) { return }\n"
+	f, err := parser.ParseFile(token.NewFileSet(), "p.go", src, 0, ast.NewScope(parser.Universe))
+	c.Assert(err, IsNil)
+	fd := f.Decls[1].(*ast.FuncDecl)
+	c.Assert(fd.Name.Obj, NotNil)
+	info := &sym.Info{ReferObj: fd.Name.Obj}
+	c.Assert(exprTypeString(info), Equals, "func (t *T) M(a, b int, rest ...string) (n int, err error)")
+}
+
+var typeStringTests = []struct {
+	src, typ string
+}{
+	{"struct{}", "struct{}"},
+	{"struct {\n\tE\n\tA int `json:\"a\"`\n\tB, C string\n}", "struct{E; A int `json:\"a\"`; B, C string}"},
+	{"*struct {\n\tp.E\n\tA []struct {\n\t\tX, Y int\n\t}\n}", "*struct{p.E; A []struct{X, Y int}}"},
+	{"map[string]struct {\n\tA int\n\tB int\n}", "map[string]struct{A int; B int}"},
+	{"interface {\n\tM(a int) (error, bool)\n\tfmt.Stringer\n}", "interface{M(a int) (error, bool); fmt.Stringer}"},
+	{"func(x ...struct {\n\tA, B int\n}) chan<- struct {\n\tX int\n}", "func(x ...struct{A, B int}) chan<- struct{X int}"},
+}
+
+func (suite) TestTypeString(c *C) {
+	for i, t := range typeStringTests {
+		c.Logf("test %d: %q", i, t.src)
+		// Parse the type as that of a variable, so that
+		// it has positions across several lines.
+		f, err := parser.ParseFile(token.NewFileSet(), "p.go", "package p\nvar v "+t.src+"\n", 0, ast.NewScope(parser.Universe))
+		c.Assert(err, IsNil)
+		typ := f.Decls[0].(*ast.GenDecl).Specs[0].(*ast.ValueSpec).Type
+		c.Assert(typeString(typ), Equals, t.typ)
+	}
+}
+
+func (suite) TestListExpand(c *C) {
+	gopath := testGoPath(c, map[string]string{
+		"p/p.go": "package p\n\ntype E struct{ X int }\n\ntype T struct {\n\tE\n\tA int `json:\"a\"`\n}\n\nvar V T\n\nvar P *T\n",
+		"q/q.go": "package q\n\ntype A B\n\ntype B A\n\nvar V A\n",
+	})
+	ctxt := testContext(gopath)
+	mask, err := parseKindMask("var")
+	c.Assert(err, IsNil)
+	types := func(pkg string, expand bool) []string {
+		cmd := &listCmd{ctxt: ctxt, init: true, defs: true, printType: true, expand: expand}
+		var types []string
+		for _, line := range strings.SplitAfter(listPackage(c, cmd, pkg, mask), "\n") {
+			if line == "" {
+				continue
+			}
+			sl, err := parseSymLine(strings.TrimSuffix(line, "\n"))
+			c.Assert(err, IsNil)
+			types = append(types, sl.expr+" "+sl.exprType)
+		}
+		return types
+	}
+	c.Assert(types("p", false), DeepEquals, []string{"E.X int", "T.E E", "T.A int", "V T", "P *T"})
+	c.Assert(types("p", true), DeepEquals, []string{
+		"E.X int",
+		"T.E struct{X int}",
+		"T.A int",
+		"V struct{E; A int `json:\"a\"`}",
+		"P *T",
+	})
+
+	// A type defined in terms of itself has no
+	// underlying type, so it is printed as named.
+	c.Assert(types("q", true), DeepEquals, []string{"V A"})
+}
+
+func (suite) TestVendoredImports(c *C) {
+	files := map[string]string{
+		"lib/lib.go":            "package lib\n\nfunc G() {}\n",
+		"app/vendor/lib/lib.go": "package lib\n\nfunc F() {}\n",
+		"app/sub/sub.go":        "package sub\n\nimport \"lib\"\n\nvar X = lib.F\n",
+		"other/other.go":        "package other\n\nimport \"lib\"\n\nvar Y = lib.G\n",
+	}
+	gopath := testGoPath(c, files)
+	ctxt := testContext(gopath)
+	mask, err := parseKindMask(allKinds())
+	c.Assert(err, IsNil)
+	refs := func(path string) []string {
+		cmd := &listCmd{ctxt: ctxt, init: true}
+		var refs []string
+		for _, line := range strings.SplitAfter(listPackage(c, cmd, path, mask), "\n") {
+			if line == "" {
+				continue
+			}
+			sl, err := parseSymLine(strings.TrimSuffix(line, "\n"))
+			c.Assert(err, IsNil)
+			refs = append(refs, sl.referPkg+"."+sl.expr)
+		}
+		return refs
+	}
+	// The import of lib in app/sub refers to the vendored
+	// package, and that in other to the one in GOPATH.
+	c.Assert(refs("app/sub"), DeepEquals, []string{"app/sub.X", "app/vendor/lib.F"})
+	c.Assert(refs("other"), DeepEquals, []string{"other.Y", "lib.G"})
+
+	// With -skipvendor, a symbol declared in a
+	// vendored package is not renamed.
+	w := newWriteCmd(ctxt)
+	w.skipVendor = true
+	addLines(c, w, filepath.Join(gopath, "src", "app", "sub", "sub.go"), "5:13: lib.F NewF")
+	w.validateLines([]*context{w.context})
+	w.addGlobals()
+	c.Assert(w.conflicts, HasLen, 1)
+	c.Assert(w.conflicts[0].msg, Equals, "lib.F is declared in a vendored package; not changing it to NewF")
+	c.Assert(w.globalReplace, HasLen, 0)
+}
+
+func (suite) TestListShadow(c *C) {
+	files := map[string]string{
+		"q/q.go":    "package q\n\nfunc F() {}\n",
+		"r/v2/r.go": "package r\n\nfunc G() {}\n",
+		"p/p.go":    "package p\n\nimport (\n\t\"q\"\n\t\"r/v2\"\n)\n\nvar n int\n\nfunc F(r string) {\n\tq.F()\n\tq := n\n\tfor n := 0; n < q; n++ {\n\t}\n\tfunc(x int) {}(len(r))\n}\n",
+		"p/p2.go":   "package p\n\nfunc H() {\n\tq, x := 1, 2\n\t_, _ = q, x\n}\n",
+	}
+	gopath := testGoPath(c, files)
+	ctxt := testContext(gopath)
+	cmd := &listCmd{ctxt: ctxt, shadow: true}
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+
+	// The package imported as r/v2 is named r. The name q
+	// is imported by p.go only, so it is no package-level
+	// declaration in p2.go, nor is the local x of p2.go
+	// shadowed by the parameter of the function literal.
+	c.Assert(listPackage(c, cmd, "p", 0), Equals, strings.NewReplacer("$pfile", pfile).Replace(`$pfile:10:8: r shadows import of "r/v2" at $pfile:5:2
+$pfile:12:2: q shadows import of "q" at $pfile:4:2
+$pfile:13:6: n shadows package-level var declared at $pfile:8:5
+`))
+}
+
+func (suite) TestListInternalCheck(c *C) {
+	files := map[string]string{
+		"a/internal/b/b.go": "package b\n\nfunc F() {}\n\ntype T struct{ X int }\n\nfunc (*T) M() {}\n",
+		"a/x/x.go":          "package x\n\nimport \"a/internal/b\"\n\nfunc G() {\n\tb.F()\n}\n",
+		"a/pub/pub.go":      "package pub\n\nimport \"a/internal/b\"\n\nfunc New() *b.T { return new(b.T) }\n",
+		"internal/z/z.go":   "package z\n\nvar V int\n",
+		"c/c.go":            "package c\n\nimport (\n\t\"a/internal/b\"\n\t\"internal/z\"\n)\n\nfunc H() {\n\tb.F()\n\tz.V++\n}\n",
+		"d/d.go":            "package d\n\nimport \"a/pub\"\n\nfunc K() {\n\tt := pub.New()\n\tt.M()\n\tpub.New().X++\n}\n",
+	}
+	gopath := testGoPath(c, files)
+	ctxt := testContext(gopath)
+	cmd := &listCmd{ctxt: ctxt, internal: true}
+	bfile := filepath.Join(gopath, "src", "a", "internal", "b", "b.go")
+	cfile := filepath.Join(gopath, "src", "c", "c.go")
+
+	// The packages in a may use a/internal/b, and any package
+	// in the same GOPATH directory may use internal/z.
+	c.Assert(listPackage(c, cmd, "a/x", 0), Equals, "")
+	c.Assert(listPackage(c, cmd, "c", 0), Equals, strings.NewReplacer("$cfile", cfile, "$bfile", bfile).Replace(`$cfile:9:4: F in internal package "a/internal/b" at $bfile:3:6 is used outside "a"
+`))
+
+	// The members of a type declared in an internal package
+	// may be used through a package that may import it.
+	c.Assert(listPackage(c, cmd, "d", 0), Equals, "")
+}
+
+func (suite) TestInternalParent(c *C) {
+	for _, t := range []struct {
+		path, parent string
+		ok           bool
+	}{
+		{"a/b", "", false},
+		{"a/internal", "a", true},
+		{"a/internal/b", "a", true},
+		{"a/internal/b/internal/c", "a/internal/b", true},
+		{"internal/z", "", true},
+		{"a/internalx/b", "", false},
+	} {
+		parent, ok := internalParent(t.path)
+		c.Check(parent, Equals, t.parent)
+		c.Check(ok, Equals, t.ok)
+	}
+}
+
+func (suite) TestListTags(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": "package p\n\ntype T struct {\n\tA, B int\n}\n\nfunc (T) M() {}\n\nconst C = 1\n\nvar V = C\n\nfunc (*T) N() {}\n"})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	ctxt := testContext(gopath)
+	mask, err := parseKindMask(allKinds())
+	c.Assert(err, IsNil)
+	tags := func(format string) string {
+		cmd := &listCmd{ctxt: ctxt, init: true, defs: true, tagsFmt: format}
+		return string(tagsFile(format, []byte(listPackage(c, cmd, "p", mask))))
+	}
+	c.Assert(tags("ctags"), Equals, strings.NewReplacer("$pfile", pfile).Replace(`!_TAG_FILE_FORMAT	2	/extended format/
+!_TAG_FILE_SORTED	1	/0=unsorted, 1=sorted, 2=foldcase/
+!_TAG_PROGRAM_NAME	gosym	//
+A	$pfile	4;"	m	type:T
+B	$pfile	4;"	m	type:T
+C	$pfile	9;"	c
+M	$pfile	7;"	f	type:T
+N	$pfile	13;"	f	type:T
+T	$pfile	3;"	s
+V	$pfile	11;"	v
+`))
+	c.Assert(tags("etags"), Equals, "\x0c\n"+pfile+",104\n"+
+		"type T\x7fT\x013,11\n"+
+		"\tA\x7fA\x014,27\n"+
+		"\tA, B\x7fB\x014,27\n"+
+		"func (T) M\x7fM\x017,40\n"+
+		"const C\x7fC\x019,57\n"+
+		"var V\x7fV\x0111,70\n"+
+		"func (*T) N\x7fN\x0113,81\n")
+}
+
+func (suite) TestListCommandLineFiles(c *C) {
+	dir := c.MkDir()
+	script := filepath.Join(dir, "script.go")
+	err := ioutil.WriteFile(script, []byte("// +build ignore\n\npackage main\n\nimport \"nonexistent/thing\"\n\nvar X = thing.Y\n"), 0666)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "lib.go"), []byte("package lib\n\nvar L = 1\n"), 0666)
+	c.Assert(err, IsNil)
+	ctxt := testContext(c.MkDir())
+	mask, err := parseKindMask(allKinds())
+	c.Assert(err, IsNil)
+	cmd := &listCmd{ctxt: ctxt, init: true}
+	pkgs, err := cmd.splitFiles([]string{script})
+	c.Assert(err, IsNil)
+	c.Assert(pkgs, DeepEquals, []string{sym.CommandLinePackage})
+	c.Assert(cmd.cmdFiles, DeepEquals, []string{script})
+	err = cmd.importCmdFiles(ctxt)
+	c.Assert(err, IsNil)
+	c.Assert(listPackage(c, cmd, pkgs[0], mask), Equals, strings.NewReplacer("$script", script).Replace(`$script:7:5: $script:7:5 command-line-arguments command-line-arguments X var+
+$script:7:15: $script:5:8 command-line-arguments ? Y bad
+`))
+
+	// The unresolved reference is not listed
+	// when only package names are.
+	mask, err = parseKindMask("package")
+	c.Assert(err, IsNil)
+	c.Assert(listPackage(c, cmd, pkgs[0], mask), Equals, "")
+}
+
+func (suite) TestGoPath(c *C) {
+	sep := string(filepath.ListSeparator)
+	c.Assert(goPath("", "/root"), DeepEquals, []string{
+		filepath.Join("/root", "src", "pkg"),
+	})
+	c.Assert(goPath("/a"+sep+sep+"/b"+sep, "/root"), DeepEquals, []string{
+		filepath.Join("/a", "src"),
+		filepath.Join("/b", "src"),
+		filepath.Join("/root", "src", "pkg"),
+	})
+	c.Assert(goPath("/a", ""), DeepEquals, []string{
+		filepath.Join("/a", "src"),
+		filepath.Join(runtime.GOROOT(), "src", "pkg"),
+	})
+}
+
+func (suite) TestFindPackageInModule(c *C) {
+	root := c.MkDir()
+	cache := filepath.Join(root, "cache")
+	files := map[string]string{
+		"m/go.mod": `module example.com/m
+
+require example.com/Dep v1.0.0
+
+require (
+	example.com/local v0.0.0 // indirect
+)
+
+replace example.com/local => ./local
+`,
+		"m/a/a.go":                             "package a\n",
+		"m/local/go.mod":                       "module example.com/local\n",
+		"m/local/l.go":                         "package local\n",
+		"cache/example.com/!dep@v1.0.0/dep.go": "package dep\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(path), 0777)
+		c.Assert(err, IsNil)
+		err = ioutil.WriteFile(path, []byte(data), 0666)
+		c.Assert(err, IsNil)
+	}
+	cwd, err := os.Getwd()
+	c.Assert(err, IsNil)
+	defer os.Chdir(cwd)
+	err = os.Chdir(filepath.Join(root, "m"))
+	c.Assert(err, IsNil)
+	for _, name := range []string{"GO111MODULE", "GOMODCACHE"} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+	os.Setenv("GO111MODULE", "on")
+	os.Setenv("GOMODCACHE", cache)
+
+	ctxt := sym.NewContext()
+	for i, test := range []struct {
+		path       string
+		importPath string
+		dir        string
+	}{
+		{"example.com/m/a", "example.com/m/a", "m/a"},
+		{"./a", "example.com/m/a", "m/a"},
+		{"example.com/Dep", "example.com/Dep", "cache/example.com/!dep@v1.0.0"},
+		{"example.com/local", "example.com/local", "m/local"},
+	} {
+		c.Logf("test %d: %s", i, test.path)
+		bpkg, err := ctxt.FindPackage(test.path, filepath.Join(root, "m"), 0)
+		c.Assert(err, IsNil)
+		c.Assert(bpkg.ImportPath, Equals, test.importPath)
+		c.Assert(bpkg.Dir, Equals, filepath.Join(root, filepath.FromSlash(test.dir)))
+	}
+	pkg := ctxt.Import("example.com/m/a")
+	c.Assert(pkg, NotNil)
+	path, err := ctxt.PackagePath(token.Position{Filename: filepath.Join(root, "m", "a", "a.go")})
+	c.Assert(err, IsNil)
+	c.Assert(path, Equals, "example.com/m/a")
+}
+
+var unresolvedLimitTests = []struct {
+	limit      string
+	syms       int
+	unresolved int
+	exceeded   bool
+	err        string
+}{
+	{"0", 10, 0, false, ""},
+	{"0", 10, 1, true, ""},
+	{"2", 10, 2, false, ""},
+	{"2", 10, 3, true, ""},
+	{"10%", 20, 2, false, ""},
+	{"10%", 20, 3, true, ""},
+	{"0.5%", 1000, 5, false, ""},
+	{"0%", 0, 0, false, ""},
+	{"1.5", 0, 0, false, `invalid -maxunresolved value "1.5"`},
+	{"-1", 0, 0, false, `invalid -maxunresolved value "-1"`},
+	{"x%", 0, 0, false, `invalid -maxunresolved value "x%"`},
+}
+
+func (suite) TestUnresolvedLimit(c *C) {
+	for i, test := range unresolvedLimitTests {
+		c.Logf("test %d: %s", i, test.limit)
+		limit, err := parseUnresolvedLimit(test.limit)
+		if test.err != "" {
+			c.Assert(err, ErrorMatches, test.err)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(limit.exceeded(test.syms, test.unresolved), Equals, test.exceeded)
+	}
+}
+
+func (suite) TestUnresolved(c *C) {
+	ctxt := sym.NewContext()
+	src := "package p\n\nvar x = y.Z\n\nvar w = x\n"
+	f, err := parser.ParseFile(ctxt.FileSet, "p.go", src, 0, ast.NewScope(parser.Universe))
+	c.Assert(err, IsNil)
+
+	// Nothing is counted unless asked for.
+	ctxt.IterateSyms(f, func(*sym.Info) bool { return true })
+	syms, unresolved := ctxt.Unresolved()
+	c.Assert(syms, Equals, 0)
+	c.Assert(unresolved, Equals, 0)
+
+	// Each identifier is counted only once.
+	ctxt.CountUnresolved = true
+	for i := 0; i < 2; i++ {
+		ctxt.IterateSyms(f, func(*sym.Info) bool { return true })
+	}
+	syms, unresolved = ctxt.Unresolved()
+	c.Assert(syms, Equals, 5)
+	c.Assert(unresolved, Equals, 2)
+}
+
+func (suite) TestImportCycle(c *C) {
+	files := map[string]string{
+		"a/a.go": "package a\n\nimport \"b\"\n\nvar X = b.X\n",
+		"b/b.go": "package b\n\nimport \"unsafe\"\n\nvar X = unsafe.Sizeof(0)\n",
+		"c/c.go": "package c\n",
+	}
+	gopath := testGoPath(c, files)
+	w := newWriteCmd(testContext(gopath))
+	c.Assert(w.importCycle("b", "a"), DeepEquals, []string{"b", "a", "b"})
+	c.Assert(w.importCycle("a", "a"), DeepEquals, []string{"a", "a"})
+	c.Assert(w.importCycle("a", "c"), IsNil)
+	c.Assert(w.importCycle("c", "a"), IsNil)
+
+	// Imports added by earlier changes are taken into account.
+	w.addPackageImport("b", "c")
+	c.Assert(w.importCycle("c", "a"), DeepEquals, []string{"c", "a", "b", "c"})
+}
+
+var renamePackageSource = `package p
+
+import (
+	"q"
+	rr "r"
+)
+
+func H() {
+	q.F()
+	rr.G()
+}
+
+func I(qq int) {
+	q.F()
+}
+`
+
+func (suite) TestRenamePackageName(c *C) {
+	files := map[string]string{
+		"p/p.go": renamePackageSource,
+		"q/q.go": "package q\n\nfunc F() {}\n",
+		"r/r.go": "package r\n\nfunc G() {}\n",
+	}
+	gopath := testGoPath(c, files)
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	var warnings []sym.Warning
+	rename := func(strict bool, lines ...string) (*writeCmd, map[string][]byte) {
+		w := newWriteCmd(testContext(gopath))
+		w.strict = strict
+		warnings = nil
+		w.Warn = func(wn sym.Warning) {
+			warnings = append(warnings, wn)
+		}
+		addLines(c, w, pfile, lines...)
+		w.addGlobals()
+		w.checkCollisions()
+		w.replace([]string{"p"})
+		srcs, err := w.FormatFiles(w.ChangedFiles)
+		c.Assert(err, IsNil)
+		return w, srcs
+	}
+
+	// An unnamed import is given a name, and a
+	// name that is the package's own is removed.
+	w, srcs := rename(false, "9:2: q s", "10:2: rr r")
+	c.Assert(w.conflicts, HasLen, 0)
+	c.Assert(string(srcs[pfile]), Equals, `package p
+
+import (
+	s "q"
+	"r"
+)
+
+func H() {
+	s.F()
+	r.G()
+}
+
+func I(qq int) {
+	s.F()
+}
+`)
+
+	// Names used by other imports, package-level
+	// declarations and locals collide.
+	w, _ = rename(true, "9:2: q rr")
+	c.Assert(w.conflicts, HasLen, 1)
+	c.Assert(w.conflicts[0].msg, Matches, `renaming q to rr collides with import of "r" at .*`)
+	w, _ = rename(true, "10:2: rr H")
+	c.Assert(w.conflicts, HasLen, 1)
+	c.Assert(w.conflicts[0].msg, Matches, `renaming rr to H collides with package-level declaration at .*`)
+	w, _ = rename(true, "9:2: q qq")
+	c.Assert(w.conflicts, HasLen, 1)
+	c.Assert(w.conflicts[0].msg, Matches, `renaming q to qq collides with local declaration at .*p.go:13:8`)
+	c.Assert(warnings, HasLen, 1)
+	c.Assert(warnings[0].Category, Equals, warnConflict)
+
+	// Without -strict, a collision is only a warning.
+	w, _ = rename(false, "9:2: q qq")
+	c.Assert(w.conflicts, HasLen, 0)
+	c.Assert(warnings, HasLen, 1)
+	c.Assert(warnings[0].Category, Equals, warnCollision)
+	c.Assert(warnings[0].Pos.Filename, Equals, pfile)
+	c.Assert(warnings[0].Msg, Matches, `renaming q to qq collides with local declaration at .*p.go:13:8`)
+}
+
+func (suite) TestWriteScope(c *C) {
+	files := map[string]string{
+		"a/p/p.go": "package p\n\nvar X int\n\ntype T struct {\n\tF int\n}\n",
+		"a/q/q.go": "package q\n\nimport \"a/p\"\n\nvar V p.T\n\nvar Y = p.X\n",
+		"a/r/r.go": "package r\n\nimport \"a/q\"\n\nvar Z = q.V.F\n",
+		"a/u/u.go": "package u\n\nvar X int\n",
+		"b/s/s.go": "package s\n\nimport \"a/p\"\n\nvar W = p.X\n",
+	}
+	gopath := testGoPath(c, files)
+	w := newWriteCmd(testContext(gopath))
+	pfile := filepath.Join(gopath, "src", "a", "p", "p.go")
+	addLines(c, w, pfile, "3:5: X Y", "6:2: F G")
+
+	// Only the packages in scope that import a/p,
+	// directly or not, are found.
+	importers, err := w.importers(filepath.Join(gopath, "src", "a"))
+	c.Assert(err, IsNil)
+	c.Assert(importers, DeepEquals, []string{"a/q", "a/r"})
+
+	w.addGlobals()
+	w.replace(append([]string{"a/p"}, importers...))
+	c.Assert(w.conflicts, HasLen, 0)
+	srcs, err := w.FormatFiles(w.ChangedFiles)
+	c.Assert(err, IsNil)
+	src := func(name string) string {
+		return string(srcs[filepath.Join(gopath, "src", filepath.FromSlash(name))])
+	}
+	c.Assert(srcs, HasLen, 3)
+	c.Assert(src("a/p/p.go"), Equals, "package p\n\nvar Y int\n\ntype T struct {\n\tG int\n}\n")
+	c.Assert(src("a/q/q.go"), Equals, "package q\n\nimport \"a/p\"\n\nvar V p.T\n\nvar Y = p.Y\n")
+	c.Assert(src("a/r/r.go"), Equals, "package r\n\nimport \"a/q\"\n\nvar Z = q.V.G\n")
+}
+
+func (suite) TestWriteDefaultScope(c *C) {
+	files := map[string]string{
+		"a/p/p.go": "package p\n\nvar X int\n",
+		"a/q/q.go": "package q\n\nimport \"a/p\"\n\nvar Y = p.X\n",
+		"b/s/s.go": "package s\n\nimport \"a/p\"\n\nvar W = p.X\n",
+	}
+	// write renames p.X to Z with the given -scope flag and
+	// returns the resulting contents of each file.
+	write := func(scope string) map[string]string {
+		gopath := testGoPath(c, files)
+		ctxt := testContext(gopath)
+		ctxt.stdout = bufio.NewWriter(ioutil.Discard)
+		if scope != "" {
+			scope = filepath.Join(gopath, "src", scope)
+		}
+		w := &writeCmd{renames: fileList{"a/p.X=Z"}, scope: scope, strict: true}
+		err := w.run(ctxt, []string{"a/p"})
+		c.Assert(err, IsNil)
+		srcs := make(map[string]string)
+		for name := range files {
+			data, err := ioutil.ReadFile(filepath.Join(gopath, "src", filepath.FromSlash(name)))
+			c.Assert(err, IsNil)
+			srcs[name] = string(data)
+		}
+		return srcs
+	}
+
+	// By default, the importers are looked for
+	// in the whole of the GOPATH entry.
+	srcs := write("")
+	c.Assert(srcs["a/p/p.go"], Equals, "package p\n\nvar Z int\n")
+	c.Assert(srcs["a/q/q.go"], Equals, "package q\n\nimport \"a/p\"\n\nvar Y = p.Z\n")
+	c.Assert(srcs["b/s/s.go"], Equals, "package s\n\nimport \"a/p\"\n\nvar W = p.Z\n")
+
+	// The -scope flag narrows the search.
+	srcs = write("a")
+	c.Assert(srcs["a/p/p.go"], Equals, "package p\n\nvar Z int\n")
+	c.Assert(srcs["a/q/q.go"], Equals, "package q\n\nimport \"a/p\"\n\nvar Y = p.Z\n")
+	c.Assert(srcs["b/s/s.go"], Equals, files["b/s/s.go"])
+}
+
+func (suite) TestReplaceLineFilesOnly(c *C) {
+	gopath := testGoPath(c, map[string]string{
+		"p/a.go": "package p\n\nvar X int\n\nfunc F() {\n\ty := X\n\t_ = y\n}\n",
+		"p/b.go": "package p\n\nvar Z = X + undefined\n",
+	})
+	dir := filepath.Join(gopath, "src", "p")
+	a, b := filepath.Join(dir, "a.go"), filepath.Join(dir, "b.go")
+	rename := func(lines ...string) (map[string]bool, map[string][]byte) {
+		w := newWriteCmd(testContext(gopath))
+		// The files visited are those in which
+		// the undefined symbol is logged.
+		visited := make(map[string]bool)
+		w.Warn = func(wn sym.Warning) {
+			visited[filepath.Base(wn.Pos.Filename)] = true
+		}
+		addLines(c, w, a, lines...)
+		w.addGlobals()
+		w.replace([]string{"p"})
+		c.Assert(w.conflicts, HasLen, 0)
+		srcs, err := w.FormatFiles(w.ChangedFiles)
+		c.Assert(err, IsNil)
+		return visited, srcs
+	}
+
+	// A local rename visits only the file it is in.
+	visited, srcs := rename("6:2: y yy")
+	c.Assert(visited, DeepEquals, map[string]bool{})
+	c.Assert(srcs, HasLen, 1)
+	c.Assert(string(srcs[a]), Equals, "package p\n\nvar X int\n\nfunc F() {\n\tyy := X\n\t_ = yy\n}\n")
+
+	// A global rename visits all the files.
+	visited, srcs = rename("6:2: y yy", "3:5: X W")
+	c.Assert(visited, DeepEquals, map[string]bool{"b.go": true})
+	c.Assert(srcs, HasLen, 2)
+	c.Assert(string(srcs[b]), Equals, "package p\n\nvar Z = W + undefined\n")
+}
+
+func (suite) TestWriteIgnoreCase(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": "package p\n\nvar foo, Bar, qux, Qux int\n\nfunc F() int {\n\treturn foo + Bar\n}\n"})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	rename := func(ignoreCase bool, lines ...string) (*writeCmd, string) {
+		w := newWriteCmd(testContext(gopath))
+		w.strict = true
+		w.ignoreCase = ignoreCase
+		addLines(c, w, pfile, lines...)
+		w.validateLines([]*context{w.context})
+		w.addGlobals()
+		w.checkCollisions()
+		w.replace([]string{"p"})
+		srcs, err := w.FormatFiles(w.ChangedFiles)
+		c.Assert(err, IsNil)
+		return w, string(srcs[pfile])
+	}
+
+	// Without -ignorecase, the names must match.
+	w, src := rename(false, "3:5: FOO Foo")
+	c.Assert(w.conflicts, HasLen, 1)
+	c.Assert(w.conflicts[0].msg, Equals, "identifier is foo, not FOO; not changing it to Foo")
+	c.Assert(src, Equals, "")
+
+	// A name that is already correct is left alone.
+	w, src = rename(true, "3:5: FOO Foo", "3:10: BAR Bar")
+	c.Assert(w.conflicts, HasLen, 0)
+	c.Assert(w.lines, HasLen, 1)
+	c.Assert(src, Equals, "package p\n\nvar Foo, Bar, qux, Qux int\n\nfunc F() int {\n\treturn Foo + Bar\n}\n")
+
+	// A case-only change can collide.
+	w, _ = rename(true, "3:15: QUX Qux")
+	c.Assert(w.conflicts, HasLen, 1)
+	c.Assert(w.conflicts[0].msg, Matches, `renaming qux to Qux collides with .*`)
+}
+
+func (suite) TestWriteKeywordAndPredeclared(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": "package p\n\ntype T struct {\n\tF int\n}\n\nfunc G(x int) int {\n\treturn x\n}\n"})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	rename := func(lines ...string) *writeCmd {
+		w := newWriteCmd(testContext(gopath))
+		w.strict = true
+		addLines(c, w, pfile, lines...)
+		w.validateLines([]*context{w.context})
+		w.addGlobals()
+		w.checkCollisions()
+		return w
+	}
+
+	// A keyword is never allowed.
+	w := rename("7:6: G type", "7:8: x range local")
+	c.Assert(w.conflicts, HasLen, 2)
+	c.Assert(w.conflicts[0].msg, Equals, "type is a keyword; not changing G to it")
+	c.Assert(w.conflicts[1].msg, Equals, "range is a keyword; not changing x to it")
+	c.Assert(w.globalReplace, HasLen, 0)
+
+	// A predeclared name collides, except as a member.
+	w = rename("7:6: G len", "7:8: x error local", "4:2: F len")
+	c.Assert(w.conflicts, HasLen, 2)
+	c.Assert(w.conflicts[0].msg, Equals, "renaming G to len collides with predeclared func len")
+	c.Assert(w.conflicts[1].msg, Equals, "renaming x to error collides with predeclared type error")
+}
+
+func (suite) TestWriteBlank(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": "package p\n\ntype T struct {\n\t_ int\n\tF int\n}\n\nvar _, X = T{}, 1\n"})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	w := newWriteCmd(testContext(gopath))
+	w.strict = true
+	w.CountUnresolved = true
+	addLines(c, w, pfile, "4:2: _ A", "8:5: _ B", "5:2: F _")
+	w.validateLines([]*context{w.context})
+	w.addGlobals()
+	w.checkCollisions()
+	c.Assert(w.conflicts, HasLen, 3)
+	c.Assert(w.conflicts[0].msg, Equals, "the blank identifier cannot be renamed; not changing it to A")
+	c.Assert(w.conflicts[1].msg, Equals, "not changing F to the blank identifier")
+	c.Assert(w.conflicts[2].msg, Equals, "the blank identifier cannot be renamed; not changing it to B")
+	c.Assert(w.globalReplace, HasLen, 0)
+
+	// The blank identifiers are not counted as unresolved.
+	syms, unresolved := w.context.Unresolved()
+	c.Assert(syms > 0, Equals, true)
+	c.Assert(unresolved, Equals, 0)
+}
+
+func (suite) TestWriteMoveToPackage(c *C) {
+	files := map[string]string{
+		"old/old.go":   "package old\n\ntype T int\n\nfunc (T) M() {}\n\nvar V T\n\ntype S int\n",
+		"user/user.go": "package user\n\nimport \"old\"\n\nvar X old.T\n",
+		"nw/nw.go":     "package nw\n\nimport \"old\"\n\nvar Y old.S\n",
+		"dst/dst.go":   "package dst\n",
+	}
+	gopath := testGoPath(c, files)
+	w := newWriteCmd(testContext(gopath))
+	w.strict = true
+	oldFile := filepath.Join(gopath, "src", "old", "old.go")
+	addLines(c, w, oldFile, "3:6: T dst.U", "9:6: S nw.S")
+	w.validateLines([]*context{w.context})
+	w.addGlobals()
+	w.checkCollisions()
+	c.Assert(w.conflicts, HasLen, 0)
+	w.replace([]string{"old", "user", "nw"})
+	c.Assert(w.conflicts, HasLen, 0)
+	srcs, err := w.FormatFiles(w.ChangedFiles)
+	c.Assert(err, IsNil)
+	c.Assert(srcs, HasLen, 3)
+
+	// The declarations and the method receiver are left
+	// unchanged; the other unqualified reference is qualified,
+	// and the reference from the new package is unqualified.
+	c.Assert(string(srcs[oldFile]), Equals, "package old\n\nimport \"dst\"\n\ntype T int\n\nfunc (T) M() {}\n\nvar V dst.U\n\ntype S int\n")
+	c.Assert(string(srcs[filepath.Join(gopath, "src", "user", "user.go")]), Equals, "package user\n\nimport (\n\t\"old\"\n\t\"dst\"\n)\n\nvar X dst.U\n")
+	c.Assert(string(srcs[filepath.Join(gopath, "src", "nw", "nw.go")]), Equals, "package nw\n\nimport \"old\"\n\nvar Y S\n")
+}
+
+func (suite) TestWriteRenameFlag(c *C) {
+	files := map[string]string{
+		"old/old.go":   "package old\n\ntype T int\n\nfunc (T) M() {}\n\nfunc F() {}\n",
+		"user/user.go": "package user\n\nimport \"old\"\n\nvar X old.T\n\nfunc G() { old.F(); X.M() }\n",
+	}
+	gopath := testGoPath(c, files)
+	rename := func(renames ...string) *writeCmd {
+		w := newWriteCmd(testContext(gopath))
+		w.strict = true
+		w.renames = renames
+		return w
+	}
+	w := rename("old.F=H", "old.T.M=N")
+	paths, err := w.checkRenames()
+	c.Assert(err, IsNil)
+	c.Assert(paths, DeepEquals, []string{"old"})
+	w.addGlobals()
+	w.addRenames()
+	c.Assert(w.globalReplace, HasLen, 2)
+	w.checkCollisions()
+	w.replace([]string{"user", "old"})
+	c.Assert(w.conflicts, HasLen, 0)
+	srcs, err := w.FormatFiles(w.ChangedFiles)
+	c.Assert(err, IsNil)
+	c.Assert(string(srcs[filepath.Join(gopath, "src", "old", "old.go")]), Equals, "package old\n\ntype T int\n\nfunc (T) N() {}\n\nfunc H() {}\n")
+	c.Assert(string(srcs[filepath.Join(gopath, "src", "user", "user.go")]), Equals, "package user\n\nimport \"old\"\n\nvar X old.T\n\nfunc G() { old.H(); X.N() }\n")
+
+	for _, test := range []struct {
+		rename string
+		err    string
+	}{
+		{"old.F", `invalid -rename "old.F"; want pkg.Name=NewName`},
+		{"old.F=func", `invalid -rename "old.F=func": "func" is not a valid new name`},
+		{"old.Missing=X", `cannot rename old.Missing: Missing not found in package old`},
+		{"nopkg.F=X", `cannot rename nopkg.F: cannot find package for "nopkg.F"`},
+	} {
+		_, err := rename(test.rename).checkRenames()
+		c.Check(err, ErrorMatches, regexp.QuoteMeta(test.err))
+	}
+}
+
+func (suite) TestWritePlan(c *C) {
+	files := map[string]string{
+		"old/old.go":   "package old\n\nfunc F() {}\n\nfunc G() { F() }\n",
+		"user/user.go": "package user\n\nimport \"old\"\n\nfunc G() { old.F() }\n",
+	}
+	gopath := testGoPath(c, files)
+	// Each command is run with a new context, as
+	// the plan is made and applied by separate runs.
+	newCtxt := func() *context {
+		ctxt := testContext(gopath)
+		ctxt.stdout = bufio.NewWriter(ioutil.Discard)
+		return ctxt
+	}
+	oldFile := filepath.Join(gopath, "src", "old", "old.go")
+	userFile := filepath.Join(gopath, "src", "user", "user.go")
+	plan := filepath.Join(gopath, "plan")
+
+	// The plan holds every identifier to change,
+	// and no files are changed when it is made.
+	w := &writeCmd{renames: fileList{"old.F=H"}, planOut: plan}
+	err := w.run(newCtxt(), []string{"user"})
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(plan)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, strings.NewReplacer("$oldFile", oldFile, "$userFile", userFile).Replace(`$oldFile:3:6: F H
+$oldFile:5:12: F H
+$userFile:5:16: F H
+`))
+	data, err = ioutil.ReadFile(oldFile)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, files["old/old.go"])
+
+	w = &writeCmd{planIn: plan}
+	err = w.run(newCtxt(), nil)
+	c.Assert(err, IsNil)
+	data, err = ioutil.ReadFile(oldFile)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "package old\n\nfunc H() {}\n\nfunc G() { H() }\n")
+	data, err = ioutil.ReadFile(userFile)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "package user\n\nimport \"old\"\n\nfunc G() { old.H() }\n")
+
+	// A plan that no longer matches the source is
+	// reported, and changes nothing.
+	w = &writeCmd{planIn: plan, strict: true}
+	err = w.run(newCtxt(), nil)
+	c.Assert(err, ErrorMatches, "found 3 conflicts in .*; no files changed")
+
+	w = &writeCmd{planIn: plan, renames: fileList{"old.H=F"}}
+	err = w.run(newCtxt(), nil)
+	c.Assert(err, ErrorMatches, "-plan-in cannot be used with packages or with -i, -rename or -scope")
+	w = &writeCmd{planIn: plan, planOut: plan}
+	err = w.run(newCtxt(), nil)
+	c.Assert(err, ErrorMatches, "-plan-out cannot be used with -n or -plan-in")
+}
+
+func (suite) TestWriteTests(c *C) {
+	files := map[string]string{
+		"p/p.go":         "package p\n\nfunc F() {}\n",
+		"p/p_test.go":    "package p\n\nfunc TestF() { F() }\n",
+		"p/x_test.go":    "package p_test\n\nimport \"p\"\n\nfunc TestX() { p.F() }\n",
+		"user/user.go":   "package user\n\nfunc G() {}\n",
+		"user/u_test.go": "package user\n\nimport \"p\"\n\nfunc TestG() { p.F() }\n",
+	}
+	// write renames p.F to H, with or without the test
+	// files, and returns the resulting contents of each file.
+	write := func(tests bool) map[string]string {
+		gopath := testGoPath(c, files)
+		ctxt := testContext(gopath)
+		ctxt.ImportTests = tests
+		ctxt.stdout = bufio.NewWriter(ioutil.Discard)
+		w := &writeCmd{renames: fileList{"p.F=H"}, scope: filepath.Join(gopath, "src", "user"), strict: true}
+		err := w.run(ctxt, []string{"p"})
+		c.Assert(err, IsNil)
+		srcs := make(map[string]string)
+		for name := range files {
+			data, err := ioutil.ReadFile(filepath.Join(gopath, "src", filepath.FromSlash(name)))
+			c.Assert(err, IsNil)
+			srcs[name] = string(data)
+		}
+		return srcs
+	}
+
+	// The package's own test files are always changed.
+	srcs := write(false)
+	c.Assert(srcs["p/p.go"], Equals, "package p\n\nfunc H() {}\n")
+	c.Assert(srcs["p/p_test.go"], Equals, "package p\n\nfunc TestF() { H() }\n")
+	c.Assert(srcs["p/x_test.go"], Equals, files["p/x_test.go"])
+	c.Assert(srcs["user/u_test.go"], Equals, files["user/u_test.go"])
+
+	// With -tests, the renaming reaches the external test
+	// package too, and the test files of packages that
+	// import the package only there.
+	srcs = write(true)
+	c.Assert(srcs["p/p.go"], Equals, "package p\n\nfunc H() {}\n")
+	c.Assert(srcs["p/p_test.go"], Equals, "package p\n\nfunc TestF() { H() }\n")
+	c.Assert(srcs["p/x_test.go"], Equals, "package p_test\n\nimport \"p\"\n\nfunc TestX() { p.H() }\n")
+	c.Assert(srcs["user/u_test.go"], Equals, "package user\n\nimport \"p\"\n\nfunc TestG() { p.H() }\n")
+	c.Assert(srcs["user/user.go"], Equals, files["user/user.go"])
+}
+
+func (suite) TestWriteEmbeddedInterfaceMethod(c *C) {
+	files := map[string]string{
+		"a/a.go": "package a\n\ntype Reader interface {\n\tRead(p []byte) (int, error)\n}\n",
+		"b/b.go": "package b\n\nimport \"a\"\n\ntype ReadCloser interface {\n\ta.Reader\n\tClose() error\n}\n",
+		"c/c.go": "package c\n\nimport \"b\"\n\ntype Rd interface {\n\tb.ReadCloser\n\tExtra()\n}\n\nfunc F(r Rd, rc b.ReadCloser) {\n\tr.Read(nil)\n\trc.Read(nil)\n}\n",
+	}
+	gopath := testGoPath(c, files)
+	w := newWriteCmd(testContext(gopath))
+	w.strict = true
+	w.renames = fileList{"a.Reader.Read=Get"}
+	_, err := w.checkRenames()
+	c.Assert(err, IsNil)
+	w.addGlobals()
+	w.addRenames()
+	w.checkCollisions()
+	w.replace([]string{"a", "b", "c"})
+	c.Assert(w.conflicts, HasLen, 0)
+	srcs, err := w.FormatFiles(w.ChangedFiles)
+	c.Assert(err, IsNil)
+
+	// The method is promoted through two levels of
+	// embedding, so the calls in c refer to a.Reader.Read.
+	c.Assert(srcs, HasLen, 2)
+	c.Assert(string(srcs[filepath.Join(gopath, "src", "a", "a.go")]), Equals, "package a\n\ntype Reader interface {\n\tGet(p []byte) (int, error)\n}\n")
+	c.Assert(string(srcs[filepath.Join(gopath, "src", "c", "c.go")]), Equals, "package c\n\nimport \"b\"\n\ntype Rd interface {\n\tb.ReadCloser\n\tExtra()\n}\n\nfunc F(r Rd, rc b.ReadCloser) {\n\tr.Get(nil)\n\trc.Get(nil)\n}\n")
+}
+
+func (suite) TestWriteInterfaceMethodPackages(c *C) {
+	files := map[string]string{
+		"a/a.go": `package a
+
+type T struct{}
+
+type Getter interface {
+	Get(t *T) error
+}
+`,
+		"b/b.go": `package b
+
+import "a"
+
+type T struct{}
+
+// X implements a.Getter, although it refers to a.T
+// differently from the interface.
+type X struct{}
+
+func (X) Get(t *a.T) error { return nil }
+
+// Y does not implement a.Getter, although its method
+// is written the same way as the interface's.
+type Y struct{}
+
+func (Y) Get(t *T) error { return nil }
+`,
+	}
+	gopath := testGoPath(c, files)
+	w := newWriteCmd(testContext(gopath))
+	w.strict = true
+	w.renames = fileList{"a.Getter.Get=Fetch"}
+	_, err := w.checkRenames()
+	c.Assert(err, IsNil)
+	w.addGlobals()
+	w.addRenames()
+	w.addInterfaceMethods([]string{"a", "b"})
+	w.checkCollisions()
+	w.replace([]string{"a", "b"})
+	c.Assert(w.conflicts, HasLen, 0)
+	srcs, err := w.FormatFiles(w.ChangedFiles)
+	c.Assert(err, IsNil)
+	c.Assert(srcs, HasLen, 2)
+	c.Assert(string(srcs[filepath.Join(gopath, "src", "b", "b.go")]), Equals, strings.Replace(files["b/b.go"], "func (X) Get", "func (X) Fetch", 1))
+}
+
+var funcLitSource = `package p
+
+import "sort"
+
+func F(xs []int) {
+	sort.Slice(xs, func(i, j int) bool { return xs[i] < xs[j] })
+	less := func(i, j int) bool { return xs[i] > xs[j] }
+	_ = less
+}
+
+func G(i, j int) int { return i + j }
+`
+
+func (suite) TestWriteFuncLitParams(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": funcLitSource})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	write := func(lines ...string) *writeCmd {
+		w := newWriteCmd(testContext(gopath))
+		w.strict = true
+		addLines(c, w, pfile, lines...)
+		w.validateLines([]*context{w.context})
+		w.addGlobals()
+		w.checkCollisions()
+		return w
+	}
+
+	// The parameters of the callback passed to sort.Slice are
+	// renamed without changing those of the other function
+	// literal or of G. The name less is declared outside the
+	// second literal, which does not refer to it, so renaming
+	// a parameter to it is no collision.
+	w := write("6:22: i a", "6:25: j b", "7:15: i less")
+	c.Assert(w.conflicts, HasLen, 0)
+	w.replace([]string{"p"})
+	srcs, err := w.FormatFiles(w.ChangedFiles)
+	c.Assert(err, IsNil)
+	c.Assert(string(srcs[pfile]), Equals, strings.Replace(strings.Replace(funcLitSource,
+		"func(i, j int) bool { return xs[i] < xs[j] }", "func(a, b int) bool { return xs[a] < xs[b] }", 1),
+		"func(i, j int) bool { return xs[i] > xs[j] }", "func(less, j int) bool { return xs[less] > xs[j] }", 1))
+
+	// A new name collides with the other parameter of the
+	// literal, and with the variable it refers to from F.
+	w = write("6:22: i j")
+	c.Assert(w.conflicts, HasLen, 1)
+	c.Assert(w.conflicts[0].msg, Matches, "renaming i to j collides with local declaration at .*p.go:6:25")
+	w = write("6:22: i xs")
+	c.Assert(w.conflicts, HasLen, 1)
+	c.Assert(w.conflicts[0].msg, Matches, "renaming i to xs collides with local declaration at .*p.go:5:8")
+}
+
+func (suite) TestWriteConflicts(c *C) {
+	files := map[string]string{
+		"p/a.go": "package p\n\nfunc F() {}\n\nvar V = 1\n",
+		"p/b.go": "package p\n\nfunc G() { F() }\n",
+	}
+	gopath := testGoPath(c, files)
+	afile := filepath.Join(gopath, "src", "p", "a.go")
+	bfile := filepath.Join(gopath, "src", "p", "b.go")
+	input := filepath.Join(gopath, "renames.txt")
+	// The declaration and use of F are given different new
+	// names, which conflict; the change to V does not.
+	lines := afile + ":3:6: F H\n" + bfile + ":3:12: F K\n" + afile + ":5:5: V W\n"
+	err := ioutil.WriteFile(input, []byte(lines), 0666)
+	c.Assert(err, IsNil)
+	write := func(strict bool) (*writeCmd, error) {
+		for name, src := range files {
+			err := ioutil.WriteFile(filepath.Join(gopath, "src", filepath.FromSlash(name)), []byte(src), 0666)
+			c.Assert(err, IsNil)
+		}
+		ctxt := testContext(gopath)
+		ctxt.stdout = bufio.NewWriter(ioutil.Discard)
+		ctxt.Warn = func(sym.Warning) {}
+		w := &writeCmd{input: input, strict: strict}
+		return w, w.run(ctxt, []string{"p"})
+	}
+	readFile := func(name string) string {
+		data, err := ioutil.ReadFile(name)
+		c.Assert(err, IsNil)
+		return string(data)
+	}
+
+	// Without -strict, the other changes are made, and
+	// the conflicts are counted in the error returned.
+	w, err := write(false)
+	c.Assert(err, ErrorMatches, "found 1 conflicts in "+regexp.QuoteMeta(bfile))
+	c.Assert(err.(*codeError).code, Equals, exitWrite)
+	c.Assert(w.conflicts, HasLen, 1)
+	c.Assert(w.conflicts[0].pos.Filename, Equals, bfile)
+	c.Assert(w.conflicts[0].pos.Line, Equals, 3)
+	c.Assert(w.conflicts[0].msg, Matches, "conflicting .*")
+	c.Assert(readFile(afile), Equals, "package p\n\nfunc H() {}\n\nvar W = 1\n")
+
+	// With -strict, no file is changed.
+	_, err = write(true)
+	c.Assert(err, ErrorMatches, "found 1 conflicts in "+regexp.QuoteMeta(bfile)+"; no files changed")
+	c.Assert(err.(*codeError).code, Equals, exitWrite)
+	c.Assert(readFile(afile), Equals, files["p/a.go"])
+	c.Assert(readFile(bfile), Equals, files["p/b.go"])
+}
+
+var localCollisionSource = `package p
+
+func F(a []int) int {
+	n := 0
+	for i := range a {
+		n += i
+	}
+	for j := range a {
+		n += j
+	}
+	if n > 0 {
+		k := n
+		_ = k
+	}
+	{
+		m := 1
+		_ = m
+		k := 2
+		_ = k
+	}
+	return n
+}
+`
+
+func (suite) TestWriteLocalCollisions(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": localCollisionSource})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	check := func(line string) []conflict {
+		w := newWriteCmd(testContext(gopath))
+		w.strict = true
+		addLines(c, w, pfile, line)
+		w.validateLines([]*context{w.context})
+		w.addGlobals()
+		w.checkCollisions()
+		return w.conflicts
+	}
+
+	// Locals in sibling blocks do not collide.
+	c.Assert(check("8:6: j i"), HasLen, 0)
+	c.Assert(check("12:3: k m"), HasLen, 0)
+
+	// A local in the same block collides, as does one in
+	// an inner block where the symbol is used, and one in
+	// an outer block that is used in the symbol's scope.
+	conflicts := check("16:3: m k")
+	c.Assert(conflicts, HasLen, 1)
+	c.Assert(conflicts[0].msg, Matches, `renaming m to k collides with local declaration at .*p.go:18:3`)
+	conflicts = check("4:2: n i")
+	c.Assert(conflicts, HasLen, 1)
+	c.Assert(conflicts[0].msg, Matches, `renaming n to i collides with local declaration at .*p.go:5:6`)
+	conflicts = check("5:6: i n")
+	c.Assert(conflicts, HasLen, 1)
+	c.Assert(conflicts[0].msg, Matches, `renaming i to n collides with local declaration at .*p.go:4:2`)
+}
+
+var collisionSource = `package p
+
+type T struct {
+	a, b int
+}
+
+var g = 1
+
+func F(t T) int {
+	x := t.a
+	return x + g
+}
+`
+
+func (suite) TestWriteCollisions(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": collisionSource})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	check := func(strict bool, line string) []conflict {
+		w := newWriteCmd(testContext(gopath))
+		w.strict = strict
+		w.Warn = func(sym.Warning) {}
+		addLines(c, w, pfile, line)
+		w.validateLines([]*context{w.context})
+		w.addGlobals()
+		w.checkCollisions()
+		return w.conflicts
+	}
+
+	// A field renamed to the name of another field
+	// of its type collides with it.
+	conflicts := check(true, "4:2: a b")
+	c.Assert(conflicts, HasLen, 1)
+	c.Assert(conflicts[0].msg, Matches, `renaming a to b collides with member of T declared at .*p.go:4:5`)
+
+	// So does a local renamed to the name of
+	// a package-level declaration.
+	conflicts = check(true, "10:2: x g")
+	c.Assert(conflicts, HasLen, 1)
+	c.Assert(conflicts[0].msg, Matches, `renaming x to g collides with package-level declaration at .*p.go:7:5`)
+
+	// Without -strict, collisions are not conflicts.
+	c.Assert(check(false, "10:2: x g"), HasLen, 0)
+}
+
+var localRenameSource = `package p
+
+var x = 1
+
+func F() int {
+	x := 2
+	g := func() int { return x + 1 }
+	if x > 0 {
+		x := x + 3
+		return x
+	}
+	return g() + x
+}
+
+func G() int {
+	x := 4
+	return x
+}
+`
+
+func (suite) TestWriteLocal(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": localRenameSource})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	input := filepath.Join(gopath, "renames.txt")
+	// write applies the given lines to the original source
+	// and returns the resulting contents of p.go.
+	write := func(lines ...string) string {
+		err := ioutil.WriteFile(pfile, []byte(localRenameSource), 0666)
+		c.Assert(err, IsNil)
+		var buf bytes.Buffer
+		for _, l := range lines {
+			fmt.Fprintf(&buf, "%s:%s\n", pfile, l)
+		}
+		err = ioutil.WriteFile(input, buf.Bytes(), 0666)
+		c.Assert(err, IsNil)
+		ctxt := testContext(gopath)
+		ctxt.stdout = bufio.NewWriter(ioutil.Discard)
+		w := &writeCmd{input: input, strict: true}
+		err = w.run(ctxt, []string{"p"})
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadFile(pfile)
+		c.Assert(err, IsNil)
+		return string(data)
+	}
+
+	// The local x of F is renamed where the closure
+	// captures it and where the inner x is initialized
+	// from it, but neither the inner x, nor the x of G,
+	// nor the package-level x is changed.
+	c.Assert(write("6:2: x y local"), Equals, `package p
+
+var x = 1
+
+func F() int {
+	y := 2
+	g := func() int { return y + 1 }
+	if y > 0 {
+		x := y + 3
+		return x
+	}
+	return g() + y
+}
+
+func G() int {
+	x := 4
+	return x
+}
+`)
+
+	// The x redeclared with := in the inner scope is
+	// renamed apart from the x it is initialized from.
+	c.Assert(write("9:3: x z local"), Equals, `package p
+
+var x = 1
+
+func F() int {
+	x := 2
+	g := func() int { return x + 1 }
+	if x > 0 {
+		z := x + 3
+		return z
+	}
+	return g() + x
+}
+
+func G() int {
+	x := 4
+	return x
+}
+`)
+
+	// The x of G is renamed without changing the x
+	// of its sibling F.
+	c.Assert(write("16:2: x w local"), Equals, `package p
+
+var x = 1
+
+func F() int {
+	x := 2
+	g := func() int { return x + 1 }
+	if x > 0 {
+		x := x + 3
+		return x
+	}
+	return g() + x
+}
+
+func G() int {
+	w := 4
+	return w
+}
+`)
+}
+
+var typeAssertSource = `package p
+
+type Old struct{ F int }
+
+func F(x interface{}) int {
+	if o, ok := x.(Old); ok {
+		return o.F
+	}
+	switch y := x.(type) {
+	case Old:
+		return y.F
+	case *Old, []Old:
+	}
+	return x.(*Old).F
+}
+`
+
+func (suite) TestWriteTypeAssert(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": typeAssertSource})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	w := newWriteCmd(testContext(gopath))
+	w.strict = true
+	addLines(c, w, pfile, "3:6: Old New")
+	w.validateLines([]*context{w.context})
+	w.addGlobals()
+	w.checkCollisions()
+	w.replace([]string{"p"})
+	c.Assert(w.conflicts, HasLen, 0)
+	srcs, err := w.FormatFiles(w.ChangedFiles)
+	c.Assert(err, IsNil)
+
+	// The type is renamed wherever it is asserted,
+	// including in the cases of a type switch.
+	c.Assert(string(srcs[pfile]), Equals, strings.Replace(typeAssertSource, "Old", "New", -1))
+}
+
+var commentSource = `package p
+
+// F adds its arguments.
+// It has a two-line doc comment.
+func F(a, b int) int { // after F
+	return a + b // sum
+}
+
+/*
+T has a block doc comment.
+*/
+type T struct {
+	// X is a field.
+	X int // x
+	Y int // y
+}
+
+// M is a method.
+func (t T) M() int { return t.X } // after M
+
+const (
+	// C is a constant.
+	C = 1 // c
+	D = 2 // d
+)
+
+var (
+	v = F(1, 2) // v
+	w = C       // w
+)
+`
+
+var renamedCommentSource = `package p
+
+// F adds its arguments.
+// It has a two-line doc comment.
+func AddTwoNumbers(a, b int) int { // after F
+	return a + b // sum
+}
+
+/*
+T has a block doc comment.
+*/
+type Pair struct {
+	// X is a field.
+	FirstField int // x
+	Y          int // y
+}
+
+// M is a method.
+func (t Pair) FirstValue() int { return t.FirstField } // after M
+
+const (
+	// C is a constant.
+	ConstantOne = 1 // c
+	D           = 2 // d
+)
+
+var (
+	variableWithALongName = AddTwoNumbers(1, 2) // v
+	w                     = ConstantOne         // w
+)
+`
+
+func (suite) TestWriteKeepsComments(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": commentSource})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	w := newWriteCmd(testContext(gopath))
+	w.strict = true
+	addLines(c, w, pfile,
+		"5:6: F AddTwoNumbers",
+		"12:6: T Pair",
+		"14:2: T.X FirstField",
+		"19:12: T.M FirstValue",
+		"23:2: C ConstantOne",
+		"28:2: v variableWithALongName",
+	)
+	w.validateLines([]*context{w.context})
+	w.addGlobals()
+	w.checkCollisions()
+	w.replace([]string{"p"})
+	c.Assert(w.conflicts, HasLen, 0)
+	srcs, err := w.FormatFiles(w.ChangedFiles)
+	c.Assert(err, IsNil)
+
+	// Only the identifiers change: each doc comment stays
+	// above its declaration, and each line comment stays
+	// at the end of its line, even where the longer names
+	// put the rest of the line beyond the comment's
+	// original column.
+	c.Assert(string(srcs[pfile]), Equals, renamedCommentSource)
+}
+
+func (suite) TestReadSymbolsFromFile(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": "package p\n\nvar X, Y int\n"})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	input := filepath.Join(gopath, "renames.txt")
+	err := ioutil.WriteFile(input, []byte(pfile+":3:5: X Z\n"+pfile+":3:8: Y Y\n"), 0666)
+	c.Assert(err, IsNil)
+	w := newWriteCmd(testContext(gopath))
+	w.input = input
+	err = w.readSymbols()
+	c.Assert(err, IsNil)
+	c.Assert(w.symPkgs, DeepEquals, map[string]bool{"p": true})
+	c.Assert(w.lines, HasLen, 1)
+	c.Assert(w.line(token.Position{Filename: pfile, Line: 3, Column: 5}, "X").newExpr, Equals, "Z")
+
+	w.input = filepath.Join(gopath, "nonexistent.txt")
+	err = w.readSymbols()
+	c.Assert(err, ErrorMatches, "open .*nonexistent.txt: no such file or directory")
+}
+
+// panicImporter imports packages with an ordinary context,
+// but panics when asked for the package with the given path.
+type panicImporter struct {
+	*sym.Context
+	path string
+}
+
+func (imp panicImporter) Import(path string) *ast.Package {
+	if path == imp.path {
+		panic("cannot import " + path)
+	}
+	return imp.Context.Import(path)
+}
+
+func (suite) TestWriteFailedFile(c *C) {
+	src := "package p\n\nimport \"q\"\n\nvar X int\n\nvar Y = X + q.F\n\nvar Z = X\n"
+	gopath := testGoPath(c, map[string]string{
+		"p/p.go": src,
+		"q/q.go": "package q\n\nconst F = 1\n",
+	})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	input := filepath.Join(gopath, "renames.txt")
+	err := ioutil.WriteFile(input, []byte(pfile+":5:5: X X1\n"), 0666)
+	c.Assert(err, IsNil)
+	bctxt := build.Default
+	bctxt.GOPATH = gopath
+	imp := panicImporter{sym.NewContext(), "q"}
+	imp.BuildContext = &bctxt
+	ctxt := newContext(&bctxt, imp)
+	imp.FileSet = ctxt.FileSet
+	ctxt.Panic = false
+	ctxt.Warn = func(sym.Warning) {}
+
+	// Visiting p.go panics at Y, whose type depends on q, after X has been renamed
+	// at its declaration, so the file is not written.
+	w := &writeCmd{input: input}
+	err = w.run(ctxt, []string{"p"})
+	c.Assert(err, ErrorMatches, "found 1 conflicts in "+regexp.QuoteMeta(pfile))
+	c.Assert(err.(*codeError).code, Equals, exitWrite)
+	c.Assert(w.conflicts, HasLen, 1)
+	c.Assert(w.conflicts[0].pos.String(), Equals, pfile+":7:5")
+	c.Assert(w.conflicts[0].msg, Equals, "cannot visit the rest of the file; not changing it")
+	data, err := ioutil.ReadFile(pfile)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, src)
+}
+
+func (suite) TestWarnings(c *C) {
+	var buf bytes.Buffer
+	writeJSONWarning(&buf, sym.Warning{Pos: token.Position{Filename: "p.go", Line: 3, Column: 5}, Category: warnConflict, Msg: "bad"})
+	writeJSONWarning(&buf, sym.Warning{Category: warnCache, Msg: "cannot write"})
+	c.Assert(buf.String(), Equals, `{"pos":{"filename":"p.go","line":3,"column":5,"offset":0},"category":"conflict","msg":"bad"}
+{"category":"cache","msg":"cannot write"}
+`)
+
+	// The warnings of a context are reported in the
+	// source category.
+	ctxt := sym.NewContext()
+	var got []sym.Warning
+	ctxt.Warn = func(w sym.Warning) {
+		got = append(got, w)
+	}
+	c.Assert(ctxt.Import("nonexistent"), IsNil)
+	c.Assert(got, HasLen, 1)
+	c.Assert(got[0].Category, Equals, warnSource)
+	c.Assert(got[0].Msg, Matches, `(?s)cannot find "nonexistent".*`)
+
+	old := *warnings
+	defer func() {
+		*warnings = old
+	}()
+	*warnings = "loud"
+	c.Assert(runCmd(nil, nil), ErrorMatches, `invalid -warnings value "loud"; want text, json or quiet`)
+}
+
+var isExportedNameTests = []struct {
+	name     string
+	exported bool
+}{
+	{"Foo", true},
+	{"foo", false},
+	{"T.M", true},
+	{"T.m", false},
+	{"t.M", false},
+	{"_.M", false},
+	{"Ä.Ö", true},
+	{"(*T).M", true},
+	{"(*t).M", false},
+	{"(*T).m", false},
+}
+
+func (suite) TestIsExportedName(c *C) {
+	for i, test := range isExportedNameTests {
+		c.Logf("test %d: %q", i, test.name)
+		c.Assert(isExportedName(test.name), Equals, test.exported)
+	}
+}
+
+// sourceImporter imports packages from source held in memory.
+type sourceImporter struct {
+	fset    *token.FileSet
+	sources map[string]string
+	imports map[string]int
+}
+
+func (imp *sourceImporter) Import(path string) *ast.Package {
+	imp.imports[path]++
+	src, ok := imp.sources[path]
+	if !ok {
+		return nil
+	}
+	scope := ast.NewScope(parser.Universe)
+	f, err := parser.ParseFile(imp.fset, path+"/x.go", src, 0, scope)
+	if err != nil {
+		return nil
+	}
+	return &ast.Package{
+		Name:  f.Name.Name,
+		Scope: scope,
+		Files: map[string]*ast.File{path + "/x.go": f},
+	}
+}
+
+func (suite) TestContextImporter(c *C) {
+	imp := &sourceImporter{
+		sources: map[string]string{"example.com/mem": "package mem\n\ntype T int\n"},
+		imports: make(map[string]int),
+	}
+	ctxt := newContext(&build.Default, imp)
+	imp.fset = ctxt.FileSet
+	c.Assert(ctxt.cacheDir, Equals, "")
+	pkg := ctxt.Import("example.com/mem")
+	c.Assert(pkg, NotNil)
+	c.Assert(pkg.Scope.Lookup("T"), NotNil)
+	c.Assert(ctxt.position(types.DeclPos(pkg.Scope.Lookup("T"))).Filename, Equals, "example.com/mem/x.go")
+	c.Assert(ctxt.Import("example.com/mem"), Equals, pkg)
+	c.Assert(imp.imports["example.com/mem"], Equals, 1)
+	c.Assert(ctxt.Import("example.com/other"), IsNil)
+}
+
+func (suite) TestSkippedFiles(c *C) {
+	gopath := testGoPath(c, map[string]string{
+		"p/a.go": "package p\n\nvar A = 1\n",
+		"p/b.go": "package p\n\nfunc B[T any]() {}\n",
+		"p/c.go": "package p\n\nvar C = A +\n",
+	})
+	dir := filepath.Join(gopath, "src", "p")
+	ctxt := testContext(gopath)
+	var warnings []sym.Warning
+	ctxt.Warn = func(w sym.Warning) {
+		warnings = append(warnings, w)
+	}
+
+	// Each file that cannot be parsed is left out,
+	// and the rest of the package is read.
+	pkg := ctxt.Import("p")
+	c.Assert(pkg, NotNil)
+	c.Assert(pkg.Scope.Lookup("A"), NotNil)
+	bfile, cfile := filepath.Join(dir, "b.go"), filepath.Join(dir, "c.go")
+	skipped := ctxt.skippedFiles()
+	c.Assert(skipped, HasLen, 2)
+	c.Assert(skipped[0].Filename, Equals, bfile)
+	c.Assert(skipped[0].Pos.String(), Equals, bfile+":3:7")
+	c.Assert(skipped[1].Filename, Equals, cfile)
+	c.Assert(skipped[1].Pos.String(), Equals, cfile+":3:13")
+	c.Assert(warnings, HasLen, 2)
+	for i, w := range warnings {
+		c.Check(w.Category, Equals, warnSource)
+		c.Check(w.Pos, Equals, skipped[i].Pos)
+		c.Check(w.Msg, Matches, `skipping file in package "p": expected .*`)
+	}
+}
+
+func (suite) TestCacheKeyParams(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": "package p\n\nvar F, Z int\n"})
+	ctxt := testContext(gopath)
+	ctxt.cacheDir = c.MkDir()
+	key := ctxt.cacheKey("p", ". F", "Z")
+	c.Assert(key != "", Equals, true)
+	c.Assert(ctxt.cacheKey("p", ". F", "Z"), Equals, key)
+
+	// Parameters whose printed forms run together
+	// when separated by spaces give different keys.
+	c.Assert(ctxt.cacheKey("p", ".", "F Z") != key, Equals, true)
+	c.Assert(ctxt.cacheKey("p", []string{"a b"}) != ctxt.cacheKey("p", []string{"a", "b"}), Equals, true)
+}
+
+func (suite) TestListCache(c *C) {
+	// The cache is used only while source
+	// warnings are not printed.
+	old := *verbose
+	defer func() {
+		*verbose = old
+	}()
+	*verbose = false
+	gopath := testGoPath(c, map[string]string{"p/p.go": "package p\n\nvar X int\n"})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	ctxt := testContext(gopath)
+	ctxt.cacheDir = c.MkDir()
+	mask, err := parseKindMask(allKinds())
+	c.Assert(err, IsNil)
+	cmd := &listCmd{ctxt: ctxt, init: true}
+	list := func() string {
+		return listPackage(c, cmd, "p", mask)
+	}
+	out := list()
+	c.Assert(out, Equals, pfile+":3:5: "+pfile+":3:5 p p X var+\n")
+	key := ctxt.cacheKey("p", cmd.all, cmd.exported, cmd.init, cmd.printType, cmd.expand, cmd.values, cmd.json, cmd.format, cmd.offset, cmd.defs, cmd.uses, cmd.context, cmd.enclosing, cmd.doc, cmd.tagsFmt, cmd.shadow, cmd.internal, cmd.match, cmd.exclude, cmd.shortener, mask, cmd.sortedRefs(), cmd.files)
+	cached, err := ioutil.ReadFile(filepath.Join(ctxt.cacheDir, key))
+	c.Assert(err, IsNil)
+	c.Assert(string(cached), Equals, out)
+
+	// The listing is read from the cache while
+	// nothing it depends on changes.
+	err = ioutil.WriteFile(filepath.Join(ctxt.cacheDir, key), []byte("cached\n"), 0666)
+	c.Assert(err, IsNil)
+	c.Assert(list(), Equals, "cached\n")
+
+	// The key changes with the build context.
+	bctxt := *ctxt.BuildContext
+	ctxt.BuildContext = &bctxt
+	bctxt.GOPATH = gopath + string(filepath.ListSeparator) + c.MkDir()
+	c.Assert(list(), Equals, out)
+	bctxt.GOPATH = gopath
+	bctxt.BuildTags = []string{"extra"}
+	c.Assert(list(), Equals, out)
+	bctxt.BuildTags = nil
+	c.Assert(list(), Equals, "cached\n")
+
+	// So it does when a source file changes. A new context
+	// is used, as the old one holds the package as parsed.
+	err = ioutil.WriteFile(pfile, []byte("package p\n\nvar Y int\n"), 0666)
+	c.Assert(err, IsNil)
+	cmd.ctxt = testContext(gopath)
+	cmd.ctxt.cacheDir = ctxt.cacheDir
+	c.Assert(list(), Equals, pfile+":3:5: "+pfile+":3:5 p p Y var+\n")
+}
+
+func (suite) TestListCacheWarnings(c *C) {
+	oldVerbose, oldWarnings := *verbose, *warnings
+	defer func() {
+		*verbose, *warnings = oldVerbose, oldWarnings
+	}()
+	*verbose, *warnings = true, "text"
+	gopath := testGoPath(c, map[string]string{"p/p.go": "package p\n\nvar X = Y\n"})
+	cacheDir := c.MkDir()
+	mask, err := parseKindMask(allKinds())
+	c.Assert(err, IsNil)
+
+	// Each listing is made with a new context, as each
+	// run of gosym would be, so the package is parsed
+	// again unless its listing is taken from the cache.
+	list := func() []sym.Warning {
+		ctxt := testContext(gopath)
+		ctxt.cacheDir = cacheDir
+		var got []sym.Warning
+		ctxt.Warn = func(w sym.Warning) {
+			got = append(got, w)
+		}
+		listPackage(c, &listCmd{ctxt: ctxt}, "p", mask)
+		return got
+	}
+
+	// The warnings are printed every time the
+	// package is listed, so it is not cached.
+	first := list()
+	c.Assert(len(first) > 0, Equals, true)
+	c.Assert(list(), DeepEquals, first)
+	entries, err := ioutil.ReadDir(cacheDir)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+
+	// Nor when the warnings are printed in JSON.
+	*warnings = "json"
+	c.Assert(list(), DeepEquals, first)
+	entries, err = ioutil.ReadDir(cacheDir)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+
+	// It is cached when they are not printed.
+	*warnings = "quiet"
+	list()
+	entries, err = ioutil.ReadDir(cacheDir)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	*warnings = "text"
+	c.Assert(list(), DeepEquals, first)
+}
+
+func (suite) TestListFormatError(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": "package p\n\nvar X int\n"})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	ctxt := testContext(gopath)
+	ctxt.cacheDir = c.MkDir()
+	mask, err := parseKindMask(allKinds())
+	c.Assert(err, IsNil)
+	cmd := &listCmd{ctxt: ctxt, init: true, format: "{{.Missing}}"}
+	cmd.tmpl = template.Must(template.New("format").Parse(cmd.format))
+
+	// A symbol that cannot be printed fails the listing,
+	// which is not cached.
+	data, err := cmd.listPackage("p", mask)
+	c.Assert(err, ErrorMatches, regexp.QuoteMeta(pfile)+`:3:5: cannot format symbol: .*Missing.*`)
+	c.Assert(data, IsNil)
+	entries, err := ioutil.ReadDir(ctxt.cacheDir)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+	err = cmd.listPackages(ioutil.Discard, []string{"p"}, mask)
+	c.Assert(err, ErrorMatches, `.*cannot format symbol: .*`)
+}
+
+func (suite) TestContextStats(c *C) {
+	imp := &sourceImporter{
+		sources: map[string]string{
+			"example.com/a": "package a\n\nimport \"example.com/b\"\n\nvar X = b.Y + b.Y\n",
+			"example.com/b": "package b\n\nconst Y = 1\n",
+		},
+		imports: make(map[string]int),
+	}
+	ctxt := newContext(&build.Default, imp)
+	imp.fset = ctxt.FileSet
+	ctxt.CollectStats = true
+	pkg := ctxt.Import("example.com/a")
+	c.Assert(pkg, NotNil)
+	nsyms := 0
+	for _, f := range pkg.Files {
+		ctxt.IterateSyms(f, func(info *sym.Info) bool {
+			nsyms++
+			return true
+		})
+	}
+	c.Assert(ctxt.Import("example.com/other"), IsNil)
+	st := ctxt.Stats()
+	c.Assert(st.Packages, Equals, 2)
+	c.Assert(st.CacheMisses, Equals, 3)
+	c.Assert(st.CacheHits > 0, Equals, true)
+	c.Assert(st.Syms, Equals, nsyms)
+	c.Assert(st.ParseTime > 0, Equals, true)
+	c.Assert(st.ResolveTime > 0, Equals, true)
+
+	// Without CollectStats, only the counts are recorded.
+	ctxt = newContext(&build.Default, imp)
+	imp.fset = ctxt.FileSet
+	c.Assert(ctxt.Import("example.com/b"), NotNil)
+	st = ctxt.Stats()
+	c.Assert(st.Packages, Equals, 1)
+	c.Assert(st.ParseTime, Equals, time.Duration(0))
+}
+
+func (suite) TestWriteSources(c *C) {
+	dir := c.MkDir()
+	a, b := filepath.Join(dir, "a.go"), filepath.Join(dir, "b.go")
+	for _, name := range []string{a, b} {
+		err := ioutil.WriteFile(name, []byte("old"), 0640)
+		c.Assert(err, IsNil)
+	}
+	// A file in a directory that does not exist
+	// cannot be written, so no file is changed.
+	err := sym.WriteSources(map[string][]byte{
+		a: []byte("new"),
+		b: []byte("new"),
+		filepath.Join(dir, "nonexistent", "c.go"): []byte("new"),
+	})
+	c.Assert(err, ErrorMatches, `cannot write ".*c\.go": .*`)
+	for _, name := range []string{a, b} {
+		data, err := ioutil.ReadFile(name)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, "old")
+	}
+	infos, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 2)
+
+	err = sym.WriteSources(map[string][]byte{a: []byte("new a"), b: []byte("new b")})
+	c.Assert(err, IsNil)
+	for _, name := range []string{a, b} {
+		data, err := ioutil.ReadFile(name)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, "new "+filepath.Base(name)[0:1])
+		info, err := os.Stat(name)
+		c.Assert(err, IsNil)
+		c.Assert(info.Mode().Perm(), Equals, os.FileMode(0640))
+	}
+	infos, err = ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 2)
+}
+
+func (suite) TestWriteSourcesSymlink(c *C) {
+	dir := c.MkDir()
+	target := filepath.Join(dir, "src", "a.go")
+	err := os.Mkdir(filepath.Dir(target), 0777)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(target, []byte("old"), 0640)
+	c.Assert(err, IsNil)
+	link := filepath.Join(dir, "link", "a.go")
+	err = os.Mkdir(filepath.Dir(link), 0777)
+	c.Assert(err, IsNil)
+	err = os.Symlink(target, link)
+	c.Assert(err, IsNil)
+
+	// The file linked to is written, and
+	// the link is left in place.
+	err = sym.WriteSources(map[string][]byte{link: []byte("new")})
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(target)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "new")
+	info, err := os.Lstat(link)
+	c.Assert(err, IsNil)
+	c.Assert(info.Mode()&os.ModeSymlink, Equals, os.ModeSymlink)
+	info, err = os.Stat(target)
+	c.Assert(err, IsNil)
+	c.Assert(info.Mode().Perm(), Equals, os.FileMode(0640))
+
+	// No temporary file is left in either directory.
+	for _, d := range []string{"src", "link"} {
+		infos, err := ioutil.ReadDir(filepath.Join(dir, d))
+		c.Assert(err, IsNil)
+		c.Assert(infos, HasLen, 1)
+	}
+}
+
+func (suite) TestFormatFilesLineEndings(c *C) {
+	gopath := testGoPath(c, map[string]string{
+		"p/crlf.go":   "package p\r\n\r\n// X is a comment.\r\nvar X = `a\r\nb`\r\n",
+		"p/lf.go":     "package p\n\n// Y is a comment.\nvar Y = 1\n",
+		"p/mostly.go": "package p\r\n\r\nvar Z = 1\n",
+	})
+	dir := filepath.Join(gopath, "src", "p")
+	ctxt := testContext(gopath)
+	pkg := ctxt.Import("p")
+	c.Assert(pkg, NotNil)
+	srcs, err := ctxt.FormatFiles(pkg.Files)
+	c.Assert(err, IsNil)
+	c.Assert(srcs, HasLen, 3)
+	c.Assert(string(srcs[filepath.Join(dir, "crlf.go")]), Equals, "package p\r\n\r\n// X is a comment.\r\nvar X = `a\r\nb`\r\n")
+	c.Assert(string(srcs[filepath.Join(dir, "lf.go")]), Equals, "package p\n\n// Y is a comment.\nvar Y = 1\n")
+	c.Assert(string(srcs[filepath.Join(dir, "mostly.go")]), Equals, "package p\r\n\r\nvar Z = 1\r\n")
+}
+
+var removeImportsTests = []struct {
+	src    string
+	remove []string
+	expect string
+}{{
+	src: `package p
+
+import (
+	"a"
+	// b is used for B.
+	"b" // trailing
+	"c" // c
+)
+`,
+	remove: []string{"b"},
+	expect: `package p
+
+import (
+	"a"
+	"c" // c
+)
+`,
+}, {
+	src: `package p
+
+import (
+	"a"
+
+	"b"
+	"c"
+)
+`,
+	remove: []string{"a", "b"},
+	expect: `package p
+
+import (
+	"c"
+)
+`,
+}, {
+	src: `package p
+
+import "a"
+import "b"
+`,
+	remove: []string{"a"},
+	expect: `package p
+
+import "b"
+`,
+}}
+
+func (suite) TestWriteLines(c *C) {
+	dir := c.MkDir()
+	w := newWriteCmd(newContext(&build.Default, nil))
+	for _, text := range []string{
+		"p.go:3:5: X Y",
+		"p.go:3:5: T.Z W",
+		"p.go:3:5: X V",
+		dir + "/q.go:1:1: A B",
+	} {
+		sl, err := parseSymLine(text)
+		c.Assert(err, IsNil)
+		w.addLine(sl)
+	}
+	c.Assert(w.conflicts, HasLen, 1)
+	c.Assert(w.conflicts[0].msg, Matches, "duplicate symbol location; original at p.go:3:5")
+
+	// Lines at the same position are told apart by the
+	// name of the symbol, and a relative file name
+	// addresses the same file as its absolute form.
+	abs, err := filepath.Abs("p.go")
+	c.Assert(err, IsNil)
+	p := token.Position{Filename: abs, Line: 3, Column: 5}
+	c.Assert(w.line(p, "X").newExpr, Equals, "Y")
+	c.Assert(w.line(p, "Z").newExpr, Equals, "W")
+	c.Assert(w.line(p, "V"), IsNil)
+	p.Column = 6
+	c.Assert(w.line(p, "X"), IsNil)
+
+	p = token.Position{Filename: dir + "/q.go", Line: 1, Column: 1}
+	c.Assert(w.line(p, "A").newExpr, Equals, "B")
+	c.Assert(w.line(p, "C"), IsNil)
+}
+
+func (suite) TestValidateLines(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": "package p\n\nvar X, Y int\n\nfunc F() int { return X }\n"})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	w := newWriteCmd(testContext(gopath))
+	addLines(c, w, pfile, "3:5: X X1", "3:8: X Y1", "4:1: Z Z1", "5:23: X X1")
+	w.validateLines([]*context{w.context})
+	c.Assert(w.conflicts, HasLen, 2)
+	c.Assert(w.conflicts[0].msg, Equals, "identifier is Y, not X; not changing it to Y1")
+	c.Assert(w.conflicts[0].pos.Line, Equals, 3)
+	c.Assert(w.conflicts[1].msg, Equals, "no symbol found; not changing Z to Z1")
+	c.Assert(w.conflicts[1].pos.Line, Equals, 4)
+
+	// Only the valid lines remain.
+	var valid []string
+	for _, p := range []token.Position{{Line: 3, Column: 5}, {Line: 3, Column: 8}, {Line: 4, Column: 1}, {Line: 5, Column: 23}} {
+		p.Filename = pfile
+		for _, l := range w.lines[p] {
+			valid = append(valid, l.pos.String())
+		}
+	}
+	c.Assert(valid, DeepEquals, []string{pfile + ":3:5", pfile + ":5:23"})
+}
+
+func (suite) TestValidateLinesKind(c *C) {
+	gopath := testGoPath(c, map[string]string{"example.com/p/p.go": "package p\n\nvar X int\n\nfunc F() int { return X }\n"})
+	pfile := filepath.Join(gopath, "src", "example.com", "p", "p.go")
+	w := newWriteCmd(testContext(gopath))
+	line := func(pos, exprPkg, expr, kind, newExpr string) string {
+		return fmt.Sprintf(`{"pos": {"filename": %q, "line": %s}, "exprPkg": %q, "expr": %q, "kind": %q, "newExpr": %q}`, pfile, pos, exprPkg, expr, kind, newExpr)
+	}
+	for _, l := range []string{
+		line(`3, "column": 5`, "example.com/p", "X", "var", "X1"),
+		line(`5, "column": 6`, "example.com/p", "F", "var", "F1"),
+		line(`5, "column": 23`, "example.com/q", "X", "var", "X1"),
+		line(`5, "column": 23`, "p", "X", "var", "X1"),
+	} {
+		sl, err := parseSymLine(l)
+		c.Assert(err, IsNil)
+		c.Assert(sl.long, Equals, true)
+		w.lines[lineKey(sl.pos)] = append(w.lines[lineKey(sl.pos)], sl)
+	}
+	w.symPkgs["example.com/p"] = true
+	w.validateLines([]*context{w.context})
+	c.Assert(w.conflicts, HasLen, 2)
+	c.Assert(w.conflicts[0].msg, Equals, "symbol is a func, not a var; not changing F to F1")
+	c.Assert(w.conflicts[0].pos.Line, Equals, 5)
+	c.Assert(w.conflicts[1].msg, Equals, "identifier is in package example.com/p, not example.com/q; not changing X to X1")
+	c.Assert(w.conflicts[1].pos.Column, Equals, 23)
+
+	// Only the lines that match remain, including the
+	// one whose package is shortened.
+	var valid []string
+	for _, p := range []token.Position{{Line: 3, Column: 5}, {Line: 5, Column: 6}, {Line: 5, Column: 23}} {
+		p.Filename = pfile
+		for _, l := range w.lines[p] {
+			valid = append(valid, l.pos.String()+" "+l.exprPkg)
+		}
+	}
+	c.Assert(valid, DeepEquals, []string{pfile + ":3:5 example.com/p", pfile + ":5:23 p"})
+}
+
+var lookupDeclTests = []struct {
+	name string
+	pos  string
+	typ  string
+	err  string
+}{
+	{"example.com/p.v2.F", "3:6", "func(t *T) int", ""},
+	{"example.com/p.v2.T", "5:6", "T", ""},
+	{"example.com/p.v2.T.x", "5:16", "int", ""},
+	{"example.com/p.v2.(*T).M", "7:13", "func (t *T) M()", ""},
+	{"example.com/p.v2.T.M", "7:13", "func (t *T) M()", ""},
+	{"example.com/p.v2.G", "", "", "G not found in package p"},
+	{"example.com/p.v2.F.x", "", "", "F is not a type"},
+	{"example.com/p.v2.(*T)", "", "", `invalid method name "example.com/p.v2.\(\*T\)"`},
+	{"example.com/p.v2.T.", "", "", `invalid name "example.com/p.v2.T."`},
+	{"example.com/q.F", "", "", `cannot find package for "example.com/q.F"`},
+}
+
+func (suite) TestLookupDecl(c *C) {
+	gopath := testGoPath(c, map[string]string{"example.com/p.v2/p.go": "package p\n\nfunc F(t *T) int { return t.x }\n\ntype T struct{ x int }\n\nfunc (t *T) M() {}\n"})
+	ctxt := testContext(gopath)
+	ctxt.Warn = func(sym.Warning) {}
+	for _, t := range lookupDeclTests {
+		obj, typ, err := lookupDecl(ctxt, t.name)
+		if t.err != "" {
+			c.Assert(err, ErrorMatches, t.err)
+			continue
+		}
+		c.Assert(err, IsNil)
+		p := ctxt.position(types.DeclPos(obj))
+		c.Assert(fmt.Sprintf("%d:%d", p.Line, p.Column), Equals, t.pos)
+		c.Assert(exprTypeString(&sym.Info{ReferObj: obj, ExprType: typ}), Equals, t.typ)
+	}
+}
+
+func (suite) TestExitStatus(c *C) {
+	defer func() {
+		exitStatus.code = 0
+	}()
+	c.Assert(exitCode(), Equals, 0)
+	setExitStatus(exitUnresolved)
+	setExitStatus(exitNotFound)
+	c.Assert(exitCode(), Equals, exitUnresolved)
+	setExitStatus(exitWrite)
+	c.Assert(exitCode(), Equals, exitWrite)
+
+	c.Assert(withCode(exitWrite, nil), IsNil)
+	err := withCode(exitWrite, fmt.Errorf("some error"))
+	c.Assert(err, ErrorMatches, "some error")
+	c.Assert(err.(*codeError).code, Equals, exitWrite)
+
+	ctxt := testContext(c.MkDir())
+	ctxt.Warn = func(sym.Warning) {}
+	_, _, err = lookupDecl(ctxt, "example.com/q.F")
+	cerr, ok := err.(*codeError)
+	c.Assert(ok, Equals, true)
+	c.Assert(cerr.code, Equals, exitNotFound)
+}
+
+func (suite) TestUniverseKinds(c *C) {
+	src := "package p\n\nconst C = iota\n\nvar E error = nil\n\nfunc F(xs []int) int {\n\txs = append(xs, len(xs))\n\tif true {\n\t\treturn cap(make([]int, 1))\n\t}\n\treturn 0\n}\n"
+	gopath := testGoPath(c, map[string]string{"p/p.go": src})
+	ctxt := testContext(gopath)
+	cmd := &listCmd{ctxt: ctxt}
+	kinds := make(map[string]string)
+	err := ctxt.WalkFiles("p", nil, func(s sym.Symbol) bool {
+		if s.Universe {
+			c.Assert(s.ReferPkg, Equals, "universe")
+			kinds[s.Name] = fmt.Sprint(s.Kind)
+			if s.Kind == ast.Typ {
+				kinds[s.Name] += fmt.Sprint(" ", cmd.kindBit(s) == interfaceBit)
+			}
+		}
+		return true
+	})
+	c.Assert(err, IsNil)
+
+	// The zero value nil is a var, as it is not a constant.
+	c.Assert(kinds, DeepEquals, map[string]string{
+		"iota":   "const",
+		"error":  "type true",
+		"nil":    "var",
+		"int":    "type false",
+		"append": "func",
+		"len":    "func",
+		"true":   "const",
+		"cap":    "func",
+		"make":   "func",
+	})
+}
+
+func (suite) TestPredeclared(c *C) {
+	defer func() {
+		delete(parser.Universe.Objects, "intrinsic")
+		delete(parser.Universe.Objects, "float16")
+	}()
+	err := declarePredeclared("intrinsic,type:float16")
+	c.Assert(err, IsNil)
+	c.Assert(parser.Universe.Lookup("intrinsic").Kind, Equals, ast.Fun)
+	c.Assert(parser.Universe.Lookup("float16").Kind, Equals, ast.Typ)
+	c.Assert(declarePredeclared("bad:x"), ErrorMatches, `unknown kind "bad" in predeclared identifier "bad:x"`)
+	c.Assert(declarePredeclared("var:1x"), ErrorMatches, `invalid predeclared identifier "var:1x"`)
+	c.Assert(declarePredeclared("func:go"), ErrorMatches, `invalid predeclared identifier "func:go"`)
+
+	gopath := testGoPath(c, map[string]string{"p/p.go": "package p\n\nvar X float16 = intrinsic()\n"})
+	ctxt := testContext(gopath)
+	ctxt.CountUnresolved = true
+	var universe []string
+	err = ctxt.WalkFiles("p", nil, func(s sym.Symbol) bool {
+		if s.Universe {
+			universe = append(universe, s.Name)
+		}
+		return true
+	})
+	c.Assert(err, IsNil)
+	c.Assert(universe, DeepEquals, []string{"float16", "intrinsic"})
+	_, unresolved := ctxt.Unresolved()
+	c.Assert(unresolved, Equals, 0)
+}
+
+func (suite) TestPositionToImportPath(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": "package p\n"})
+	dir := filepath.Join(gopath, "src", "p")
+	link := filepath.Join(c.MkDir(), "link")
+	err := os.Symlink(dir, link)
+	c.Assert(err, IsNil)
+	ctxt := testContext(gopath)
+
+	path, err := ctxt.positionToImportPath(token.Position{Filename: filepath.Join(dir, "p.go")})
+	c.Assert(err, IsNil)
+	c.Assert(path, Equals, "p")
+
+	// A package reached through a symbolic link
+	// is found in the directory linked to.
+	path, err = ctxt.positionToImportPath(token.Position{Filename: filepath.Join(link, "p.go")})
+	c.Assert(err, IsNil)
+	c.Assert(path, Equals, "p")
+
+	_, err = ctxt.positionToImportPath(token.Position{})
+	c.Assert(err, ErrorMatches, "cannot find package of : no file name for position")
+}
+
+func (suite) TestServe(c *C) {
+	gopath := testGoPath(c, map[string]string{"p/p.go": "package p\n\nvar Xyz = 1\n\nfunc F() int { return Xyz }\n"})
+	pfile := filepath.Join(gopath, "src", "p", "p.go")
+	ctxt := testContext(gopath)
+	ctxt.Warn = func(sym.Warning) {}
+	var out bytes.Buffer
+	ctxt.stdout = bufio.NewWriter(&out)
+	mask, err := parseKindMask(allKinds())
+	c.Assert(err, IsNil)
+	cmd := &listCmd{ctxt: ctxt, printType: true, jobs: 1}
+	in := "def p.F\n" +
+		"\n" +
+		"refs " + pfile + ":5:23\n" +
+		"find p.F\n" +
+		"def " + pfile + ":5:24\n" +
+		"def " + pfile + ":5:14\n" +
+		"def " + pfile + ":5:10\n"
+	err = cmd.serve(ctxt, strings.NewReader(in), []string{"p"}, mask)
+	c.Assert(err, IsNil)
+	c.Assert(out.String(), Equals, strings.NewReplacer("$pfile", pfile).Replace(`$pfile:5:6 func() int
+
+$pfile:3:5: $pfile:3:5 p p Xyz var+ int
+$pfile:5:23: $pfile:3:5 p p Xyz var int
+
+error: invalid query "find p.F"
+
+$pfile:3:5 int
+
+error: no symbol found at $pfile:5:14
+
+error: int is predeclared
+
+`))
+}
+
+func (suite) TestRemoveImports(c *C) {
+	for i, test := range removeImportsTests {
+		c.Logf("test %d", i)
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "x.go", test.src, parser.ParseComments, ast.NewScope(parser.Universe))
+		c.Assert(err, IsNil)
+		remove := make(map[*ast.ImportSpec]bool)
+		for _, imp := range sym.FileImports(f) {
+			for _, path := range test.remove {
+				if importPath(imp) == path {
+					remove[imp] = true
+				}
+			}
+		}
+		c.Assert(remove, HasLen, len(test.remove))
+		removeImports(fset, f, remove)
+		var buf bytes.Buffer
+		cfg := printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+		_, err = cfg.Fprint(&buf, fset, f)
+		c.Assert(err, IsNil)
+		c.Assert(buf.String(), Equals, test.expect)
+	}
+}
+
+var retagTests = []struct {
+	tag     string
+	expect  string
+	changed bool
+}{
+	{`json:"Old"`, `json:"New"`, true},
+	{`json:"Old,omitempty" xml:"Old,attr"`, `json:"New,omitempty" xml:"New,attr"`, true},
+	{`json:"old" xml:"Old"`, `json:"old" xml:"New"`, true},
+	{`json:",omitempty"`, `json:",omitempty"`, false},
+	{`json:"Older"`, `json:"Older"`, false},
+	{`  json:"Old"   yaml:"x"`, `  json:"New"   yaml:"x"`, true},
+	{`json:"Old" bad`, `json:"New" bad`, true},
+	{`json:"Old`, `json:"Old`, false},
+	{`json:"a\"b" xml:"Old"`, `json:"a\"b" xml:"New"`, true},
+	{``, ``, false},
+}
+
+func (suite) TestRetag(c *C) {
+	for i, test := range retagTests {
+		c.Logf("test %d: %q", i, test.tag)
+		tag, changed := retag(test.tag, "Old", "New")
+		c.Assert(tag, Equals, test.expect)
+		c.Assert(changed, Equals, test.changed)
+	}
+}
+
+var matchPatternTests = []struct {
+	pattern string
+	name    string
+	match   bool
+}{
+	{"./...", ".", true},
+	{"./...", "./foo/bar", true},
+	{"./...", "foo", false},
+	{"foo/...", "foo", true},
+	{"foo/...", "foo/bar", true},
+	{"foo/...", "foobar", false},
+	{"net/.../http", "net/x/http", true},
+	{"net/.../http", "net/x/httpx", false},
+}
+
+var pathShortenerTests = []struct {
+	s    pathShortener
+	path string
+	want string
+}{
+	{pathShortener{}, "example.com/a/b", "example.com/a/b"},
+	{pathShortener{root: "example.com/a"}, "example.com/a", "."},
+	{pathShortener{root: "example.com/a"}, "example.com/a/b/c", "./b/c"},
+	{pathShortener{root: "example.com/a"}, "example.com/ab", "example.com/ab"},
+	{pathShortener{root: "example.com/a"}, "universe", "universe"},
+	{pathShortener{n: 2}, "example.com/a/b", "a/b"},
+	{pathShortener{n: 2}, "fmt", "fmt"},
+	{pathShortener{n: 1}, "universe", "universe"},
+}
+
+func (suite) TestPathShortener(c *C) {
+	for _, t := range pathShortenerTests {
+		c.Assert(t.s.shorten(t.path), Equals, t.want)
+	}
+	s, err := newPathShortener(nil, "3")
+	c.Assert(err, IsNil)
+	c.Assert(s, Equals, pathShortener{n: 3})
+	for _, short := range []string{"0", "x", "./a"} {
+		_, err := newPathShortener(nil, short)
+		c.Assert(err, ErrorMatches, "invalid -short value .*")
+	}
+}
+
+var ignorerTests = []struct {
+	path    string
+	isDir   bool
+	ignored bool
+}{
+	{"a.go", false, false},
+	{"x_yacc.go", false, true},
+	{"sub/x_yacc.go", false, true},
+	{"keep_yacc.go", false, false},
+	{"gen", true, true},
+	{"gen", false, false},
+	{"sub/gen/a.go", false, true},
+	{"internal/old", true, false},
+	{"a/internal/b/c/old/o.go", false, false},
+	{"internal/b/c/old/o.go", false, true},
+	{"internal/old/o.go", false, true},
+	{"../x_yacc.go", false, false},
+}
+
+func (suite) TestIgnorer(c *C) {
+	dir := c.MkDir()
+	ig, err := readIgnorer(strings.NewReader(`
+# Generated files.
+*_yacc.go
+!keep_yacc.go
+gen/
+/internal/**/old/o.go
+`), dir, ".gosymignore")
+	c.Assert(err, IsNil)
+	for _, test := range ignorerTests {
+		if got := ig.ignored(filepath.Join(dir, filepath.FromSlash(test.path)), test.isDir); got != test.ignored {
+			c.Errorf("ignored(%q, %v) = %v; want %v", test.path, test.isDir, got, test.ignored)
+		}
+	}
+	_, err = readIgnorer(strings.NewReader("ok\na/[/b\n"), dir, ".gosymignore")
+	c.Assert(err, ErrorMatches, `\.gosymignore:2: invalid pattern "a/\[/b"`)
+
+	// The nearest ignore file above a directory is found.
+	sub := filepath.Join(dir, "a", "b")
+	err = os.MkdirAll(sub, 0777)
+	c.Assert(err, IsNil)
+	ig, err = findIgnorer(sub)
+	c.Assert(err, IsNil)
+	c.Assert(ig, IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "a", ignoreFileName), []byte("*.txt\n"), 0666)
+	c.Assert(err, IsNil)
+	ig, err = findIgnorer(sub)
+	c.Assert(err, IsNil)
+	c.Assert(ig.dir, Equals, filepath.Join(dir, "a"))
+
+	// Ignored entries are not read.
+	for _, name := range []string{"x.go", "y.txt"} {
+		err = ioutil.WriteFile(filepath.Join(sub, name), nil, 0666)
+		c.Assert(err, IsNil)
+	}
+	infos, err := ig.readDir(sub)
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 1)
+	c.Assert(infos[0].Name(), Equals, "x.go")
+}
+
+func (suite) TestWalkPackageDirsDepth(c *C) {
+	root := c.MkDir()
+	for _, dir := range []string{"", "a", "a/b", "a/b/c", "d"} {
+		path := filepath.Join(root, filepath.FromSlash(dir))
+		err := os.MkdirAll(path, 0777)
+		c.Assert(err, IsNil)
+		err = ioutil.WriteFile(filepath.Join(path, "x.go"), []byte("package x\n"), 0666)
+		c.Assert(err, IsNil)
+	}
+	for _, test := range []struct {
+		depth int
+		dirs  []string
+	}{
+		{-1, []string{".", "a", "a/b", "a/b/c", "d"}},
+		{0, []string{"."}},
+		{1, []string{".", "a", "d"}},
+		{2, []string{".", "a", "a/b", "d"}},
+	} {
+		var dirs []string
+		walkPackageDirs(root, test.depth, func(dir string) {
+			rel, err := filepath.Rel(root, dir)
+			c.Assert(err, IsNil)
+			dirs = append(dirs, filepath.ToSlash(rel))
+		})
+		c.Check(dirs, DeepEquals, test.dirs)
+	}
+}
+
+func (suite) TestOverlay(c *C) {
+	gopath := c.MkDir()
+	dir := filepath.Join(gopath, "src", "p")
+	err := os.MkdirAll(dir, 0777)
+	c.Assert(err, IsNil)
+	staged := c.MkDir()
+	for name, src := range map[string]string{
+		filepath.Join(dir, "a.go"):    "package p\n\nfunc F() int { return 1 }\n",
+		filepath.Join(dir, "b.go"):    "package p\n\nfunc G() int { return F() }\n",
+		filepath.Join(staged, "a.go"): "package p\n\n// F has moved.\nfunc F() int { return 1 }\n",
+		filepath.Join(staged, "c.go"): "package p\n\nfunc H() int { return F() }\n",
+	} {
+		err := ioutil.WriteFile(name, []byte(src), 0666)
+		c.Assert(err, IsNil)
+	}
+	ovfile := filepath.Join(staged, "overlay.json")
+	data, err := json.Marshal(map[string]interface{}{
+		"Replace": map[string]string{
+			filepath.Join(dir, "a.go"): filepath.Join(staged, "a.go"),
+			filepath.Join(dir, "b.go"): "",
+			filepath.Join(dir, "c.go"): filepath.Join(staged, "c.go"),
+		},
+	})
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(ovfile, data, 0666)
+	c.Assert(err, IsNil)
+	ov, err := readOverlay(ovfile)
+	c.Assert(err, IsNil)
+	overlayFiles = ov
+	defer func() {
+		overlayFiles = nil
+	}()
+
+	bctxt := build.Default
+	bctxt.GOPATH = gopath
+	bctxt.ReadDir = ov.readDirFunc(ioutil.ReadDir)
+	bctxt.OpenFile = ov.openFile
+	ctxt := newContext(&bctxt, nil)
+	c.Assert(ctxt.cacheDir, Equals, "")
+	mask, err := parseKindMask(allKinds())
+	c.Assert(err, IsNil)
+	cmd := &listCmd{ctxt: ctxt, init: true}
+	afile, cfile := filepath.Join(dir, "a.go"), filepath.Join(dir, "c.go")
+	c.Assert(listPackage(c, cmd, "p", mask), Equals, strings.NewReplacer("$afile", afile, "$cfile", cfile).Replace(`$afile:4:6: $afile:4:6 p p F func+
+$cfile:3:6: $cfile:3:6 p p H func+
+$cfile:3:23: $afile:4:6 p p F func
+`))
+
+	// The source lines are read through the overlay too.
+	lt, err := make(lineTables).context(token.Position{Filename: afile, Line: 4, Column: 6}, 1)
+	c.Assert(err, IsNil)
+	c.Assert(lt, Equals, "func «F»() int { return 1 }")
+
+	w := &writeCmd{dryRun: false}
+	c.Assert(w.run(ctxt, nil), ErrorMatches, "cannot change files read through -overlay.*")
+}
+
+func (suite) TestMatchPattern(c *C) {
+	for i, test := range matchPatternTests {
+		c.Logf("test %d: %q %q", i, test.pattern, test.name)
+		c.Assert(matchPattern(test.pattern)(test.name), Equals, test.match)
+	}
+}
+
+var sameSignatureTests = []struct {
+	t0, t1 string
+	same   bool
+}{
+	{"func()", "func()", true},
+	{"func(p []byte) (int, error)", "func(buf []byte) (n int, err error)", true},
+	{"func(a, b int)", "func(int, int)", true},
+	{"func(a, b int)", "func(int)", false},
+	{"func(x ...int)", "func([]int)", false},
+	{"func() error", "func()", false},
+	{"func(io.Reader)", "func(Reader)", false},
+	{"func(io.Reader)", "func(io.Reader)", true},
+	{"func(m map[string][]int)", "func(map[string][]int)", true},
+	{"func([2]int)", "func([1 + 1]int)", true},
+	{"func([2]int)", "func([3]int)", false},
+	{"func(chan<- int)", "func(chan int)", false},
+	{"func(f func(int) error)", "func(func(x int) (err error))", true},
+	{"func(struct{ a, b int })", "func(struct {\n\ta int\n\tb int\n})", true},
+	{"func(struct{ a int })", "func(struct{ b int })", false},
+	{"func(struct{ a int `t` })", "func(struct{ a int \"t\" })", true},
+	{"func(interface{ M(); N() })", "func(interface{ N(); M() })", true},
+	{"func(interface{ M() })", "func(interface{ M() int })", false},
+}
+
+func (suite) TestSameSignature(c *C) {
+	fset := token.NewFileSet()
+	w := newWriteCmd(testContext(""))
+	for i, test := range sameSignatureTests {
+		c.Logf("test %d: %s; %s", i, test.t0, test.t1)
+		t0, err := parser.ParseExpr(fset, "", test.t0, nil)
+		c.Assert(err, IsNil)
+		t1, err := parser.ParseExpr(fset, "", test.t1, nil)
+		c.Assert(err, IsNil)
+		c.Assert(w.sameSignature(t0.(*ast.FuncType), t1.(*ast.FuncType)), Equals, test.same)
+	}
+}
+
 // TODO
 //func (suite) TestList(c *C) {
 //	cwd, err := os.Getwd()
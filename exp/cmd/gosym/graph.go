@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// graphEdge is an edge of the graph printed by the
+// list -graph flag: the package from which symbols in
+// another package are referred to, and the package
+// that declares them.
+type graphEdge struct {
+	from, to string
+}
+
+// graphFile returns the graph of the references between
+// packages made by the lines in data, as printed by the list
+// command, in the given format (dot or edges). The weight of
+// each edge is the number of references it stands for.
+// Declarations are not references, references to the
+// universe are omitted, and so are references within
+// a package unless self is true. Any fields
+// that follow a tab, as printed with -context, -enclosing
+// or -doc, are ignored.
+func graphFile(format string, self bool, data []byte) ([]byte, error) {
+	weights := make(map[graphEdge]int)
+	for _, text := range strings.SplitAfter(string(data), "\n") {
+		if text == "" {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimSuffix(text, "\n"), "\t", 2)
+		sl, err := parseSymLine(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse line %q: %v", text, err)
+		}
+		if sl.plus || sl.referPkg == "" || sl.referPkg == "universe" || sl.exprPkg == sl.referPkg && !self {
+			continue
+		}
+		weights[graphEdge{sl.exprPkg, sl.referPkg}]++
+	}
+	edges := make([]graphEdge, 0, len(weights))
+	for e := range weights {
+		edges = append(edges, e)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].from != edges[j].from {
+			return edges[i].from < edges[j].from
+		}
+		return edges[i].to < edges[j].to
+	})
+	var buf bytes.Buffer
+	if format == "dot" {
+		buf.WriteString("digraph gosym {\n")
+		for _, e := range edges {
+			fmt.Fprintf(&buf, "\t%q -> %q [weight=%d, label=\"%d\"];\n", e.from, e.to, weights[e], weights[e])
+		}
+		buf.WriteString("}\n")
+		return buf.Bytes(), nil
+	}
+	for _, e := range edges {
+		fmt.Fprintf(&buf, "%s %s %d\n", e.from, e.to, weights[e])
+	}
+	return buf.Bytes(), nil
+}
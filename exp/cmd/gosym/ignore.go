@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreFileName is the name of the file that holds
+// the patterns of files and directories to skip.
+const ignoreFileName = ".gosymignore"
+
+// ignorer reports whether files are matched by
+// the patterns read from an ignore file.
+type ignorer struct {
+	// dir holds the directory containing the ignore file,
+	// relative to which the patterns are matched.
+	dir  string
+	pats []ignorePattern
+}
+
+// ignorePattern holds a single pattern of an ignore file.
+type ignorePattern struct {
+	// elems holds the elements of the pattern, each of which
+	// is matched as by path.Match, except that "**" matches
+	// any number of path elements.
+	elems []string
+
+	// negate is true if a file that matches the pattern
+	// is not ignored, as for a pattern starting with "!".
+	negate bool
+
+	// dirOnly is true if the pattern matches only
+	// directories, as for a pattern ending in "/".
+	dirOnly bool
+}
+
+// findIgnorer returns the ignorer for the ignore file in dir or
+// in the nearest directory above it that holds one, or nil if
+// there is none.
+func findIgnorer(dir string) (*ignorer, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		file := filepath.Join(dir, ignoreFileName)
+		f, err := os.Open(file)
+		if err == nil {
+			defer f.Close()
+			return readIgnorer(f, dir, file)
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// readIgnorer reads the patterns of an ignore file in
+// the given directory from rd; name is used in error messages.
+// As in a .gitignore file, blank lines and lines starting
+// with "#" are ignored; a pattern that contains a slash other
+// than at its end is matched against the path relative to the
+// directory, and any other pattern against the name of each
+// file and directory at any depth below it.
+func readIgnorer(rd io.Reader, dir, name string) (*ignorer, error) {
+	ig := &ignorer{dir: dir}
+	r := bufio.NewReader(rd)
+	for n := 1; ; n++ {
+		line, err := readLine(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %v", name, err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		text := line
+		var p ignorePattern
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if !strings.Contains(line, "/") {
+			line = "**/" + line
+		}
+		line = strings.TrimPrefix(line, "/")
+		p.elems = strings.Split(line, "/")
+		for _, elem := range p.elems {
+			if _, err := path.Match(elem, ""); err != nil || elem == "" {
+				return nil, fmt.Errorf("%s:%d: invalid pattern %q", name, n, text)
+			}
+		}
+		ig.pats = append(ig.pats, p)
+	}
+	return ig, nil
+}
+
+// ignored reports whether the file or directory with the given
+// path is ignored, either because it matches the patterns or
+// because a directory containing it does. It reports false for
+// any path outside the ignore file's directory, and if ig is nil.
+func (ig *ignorer) ignored(file string, isDir bool) bool {
+	if ig == nil {
+		return false
+	}
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(ig.dir, file)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	elems := strings.Split(filepath.ToSlash(rel), "/")
+	for i := 1; i <= len(elems); i++ {
+		if ig.match(elems[0:i], i < len(elems) || isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether the path with the given elements
+// is ignored by the patterns, without regard to the
+// directories containing it. As in a .gitignore file,
+// the last pattern that matches takes precedence.
+func (ig *ignorer) match(elems []string, isDir bool) bool {
+	ignored := false
+	for _, p := range ig.pats {
+		if (isDir || !p.dirOnly) && matchElems(p.elems, elems) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// matchElems reports whether the path elements elems
+// match the pattern elements pat.
+func matchElems(pat, elems []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(elems); i++ {
+				if matchElems(pat[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], elems[0]); !ok {
+			return false
+		}
+		pat, elems = pat[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
+
+// readDir is like ioutil.ReadDir, but omits the ignored
+// entries. It is used as the ReadDir function of the
+// build contexts, so that ignored files are never seen.
+func (ig *ignorer) readDir(dir string) ([]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	kept := infos[:0]
+	for _, info := range infos {
+		if !ig.ignored(filepath.Join(dir, info.Name()), info.IsDir()) {
+			kept = append(kept, info)
+		}
+	}
+	return kept, nil
+}
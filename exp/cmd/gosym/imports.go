@@ -0,0 +1,343 @@
+package main
+
+import (
+	"code.google.com/p/rog-go/exp/go/ast"
+	"code.google.com/p/rog-go/exp/go/sym"
+	"code.google.com/p/rog-go/exp/go/token"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// importName returns the name by which the package with the
+// given import path can be referred to in f, adding an
+// import of the package to f if it is not already imported.
+func (c *writeCmd) importName(f *ast.File, path string) (string, error) {
+	for _, imp := range sym.FileImports(f) {
+		if importPath(imp) != path {
+			continue
+		}
+		if imp.Name == nil {
+			return c.packageName(path)
+		}
+		if name := imp.Name.Name; name != "_" && name != "." {
+			return name, nil
+		}
+	}
+	name, err := c.packageName(path)
+	if err != nil {
+		return "", err
+	}
+	for _, imp := range sym.FileImports(f) {
+		other := importPath(imp)
+		if imp.Name != nil && imp.Name.Name == name {
+			return "", fmt.Errorf("name %q is already used by import of %q", name, other)
+		}
+		if imp.Name == nil {
+			if otherName, err := c.packageName(other); err == nil && otherName == name {
+				return "", fmt.Errorf("name %q is already used by import of %q", name, other)
+			}
+		}
+	}
+	addImport(f, path)
+	return name, nil
+}
+
+// importCycle returns the chain of imports that would make
+// an import cycle if the package with the import path from
+// imported the package with the given path, taking into
+// account the imports added by earlier changes, or nil if
+// there would be no cycle.
+func (c *writeCmd) importCycle(from, path string) []string {
+	seen := make(map[string]bool)
+	var find func(p string) []string
+	find = func(p string) []string {
+		if p == from {
+			return []string{p}
+		}
+		if seen[p] {
+			return nil
+		}
+		seen[p] = true
+		for _, imp := range c.packageImports(p) {
+			if chain := find(imp); chain != nil {
+				return append([]string{p}, chain...)
+			}
+		}
+		return nil
+	}
+	chain := find(path)
+	if chain == nil {
+		return nil
+	}
+	return append([]string{from}, chain...)
+}
+
+// packageImports returns the paths of the packages imported
+// by the non-test files of the package with the given path,
+// including any imports added by earlier changes.
+func (c *writeCmd) packageImports(path string) []string {
+	imps, ok := c.pkgImports[path]
+	if !ok {
+		if bpkg, err := c.FindPackage(path, "", 0); err == nil {
+			for _, imp := range bpkg.Imports {
+				if imp != "C" && imp != "unsafe" {
+					imps = append(imps, imp)
+				}
+			}
+		}
+		c.pkgImports[path] = imps
+	}
+	var added []string
+	for imp := range c.newImports[path] {
+		added = append(added, imp)
+	}
+	sort.Strings(added)
+	return append(added, imps...)
+}
+
+// addPackageImport records that the package with the
+// import path from now imports the package with the given path.
+func (c *writeCmd) addPackageImport(from, path string) {
+	if c.newImports[from] == nil {
+		c.newImports[from] = make(map[string]bool)
+	}
+	c.newImports[from][path] = true
+}
+
+// packageName returns the name of the package
+// with the given import path.
+func (c *writeCmd) packageName(path string) (string, error) {
+	pkg := c.Import(path)
+	if pkg == nil {
+		return "", fmt.Errorf("cannot import %q", path)
+	}
+	return pkg.Name, nil
+}
+
+// localName returns the name by which the package imported
+// by imp is referred to, or the empty string if the package
+// cannot be found.
+func (c *writeCmd) localName(imp *ast.ImportSpec) string {
+	if imp.Name != nil {
+		return imp.Name.Name
+	}
+	name, _ := c.packageName(importPath(imp))
+	return name
+}
+
+// renameImport changes the name of the package imported by
+// the declaration of obj, a package name in f. The import is
+// given an explicit name, unless the new name is the package's
+// own, in which case any explicit name is removed.
+func (c *writeCmd) renameImport(f *ast.File, obj *ast.Object, name string) {
+	imp, ok := obj.Decl.(*ast.ImportSpec)
+	if !ok {
+		return
+	}
+	switch pkgName, _ := c.packageName(importPath(imp)); {
+	case pkgName == name:
+		imp.Name = nil
+	case imp.Name == nil:
+		imp.Name = &ast.Ident{NamePos: imp.Path.Pos(), Name: name, Obj: obj}
+	default:
+		imp.Name.Name = name
+	}
+	c.ChangedFiles[c.position(f.Package).Filename] = f
+}
+
+// importPath returns the import path of the package imported
+// by imp, which includes the vendor directory of a vendored
+// package.
+func importPath(imp *ast.ImportSpec) string {
+	if imp.Resolved != "" {
+		return imp.Resolved
+	}
+	path, err := strconv.Unquote(imp.Path.Value)
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// addImport adds an import of the package with
+// the given path to the first import declaration in f,
+// creating the declaration if necessary. A vendored
+// package is imported by the path without its vendor
+// directory.
+func addImport(f *ast.File, path string) {
+	var decl *ast.GenDecl
+	for _, d := range f.Decls {
+		if d, ok := d.(*ast.GenDecl); ok && d.Tok == token.IMPORT {
+			decl = d
+			break
+		}
+	}
+	if decl == nil {
+		decl = &ast.GenDecl{
+			TokPos: f.Name.End(),
+			Tok:    token.IMPORT,
+		}
+		f.Decls = append([]ast.Decl{decl}, f.Decls...)
+	}
+	var pos token.Pos
+	switch {
+	case len(decl.Specs) == 0:
+		pos = decl.TokPos
+	case !decl.Lparen.IsValid():
+		// Add parentheses around the existing import.
+		decl.Lparen = decl.Specs[0].Pos()
+		decl.Rparen = decl.Specs[0].End()
+		pos = decl.Rparen
+	default:
+		pos = decl.End()
+	}
+	spec := &ast.ImportSpec{
+		Path: &ast.BasicLit{
+			ValuePos: pos,
+			Kind:     token.STRING,
+			Value:    strconv.Quote(sym.VendorlessPath(path)),
+		},
+	}
+	if spec.Path.Value != strconv.Quote(path) {
+		spec.Resolved = path
+	}
+	decl.Specs = append(decl.Specs, spec)
+}
+
+// removeUnusedImports removes from f any imports that are no
+// longer referred to through a package qualifier.
+// Blank, dot and cgo imports
+// are never removed, nor are imports of packages
+// that cannot be found.
+func (c *writeCmd) removeUnusedImports(f *ast.File) {
+	used := make(map[string]bool)
+	ast.Inspect(f, func(n ast.Node) bool {
+		if e, ok := n.(*ast.SelectorExpr); ok {
+			if x, ok := e.X.(*ast.Ident); ok && (x.Obj == nil || x.Obj.Kind == ast.Pkg) {
+				used[x.Name] = true
+			}
+		}
+		return true
+	})
+	unused := make(map[*ast.ImportSpec]bool)
+	for _, imp := range sym.FileImports(f) {
+		path := importPath(imp)
+		if path == "C" {
+			continue
+		}
+		name := c.localName(imp)
+		if name == "" || name == "_" || name == "." || used[name] {
+			continue
+		}
+		unused[imp] = true
+		p := c.position(imp.Pos())
+		p.Offset = 0
+		c.warnf(p, warnChange, "removing unused import of %q", path)
+	}
+	if len(unused) > 0 {
+		removeImports(c.FileSet, f, unused)
+	}
+}
+
+// removeImports removes the given imports from f, along with
+// their comments. An import declaration left without any
+// imports is removed too. When whole lines of a parenthesized
+// declaration are removed, they are removed from the line
+// table of f's file in fset too, so that no blank line is
+// left in the group when f is printed.
+func removeImports(fset *token.FileSet, f *ast.File, imps map[*ast.ImportSpec]bool) {
+	comments := make(map[*ast.CommentGroup]bool)
+	tf := fset.File(f.Package)
+	decls := f.Decls[:0]
+	for _, d := range f.Decls {
+		if d, ok := d.(*ast.GenDecl); ok && d.Tok == token.IMPORT {
+			specs := d.Specs[:0]
+			// The removed lines are deleted after
+			// all the positions have been found.
+			var deleted [][2]int
+			prevLine := tf.Line(d.Lparen)
+			start := 0 // first line of the imports removed since the last one kept.
+			for i, spec := range d.Specs {
+				imp := spec.(*ast.ImportSpec)
+				first, last := importLines(tf, imp)
+				if !imps[imp] {
+					specs = append(specs, spec)
+					prevLine = last
+					continue
+				}
+				comments[imp.Doc] = true
+				comments[imp.Comment] = true
+				if start == 0 {
+					start = first
+				}
+				nextLine := tf.Line(d.Rparen)
+				if i+1 < len(d.Specs) {
+					next := d.Specs[i+1].(*ast.ImportSpec)
+					if imps[next] {
+						continue
+					}
+					nextLine, _ = importLines(tf, next)
+				}
+				if d.Lparen.IsValid() && start > prevLine && last < nextLine {
+					deleted = append(deleted, [2]int{start, last})
+				}
+				start = 0
+			}
+			d.Specs = specs
+			// Delete the lines last first so that the
+			// earlier line numbers remain valid.
+			for i := len(deleted) - 1; i >= 0; i-- {
+				deleteLines(tf, deleted[i][0], deleted[i][1])
+			}
+			if len(d.Specs) == 0 {
+				comments[d.Doc] = true
+				continue
+			}
+		}
+		decls = append(decls, d)
+	}
+	f.Decls = decls
+
+	var groups []*ast.CommentGroup
+	for _, g := range f.Comments {
+		if !comments[g] {
+			groups = append(groups, g)
+		}
+	}
+	f.Comments = groups
+}
+
+// importLines returns the first and last lines
+// occupied by imp, including its comments.
+func importLines(tf *token.File, imp *ast.ImportSpec) (first, last int) {
+	first, last = tf.Line(imp.Pos()), tf.Line(imp.End())
+	if imp.Doc != nil {
+		first = tf.Line(imp.Doc.Pos())
+	}
+	if imp.Comment != nil {
+		last = tf.Line(imp.Comment.End())
+	}
+	return first, last
+}
+
+// deleteLines deletes lines from through to from the line
+// table of tf, so that their contents become part of
+// the line before.
+func deleteLines(tf *token.File, from, to int) {
+	var lines []int
+	for line := 1; line <= tf.LineCount(); line++ {
+		if line < from || line > to {
+			lines = append(lines, lineOffset(tf, line))
+		}
+	}
+	tf.SetLines(lines)
+}
+
+// lineOffset returns the offset of the start of
+// the given line in tf.
+func lineOffset(tf *token.File, line int) int {
+	return sort.Search(tf.Size(), func(offset int) bool {
+		return tf.Line(tf.Pos(offset)) >= line
+	})
+}
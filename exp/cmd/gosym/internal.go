@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/rog-go/exp/go/ast"
+	"code.google.com/p/rog-go/exp/go/sym"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// printInternal prints a line to buf if s names a symbol
+// declared in an internal package that the package containing
+// s may not import. It is used for the -internal-check flag.
+func (c *listCmd) printInternal(buf *bytes.Buffer, lines lineTables, s sym.Symbol) error {
+	if s.Decl || s.Local || s.ReferPkg == "universe" || s.ReferPkg == "?" {
+		return nil
+	}
+	if !s.DotImport && !isPkgSelector(s.Expr) {
+		// Only a name taken from the package itself is a use
+		// of it; members reached through a value of one of its
+		// types, as in pub.New().M(), are not.
+		return nil
+	}
+	referPkg, err := c.ctxt.positionToImportPath(s.ReferPosition)
+	if err != nil {
+		c.ctxt.warnf(s.Position, warnSource, "%v", err)
+		return nil
+	}
+	parent, ok := internalParent(referPkg)
+	if !ok {
+		return nil
+	}
+	exprPkg, err := c.ctxt.positionToImportPath(s.Position)
+	if err != nil {
+		c.ctxt.warnf(s.Position, warnSource, "%v", err)
+		return nil
+	}
+	if exprPkg == sym.CommandLinePackage {
+		// Files named on the command line have
+		// no import path to check.
+		return nil
+	}
+	var outside string
+	if parent == "" {
+		// An internal directory at the top of a source tree,
+		// such as those of the standard library, may be
+		// imported by any package in the same tree.
+		root := srcRoot(s.ReferPosition.Filename, referPkg)
+		if srcRoot(s.Position.Filename, exprPkg) == root {
+			return nil
+		}
+		outside = root
+	} else {
+		if exprPkg == parent || strings.HasPrefix(exprPkg, parent+"/") {
+			return nil
+		}
+		outside = parent
+	}
+	p, pos := s.Position, s.ReferPosition
+	if *runes && !c.offset {
+		var err error
+		if p, err = lines.runeColumn(p); err == nil {
+			pos, err = lines.runeColumn(pos)
+		}
+		if err != nil {
+			return fmt.Errorf("%v: cannot count columns in runes: %v", s.Position, err)
+		}
+	}
+	fmt.Fprintf(buf, "%s: %s in internal package %q at %s is used outside %q\n", formatPosition(p, c.offset), s.Ident.Name, referPkg, formatPosition(pos, c.offset), outside)
+	return nil
+}
+
+// isPkgSelector reports whether e selects a name
+// from an imported package, as in b.F.
+func isPkgSelector(e ast.Expr) bool {
+	sel, ok := e.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	id, ok := sel.X.(*ast.Ident)
+	return ok && id.Obj != nil && id.Obj.Kind == ast.Pkg
+}
+
+// internalParent returns the import path of the tree of
+// packages that may import the package with the given path,
+// and whether it is an internal package at all. The tree is
+// rooted at the parent of the last path element named
+// "internal"; the empty path stands for the whole source
+// tree that holds the package.
+func internalParent(path string) (string, bool) {
+	elems := strings.Split(path, "/")
+	for i := len(elems) - 1; i >= 0; i-- {
+		if elems[i] == "internal" {
+			return strings.Join(elems[0:i], "/"), true
+		}
+	}
+	return "", false
+}
+
+// srcRoot returns the source directory that holds the
+// package with the given import path, such as $GOPATH/src,
+// found from the name of one of its files.
+func srcRoot(filename, path string) string {
+	dir := filepath.ToSlash(filepath.Dir(filename))
+	return filepath.FromSlash(strings.TrimSuffix(dir, "/"+path))
+}
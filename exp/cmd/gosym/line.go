@@ -1,91 +1,344 @@
 package main
 
 import (
+	"bytes"
 	"code.google.com/p/rog-go/exp/go/ast"
 	"code.google.com/p/rog-go/exp/go/token"
+	"encoding/json"
 	"fmt"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 type symLine struct {
-	pos      token.Position // file address of identifier; addr.Offset is zero.
-	referPos token.Position // file address of referred-to identifier.
-	long     bool           // line is in long format.
-	exprPkg  string         // package containing identifier (long format only)
-	referPkg string         // package containing referred-to object (long format only)
-	expr     string         // name of identifier. fully qualified.
-	local    bool           // identifier is function-local (long format only)
-	kind     ast.ObjKind    // kind of identifier (long format only)
-	plus     bool           // line is, or refers to, definition of object. (long format only)
-	exprType string         // type of expression (unparsed). (long format only)
+	pos        token.Position // file address of identifier; addr.Offset is zero.
+	referPos   token.Position // file address of referred-to identifier.
+	long       bool           // line is in long format.
+	exprPkg    string         // package containing identifier (long format only)
+	referPkg   string         // package containing referred-to object (long format only)
+	expr       string         // name of identifier. fully qualified.
+	local      bool           // identifier is function-local
+	kind       ast.ObjKind    // kind of identifier (long format only)
+	plus       bool           // line is, or refers to, definition of object. (long format only)
+	exprType   string         // type of expression (unparsed). (long format only)
+	value      string         // value of constant (long format only)
+	build      string         // platform the line was printed for (JSON and list -format only)
+	enclosing  string         // declaration containing the identifier (long format only)
+	doc        bool           // declaration has a doc comment (long format only)
+	deprecated bool           // declaration's doc comment marks it deprecated (long format only)
+	offsets    bool           // positions are printed as byte offsets.
 	// valid in short form only.
-	newExpr  string         // new name of identifier, unqualified.
+	newExpr    string         // new name of identifier, unqualified.
 }
 
 // long format:
-// filename.go:35:5: referfilename.go:2:4 pkg referPkg expr kind [type]
+// filename.go:35:5: referfilename.go:2:4 pkg referPkg expr kind [type] [= value]
 // short format:
-// filename.go:35.5: expr newExpr
+// filename.go:35.5: expr newExpr [local]
+// Any position may be given as a byte offset
+// instead, as in filename.go:#1234.
+
+// positionPat matches a file position in either form.
+const positionPat = `([^:]+):(?:(\d+):(\d+)|#(\d+))`
 
 var linePat = regexp.MustCompile(`^` +
-	`([^:]+):(\d+):(\d+):` + // 1,2,3: filename
+	positionPat + `:` + // 1,2,3,4: filename, line, column, offset
 	`(` +
-	`\s+([^:]+):(\d+):(\d+)` + // 5,6,7: filename
-	`\s+([^\s]+)` + // 8: exprPkg
-	`\s+([^\s]+)` + // 9: referPkg
-	`\s+([^\s]+)` + // 10: expr
-	`\s+(local)?([^\s+]+)(\+)?` + // 11,12,13: local, kind, plus
-	`(\s+([^\s].*))?` + // 15: exprType
+	`\s+` + positionPat + // 6,7,8,9: filename, line, column, offset
+	`\s+([^\s]+)` + // 10: exprPkg
+	`\s+([^\s]+)` + // 11: referPkg
+	`\s+([^\s]+)` + // 12: expr
+	`\s+(local)?([^\s+]+)(\+)?` + // 13,14,15: local, kind, plus
+	`(\s+([^\s].*))?` + // 17: exprType
 	`|` +
-	`\s+([^\s]+)` + // 16: expr
-	`\s+([^\s]+)` + // 17: newExpr
+	`\s+([^\s]+)` + // 18: expr
+	`\s+([^\s]+)` + // 19: newExpr
+	`(\s+(local))?` + // 21: local
 	`)` +
 	`$`)
 
-func atoi(s string) int {
-	i, err := strconv.Atoi(s)
+var posPat = regexp.MustCompile(`^` + positionPat + `:?$`)
+
+// parsePosition parses a file position in file:line:column
+// or file:#offset format.
+func parsePosition(s string) (token.Position, error) {
+	m := posPat.FindStringSubmatch(s)
+	if m == nil {
+		return token.Position{}, fmt.Errorf("invalid position %q", s)
+	}
+	return matchedPosition(m[1:5])
+}
+
+// matchedPosition returns the position matched by positionPat,
+// given the text of its four subexpressions, or an error if a
+// number in it is out of range. A position given as an offset
+// has no line or column; see lineTables.resolve.
+func matchedPosition(m []string) (token.Position, error) {
+	if m[3] != "" {
+		offset, err := strconv.Atoi(m[3])
+		if err != nil {
+			return token.Position{}, err
+		}
+		return token.Position{
+			Filename: m[0],
+			Offset:   offset,
+		}, nil
+	}
+	line, err := strconv.Atoi(m[1])
+	if err != nil {
+		return token.Position{}, err
+	}
+	column, err := strconv.Atoi(m[2])
+	if err != nil {
+		return token.Position{}, err
+	}
+	return token.Position{
+		Filename: m[0],
+		Line:     line,
+		Column:   column,
+	}, nil
+}
+
+// formatPosition formats p in file:line:column format,
+// or in file:#offset format if offsets is true.
+func formatPosition(p token.Position, offsets bool) string {
+	if offsets {
+		return fmt.Sprintf("%s:#%d", p.Filename, p.Offset)
+	}
+	return p.String()
+}
+
+// lineTables holds the contents of a set of files and the
+// offset of the start of each line in them, indexed by filename.
+type lineTables map[string]*lineTable
+
+type lineTable struct {
+	data []byte
+	// lines holds the offset of the start of each line.
+	// The final entry holds the size of the file.
+	lines []int
+}
+
+// table returns the table for the named file,
+// reading the file if necessary.
+func (t lineTables) table(filename string) (*lineTable, error) {
+	if lt, ok := t[filename]; ok {
+		return lt, nil
+	}
+	data, err := overlayFiles.readFile(filename)
 	if err != nil {
-		panic("bad number")
+		return nil, err
+	}
+	lines := []int{0}
+	for i, c := range data {
+		if c == '\n' {
+			lines = append(lines, i+1)
+		}
+	}
+	lines = append(lines, len(data))
+	lt := &lineTable{data, lines}
+	t[filename] = lt
+	return lt, nil
+}
+
+// resolve returns p with its line and column filled in from
+// its offset and its offset zeroed, reading the file it
+// refers to if necessary. A position that already has a
+// line is returned unchanged.
+func (t lineTables) resolve(p token.Position) (token.Position, error) {
+	if p.Line > 0 {
+		return p, nil
+	}
+	lt, err := t.table(p.Filename)
+	if err != nil {
+		return p, err
+	}
+	lines := lt.lines
+	if p.Offset < 0 || p.Offset >= lines[len(lines)-1] {
+		return p, fmt.Errorf("offset %d out of range in %s", p.Offset, p.Filename)
+	}
+	// Find the last line that starts at or before the offset.
+	i := sort.Search(len(lines), func(i int) bool { return lines[i] > p.Offset }) - 1
+	return token.Position{
+		Filename: p.Filename,
+		Line:     i + 1,
+		Column:   p.Offset - lines[i] + 1,
+	}, nil
+}
+
+// line returns the text of line n (counting from 1) in
+// the named file, including any line terminator.
+func (t lineTables) line(filename string, n int) ([]byte, error) {
+	lt, err := t.table(filename)
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 || n >= len(lt.lines) {
+		return nil, fmt.Errorf("line %d out of range in %s", n, filename)
+	}
+	return lt.data[lt.lines[n-1]:lt.lines[n]], nil
+}
+
+// context returns the line containing p, with space trimmed
+// from both ends and the n bytes at p marked as in «name».
+func (t lineTables) context(p token.Position, n int) (string, error) {
+	line, err := t.line(p.Filename, p.Line)
+	if err != nil {
+		return "", err
+	}
+	line = bytes.TrimRight(line, "\r\n")
+	col := p.Column - 1
+	if col < 0 || col+n > len(line) {
+		return "", fmt.Errorf("column %d out of range at %s:%d", p.Column, p.Filename, p.Line)
+	}
+	text := string(line[0:col]) + "«" + string(line[col:col+n]) + "»" + string(line[col+n:])
+	return strings.TrimSpace(text), nil
+}
+
+// runeColumn returns p with its column, counted in bytes,
+// converted to a column counted in runes, as many editors
+// count them. A position given as an offset is returned
+// unchanged.
+func (t lineTables) runeColumn(p token.Position) (token.Position, error) {
+	if p.Line == 0 {
+		return p, nil
+	}
+	line, err := t.line(p.Filename, p.Line)
+	if err != nil {
+		return p, err
+	}
+	if p.Column < 1 || p.Column-1 > len(line) {
+		return p, fmt.Errorf("column %d out of range at %s:%d", p.Column, p.Filename, p.Line)
+	}
+	p.Column = utf8.RuneCount(line[0:p.Column-1]) + 1
+	return p, nil
+}
+
+// byteColumn is the inverse of runeColumn: it returns p
+// with its column, counted in runes, converted to a
+// column counted in bytes.
+func (t lineTables) byteColumn(p token.Position) (token.Position, error) {
+	if p.Line == 0 {
+		return p, nil
+	}
+	line, err := t.line(p.Filename, p.Line)
+	if err != nil {
+		return p, err
+	}
+	if p.Column < 1 {
+		return p, fmt.Errorf("column %d out of range at %s:%d", p.Column, p.Filename, p.Line)
+	}
+	i := 0
+	for n := 1; n < p.Column; n++ {
+		if i >= len(line) {
+			return p, fmt.Errorf("column %d out of range at %s:%d", p.Column, p.Filename, p.Line)
+		}
+		_, size := utf8.DecodeRune(line[i:])
+		i += size
+	}
+	p.Column = i + 1
+	return p, nil
+}
+
+// byteColumns converts the columns of any positions in l
+// that are given as lines and columns from runes to bytes.
+// See lineTables.byteColumn.
+func (l *symLine) byteColumns(t lineTables) (err error) {
+	if l.pos, err = t.byteColumn(l.pos); err != nil {
+		return err
+	}
+	if l.long {
+		if l.referPos, err = t.byteColumn(l.referPos); err != nil {
+			return err
+		}
 	}
-	return i
+	return nil
+}
+
+// runeColumns is the inverse of byteColumns: it converts
+// the columns of the positions in l from bytes to runes.
+func (l *symLine) runeColumns(t lineTables) (err error) {
+	if l.pos, err = t.runeColumn(l.pos); err != nil {
+		return err
+	}
+	if l.long {
+		if l.referPos, err = t.runeColumn(l.referPos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveOffsets resolves any positions in l
+// that are given as byte offsets.
+func (l *symLine) resolveOffsets(t lineTables) (err error) {
+	if l.pos, err = t.resolve(l.pos); err != nil {
+		return err
+	}
+	if l.long {
+		if l.referPos, err = t.resolve(l.referPos); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func parseSymLine(line string) (*symLine, error) {
+	if strings.HasPrefix(line, "{") {
+		return parseJSONSymLine(line)
+	}
 	m := linePat.FindStringSubmatch(line)
 	if m == nil {
 		return nil, fmt.Errorf("invalid line")
 	}
 	var l symLine
-	l.pos.Filename = m[1]
-	l.pos.Line = atoi(m[2])
-	l.pos.Column = atoi(m[3])
-	if m[5] != "" {
+	var err error
+	if l.pos, err = matchedPosition(m[1:5]); err != nil {
+		return nil, err
+	}
+	if m[6] != "" {
 		l.long = true
-		l.referPos.Filename = m[5]
-		l.referPos.Line = atoi(m[6])
-		l.referPos.Column = atoi(m[7])
-		l.exprPkg = m[8]
-		l.referPkg = m[9]
-		l.expr = m[10] // TODO check for invalid chars in expr
-		l.local = m[11] == "local"
-		var ok bool
-		l.kind, ok = objKinds[m[12]]
-		if !ok {
-			return nil, fmt.Errorf("invalid kind %q", m[12])
+		if l.referPos, err = matchedPosition(m[6:10]); err != nil {
+			return nil, err
+		}
+		l.exprPkg = m[10]
+		l.referPkg = m[11]
+		l.expr = m[12] // TODO check for invalid chars in expr
+		l.local = m[13] == "local"
+		if l.kind, err = parseKind(m[14]); err != nil {
+			return nil, err
 		}
-		l.plus = m[13] == "+"
-		if m[15] != "" {
-			l.exprType = m[15]
+		l.plus = m[15] == "+"
+		if l.kind == ast.Con {
+			l.exprType, l.value = splitValue(m[17])
+		} else {
+			l.exprType = m[17]
 		}
 	} else {
-		l.expr = m[16]
-		l.newExpr = m[17]
+		l.expr = m[18]
+		l.newExpr = m[19]
+		l.local = m[21] == "local"
 	}
 	return &l, nil
 }
 
+// parseKind returns the kind of symbol named by s in a
+// listed line: one of objKinds, or "bad" for an unresolved
+// reference (see sym.ImportFiles).
+func parseKind(s string) (ast.ObjKind, error) {
+	if s == "bad" {
+		return ast.Bad, nil
+	}
+	kind, ok := objKinds[s]
+	if !ok {
+		return 0, fmt.Errorf("invalid kind %q", s)
+	}
+	return kind, nil
+}
+
 func (l *symLine) String() string {
 	if l.long {
 		local := ""
@@ -100,12 +353,46 @@ func (l *symLine) String() string {
 		if len(l.exprType) > 0 {
 			exprType = " " + l.exprType
 		}
-		return fmt.Sprintf("%v: %v %s %s %s %s%s%s%s", l.pos, l.referPos, l.exprPkg, l.referPkg, l.expr, local, l.kind, def, exprType)
+		if len(l.value) > 0 {
+			exprType += " = " + l.value
+		}
+		return fmt.Sprintf("%s: %s %s %s %s %s%s%s%s", formatPosition(l.pos, l.offsets), formatPosition(l.referPos, l.offsets), l.exprPkg, l.referPkg, l.expr, local, l.kind, def, exprType)
 	}
 	if l.newExpr == "" {
 		panic("no new expr in short-form sym line")
 	}
-	return fmt.Sprintf("%v: %s %s", l.pos, l.expr, l.newExpr)
+	if l.local {
+		return fmt.Sprintf("%s: %s %s local", formatPosition(l.pos, l.offsets), l.expr, l.newExpr)
+	}
+	return fmt.Sprintf("%s: %s %s", formatPosition(l.pos, l.offsets), l.expr, l.newExpr)
+}
+
+// splitValue splits the text following the kind of a
+// constant into its type and its value, either of
+// which may be empty.
+func splitValue(s string) (exprType, value string) {
+	if strings.HasPrefix(s, "= ") {
+		return "", s[len("= "):]
+	}
+	if i := strings.Index(s, " = "); i >= 0 {
+		return s[:i], s[i+len(" = "):]
+	}
+	return s, ""
+}
+
+// docStatus returns the documentation status of l as
+// printed by list -doc: "doc", "nodoc" or "deprecated"
+// for a declaration, and "-" for any other symbol.
+func (l *symLine) docStatus() string {
+	switch {
+	case !l.plus:
+		return "-"
+	case l.deprecated:
+		return "deprecated"
+	case l.doc:
+		return "doc"
+	}
+	return "nodoc"
 }
 
 func (l *symLine) symName() string {
@@ -114,3 +401,166 @@ func (l *symLine) symName() string {
 	}
 	return l.expr
 }
+
+// jsonPosition is the JSON representation of a token.Position.
+type jsonPosition struct {
+	Filename string `json:"filename"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Offset   int    `json:"offset"`
+}
+
+// jsonSymLine is the JSON representation of a symLine,
+// as printed by list -json. A line is in long format
+// if it has a kind.
+type jsonSymLine struct {
+	Pos        jsonPosition  `json:"pos"`
+	ReferPos   *jsonPosition `json:"referPos,omitempty"`
+	ExprPkg    string        `json:"exprPkg,omitempty"`
+	ReferPkg   string        `json:"referPkg,omitempty"`
+	Expr       string        `json:"expr"`
+	Kind       string        `json:"kind,omitempty"`
+	Local      bool          `json:"local"`
+	Universe   bool          `json:"universe"`
+	Plus       bool          `json:"plus"`
+	ExprType   string        `json:"exprType,omitempty"`
+	Value      string        `json:"value,omitempty"`
+	Build      string        `json:"build,omitempty"`
+	NewExpr    string        `json:"newExpr,omitempty"`
+	Enclosing  string        `json:"enclosing,omitempty"`
+	Documented bool          `json:"documented,omitempty"`
+	Deprecated bool          `json:"deprecated,omitempty"`
+}
+
+func toJSONPosition(p token.Position) jsonPosition {
+	return jsonPosition{
+		Filename: p.Filename,
+		Line:     p.Line,
+		Column:   p.Column,
+		Offset:   p.Offset,
+	}
+}
+
+// position returns p as a token.Position. The offset
+// is kept only if p has no line.
+func (p jsonPosition) position() token.Position {
+	if p.Line == 0 {
+		return token.Position{
+			Filename: p.Filename,
+			Offset:   p.Offset,
+		}
+	}
+	return token.Position{
+		Filename: p.Filename,
+		Line:     p.Line,
+		Column:   p.Column,
+	}
+}
+
+// toJSON returns the JSON representation of l.
+func (l *symLine) toJSON() *jsonSymLine {
+	jl := &jsonSymLine{
+		Pos:     toJSONPosition(l.pos),
+		Expr:    l.expr,
+		NewExpr: l.newExpr,
+		Local:   l.local,
+	}
+	if l.long {
+		referPos := toJSONPosition(l.referPos)
+		jl.ReferPos = &referPos
+		jl.ExprPkg = l.exprPkg
+		jl.ReferPkg = l.referPkg
+		jl.Kind = l.kind.String()
+		jl.Universe = l.referPkg == "universe"
+		jl.Plus = l.plus
+		jl.ExprType = l.exprType
+		jl.Value = l.value
+		jl.Build = l.build
+		jl.Enclosing = l.enclosing
+		jl.Documented = l.doc
+		jl.Deprecated = l.deprecated
+	}
+	return jl
+}
+
+// templateSymLine holds the data for a line printed
+// by list -format.
+type templateSymLine struct {
+	Pos        string
+	ReferPos   string
+	ExprPkg    string
+	ReferPkg   string
+	Expr       string
+	Kind       string
+	Local      bool
+	Universe   bool
+	Plus       bool
+	ExprType   string
+	Value      string
+	Build      string
+	Enclosing  string
+	Documented bool
+	Deprecated bool
+}
+
+// templateData returns the data used to print
+// the long-format line l with list -format.
+func (l *symLine) templateData() *templateSymLine {
+	return &templateSymLine{
+		Pos:        formatPosition(l.pos, l.offsets),
+		ReferPos:   formatPosition(l.referPos, l.offsets),
+		ExprPkg:    l.exprPkg,
+		ReferPkg:   l.referPkg,
+		Expr:       l.expr,
+		Kind:       l.kind.String(),
+		Local:      l.local,
+		Universe:   l.referPkg == "universe",
+		Plus:       l.plus,
+		ExprType:   l.exprType,
+		Value:      l.value,
+		Build:      l.build,
+		Enclosing:  l.enclosing,
+		Documented: l.doc,
+		Deprecated: l.deprecated,
+	}
+}
+
+// parseJSONSymLine parses a line as printed by list -json.
+// As with lines in the usual format, the offsets
+// of the resulting positions are zero.
+func parseJSONSymLine(line string) (*symLine, error) {
+	var jl jsonSymLine
+	if err := json.Unmarshal([]byte(line), &jl); err != nil {
+		return nil, fmt.Errorf("invalid JSON line: %v", err)
+	}
+	l := &symLine{
+		pos:     jl.Pos.position(),
+		expr:    jl.Expr,
+		newExpr: jl.NewExpr,
+		local:   jl.Local,
+	}
+	if jl.Kind == "" {
+		if l.newExpr == "" {
+			return nil, fmt.Errorf("no kind or new expr in JSON line")
+		}
+		return l, nil
+	}
+	var err error
+	if l.kind, err = parseKind(jl.Kind); err != nil {
+		return nil, err
+	}
+	l.long = true
+	if jl.ReferPos != nil {
+		l.referPos = jl.ReferPos.position()
+	}
+	l.exprPkg = jl.ExprPkg
+	l.referPkg = jl.ReferPkg
+	l.plus = jl.Plus
+	l.exprType = jl.ExprType
+	l.value = jl.Value
+	l.build = jl.Build
+	l.enclosing = jl.Enclosing
+	l.doc = jl.Documented
+	l.deprecated = jl.Deprecated
+	return l, nil
+}
@@ -1,83 +1,967 @@
 package main
 
 import (
+	"bytes"
 	"code.google.com/p/rog-go/exp/go/ast"
 	"code.google.com/p/rog-go/exp/go/sym"
+	"code.google.com/p/rog-go/exp/go/token"
 	"code.google.com/p/rog-go/exp/go/types"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"text/template"
 	"unicode"
 )
 
 type listCmd struct {
 	all       bool
+	exported  bool
+	init      bool
 	verbose   bool
 	printType bool
-	kinds     string
+	expand    bool
+	values    bool
+	context   bool
+	enclosing bool
+	doc       bool
+	json      bool
+	offset    bool
+	sort      bool
+	defs      bool
+	uses      bool
+	unused    bool
+	unique    bool
+	shadow    bool
+	internal  bool
+	jobs      int
+	kinds     kindList
+	excluded  kindList
+	refs      string
+	format    string
+	match     string
+	exclude   string
+	baseline  string
+	tagsFmt   string
+	graphFmt  string
+	graphSelf bool
+	short     string
+	decl      string
+	server    bool
+	files     fileList
 	ctxt      *context
+
+	// cmdFiles holds the files named on the command line
+	// that are not part of the package in their directory,
+	// which are listed as the package sym.CommandLinePackage.
+	cmdFiles []string
+
+	// tmpl holds the template parsed from the -format flag.
+	tmpl *template.Template
+
+	// matchPat and excludePat hold the regular expressions
+	// parsed from the -match and -exclude flags.
+	matchPat, excludePat *regexp.Regexp
+
+	// refPos holds the declarations named by the -refs flag.
+	refPos map[token.Position]bool
+
+	// shortener shortens package paths
+	// as specified by the -short flag.
+	shortener pathShortener
+
+	// When several platforms are being listed, multi
+	// is true and seen records the platform that
+	// each symbol was first printed for.
+	multi bool
+	mu    sync.Mutex
+	seen  map[token.Position]string
 }
 
 var listAbout = `
-gosym list [flags] [pkg...]
+gosym list [flags] [pkg|file...]
 
 The list command prints a line for each identifier
 used in the named packages. Each line printed has at least 6 space-separated fields
 in the following format:
 	file-position referenced-file-position package referenced-package name type-kind
 This format is known as "long" format.
-If no packages are named, "." is used.
+If no packages are named, "." is used. Package patterns
+containing "..." are expanded as with the go tool.
+The packages are printed in the order they are named, and
+the symbols in each package are printed in order of their
+position in the source; if the -sort flag is given, all
+the lines are instead sorted by referenced package, name
+and type kind.
 
 The file-position field holds the location of the identifier.
 The referenced-file-position field holds the location of the
-definition of the identifier.
+definition of the identifier, so that each use can be
+linked to its declaration, as a cross-reference index needs.
+Predeclared identifiers, such as int and len, have no
+declaration and are not printed.
+Identifiers predeclared by a particular compiler, such as
+intrinsic functions, can be added to them with the gosym
+-predeclared flag, so that they are resolved instead of
+reported as undefined. It takes a comma-separated list of
+names, each preceded by its kind (func, type, const or var)
+and a colon unless it is a function, as in:
+	gosym -predeclared type:float16,const:maxAlign,prefetch list
 The package field holds the path of the package containing the identifier.
 The referenced-package field holds the path of the package
 where the identifier is defined.
 The name field holds the name of the identifier (in X.Y format if
-it is defined as a member of another type X).
+it is defined as a member of another type X). A method is named by
+its receiver type, as in T.M or (*T).M, and a field by the type
+that declares it, alike at its declaration and its uses.
 The type-kind field holds the type class of identifier (const,
-type, var or func), and ends with a "+" sign if this line
+type, var, func or package), and ends with a "+" sign if this line
 marks the definition of the identifier.
+It starts with "local" if the identifier refers to a
+function-local object, such as a parameter or a variable
+declared inside a function, so that a local symbol can be
+told apart from a global one with the same name that it
+shadows.
+If the -t flag is given, the type of the identifier follows
+the type-kind field. Methods are printed with their receiver
+and name, as they are declared. Struct and interface types
+are printed on one line, with their members, including any
+field tags, separated by semicolons, as in struct{E; A, B int}.
+A named type is printed as its name unless the -expand flag
+is given, in which case it is printed as the type it is
+defined as, so that the fields of a variable of a named
+struct type are shown.
+If the -values flag is given, the value of each constant
+follows, after an "=" sign, as in "const+ Mode = 4".
+Integer, rune, string and boolean constants are evaluated,
+including those declared with iota; no value is printed for
+other constants (the -v flag reports why).
+
+The -k flag may be repeated, and its lists of kinds are
+joined. The kind all stands for all the kinds listed by
+default, and a kind with a leading "-" is removed from those
+before it, so -k all -k -var (or just -k -var) lists all but
+variables. If no -k flag is given, all is assumed. The -K flag,
+which may also be repeated, names kinds to exclude from those
+selected by -k, so -K func,var lists all but functions and
+variables, and -k type -K interface lists all but interface
+types.
+
+The -k flag may also name the kinds of type interface, struct
+and othertype, as in -k interface, to select only the types
+whose underlying type is an interface, a struct or any other
+type respectively; the type kind includes all three. The
+type-kind field holds "type" for each of them.
+
+Package names, which refer to the imports of the file
+they are in, are printed only if the -k flag includes
+the package kind, as in -k package.
+
+If the -exported flag is given, only symbols with exported
+names are printed; a name in X.Y format is counted as
+exported only if both X and Y are exported.
+
+If the -match flag is given, only symbols whose names
+match the given regular expression are printed, and if the
+-exclude flag is given, only those whose names do not match
+it; a name in X.Y format is matched as a whole, as printed.
+For example, this prints the declarations of the test
+functions of a package, except those whose names end in Slow:
+	gosym list -k func -defs -match '^Test' -exclude 'Slow$'
+
+If the -offset flag is given, file positions are printed
+as byte offsets, in file:#offset format, instead of as lines
+and columns. Commands that read lines accept positions
+in either format.
+
+Columns are counted in bytes, as by the Go tools. If the
+gosym -runes flag is given, columns are instead counted in
+runes, as by many editors, both in the lines printed by all
+commands and in those read by them. The flag makes no
+difference to byte offsets, nor to lines that contain
+only ASCII text.
+
+If the -context flag is given, each line is followed by a tab
+and the line of source containing the symbol, with space
+trimmed from both ends and the identifier marked
+as in «name». Lines printed with -context cannot be read
+by other commands. The -context flag cannot be used
+with the -json, -format or -baseline flags.
+
+If the -enclosing flag is given, each line is followed by a
+tab and the name of the top-level declaration containing the
+symbol: a function, as in F, a method, as in T.M or (*T).M,
+or a type, or "-" for a symbol outside any of them. Symbols
+inside function literals and types declared in a function
+are counted as in that function. With -json, the name is
+instead held in the enclosing field. Lines printed with
+-enclosing and without -json cannot be read by other commands.
+If -context is given too, the source line follows the name.
+The -enclosing flag cannot be used with the -format or
+-baseline flags.
+
+If the -doc flag is given, each line is followed by a tab
+and the documentation status of the symbol: for a declaration,
+"doc" if it has a doc comment, "nodoc" if it has none, or
+"deprecated" if its doc comment has a line starting
+"Deprecated:", and for any other symbol, "-". A declaration
+in a parenthesized group that has no comment of its own is
+documented by the comment of the group. With -json, the
+status is instead held in the documented and deprecated
+fields. For example, this prints the exported declarations
+of a package that are not documented:
+	gosym list -defs -doc | grep 'nodoc$'
+The status follows the name printed with -enclosing and
+precedes the source line printed with -context. Lines printed
+with -doc and without -json cannot be read by other commands.
+The -doc flag cannot be used with the -format or -baseline
+flags.
+
+If the -short flag is given, the package and referenced-package
+fields are shortened for reading: with -short=., the paths of
+the package in the current directory and of those below
+it are printed relative to it, as "." or as in ./sub, and
+with -short=n, only the last n elements of each path are
+printed.
+As shortened paths may be ambiguous, lines printed with
+-short should not be read by the used or unused commands.
+
+If the -json flag is given, each line is instead printed
+as a JSON object holding the same fields. Lines in this
+form are also accepted by commands that read long format.
+
+If the -format flag is given, each line is instead printed
+by executing it as a template (see text/template) with
+the fields Pos, ReferPos, ExprPkg, ReferPkg, Expr, Kind,
+Local, Universe, Plus, ExprType, Value, Build, Enclosing,
+Documented and Deprecated, which hold the fields of the line
+as printed with -json, with positions
+formatted as they are in long format, for example:
+	gosym list -format '{{.Pos}},{{.Expr}},{{.Kind}}'
+The type, value, enclosing declaration and documentation
+status of the symbol are provided whether or not the -t,
+-values, -enclosing and -doc flags are given.
+The -format flag cannot be used with
+the -json or -sort flags.
+
+If several target platforms are given (see the gosym -os
+and -arch flags), each symbol is printed once only, unless
+-json is given, in which case the symbols for each platform
+are printed in turn, labelled with the platform. A file that
+the build constraints leave out for every target platform,
+such as one for windows only when listing for linux, is
+reported with a warning, as none of its symbols are printed.
+
+If the -file flag is given, only the symbols in the named
+file are printed; the flag may be repeated to name several
+files. Go source files may also be named instead of packages,
+with the same effect. The whole of each package is still
+read, so that references between its files are resolved.
+If only files are named, the packages containing them are
+listed.
+
+A named file that is not part of the package in its
+directory, such as a script excluded by its build
+constraints or a file in a directory outside GOPATH that
+holds other packages, is listed on its own, together with
+any other such files, as the package command-line-arguments,
+as the go tool does. As its imports often cannot be found,
+its references to members of packages that cannot be found
+are printed too, with the position of the import as the
+referenced position, "?" as the referenced package, and
+"bad" as the type-kind. They are printed whenever any kind
+of symbol but package names is.
+
+Generated files, marked by a comment of the form
+	// Code generated ... DO NOT EDIT.
+before the package clause, are skipped unless the gosym
+-generated flag is given or they are named explicitly.
+
+Outside modules, imports are resolved as the go tool
+resolves them, so a package in a vendor directory is
+found in preference to one elsewhere when the vendor
+directory is in the importing package's directory or a
+directory above it. A vendored package is printed with
+its full import path, including the vendor directory.
+
+Files and directories matched by the patterns in a
+.gosymignore file are skipped by all commands, both when
+packages are found for patterns containing "..." and when
+the files of a package are read, unless the gosym -noignore
+flag is given. The file is looked for in the current directory
+and then in each directory above it; only the first found
+is used. As in a .gitignore file, each line holds a pattern,
+and blank lines and lines starting with "#" are ignored.
+A pattern starting with "!" includes again the files
+matched by an earlier pattern, and one ending in "/" matches
+only directories. A pattern holding any other "/" is matched
+against the path relative to the directory of the .gosymignore
+file, and any other pattern against the name of each file and
+directory at any depth below it. In a pattern, "*" matches
+any sequence of characters other than "/", and "**" any
+sequence of path elements, as in:
+	# Skip generated parsers and the old copies of the API.
+	*_yacc.go
+	/internal/**/old/
+
+If the gosym -depth flag is given, a package pattern
+containing "..." matches only the packages at most the given
+number of directory levels below the directory that the
+pattern starts from; with -depth 0, for instance, ./...
+matches the package in the current directory only, and
+foo/... the package foo only. Unlike .gosymignore files,
+the flag does not limit the importing packages that write
+finds to change (see its -scope flag).
+
+If the -refs flag is given, only references to the declaration
+at the given file position (in file:line:column or file:#offset
+format) are printed, whether they are exported or not. If the
+position is "-", the declarations are read from the standard
+input instead, as lines in any of the formats printed by gosym;
+the referenced-file-position field of each line in long format
+is used, and the file-position field of each line in short format.
+
+If the -decl flag is given, no packages are listed; instead,
+the position of the declaration of the named symbol is printed,
+followed by its type if the -t flag is given. The symbol is named
+in pkg.Name format, where pkg is an import path, or in pkg.T.M
+or pkg.(*T).M format for a field or method M of type T,
+for example:
+	gosym list -t -decl 'bufio.(*Reader).ReadLine'
+
+If the -server flag is given, queries are read from the
+standard input, one per line, and the response to each is
+printed followed by an empty line, so that an editor can
+keep gosym running and avoid reading the same packages
+again for each query. A query is of the form
+	def target
+which prints the declaration of the target symbol as for
+the -decl flag, or
+	refs target
+which lists the references to the target symbol in the
+named packages as for the -refs flag. The target is either
+the file position of any identifier referring to the symbol
+(in file:line:column or file:#offset format, at any character
+of the identifier), or a name as accepted by -decl.
+If a query fails, the response is a single line
+starting "error:". The packages are read only once,
+so any changes made to their source while gosym
+is running are not seen. The -server flag cannot be
+used with the -decl, -refs, -baseline or -sort flags.
+
+If the -defs flag is given, only declarations (the lines
+marked with "+") are printed; if the -uses flag is given,
+only the other lines are printed.
+
+If the -tags-format flag is given, the declarations are
+printed as a tags file for editors, in ctags format (sorted
+by name, each with its line number and kind) or in etags
+format. The ctags kinds are c for constants, v for variables,
+f for functions and methods, s for struct types, i for
+interface types, t for other types, m for struct fields and
+interface methods, and p for package names; methods, fields
+and interface methods have a "type" field naming the type
+they belong to. The -tags-format flag cannot be used with
+the -json, -format, -sort, -uses, -unused, -baseline, -decl
+or -server flags.
+
+If the -graph flag is given, no symbols are printed; instead,
+the references between packages made by the symbols listed
+are printed as a graph, in the given format: "edges" prints a
+line for each pair of packages, holding the package making
+the references, the package referred to and the number of
+references, as in:
+	example.com/foo example.com/bar 12
+and "dot" prints the same graph for Graphviz's dot command,
+with the number of references as the weight and label of
+each edge. References to the universe are omitted, as are
+references within a package unless the -graph-self flag is
+given. The -graph flag cannot be used with the -json, -format,
+-sort, -defs, -unused, -unique, -baseline, -tags-format,
+-shadow, -decl or -server flags.
+
+If the -unused flag is given, only the declarations that
+are not referred to by any of the symbols listed are printed,
+which can help to find dead code. As a declaration is
+counted as used only if one of its uses is listed, all
+the packages that might use it should be named, and
+it should be used with -a to find unused internal
+symbols. The -unused flag cannot be used with the
+-defs, -uses, -format or -baseline flags.
+
+If the -unique flag is given, only one line is printed for
+each declaration referred to by the symbols listed: the line
+for the declaration itself if it is listed, or else the first
+line that refers to it, so that a listing of many uses is
+reduced to the set of distinct symbols they refer to, as in:
+	gosym list -unique -uses ./...
+The lines kept are printed in the order they would otherwise
+be. The -unique flag cannot be used with the -format, -unused,
+-baseline, -tags-format, -decl or -server flags.
+
+If the -shadow flag is given, no symbols are printed; instead,
+a line is printed for each local declaration, such as a
+variable or parameter, that shadows a package imported by its
+file or a package-level declaration of its package, which
+cannot then be referred to where the local is in scope. Each
+line holds the position of the local declaration, its name and
+what it shadows, with the position of the import or declaration,
+as in:
+	p.go:12:2: json shadows import of "encoding/json" at p.go:4:2
+The -shadow flag cannot be used with the -json, -format,
+-sort, -unused, -baseline, -tags-format, -refs, -decl or
+-server flags.
+
+If the -internal-check flag is given, no symbols are printed;
+instead, a line is printed for each name taken from an
+internal package, as in b.F, by a package that may not import
+it. Members reached through a value of one of its types, as in
+pub.New().M(), are not counted, as the package that returns
+the value may import the internal one.
+A package whose import path has an element named "internal"
+may be imported only by the packages whose paths begin with
+the path before that element, or by any package in its source
+tree if there is none. Each line holds the position of the use,
+its name, the internal package with the position of the
+declaration, and the path outside which it is used, as in:
+	p.go:9:4: F in internal package "a/internal/b" at b.go:3:6 is used outside "a"
+The -internal-check flag cannot be used with the -json,
+-format, -sort, -unused, -unique, -baseline, -tags-format,
+-graph, -shadow, -refs, -decl or -server flags.
+
+If the -baseline flag is given, the declarations found are
+compared with those in the named file, which holds the output
+of an earlier list command, and only the differences are
+printed, sorted by package and name. Each line is prefixed
+with "added", "removed" or "changed". Declarations are matched
+by package and name, and a declaration has changed if its
+kind or type differs; the kind and type it had in the
+baseline follow "was" at the end of the line. Types are
+compared only if the baseline was saved with the -t flag;
+otherwise it should be saved with the same flags, as in:
+	gosym list -t -exported ./... > api.txt
+	gosym list -exported -baseline api.txt ./...
+If any declaration was removed or changed, gosym exits with
+an error. The -baseline flag cannot be used with the -json
+or -format flags.
+
+The output for each package is cached on disk, and reused
+while none of the package's source files, nor those of any
+package it imports, have changed. The gosym -nocache flag
+disables the cache, as does the gosym -maxunresolved flag,
+because it needs every symbol to be resolved again, and so does
+the gosym -overlay flag (see the write command). Nor is the
+cache used while warnings about the source are printed, as
+they would not be printed again for a package taken from
+it, so it is used only with gosym -v=false or -warnings=quiet.
+
+The gosym -stats flag prints to the standard error the number
+of packages parsed and symbols resolved, the time taken by each
+and the proportion of imports found already parsed. As packages
+whose output is taken from the cache are not read, it should
+be used with -nocache to see what listing them all costs.
+
+Files that cannot be parsed, such as those using syntax that
+gosym does not understand, are left out of their packages,
+with a warning giving the position of the first error in each,
+and the rest of each package is read without them. Unless the
+gosym -v flag is false, the files left out are listed again
+when the command finishes, with those positions, as in:
+	gosym: 2 files skipped as they could not be parsed:
+	gosym: 	/go/src/p/iter.go:18:30
+	gosym: 	/go/src/p/seq.go:7:12
 `[1:]
 
 func init() {
 	c := &listCmd{}
 	fset := flag.NewFlagSet("gosym list", flag.ExitOnError)
-	fset.StringVar(&c.kinds, "k", allKinds(), "kinds of symbol types to include")
+	fset.Var(&c.kinds, "k", "kinds of symbol types to include (may be repeated; default all)")
+	fset.Var(&c.excluded, "K", "kinds of symbol types to exclude (may be repeated)")
 	fset.BoolVar(&c.verbose, "v", false, "print warnings about undefined symbols")
 	fset.BoolVar(&c.printType, "t", false, "print symbol type")
+	fset.BoolVar(&c.expand, "expand", false, "print named types as the types they are defined as")
+	fset.BoolVar(&c.values, "values", false, "print the values of constants")
+	fset.BoolVar(&c.context, "context", false, "print the source line containing each symbol")
+	fset.BoolVar(&c.doc, "doc", false, "print whether each declaration is documented or deprecated")
+	fset.BoolVar(&c.enclosing, "enclosing", false, "print the function or type declaration containing each symbol")
 	fset.BoolVar(&c.all, "a", false, "print internal symbols too")
+	fset.BoolVar(&c.exported, "exported", false, "print only symbols with exported names")
+	fset.BoolVar(&c.init, "init", true, "print init functions (only with -a)")
+	fset.BoolVar(&c.json, "json", false, "print symbols as JSON objects, one per line")
+	fset.StringVar(&c.format, "format", "", "print each symbol with this template")
+	fset.StringVar(&c.match, "match", "", "print only symbols whose names match this regular expression")
+	fset.StringVar(&c.exclude, "exclude", "", "do not print symbols whose names match this regular expression")
+	fset.StringVar(&c.short, "short", "", "shorten package paths: \".\" for paths relative to the current directory, or n to keep the last n elements")
+	fset.BoolVar(&c.offset, "offset", false, "print file positions as byte offsets")
+	fset.BoolVar(&c.sort, "sort", false, "sort all symbols by referenced package, name and kind")
+	fset.BoolVar(&c.defs, "defs", false, "print only declarations")
+	fset.BoolVar(&c.uses, "uses", false, "print only uses of symbols, not their declarations")
+	fset.BoolVar(&c.unused, "unused", false, "print only declarations with no uses")
+	fset.BoolVar(&c.unique, "unique", false, "print only one line for each declaration referred to")
+	fset.BoolVar(&c.shadow, "shadow", false, "print local declarations that shadow imports or package-level declarations")
+	fset.BoolVar(&c.internal, "internal-check", false, "print uses of internal packages that their packages may not import")
+	fset.IntVar(&c.jobs, "j", runtime.GOMAXPROCS(0), "number of packages to process concurrently")
+	fset.BoolVar(&c.server, "server", false, "answer queries read from the standard input")
+	fset.StringVar(&c.decl, "decl", "", "print only the declaration position of this symbol")
+	fset.StringVar(&c.tagsFmt, "tags-format", "", "print declarations as a tags file in this format (ctags or etags)")
+	fset.StringVar(&c.graphFmt, "graph", "", "print the references between packages as a graph in this format (dot or edges)")
+	fset.BoolVar(&c.graphSelf, "graph-self", false, "include references within a package in the -graph output")
+	fset.StringVar(&c.baseline, "baseline", "", "print the differences from the declarations listed in this file")
+	fset.Var(&c.files, "file", "print only symbols in this file (may be repeated)")
+	fset.StringVar(&c.refs, "refs", "", "print only references to the declaration at this position (\"-\" for stdin)")
 	register("list", c, fset, listAbout)
 }
 
 func (c *listCmd) run(ctxt *context, args []string) error {
 	c.ctxt = ctxt
-	if c.kinds == "" {
-		return fmt.Errorf("no type kinds specified")
+	mask, err := c.kindMask()
+	if err != nil {
+		return err
+	}
+	if c.format != "" {
+		if c.json || c.sort {
+			return fmt.Errorf("-format cannot be used with -json or -sort")
+		}
+		if c.tmpl, err = template.New("format").Parse(c.format); err != nil {
+			return fmt.Errorf("invalid -format template: %v", err)
+		}
+	}
+	if c.match != "" {
+		if c.matchPat, err = regexp.Compile(c.match); err != nil {
+			return fmt.Errorf("invalid -match regexp: %v", err)
+		}
+	}
+	if c.exclude != "" {
+		if c.excludePat, err = regexp.Compile(c.exclude); err != nil {
+			return fmt.Errorf("invalid -exclude regexp: %v", err)
+		}
+	}
+	if c.context && (c.json || c.format != "" || c.baseline != "") {
+		return fmt.Errorf("-context cannot be used with -json, -format or -baseline")
+	}
+	if c.enclosing && (c.format != "" || c.baseline != "") {
+		return fmt.Errorf("-enclosing cannot be used with -format or -baseline")
+	}
+	if c.doc && (c.format != "" || c.baseline != "") {
+		return fmt.Errorf("-doc cannot be used with -format or -baseline")
+	}
+	if c.short != "" {
+		if c.shortener, err = newPathShortener(ctxt, c.short); err != nil {
+			return err
+		}
+	}
+	if c.defs && c.uses {
+		return fmt.Errorf("-defs cannot be used with -uses")
+	}
+	if c.unused && (c.defs || c.uses || c.format != "" || c.baseline != "") {
+		return fmt.Errorf("-unused cannot be used with -defs, -uses, -format or -baseline")
+	}
+	if c.unique && (c.format != "" || c.unused || c.baseline != "" || c.tagsFmt != "" || c.decl != "" || c.server) {
+		return fmt.Errorf("-unique cannot be used with -format, -unused, -baseline, -tags-format, -decl or -server")
 	}
-	mask, err := parseKindMask(c.kinds)
+	if c.shadow && (c.json || c.format != "" || c.sort || c.unused || c.baseline != "" || c.tagsFmt != "" || c.refs != "" || c.decl != "" || c.server) {
+		return fmt.Errorf("-shadow cannot be used with -json, -format, -sort, -unused, -baseline, -tags-format, -refs, -decl or -server")
+	}
+	if c.internal && (c.json || c.format != "" || c.sort || c.unused || c.unique || c.baseline != "" || c.tagsFmt != "" || c.graphFmt != "" || c.shadow || c.refs != "" || c.decl != "" || c.server) {
+		return fmt.Errorf("-internal-check cannot be used with -json, -format, -sort, -unused, -unique, -baseline, -tags-format, -graph, -shadow, -refs, -decl or -server")
+	}
+	if c.tagsFmt != "" {
+		if c.tagsFmt != "ctags" && c.tagsFmt != "etags" {
+			return fmt.Errorf("unknown tags format %q", c.tagsFmt)
+		}
+		if c.json || c.format != "" || c.sort || c.uses || c.unused || c.baseline != "" || c.decl != "" || c.server {
+			return fmt.Errorf("-tags-format cannot be used with -json, -format, -sort, -uses, -unused, -baseline, -decl or -server")
+		}
+		c.defs = true
+	}
+	if c.graphFmt != "" {
+		if c.graphFmt != "dot" && c.graphFmt != "edges" {
+			return fmt.Errorf("unknown graph format %q", c.graphFmt)
+		}
+		if c.json || c.format != "" || c.sort || c.defs || c.unused || c.unique || c.baseline != "" || c.tagsFmt != "" || c.shadow || c.decl != "" || c.server {
+			return fmt.Errorf("-graph cannot be used with -json, -format, -sort, -defs, -unused, -unique, -baseline, -tags-format, -shadow, -decl or -server")
+		}
+	} else if c.graphSelf {
+		return fmt.Errorf("-graph-self can only be used with -graph")
+	}
+	if c.refs != "" {
+		if c.refPos, err = ctxt.readRefs(c.refs); err != nil {
+			return err
+		}
+	}
+	if c.decl != "" {
+		if len(args) > 0 || c.json || c.format != "" || c.refs != "" || c.baseline != "" || c.server {
+			return fmt.Errorf("-decl cannot be used with packages or with -json, -format, -refs, -baseline or -server")
+		}
+		return c.printDecl(ctxt)
+	}
+	var baseline []*symLine
+	if c.baseline != "" {
+		if c.json || c.format != "" {
+			return fmt.Errorf("-baseline cannot be used with -json or -format")
+		}
+		if baseline, err = readBaseline(c.baseline); err != nil {
+			return err
+		}
+		c.printType = true
+	}
+	pkgs, err := c.splitFiles(args)
 	if err != nil {
 		return err
 	}
-	pkgs := args
 	if len(pkgs) == 0 {
 		pkgs = []string{"."}
 	}
-	visitor := func(info *sym.Info) bool {
-		return c.visit(info, mask)
+	pkgs = ctxt.expandPackages(pkgs)
+	if c.server {
+		if c.refs != "" || c.baseline != "" || c.sort {
+			return fmt.Errorf("-server cannot be used with -refs, -baseline or -sort")
+		}
+		c.ctxt = ctxt
+		if err := c.importCmdFiles(ctxt); err != nil {
+			return err
+		}
+		return c.serve(ctxt, os.Stdin, pkgs, mask)
+	}
+	ctxts := ctxt.platformContexts()
+	c.multi = len(ctxts) > 1
+	c.seen = make(map[token.Position]string)
+	ctxt.reportExcluded(pkgs)
+	var out bytes.Buffer
+	for _, pctxt := range ctxts {
+		c.ctxt = pctxt
+		if err := c.importCmdFiles(pctxt); err != nil {
+			return err
+		}
+		w := io.Writer(ctxt.stdout)
+		if c.sort || c.unused || c.unique || c.baseline != "" || c.tagsFmt != "" || c.graphFmt != "" {
+			w = &out
+		}
+		if err := c.listPackages(w, pkgs, mask); err != nil {
+			return err
+		}
+	}
+	if c.baseline != "" {
+		lines, err := readListing(&out, "list output")
+		if err != nil {
+			return err
+		}
+		if n := printBaselineDiff(ctxt.stdout, declLines(baseline), declLines(lines)); n > 0 {
+			return fmt.Errorf("%d declarations removed or changed since %s", n, c.baseline)
+		}
+		return nil
+	}
+	if c.tagsFmt != "" {
+		ctxt.stdout.Write(tagsFile(c.tagsFmt, out.Bytes()))
+		return nil
+	}
+	if c.graphFmt != "" {
+		data, err := graphFile(c.graphFmt, c.graphSelf, out.Bytes())
+		if err != nil {
+			return err
+		}
+		ctxt.stdout.Write(data)
+		return nil
+	}
+	if c.sort || c.unused || c.unique {
+		data := out.Bytes()
+		if c.unused {
+			if data, err = unusedLines(data); err != nil {
+				return err
+			}
+		}
+		if c.unique {
+			if data, err = uniqueLines(data); err != nil {
+				return err
+			}
+		}
+		if c.sort {
+			if data, err = sortLines(data); err != nil {
+				return err
+			}
+		}
+		ctxt.stdout.Write(data)
+	}
+	return nil
+}
+
+// listPackages prints the symbols in all the given packages to w.
+// If the symbols of a package cannot be printed, it stops
+// there and returns the error.
+func (c *listCmd) listPackages(w io.Writer, pkgs []string, mask uint) error {
+	jobs := c.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	// Packages are listed concurrently, but the output for
+	// each package is printed in the order the packages were named.
+	type listing struct {
+		data []byte
+		err  error
+	}
+	out := make([]chan listing, len(pkgs))
+	for i := range out {
+		out[i] = make(chan listing, 1)
+	}
+	indexes := make(chan int)
+	go func() {
+		for i := range pkgs {
+			indexes <- i
+		}
+		close(indexes)
+	}()
+	for j := 0; j < jobs; j++ {
+		go func() {
+			for i := range indexes {
+				data, err := c.listPackage(pkgs[i], mask)
+				out[i] <- listing{data, err}
+			}
+		}()
+	}
+	for _, o := range out {
+		l := <-o
+		if l.err != nil {
+			return l.err
+		}
+		w.Write(l.data)
+	}
+	return nil
+}
+
+// listPackage returns the lines printed for all the
+// symbols in the package with the given path, or an
+// error if any of them cannot be printed.
+func (c *listCmd) listPackage(path string, mask uint) ([]byte, error) {
+	// When several platforms are listed, the output for each
+	// depends on the others, so it is not cached. Nor is it
+	// cached when warnings are printed, as a cache hit would
+	// not print them again, nor for files listed on their own,
+	// whose package has no directory to key it.
+	var key string
+	if !c.multi && !sourceWarnings() && path != sym.CommandLinePackage {
+		key = c.ctxt.cacheKey(path, c.all, c.exported, c.init, c.printType, c.expand, c.values, c.json, c.format, c.offset, c.defs, c.uses, c.context, c.enclosing, c.doc, c.tagsFmt, c.shadow, c.internal, c.match, c.exclude, c.shortener, mask, c.sortedRefs(), c.files)
+	}
+	if key != "" {
+		if data, ok := c.ctxt.readCache(key); ok {
+			return data, nil
+		}
+	}
+	var buf bytes.Buffer
+	lines := make(lineTables)
+	var groups map[ast.Spec]*ast.GenDecl
+	if c.doc || c.tmpl != nil {
+		groups = specGroups(c.ctxt.importPackages(path))
+	}
+	printSym := func(s sym.Symbol) error {
+		return c.visit(&buf, lines, groups, s, mask)
+	}
+	if c.shadow {
+		files := c.shadowFiles(path)
+		printSym = func(s sym.Symbol) error {
+			return c.printShadow(&buf, lines, files, s)
+		}
+	}
+	if c.internal {
+		printSym = func(s sym.Symbol) error {
+			return c.printInternal(&buf, lines, s)
+		}
+	}
+	var printErr error
+	err := c.ctxt.WalkFiles(path, c.files, func(s sym.Symbol) bool {
+		printErr = printSym(s)
+		return printErr == nil
+	})
+	if printErr != nil {
+		// The listing is incomplete, so it is not cached.
+		return nil, printErr
+	}
+	if err != nil {
+		c.ctxt.warnf(token.Position{}, warnPackage, "%v", err)
+		if c.ctxt.Import(path) == nil {
+			setExitStatus(exitNotFound)
+		} else {
+			setExitStatus(exitError)
+		}
+		return buf.Bytes(), nil
+	}
+	if key != "" {
+		c.ctxt.writeCache(key, buf.Bytes())
+	}
+	return buf.Bytes(), nil
+}
+
+// splitFiles adds any Go source files named in args to the
+// files named by the -file flag, and returns the remaining
+// arguments. If args names no packages, the packages
+// containing the files are returned. Files that are not part
+// of the package in their directory are recorded in c.cmdFiles,
+// and their package is always returned.
+func (c *listCmd) splitFiles(args []string) ([]string, error) {
+	var pkgs []string
+	for _, a := range args {
+		if strings.HasSuffix(a, ".go") {
+			c.files = append(c.files, a)
+		} else {
+			pkgs = append(pkgs, a)
+		}
+	}
+	if len(c.files) == 0 {
+		return pkgs, nil
+	}
+	for i, f := range c.files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return nil, fmt.Errorf("%s is a directory, not a file", f)
+		}
+		if c.files[i], err = filepath.Abs(f); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(c.files)
+	named := len(pkgs) > 0
+	for _, f := range c.files {
+		switch {
+		case !c.ctxt.isPackageFile(f):
+			c.cmdFiles = append(c.cmdFiles, f)
+		case !named:
+			pkgs = append(pkgs, dirPackage(filepath.Dir(f)))
+		}
 	}
-	for _, path := range pkgs {
-		if pkg := ctxt.Import(path); pkg != nil {
-			for _, f := range pkg.Files {
-				ctxt.IterateSyms(f, visitor)
+	if len(c.cmdFiles) > 0 {
+		pkgs = append(pkgs, sym.CommandLinePackage)
+	}
+	return pkgs, nil
+}
+
+// importCmdFiles imports the files in c.cmdFiles into ctxt
+// as the package sym.CommandLinePackage.
+func (c *listCmd) importCmdFiles(ctxt *context) error {
+	if len(c.cmdFiles) == 0 {
+		return nil
+	}
+	if _, err := ctxt.ImportFiles(c.cmdFiles); err != nil {
+		return fmt.Errorf("cannot import %s: %v", strings.Join(c.cmdFiles, ", "), err)
+	}
+	return nil
+}
+
+// isPackageFile reports whether the named file is one of the
+// files of the package in its directory, as built for ctxt.
+func (ctxt *context) isPackageFile(file string) bool {
+	bpkg, err := ctxt.FindPackage(".", filepath.Dir(file), 0)
+	if err != nil {
+		return false
+	}
+	for _, names := range [][]string{bpkg.GoFiles, bpkg.CgoFiles, bpkg.TestGoFiles, bpkg.XTestGoFiles} {
+		for _, name := range names {
+			if name == filepath.Base(file) {
+				return true
 			}
 		}
 	}
+	return false
+}
+
+// dirPackage returns the path used to import the package
+// in the given absolute directory: a path relative to the
+// current directory if there is one, or the directory itself.
+func dirPackage(dir string) string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return dir
+	}
+	rel, err := filepath.Rel(cwd, dir)
+	if err != nil {
+		return dir
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return rel
+	}
+	return "./" + rel
+}
+
+// fileList holds the values of a flag that may be repeated.
+type fileList []string
+
+func (l *fileList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *fileList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// kindMask returns the kind mask selecting the kinds named
+// by the -k flags, or all the kinds listed by default if
+// there are none, less the kinds named by the -K flags.
+func (c *listCmd) kindMask() (uint, error) {
+	kinds := strings.Join(c.kinds, ",")
+	if c.kinds == nil {
+		kinds = "all"
+	}
+	if kinds == "" {
+		return 0, fmt.Errorf("no type kinds specified")
+	}
+	mask, err := parseKindMask(kinds)
+	if err != nil {
+		return 0, err
+	}
+	if c.excluded == nil {
+		return mask, nil
+	}
+	excluded := strings.Join(c.excluded, ",")
+	if excluded == "" {
+		return 0, fmt.Errorf("no type kinds specified to exclude")
+	}
+	for _, k := range strings.Split(excluded, ",") {
+		if strings.HasPrefix(k, "-") {
+			return 0, fmt.Errorf("cannot exclude negated type kind %q", k)
+		}
+	}
+	bits, err := parseKindMask(excluded)
+	if err != nil {
+		return 0, err
+	}
+	return mask &^ bits, nil
+}
+
+// kindList holds the values of the -k or -K flag, which are
+// joined to make a single list of kinds.
+type kindList []string
+
+func (l *kindList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *kindList) Set(s string) error {
+	*l = append(*l, s)
 	return nil
 }
 
+// sortedRefs returns the positions in c.refPos in a
+// canonical form.
+func (c *listCmd) sortedRefs() []string {
+	var refs []string
+	for p := range c.refPos {
+		refs = append(refs, p.String())
+	}
+	sort.Strings(refs)
+	return refs
+}
+
 func isExported(name string) bool {
 	for _, r := range name {
 		return unicode.IsUpper(r)
@@ -85,61 +969,446 @@ func isExported(name string) bool {
 	return false
 }
 
-func (c *listCmd) visit(info *sym.Info, kindMask uint) bool {
-	if (1<<uint(info.ReferObj.Kind))&kindMask == 0 {
-		return true
+// isExportedName reports whether all the dot-separated
+// parts of a symbol name, as printed by list, are exported.
+func isExportedName(name string) bool {
+	for _, part := range strings.Split(name, ".") {
+		// Allow for a pointer receiver, as in (*T).M.
+		part = strings.TrimSuffix(strings.TrimPrefix(part, "(*"), ")")
+		if !isExported(part) {
+			return false
+		}
 	}
-	if info.Universe {
-		return true
+	return true
+}
+
+// visit prints the symbol s to buf if it is selected by the
+// flags and kindMask. If the gosym -runes flag is given, lines
+// is used to convert the columns of its positions to runes.
+// The doc comments of declarations are found using groups
+// (see specGroups), which is needed only with -doc or -format.
+// It returns an error if the symbol cannot be printed.
+func (c *listCmd) visit(buf *bytes.Buffer, lines lineTables, groups map[ast.Spec]*ast.GenDecl, s sym.Symbol, kindMask uint) error {
+	if s.Kind == ast.Bad {
+		// The kind of an unresolved reference (see
+		// sym.ImportFiles) is unknown, so it is listed
+		// if any kind but package names is.
+		if kindMask&^(1<<uint(ast.Pkg)) == 0 {
+			return nil
+		}
+	} else if (1<<c.kindBit(s))&kindMask == 0 {
+		return nil
 	}
-	if !c.all && !isExported(info.Ident.Name) {
-		return true
+	if s.Universe {
+		return nil
 	}
-	eposition := c.ctxt.position(info.Pos)
-	exprPkg := c.ctxt.positionToImportPath(eposition)
-	var referPkg string
-	if info.Universe {
-		referPkg = "universe"
-	} else {
-		referPkg = c.ctxt.positionToImportPath(c.ctxt.position(info.ReferPos))
+	if c.refPos != nil {
+		p := s.ReferPosition
+		p.Offset = 0
+		if !c.refPos[p] {
+			return nil
+		}
+	} else if !c.all && !isExported(s.Ident.Name) {
+		return nil
 	}
-	name := info.Ident.Name
-	if e, ok := info.Expr.(*ast.SelectorExpr); ok {
-		_, xt := types.ExprType(e.X, func(path string) *ast.Package {
-			return c.ctxt.Import(path)
-		})
-		//		c.ctxt.print("exprtype %s\n", pretty(e.X))
-		name = e.Sel.Name
-		switch xn := depointer(xt.Node).(type) {
-		case nil:
+	if !c.init && isInit(s.ReferObj) {
+		return nil
+	}
+	if c.defs && !s.Decl || c.uses && s.Decl {
+		return nil
+	}
+	if s.Name == "" {
+		if c.verbose {
+			e := s.Expr.(*ast.SelectorExpr)
+			c.ctxt.warnf(c.ctxt.position(e.Pos()), warnSource, "no type for %s", pretty(e.X))
+		}
+		return nil
+	}
+	if c.exported && !isExportedName(s.Name) {
+		return nil
+	}
+	if c.matchPat != nil && !c.matchPat.MatchString(s.Name) || c.excludePat != nil && c.excludePat.MatchString(s.Name) {
+		return nil
+	}
+	line := &symLine{
+		long:     true,
+		pos:      s.Position,
+		referPos: s.ReferPosition,
+		exprPkg:  c.shortener.shorten(s.Pkg),
+		referPkg: c.shortener.shorten(s.ReferPkg),
+		local:    s.Local,
+		kind:     s.Kind,
+		plus:     s.Decl,
+		expr:     s.Name,
+		offsets:  c.offset,
+	}
+	if c.enclosing || c.tmpl != nil {
+		line.enclosing = s.Enclosing
+	}
+	if (c.doc || c.tmpl != nil) && s.Decl {
+		line.doc, line.deprecated = docInfo(s.ReferObj, groups)
+	}
+	if *runes && !c.offset {
+		var err error
+		if line.pos, err = lines.runeColumn(line.pos); err == nil {
+			line.referPos, err = lines.runeColumn(line.referPos)
+		}
+		if err != nil {
+			return fmt.Errorf("%v: cannot count columns in runes: %v", s.Position, err)
+		}
+	}
+	if c.printType || c.tmpl != nil {
+		line.exprType = c.exprTypeString(s.Info)
+	}
+	if (c.values || c.tmpl != nil) && s.Kind == ast.Con {
+		v, err := types.ConstValue(s.Expr, c.ctxt.Import)
+		if err != nil {
 			if c.verbose {
-				log.Printf("%v: no type for %s", c.ctxt.position(e.Pos()), pretty(e.X))
+				c.ctxt.warnf(s.Position, warnSource, "no value for %s: %v", s.Name, err)
 			}
-			return true
-		case *ast.Ident:
-			name = xn.Name + "." + name
-		case *ast.ImportSpec:
-			// don't qualify with package identifier
+		} else {
+			line.value = v
+		}
+	}
+	if c.multi {
+		line.build = c.ctxt.platform
+		if !c.json && !c.firstSeen(s.Position) {
+			return nil
+		}
+	}
+	if c.tagsFmt != "" {
+		return c.printTag(buf, lines, s)
+	}
+	if c.tmpl != nil {
+		if err := c.tmpl.Execute(buf, line.templateData()); err != nil {
+			return fmt.Errorf("%v: cannot format symbol: %v", s.Position, err)
+		}
+		buf.WriteByte('\n')
+		return nil
+	}
+	if c.json {
+		data, err := json.Marshal(line.toJSON())
+		if err != nil {
+			return fmt.Errorf("%v: cannot encode symbol: %v", s.Position, err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+		return nil
+	}
+	text := line.String()
+	if c.enclosing {
+		enclosing := line.enclosing
+		if enclosing == "" {
+			enclosing = "-"
+		}
+		text += "\t" + enclosing
+	}
+	if c.doc {
+		text += "\t" + line.docStatus()
+	}
+	if c.context {
+		context, err := lines.context(s.Position, len(s.Ident.Name))
+		if err != nil {
+			return fmt.Errorf("%v: cannot find source line: %v", s.Position, err)
+		}
+		text += "\t" + context
+	}
+	fmt.Fprintf(buf, "%s\n", text)
+	return nil
+}
+
+// sortLines sorts the given lines, as printed by the list
+// command, by referenced package, name and kind, and then
+// by position.
+func sortLines(data []byte) ([]byte, error) {
+	var lines []listedLine
+	for _, text := range strings.SplitAfter(string(data), "\n") {
+		if text == "" {
+			continue
+		}
+		sl, err := parseSymLine(strings.TrimSuffix(text, "\n"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse line %q: %v", text, err)
+		}
+		lines = append(lines, listedLine{sl, text})
+	}
+	sort.Stable(listedLines(lines))
+	var buf bytes.Buffer
+	for _, l := range lines {
+		buf.WriteString(l.text)
+	}
+	return buf.Bytes(), nil
+}
+
+// uniqueLines returns the lines in data, as printed by the
+// list command, omitting all but one of the lines that refer
+// to each declaration: the declaration itself if it is listed,
+// or else the first use of it. The lines kept are in the order
+// they were in data. Any fields that follow a tab, as printed
+// with -context, -enclosing or -doc, are ignored.
+func uniqueLines(data []byte) ([]byte, error) {
+	var lines []listedLine
+	kept := make(map[token.Position]int) // index in lines of the line kept.
+	for _, text := range strings.SplitAfter(string(data), "\n") {
+		if text == "" {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimSuffix(text, "\n"), "\t", 2)
+		sl, err := parseSymLine(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse line %q: %v", text, err)
+		}
+		i, ok := kept[sl.referPos]
+		switch {
+		case !ok:
+			kept[sl.referPos] = len(lines)
+		case sl.plus && !lines[i].sl.plus:
+			// Keep the declaration instead of the use.
+			lines[i].text = ""
+			kept[sl.referPos] = len(lines)
 		default:
-			// literal struct or interface expression.
-			name = "_." + name
+			continue
 		}
+		lines = append(lines, listedLine{sl, text})
 	}
-	line := &symLine{
-		long:     true,
-		pos:      eposition,
-		referPos: c.ctxt.position(info.ReferPos),
-		exprPkg:  exprPkg,
-		referPkg: referPkg,
-		local:    info.Local && info.ReferPos == info.Pos,
-		kind:     info.ReferObj.Kind,
-		plus:     info.ReferPos == info.Pos,
-		expr:     name,
-	}
-	if c.printType {
-		line.exprType = pretty(info.ExprType.Node)
-	}
-	c.ctxt.printf("%s\n", line)
+	var buf bytes.Buffer
+	for _, l := range lines {
+		buf.WriteString(l.text)
+	}
+	return buf.Bytes(), nil
+}
+
+// unusedLines returns the lines in data, as printed by
+// the list command, that are declarations whose positions
+// are not referred to by any of the other lines.
+func unusedLines(data []byte) ([]byte, error) {
+	var lines []listedLine
+	used := make(map[token.Position]bool)
+	for _, text := range strings.SplitAfter(string(data), "\n") {
+		if text == "" {
+			continue
+		}
+		sl, err := parseSymLine(strings.TrimSuffix(text, "\n"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse line %q: %v", text, err)
+		}
+		if sl.plus {
+			lines = append(lines, listedLine{sl, text})
+		} else {
+			used[sl.referPos] = true
+		}
+	}
+	var buf bytes.Buffer
+	for _, l := range lines {
+		if !used[l.sl.pos] {
+			buf.WriteString(l.text)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// listedLine holds a line printed by the list command.
+type listedLine struct {
+	sl   *symLine
+	text string
+}
+
+type listedLines []listedLine
+
+func (l listedLines) Len() int      { return len(l) }
+func (l listedLines) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l listedLines) Less(i, j int) bool {
+	a, b := l[i].sl, l[j].sl
+	switch {
+	case a.referPkg != b.referPkg:
+		return a.referPkg < b.referPkg
+	case a.expr != b.expr:
+		return a.expr < b.expr
+	case a.kind != b.kind:
+		return a.kind < b.kind
+	case a.pos.Filename != b.pos.Filename:
+		return a.pos.Filename < b.pos.Filename
+	case a.pos.Line != b.pos.Line:
+		return a.pos.Line < b.pos.Line
+	case a.pos.Column != b.pos.Column:
+		return a.pos.Column < b.pos.Column
+	}
+	return a.pos.Offset < b.pos.Offset
+}
+
+// readRefs returns the set of declaration positions
+// named by the -refs flag value.
+func (ctxt *context) readRefs(refs string) (map[token.Position]bool, error) {
+	refPos := make(map[token.Position]bool)
+	add := func(p token.Position) {
+		if abs, err := filepath.Abs(p.Filename); err == nil {
+			p.Filename = abs
+		}
+		refPos[p] = true
+	}
+	if refs != "-" {
+		p, err := parsePosition(refs)
+		if err != nil {
+			return nil, err
+		}
+		lines := make(lineTables)
+		if *runes {
+			if p, err = lines.byteColumn(p); err != nil {
+				return nil, err
+			}
+		}
+		if p, err = lines.resolve(p); err != nil {
+			return nil, err
+		}
+		add(p)
+		return refPos, nil
+	}
+	err := ctxt.readLines(func(sl *symLine) error {
+		if sl.long {
+			add(sl.referPos)
+		} else {
+			add(sl.pos)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refPos, nil
+}
+
+// exprTypeString returns the type of the symbol
+// in info as printed by list -t. Methods are printed with
+// their receiver and name, as they are declared.
+func exprTypeString(info *sym.Info) string {
+	if fd, ok := info.ReferObj.Decl.(*ast.FuncDecl); ok && info.ReferObj.Kind == ast.Fun && fd.Recv != nil {
+		return pretty(&ast.FuncDecl{
+			Recv: fd.Recv,
+			Name: fd.Name,
+			Type: fd.Type,
+		})
+	}
+	return typeString(info.ExprType.Node)
+}
+
+// exprTypeString is like exprTypeString, but if the -expand
+// flag is given, a named type is printed as the type it is
+// defined as, for instance as a struct type with all its fields.
+func (c *listCmd) exprTypeString(info *sym.Info) string {
+	if c.expand {
+		if u := info.ExprType.Underlying(true, c.ctxt.Import); u.Node != nil {
+			expanded := *info
+			expanded.ExprType = u
+			info = &expanded
+		}
+	}
+	return exprTypeString(info)
+}
+
+// typeString returns the type t printed on one line. The
+// printer lays out struct and interface types with several
+// members according to their position in the source, which
+// does not apply to types taken from any file, so these are
+// printed here instead, with their members separated by
+// semicolons, as in struct{E; A int `json:"a"`; B, C string}.
+func typeString(t ast.Node) string {
+	if e, ok := t.(ast.Expr); ok {
+		t = flattenType(e)
+	}
+	return pretty(t)
+}
+
+// flattenType returns a copy of the type expression e in which
+// each struct or interface type is replaced by an identifier
+// holding its text as printed by typeString. Parts of e that
+// hold no such types are shared with it.
+func flattenType(e ast.Expr) ast.Expr {
+	switch e := e.(type) {
+	case *ast.StructType:
+		var fields []string
+		for _, f := range e.Fields.List {
+			text := fieldString(f, " ")
+			if f.Tag != nil {
+				text += " " + f.Tag.Value
+			}
+			fields = append(fields, text)
+		}
+		return &ast.Ident{Name: "struct{" + strings.Join(fields, "; ") + "}"}
+	case *ast.InterfaceType:
+		var methods []string
+		for _, f := range e.Methods.List {
+			methods = append(methods, fieldString(f, ""))
+		}
+		return &ast.Ident{Name: "interface{" + strings.Join(methods, "; ") + "}"}
+	case *ast.StarExpr:
+		return &ast.StarExpr{X: flattenType(e.X)}
+	case *ast.ParenExpr:
+		return &ast.ParenExpr{X: flattenType(e.X)}
+	case *ast.Ellipsis:
+		if e.Elt != nil {
+			return &ast.Ellipsis{Elt: flattenType(e.Elt)}
+		}
+	case *ast.ArrayType:
+		return &ast.ArrayType{Len: e.Len, Elt: flattenType(e.Elt)}
+	case *ast.MapType:
+		return &ast.MapType{Key: flattenType(e.Key), Value: flattenType(e.Value)}
+	case *ast.ChanType:
+		return &ast.ChanType{Dir: e.Dir, Value: flattenType(e.Value)}
+	case *ast.FuncType:
+		return &ast.FuncType{
+			Params:  flattenFields(e.Params),
+			Results: flattenFields(e.Results),
+		}
+	}
+	return e
+}
+
+// flattenFields returns a copy of the parameters or
+// results fl with their types flattened by flattenType.
+func flattenFields(fl *ast.FieldList) *ast.FieldList {
+	if fl == nil {
+		return nil
+	}
+	list := make([]*ast.Field, len(fl.List))
+	for i, f := range fl.List {
+		list[i] = &ast.Field{Names: f.Names, Type: flattenType(f.Type)}
+	}
+	return &ast.FieldList{List: list}
+}
+
+// fieldString returns the struct field or interface member f
+// as printed by typeString, with sep between its names and type;
+// a method is printed with its signature following its name.
+func fieldString(f *ast.Field, sep string) string {
+	typ := typeString(f.Type)
+	if len(f.Names) == 0 {
+		return typ
+	}
+	var names []string
+	for _, name := range f.Names {
+		names = append(names, name.Name)
+	}
+	if _, ok := f.Type.(*ast.FuncType); ok && sep == "" {
+		typ = strings.TrimPrefix(typ, "func")
+	}
+	return strings.Join(names, ", ") + sep + typ
+}
+
+// isInit reports whether obj represents an init function.
+func isInit(obj *ast.Object) bool {
+	fd, ok := obj.Decl.(*ast.FuncDecl)
+	return ok && obj.Kind == ast.Fun && fd.Recv == nil && fd.Name.Name == "init"
+}
+
+// firstSeen reports whether the symbol at the given
+// position has not been printed for any earlier platform.
+func (c *listCmd) firstSeen(pos token.Position) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.seen[pos]; ok && p != c.ctxt.platform {
+		return false
+	}
+	c.seen[pos] = c.ctxt.platform
 	return true
 }
 
@@ -150,31 +1419,100 @@ func depointer(x ast.Node) ast.Node {
 	return x
 }
 
+// Types are selected by the kind of their underlying type;
+// the bits in a kind mask for these kinds of type follow
+// those for the kinds of object.
+const (
+	interfaceBit = uint(ast.Lbl) + 1 + iota
+	structBit
+	otherTypeBit
+)
+
+// typeKinds holds the kinds of type that can be
+// named in a kind mask, with their bits.
+var typeKinds = map[string]uint{
+	"interface": interfaceBit,
+	"struct":    structBit,
+	"othertype": otherTypeBit,
+}
+
+// parseKindMask returns the kind mask selecting the comma-separated
+// kinds. The kind "all" stands for all the kinds listed by default
+// (see allKinds), and a kind with a leading "-" is removed from
+// those before it; if the first kind is removed, it is removed
+// from all the kinds, so that "-var" selects all but variables.
 func parseKindMask(kinds string) (uint, error) {
 	mask := uint(0)
-	ks := strings.Split(kinds, ",")
-	for _, k := range ks {
-		c, ok := objKinds[k]
-		if ok {
-			mask |= 1 << uint(c)
+	for i, k := range strings.Split(kinds, ",") {
+		negate := strings.HasPrefix(k, "-")
+		if negate {
+			k = k[1:]
+			if i == 0 {
+				mask, _ = parseKindMask(allKinds())
+			}
+		}
+		var bits uint
+		if k == "all" {
+			bits, _ = parseKindMask(allKinds())
+		} else if bit, ok := typeKinds[k]; ok {
+			bits = 1 << bit
+		} else if c, ok := objKinds[k]; ok && c == ast.Typ {
+			// Types are selected only by their kind of type.
+			for _, bit := range typeKinds {
+				bits |= 1 << bit
+			}
+		} else if ok {
+			bits = 1 << uint(c)
 		} else {
 			return 0, fmt.Errorf("unknown type kind %q", k)
 		}
+		if negate {
+			mask &^= bits
+		} else {
+			mask |= bits
+		}
 	}
 	return mask, nil
 }
 
+// kindBit returns the bit in a kind mask that
+// selects the symbol s.
+func (c *listCmd) kindBit(s sym.Symbol) uint {
+	if s.Kind != ast.Typ {
+		return uint(s.Kind)
+	}
+	if s.Universe && s.Name == "error" {
+		// The predeclared error type has no declaration
+		// to find its underlying type from.
+		return interfaceBit
+	}
+	switch s.ExprType.Underlying(true, c.ctxt.Import).Node.(type) {
+	case *ast.InterfaceType:
+		return interfaceBit
+	case *ast.StructType:
+		return structBit
+	}
+	return otherTypeBit
+}
+
 var objKinds = map[string]ast.ObjKind{
-	"const": ast.Con,
-	"type":  ast.Typ,
-	"var":   ast.Var,
-	"func":  ast.Fun,
+	"const":   ast.Con,
+	"type":    ast.Typ,
+	"var":     ast.Var,
+	"func":    ast.Fun,
+	"package": ast.Pkg,
 }
 
+// allKinds returns the kinds of symbol listed by default.
+// Package names are local to each file, and are
+// listed only if asked for.
 func allKinds() string {
 	var ks []string
-	for k := range objKinds {
-		ks = append(ks, k)
+	for k, kind := range objKinds {
+		if kind != ast.Pkg {
+			ks = append(ks, k)
+		}
 	}
+	sort.Strings(ks)
 	return strings.Join(ks, ",")
 }
@@ -6,11 +6,13 @@
 // The short command reads lines from standard input
 // in short or long format (see the list command) and
 // prints them in short format:
-// 	file-position name new-name
+// 	file-position name new-name [local]
 // The file-position field holds the location of the identifier.
 // The name field holds the name of the identifier (in X.Y format if
 // it is defined as a member of another type X).
 // The new-name field holds the desired new name for the identifier.
+// The word local follows if the identifier refers to a
+// function-local object.
 // 
 // gosym export
 // 
@@ -53,32 +55,440 @@
 // prints (in long format) any definitions found in the named packages that
 // have no references to them from any other package.
 // 
-// gosym list [flags] [pkg...]
+// gosym list [flags] [pkg|file...]
 // 
 // The list command prints a line for each identifier
 // used in the named packages. Each line printed has at least 6 space-separated fields
 // in the following format:
 // 	file-position referenced-file-position package referenced-package name type-kind
 // This format is known as "long" format.
-// If no packages are named, "." is used.
+// If no packages are named, "." is used. Package patterns
+// containing "..." are expanded as with the go tool.
+// The packages are printed in the order they are named, and
+// the symbols in each package are printed in order of their
+// position in the source; if the -sort flag is given, all
+// the lines are instead sorted by referenced package, name
+// and type kind.
 // 
 // The file-position field holds the location of the identifier.
 // The referenced-file-position field holds the location of the
-// definition of the identifier.
+// definition of the identifier, so that each use can be
+// linked to its declaration, as a cross-reference index needs.
+// Predeclared identifiers, such as int and len, have no
+// declaration and are not printed.
+// Identifiers predeclared by a particular compiler, such as
+// intrinsic functions, can be added to them with the gosym
+// -predeclared flag, so that they are resolved instead of
+// reported as undefined. It takes a comma-separated list of
+// names, each preceded by its kind (func, type, const or var)
+// and a colon unless it is a function, as in:
+// 	gosym -predeclared type:float16,const:maxAlign,prefetch list
 // The package field holds the path of the package containing the identifier.
 // The referenced-package field holds the path of the package
 // where the identifier is defined.
 // The name field holds the name of the identifier (in X.Y format if
-// it is defined as a member of another type X).
+// it is defined as a member of another type X). A method is named by
+// its receiver type, as in T.M or (*T).M, and a field by the type
+// that declares it, alike at its declaration and its uses.
 // The type-kind field holds the type class of identifier (const,
-// type, var or func), and ends with a "+" sign if this line
+// type, var, func or package), and ends with a "+" sign if this line
 // marks the definition of the identifier.
-//   -a=false: print internal and universe symbols too
-//   -k="type,const,var,func": kinds of symbol types to include
+// It starts with "local" if the identifier refers to a
+// function-local object, such as a parameter or a variable
+// declared inside a function, so that a local symbol can be
+// told apart from a global one with the same name that it
+// shadows.
+// If the -t flag is given, the type of the identifier follows
+// the type-kind field. Methods are printed with their receiver
+// and name, as they are declared. Struct and interface types
+// are printed on one line, with their members, including any
+// field tags, separated by semicolons, as in struct{E; A, B int}.
+// A named type is printed as its name unless the -expand flag
+// is given, in which case it is printed as the type it is
+// defined as, so that the fields of a variable of a named
+// struct type are shown.
+// If the -values flag is given, the value of each constant
+// follows, after an "=" sign, as in "const+ Mode = 4".
+// Integer, rune, string and boolean constants are evaluated,
+// including those declared with iota; no value is printed for
+// other constants (the -v flag reports why).
+//
+// The -k flag may be repeated, and its lists of kinds are
+// joined. The kind all stands for all the kinds listed by
+// default, and a kind with a leading "-" is removed from those
+// before it, so -k all -k -var (or just -k -var) lists all but
+// variables. If no -k flag is given, all is assumed. The -K flag,
+// which may also be repeated, names kinds to exclude from those
+// selected by -k, so -K func,var lists all but functions and
+// variables, and -k type -K interface lists all but interface
+// types.
+//
+// The -k flag may also name the kinds of type interface, struct
+// and othertype, as in -k interface, to select only the types
+// whose underlying type is an interface, a struct or any other
+// type respectively; the type kind includes all three. The
+// type-kind field holds "type" for each of them.
+//
+// Package names, which refer to the imports of the file
+// they are in, are printed only if the -k flag includes
+// the package kind, as in -k package.
+//
+// If the -exported flag is given, only symbols with exported
+// names are printed; a name in X.Y format is counted as
+// exported only if both X and Y are exported.
+//
+// If the -match flag is given, only symbols whose names
+// match the given regular expression are printed, and if the
+// -exclude flag is given, only those whose names do not match
+// it; a name in X.Y format is matched as a whole, as printed.
+// For example, this prints the declarations of the test
+// functions of a package, except those whose names end in Slow:
+// 	gosym list -k func -defs -match '^Test' -exclude 'Slow$'
+//
+// If the -offset flag is given, file positions are printed
+// as byte offsets, in file:#offset format, instead of as lines
+// and columns. Commands that read lines accept positions
+// in either format.
+//
+// Columns are counted in bytes, as by the Go tools. If the
+// gosym -runes flag is given, columns are instead counted in
+// runes, as by many editors, both in the lines printed by all
+// commands and in those read by them. The flag makes no
+// difference to byte offsets, nor to lines that contain
+// only ASCII text.
+//
+// If the -context flag is given, each line is followed by a tab
+// and the line of source containing the symbol, with space
+// trimmed from both ends and the identifier marked
+// as in «name». Lines printed with -context cannot be read
+// by other commands. The -context flag cannot be used
+// with the -json, -format or -baseline flags.
+//
+// If the -enclosing flag is given, each line is followed by a
+// tab and the name of the top-level declaration containing the
+// symbol: a function, as in F, a method, as in T.M or (*T).M,
+// or a type, or "-" for a symbol outside any of them. Symbols
+// inside function literals and types declared in a function
+// are counted as in that function. With -json, the name is
+// instead held in the enclosing field. Lines printed with
+// -enclosing and without -json cannot be read by other commands.
+// If -context is given too, the source line follows the name.
+// The -enclosing flag cannot be used with the -format or
+// -baseline flags.
+//
+// If the -doc flag is given, each line is followed by a tab
+// and the documentation status of the symbol: for a declaration,
+// "doc" if it has a doc comment, "nodoc" if it has none, or
+// "deprecated" if its doc comment has a line starting
+// "Deprecated:", and for any other symbol, "-". A declaration
+// in a parenthesized group that has no comment of its own is
+// documented by the comment of the group. With -json, the
+// status is instead held in the documented and deprecated
+// fields. For example, this prints the exported declarations
+// of a package that are not documented:
+// 	gosym list -defs -doc | grep 'nodoc$'
+// The status follows the name printed with -enclosing and
+// precedes the source line printed with -context. Lines printed
+// with -doc and without -json cannot be read by other commands.
+// The -doc flag cannot be used with the -format or -baseline
+// flags.
+//
+// If the -short flag is given, the package and referenced-package
+// fields are shortened for reading: with -short=., the paths of
+// the package in the current directory and of those below
+// it are printed relative to it, as "." or as in ./sub, and
+// with -short=n, only the last n elements of each path are
+// printed.
+// As shortened paths may be ambiguous, lines printed with
+// -short should not be read by the used or unused commands.
+//
+// If the -json flag is given, each line is instead printed
+// as a JSON object holding the same fields. Lines in this
+// form are also accepted by commands that read long format.
+//
+// If the -format flag is given, each line is instead printed
+// by executing it as a template (see text/template) with
+// the fields Pos, ReferPos, ExprPkg, ReferPkg, Expr, Kind,
+// Local, Universe, Plus, ExprType, Value, Build, Enclosing,
+// Documented and Deprecated, which hold the fields of the line
+// as printed with -json, with positions
+// formatted as they are in long format, for example:
+// 	gosym list -format '{{.Pos}},{{.Expr}},{{.Kind}}'
+// The type, value, enclosing declaration and documentation
+// status of the symbol are provided whether or not the -t,
+// -values, -enclosing and -doc flags are given.
+// The -format flag cannot be used with
+// the -json or -sort flags.
+//
+// If several target platforms are given (see the gosym -os
+// and -arch flags), each symbol is printed once only, unless
+// -json is given, in which case the symbols for each platform
+// are printed in turn, labelled with the platform. A file that
+// the build constraints leave out for every target platform,
+// such as one for windows only when listing for linux, is
+// reported with a warning, as none of its symbols are printed.
+//
+// If the -file flag is given, only the symbols in the named
+// file are printed; the flag may be repeated to name several
+// files. Go source files may also be named instead of packages,
+// with the same effect. The whole of each package is still
+// read, so that references between its files are resolved.
+// If only files are named, the packages containing them are
+// listed.
+//
+// A named file that is not part of the package in its
+// directory, such as a script excluded by its build
+// constraints or a file in a directory outside GOPATH that
+// holds other packages, is listed on its own, together with
+// any other such files, as the package command-line-arguments,
+// as the go tool does. As its imports often cannot be found,
+// its references to members of packages that cannot be found
+// are printed too, with the position of the import as the
+// referenced position, "?" as the referenced package, and
+// "bad" as the type-kind. They are printed whenever any kind
+// of symbol but package names is.
+//
+// Generated files, marked by a comment of the form
+// 	// Code generated ... DO NOT EDIT.
+// before the package clause, are skipped unless the gosym
+// -generated flag is given or they are named explicitly.
+//
+// Outside modules, imports are resolved as the go tool
+// resolves them, so a package in a vendor directory is
+// found in preference to one elsewhere when the vendor
+// directory is in the importing package's directory or a
+// directory above it. A vendored package is printed with
+// its full import path, including the vendor directory.
+//
+// Files and directories matched by the patterns in a
+// .gosymignore file are skipped by all commands, both when
+// packages are found for patterns containing "..." and when
+// the files of a package are read, unless the gosym -noignore
+// flag is given. The file is looked for in the current directory
+// and then in each directory above it; only the first found
+// is used. As in a .gitignore file, each line holds a pattern,
+// and blank lines and lines starting with "#" are ignored.
+// A pattern starting with "!" includes again the files
+// matched by an earlier pattern, and one ending in "/" matches
+// only directories. A pattern holding any other "/" is matched
+// against the path relative to the directory of the .gosymignore
+// file, and any other pattern against the name of each file and
+// directory at any depth below it. In a pattern, "*" matches
+// any sequence of characters other than "/", and "**" any
+// sequence of path elements, as in:
+// 	# Skip generated parsers and the old copies of the API.
+// 	*_yacc.go
+// 	/internal/**/old/
+//
+// If the gosym -depth flag is given, a package pattern
+// containing "..." matches only the packages at most the given
+// number of directory levels below the directory that the
+// pattern starts from; with -depth 0, for instance, ./...
+// matches the package in the current directory only, and
+// foo/... the package foo only. Unlike .gosymignore files,
+// the flag does not limit the importing packages that write
+// finds to change (see its -scope flag).
+//
+// If the -refs flag is given, only references to the declaration
+// at the given file position (in file:line:column or file:#offset
+// format) are printed, whether they are exported or not. If the
+// position is "-", the declarations are read from the standard
+// input instead, as lines in any of the formats printed by gosym;
+// the referenced-file-position field of each line in long format
+// is used, and the file-position field of each line in short format.
+//
+// If the -decl flag is given, no packages are listed; instead,
+// the position of the declaration of the named symbol is printed,
+// followed by its type if the -t flag is given. The symbol is named
+// in pkg.Name format, where pkg is an import path, or in pkg.T.M
+// or pkg.(*T).M format for a field or method M of type T,
+// for example:
+// 	gosym list -t -decl 'bufio.(*Reader).ReadLine'
+//
+// If the -server flag is given, queries are read from the
+// standard input, one per line, and the response to each is
+// printed followed by an empty line, so that an editor can
+// keep gosym running and avoid reading the same packages
+// again for each query. A query is of the form
+// 	def target
+// which prints the declaration of the target symbol as for
+// the -decl flag, or
+// 	refs target
+// which lists the references to the target symbol in the
+// named packages as for the -refs flag. The target is either
+// the file position of any identifier referring to the symbol
+// (in file:line:column or file:#offset format, at any character
+// of the identifier), or a name as accepted by -decl.
+// If a query fails, the response is a single line
+// starting "error:". The packages are read only once,
+// so any changes made to their source while gosym
+// is running are not seen. The -server flag cannot be
+// used with the -decl, -refs, -baseline or -sort flags.
+//
+// If the -defs flag is given, only declarations (the lines
+// marked with "+") are printed; if the -uses flag is given,
+// only the other lines are printed.
+//
+// If the -tags-format flag is given, the declarations are
+// printed as a tags file for editors, in ctags format (sorted
+// by name, each with its line number and kind) or in etags
+// format. The ctags kinds are c for constants, v for variables,
+// f for functions and methods, s for struct types, i for
+// interface types, t for other types, m for struct fields and
+// interface methods, and p for package names; methods, fields
+// and interface methods have a "type" field naming the type
+// they belong to. The -tags-format flag cannot be used with
+// the -json, -format, -sort, -uses, -unused, -baseline, -decl
+// or -server flags.
+//
+// If the -graph flag is given, no symbols are printed; instead,
+// the references between packages made by the symbols listed
+// are printed as a graph, in the given format: "edges" prints a
+// line for each pair of packages, holding the package making
+// the references, the package referred to and the number of
+// references, as in:
+// 	example.com/foo example.com/bar 12
+// and "dot" prints the same graph for Graphviz's dot command,
+// with the number of references as the weight and label of
+// each edge. References to the universe are omitted, as are
+// references within a package unless the -graph-self flag is
+// given. The -graph flag cannot be used with the -json, -format,
+// -sort, -defs, -unused, -unique, -baseline, -tags-format,
+// -shadow, -decl or -server flags.
+//
+// If the -unused flag is given, only the declarations that
+// are not referred to by any of the symbols listed are printed,
+// which can help to find dead code. As a declaration is
+// counted as used only if one of its uses is listed, all
+// the packages that might use it should be named, and
+// it should be used with -a to find unused internal
+// symbols. The -unused flag cannot be used with the
+// -defs, -uses, -format or -baseline flags.
+//
+// If the -unique flag is given, only one line is printed for
+// each declaration referred to by the symbols listed: the line
+// for the declaration itself if it is listed, or else the first
+// line that refers to it, so that a listing of many uses is
+// reduced to the set of distinct symbols they refer to, as in:
+// 	gosym list -unique -uses ./...
+// The lines kept are printed in the order they would otherwise
+// be. The -unique flag cannot be used with the -format, -unused,
+// -baseline, -tags-format, -decl or -server flags.
+//
+// If the -shadow flag is given, no symbols are printed; instead,
+// a line is printed for each local declaration, such as a
+// variable or parameter, that shadows a package imported by its
+// file or a package-level declaration of its package, which
+// cannot then be referred to where the local is in scope. Each
+// line holds the position of the local declaration, its name and
+// what it shadows, with the position of the import or declaration,
+// as in:
+// 	p.go:12:2: json shadows import of "encoding/json" at p.go:4:2
+// The -shadow flag cannot be used with the -json, -format,
+// -sort, -unused, -baseline, -tags-format, -refs, -decl or
+// -server flags.
+//
+// If the -internal-check flag is given, no symbols are printed;
+// instead, a line is printed for each name taken from an
+// internal package, as in b.F, by a package that may not import
+// it. Members reached through a value of one of its types, as in
+// pub.New().M(), are not counted, as the package that returns
+// the value may import the internal one.
+// A package whose import path has an element named "internal"
+// may be imported only by the packages whose paths begin with
+// the path before that element, or by any package in its source
+// tree if there is none. Each line holds the position of the use,
+// its name, the internal package with the position of the
+// declaration, and the path outside which it is used, as in:
+// 	p.go:9:4: F in internal package "a/internal/b" at b.go:3:6 is used outside "a"
+// The -internal-check flag cannot be used with the -json,
+// -format, -sort, -unused, -unique, -baseline, -tags-format,
+// -graph, -shadow, -refs, -decl or -server flags.
+//
+// If the -baseline flag is given, the declarations found are
+// compared with those in the named file, which holds the output
+// of an earlier list command, and only the differences are
+// printed, sorted by package and name. Each line is prefixed
+// with "added", "removed" or "changed". Declarations are matched
+// by package and name, and a declaration has changed if its
+// kind or type differs; the kind and type it had in the
+// baseline follow "was" at the end of the line. Types are
+// compared only if the baseline was saved with the -t flag;
+// otherwise it should be saved with the same flags, as in:
+// 	gosym list -t -exported ./... > api.txt
+// 	gosym list -exported -baseline api.txt ./...
+// If any declaration was removed or changed, gosym exits with
+// an error. The -baseline flag cannot be used with the -json
+// or -format flags.
+//
+// The output for each package is cached on disk, and reused
+// while none of the package's source files, nor those of any
+// package it imports, have changed. The gosym -nocache flag
+// disables the cache, as does the gosym -maxunresolved flag,
+// because it needs every symbol to be resolved again, and so does
+// the gosym -overlay flag (see the write command). Nor is the
+// cache used while warnings about the source are printed, as
+// they would not be printed again for a package taken from
+// it, so it is used only with gosym -v=false or -warnings=quiet.
+//
+// The gosym -stats flag prints to the standard error the number
+// of packages parsed and symbols resolved, the time taken by each
+// and the proportion of imports found already parsed. As packages
+// whose output is taken from the cache are not read, it should
+// be used with -nocache to see what listing them all costs.
+//
+// Files that cannot be parsed, such as those using syntax that
+// gosym does not understand, are left out of their packages,
+// with a warning giving the position of the first error in each,
+// and the rest of each package is read without them. Unless the
+// gosym -v flag is false, the files left out are listed again
+// when the command finishes, with those positions, as in:
+// 	gosym: 2 files skipped as they could not be parsed:
+// 	gosym: 	/go/src/p/iter.go:18:30
+// 	gosym: 	/go/src/p/seq.go:7:12
+//
+// The gosym -warnings flag sets how warnings are printed to the
+// standard error: as text (the default); as JSON objects, one to
+// a line, with pos, category and msg fields (json); or not at all
+// (quiet). The skipped files are listed again in text mode only.
+// Whatever the mode, the warnings about source that cannot be
+// found, parsed or resolved are dropped if the -v flag is false.
+//   -K=: kinds of symbol types to exclude (may be repeated)
+//   -a=false: print internal symbols too
+//   -baseline="": print the differences from the declarations listed in this file
+//   -context=false: print the source line containing each symbol
+//   -decl="": print only the declaration position of this symbol
+//   -defs=false: print only declarations
+//   -doc=false: print whether each declaration is documented or deprecated
+//   -enclosing=false: print the function or type declaration containing each symbol
+//   -expand=false: print named types as the types they are defined as
+//   -exclude="": do not print symbols whose names match this regular expression
+//   -exported=false: print only symbols with exported names
+//   -file=: print only symbols in this file (may be repeated)
+//   -format="": print each symbol with this template
+//   -graph="": print the references between packages as a graph in this format (dot or edges)
+//   -graph-self=false: include references within a package in the -graph output
+//   -init=true: print init functions (only with -a)
+//   -internal-check=false: print uses of internal packages that their packages may not import
+//   -j=GOMAXPROCS: number of packages to process concurrently
+//   -json=false: print symbols as JSON objects, one per line
+//   -k=: kinds of symbol types to include (may be repeated; default all)
+//   -match="": print only symbols whose names match this regular expression
+//   -offset=false: print file positions as byte offsets
+//   -refs="": print only references to the declaration at this position ("-" for stdin)
+//   -server=false: answer queries read from the standard input
+//   -shadow=false: print local declarations that shadow imports or package-level declarations
+//   -short="": shorten package paths: "." for paths relative to the current directory, or n to keep the last n elements
+//   -sort=false: sort all symbols by referenced package, name and kind
 //   -t=false: print symbol type
+//   -tags-format="": print declarations as a tags file in this format (ctags or etags)
+//   -unique=false: print only one line for each declaration referred to
+//   -unused=false: print only declarations with no uses
+//   -uses=false: print only uses of symbols, not their declarations
 //   -v=false: print warnings about undefined symbols
+//   -values=false: print the values of constants
 // 
-// gosym write [pkg...]
+// gosym write [flags] [pkg...]
 // 
 // The gosym command reads lines in short format (see the
 // "short" subcommand) from its standard input
@@ -87,18 +497,229 @@
 // at each line's file-position (and all uses of it) is changed to the new-name
 // field.
 // 
-// If no packages are named, "." is used. No files outside the named packages
-// will be changed. The names of any changed files will
-// be printed.
+// If the -i flag is given, the lines are read from the named
+// file instead of the standard input, which is ignored.
+//
+// The -rename flag, which may be repeated, renames a symbol
+// without any input lines: its value, as in
+// 	-rename example.com/foo.Bar=Baz
+// names the symbol in pkg.Name, pkg.T.M or pkg.(*T).M format,
+// as for list -decl, followed by its new name. The symbol is
+// changed as if it were named by an input line at its
+// declaration, along with all the references to it in the
+// named packages and the package that declares it, which is
+// changed even if it is not named. A name that does not
+// resolve to exactly one symbol is reported as an error, and
+// no files are changed. When -rename is given, the standard
+// input is not read, but the lines in the file named by -i,
+// if given, are applied too.
+//
+// A large change can be made in two steps. If the -plan-out flag
+// is given, no files are changed; instead, the changes are
+// written to the named file as input lines, one for each
+// identifier changed, including every reference to a renamed
+// symbol, sorted by position. When the plan has been reviewed,
+// the -plan-in flag applies it: only the identifiers at its
+// lines are changed, with no symbols resolved again, and only
+// the packages holding them are read, so no packages may be
+// named. A line whose identifier no longer has its name, as
+// when the files have changed since the plan was made, is
+// reported as a conflict. Flags that change other text, such
+// as -fiximports and -retag, must be given again when the
+// plan is applied. The -plan-out flag cannot be used with the
+// -n flag, and the -plan-in flag cannot be used with the -i,
+// -rename or -scope flags.
+//
+// A line that ends with the word local (see the short
+// command) requests a change only to the function-local
+// symbol at its file-position, and uses of it; if that
+// symbol is not local, the change is reported as a conflict
+// instead of being made.
+//
+// The parameters of a function literal, such as the i and j
+// of a func(i, j int) bool passed to sort.Slice, and the
+// locals declared in it, are local to the literal, so
+// renaming one changes none of the same-named symbols of
+// other functions. A new name collides with the locals
+// declared in the literal, and with those declared outside
+// it that the literal refers to, but not with those of the
+// rest of the function containing it.
+// 
+// Two lines may give the same file-position only if they
+// name different symbols, in which case each applies only to
+// the identifier with its name.
+//
+// If the new name is qualified by an import path (for
+// instance example.com/foo.Bar), references to the symbol
+// through a package qualifier are changed to refer to that
+// package instead, and it is imported where necessary.
+// Unqualified references to it are qualified by the package,
+// and references within that package lose their qualifier.
+// The symbol's declaration cannot be moved, and is left
+// unchanged, with a warning, as are references that cannot
+// be qualified, such as local symbols and method receivers.
+// A change that would make a package
+// import itself, directly or through the packages it imports
+// (including imports added by other changes), is reported
+// as a conflict, along with the cycle of imports, instead
+// of being made.
+//
+// A package name (as printed by list -k package) may be
+// changed too, which changes the name of the import that it
+// refers to, and of all the references to it, in its file only.
+// The import is given an explicit name unless the new name is
+// the name of the package itself, in which case any explicit
+// name is removed. A new name that is already used by another
+// import in the file, by a package-level declaration or by a
+// local declaration in a function that uses the package name
+// is reported as a collision.
+//
+// If no packages are named, "." is used. Package patterns
+// containing "..." are expanded as with the go tool.
+// No files outside the named packages and the packages that
+// import them (see below) will be changed. The names of any
+// changed files will be printed.
+//
+// The packages that import the packages of the input lines,
+// directly or through other packages, are changed too, so that
+// all the references to a renamed exported symbol are changed
+// along with its declaration. They are looked for below the root
+// of the source tree holding each package of the input lines:
+// the directory of its module or, outside modules, the src
+// directory of its GOPATH entry. If the -scope flag is given,
+// they are looked for at or below the given directory instead,
+// and importing packages elsewhere are left unchanged.
+//
+// Generated files (see the list command) are not changed
+// unless the gosym -generated flag is given; a warning is
+// printed for each generated file that the changes would
+// otherwise have reached, as the renaming is incomplete there.
+// Nor are the files that the build constraints leave out
+// for every target platform (see the gosym -os, -arch and
+// -tags flags), each of which is reported with a warning.
+//
+// If the -skipvendor flag is given, vendored packages are
+// treated as external: a line that names a symbol declared
+// in one is reported as a conflict, and their files are not
+// changed, with a warning for each that the changes would
+// otherwise have reached.
+//
+// If the -n flag is given, no files are changed; instead
+// a unified diff of the changes is printed.
+//
+// If the gosym -overlay flag is given, the source files are
+// read as replaced by the overlay in the named file, which holds
+// a JSON object in the format used by the go tool's -overlay
+// flag, as in:
+// 	{"Replace": {"a.go": "/tmp/staged/a.go", "old.go": ""}}
+// Each file named as a key is read from the file it maps to, or
+// is treated as missing if that is empty, so that, for instance,
+// a pre-commit hook can check the staged contents of the files
+// without writing them out. As the files on disk are not those
+// read, the -n flag must be given too, and the diff printed is
+// between the overlaid contents and the changed ones.
+//
+// If any requested changes conflict with one another, the
+// command fails after making the other changes; if the -strict
+// flag is given, no files are changed at all. A change that
+// would make a symbol collide with another symbol of the same
+// name is reported as a warning, or as a conflict if -strict
+// is given. A new name that is predeclared, such as len or
+// error, counts as such a collision, as the symbol would hide
+// the predeclared one; a new name that is a keyword is always
+// reported as a conflict, as is a line that names the blank
+// identifier, _, either as the symbol or as its new name.
+// A file whose symbols cannot all be visited, because the
+// command panics part way through it (see -failfast), is also
+// reported as a conflict and left unchanged.
+//
+// Input lines that cannot be parsed are reported along with
+// their line numbers, and the command fails after making the
+// changes requested by the other lines, unless -strict is
+// given, in which case no files are changed.
+//
+// Before any change is made, each input line is checked
+// against the source. A line whose file-position holds no
+// symbol, or holds an identifier other than the one the
+// line names, is reported as a conflict and ignored, so
+// that stale or hand-edited input cannot change the wrong
+// identifiers; if -strict is given, no files are changed.
+// A line may also be given as printed by list -json, with
+// the new name added as its newExpr field; the symbol it
+// addresses must then also have the line's kind, and the
+// identifier be in its exprPkg package, which may be
+// shortened as by list -short with a number.
+//
+// If the -ignorecase flag is given, a line also applies to an
+// identifier whose name differs from the one it gives only in
+// case, so that, for instance, the line
+// 	p.go:3:5: FOO Foo
+// changes the identifier foo at that position to Foo, which can
+// be used to enforce naming conventions. An identifier that
+// already has the new name is left unchanged, and a change
+// that would make it collide with another identifier is
+// reported as for any other change.
+//
+// When a method is renamed, any methods that must change
+// with it so that a type declared in the named packages (or
+// the packages of the input lines) still implements an
+// interface declared there are renamed too, and the interfaces
+// involved are reported. Methods are matched by name and
+// signature.
+// 
+// If the -fiximports flag is given, imports that are no
+// longer used in a changed file (for instance because
+// the package qualifier of the only reference to them
+// has changed) are removed from it.
+// 
+// If the -retag flag is given, when a struct field is renamed,
+// any values in its tag that name the field by its old name
+// (for instance json:"Old,omitempty") are changed to name
+// it by its new name.
+// 
+// The changed files are written only when all of them have
+// been formatted, and each is written to a temporary file
+// that replaces the original only when all the others have
+// been written too, so an error part way through leaves
+// the files unchanged.
+// Each file keeps its permissions and, if most of its lines
+// end in CRLF, its line endings. A file that is a symbolic
+// link stays one, and the file it links to is changed.
 // 
 // As with gofix, writes are destructive - make sure your
 // source files are backed up before using this command.
+//   -fiximports=false: remove imports left unused by the changes
+//   -i="": read the input lines from this file instead of stdin
+//   -ignorecase=false: match the names in input lines to identifiers regardless of case
+//   -n=false: print a diff of the changes instead of writing them
+//   -plan-in="": change only the identifiers at the lines of the plan in this file
+//   -plan-out="": write the changes to this file as input lines instead of making them
+//   -rename=: rename the symbol pkg.Name to NewName (pkg.Name=NewName); may be repeated
+//   -retag=false: change struct tag values that name a renamed field
+//   -scope="": change only the importing packages at or below this directory
+//   -skipvendor=false: treat vendored packages as external, leaving them unchanged
+//   -strict=false: do not change any files if there are conflicts
+//
+// Exit status
+//
+// The gosym command exits with status 0 if it succeeds, and
+// otherwise with one of the following, chosen so that scripts
+// can tell the outcomes apart:
+// 	1: the command failed for some other reason
+// 	2: the command line was invalid
+// 	3: a named package could not be found
+// 	4: more symbols were unresolved than -maxunresolved allows
+// 	5: some of the changes asked of the write command were
+// 	   not made, because of conflicts or because the files
+// 	   could not be formatted or written
+// When more than one applies, the highest status is used.
 package main
 
 import (
 	"bufio"
 	"bytes"
 	"code.google.com/p/rog-go/exp/go/ast"
+	"code.google.com/p/rog-go/exp/go/parser"
 	"code.google.com/p/rog-go/exp/go/printer"
 	"code.google.com/p/rog-go/exp/go/sym"
 	"code.google.com/p/rog-go/exp/go/token"
@@ -106,38 +727,58 @@ import (
 	"flag"
 	"fmt"
 	"go/build"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
+	"time"
+	"unicode"
 )
 
-// TODO allow changing of package identifiers too.
-
 // CAVEATS:
-// - map keys are not properly resolved.
-// - no declaration for init
-// - identifer in a type switch probably doesn't work properly.
+// - the keys of composite literals whose type cannot be determined are not resolved.
 // - type names embedded in structs or interfaces don't rename properly.
-// - import to . is not supported.
-// - test files are not dealt with properly.
-// - can't change package identifiers
-// - there's no way to give an error if renaming creates a
-//	clash of symbols.
-// - conditional compilation not supported
+// - symbols imported to . are renamed without qualification.
+// - external test packages are only dealt with when -tests is given.
+// - generated files are only dealt with when -generated is given.
 
 var verbose = flag.Bool("v", true, "print warning messages")
+var warnings = flag.String("warnings", "text", "print warnings as text, as JSON objects (json), or not at all (quiet)")
+var tests = flag.Bool("tests", false, "include external test packages (package foo_test)")
+var buildTags = flag.String("tags", "", "comma-separated list of build tags to consider satisfied")
+var buildOS = flag.String("os", "", "comma-separated list of target operating systems (default $GOOS)")
+var buildArch = flag.String("arch", "", "comma-separated list of target architectures (default $GOARCH)")
+var noCache = flag.Bool("nocache", false, "do not use the on-disk cache of package listings")
+var generated = flag.Bool("generated", false, "include generated files (marked \"Code generated ... DO NOT EDIT.\")")
+var runes = flag.Bool("runes", false, "count the columns of file positions in runes instead of bytes")
+var failFast = flag.Bool("failfast", false, "stop at the first panic instead of skipping the file that caused it")
+var noIgnore = flag.Bool("noignore", false, "do not skip the files matched by .gosymignore files")
+var maxDepth = flag.Int("depth", -1, "expand package patterns containing \"...\" to at most this many directory levels below the pattern's directory (-1 for no limit)")
+var overlayFile = flag.String("overlay", "", "read the source files replaced in this JSON file instead, as for the go tool's -overlay flag")
+var printStats = flag.Bool("stats", false, "print the time spent parsing and resolving, and other statistics, to stderr")
+var predeclared = flag.String("predeclared", "", "comma-separated list of extra predeclared identifiers, as kind:name (kind func, type, const or var; func if omitted)")
+var maxUnresolved = flag.String("maxunresolved", "", "fail if more symbols than this, or than this percentage (e.g. 5%), are unresolved")
+
+// ignore holds the patterns of the files that are skipped,
+// or nil if there are none.
+var ignore *ignorer
+
+// overlayFiles holds the overlay read from the file
+// named by the -overlay flag, or nil if there is none.
+var overlayFiles overlay
 
 func main() {
 	printf := func(f string, a ...interface{}) { fmt.Fprintf(os.Stderr, f, a...) }
 	flag.Usage = func() {
-		printf("usage: gosym [-v] command [flags] [args...]\n")
+		printf("usage: gosym [-v] [-warnings mode] [-tests] [-tags tags] [-os os] [-arch arch] [-nocache] [-maxunresolved n] [-predeclared ids] [-overlay file] [-stats] [-generated] [-noignore] [-depth n] [-runes] [-failfast] command [flags] [args...]\n")
 		printf("%s", `
 Gosym manipulates symbols in Go source code.
 Various sub-commands print, process or write symbols.
 `)
-		os.Exit(2)
+		os.Exit(exitUsage)
 	}
 	flag.Parse()
 	if flag.NArg() == 0 {
@@ -163,16 +804,66 @@ Various sub-commands print, process or write symbols.
 	}
 	if err := runCmd(c, args); err != nil {
 		log.Printf("gosym %s: %v", name, err)
-		os.Exit(1)
+		code := exitError
+		if err, ok := err.(*codeError); ok {
+			code = err.code
+		}
+		setExitStatus(code)
 	}
+	os.Exit(exitCode())
 }
 
 func runCmd(c cmd, args []string) error {
-	types.Panic = false
+	var limit *unresolvedLimit
+	if *maxUnresolved != "" {
+		var err error
+		if limit, err = parseUnresolvedLimit(*maxUnresolved); err != nil {
+			return err
+		}
+	}
+	if warnHandlers[*warnings] == nil {
+		return fmt.Errorf("invalid -warnings value %q; want text, json or quiet", *warnings)
+	}
+	types.Panic = *failFast
+	parser.Panic = *failFast
+	if err := declarePredeclared(*predeclared); err != nil {
+		return err
+	}
 	initGoPath()
-	ctxt := newContext()
+	if !*noIgnore {
+		var err error
+		if ignore, err = findIgnorer("."); err != nil {
+			return err
+		}
+	}
+	if *overlayFile != "" {
+		var err error
+		if overlayFiles, err = readOverlay(*overlayFile); err != nil {
+			return err
+		}
+	}
+	start := time.Now()
+	ctxt := newContext(buildContexts()[0], nil)
 	defer ctxt.stdout.Flush()
-	return c.run(ctxt, args)
+	if *printStats {
+		defer func() {
+			ctxt.stdout.Flush()
+			ctxt.printStats(time.Since(start))
+		}()
+	}
+	if *verbose && *warnings == "text" {
+		defer func() {
+			ctxt.stdout.Flush()
+			ctxt.printSkipped()
+		}()
+	}
+	if err := c.run(ctxt, args); err != nil {
+		return err
+	}
+	if limit != nil {
+		return withCode(exitUnresolved, ctxt.checkUnresolved(limit))
+	}
+	return nil
 }
 
 type cmd interface {
@@ -216,59 +907,210 @@ func help() {
 }
 
 type context struct {
-	mu sync.Mutex
+	mu sync.Mutex // guards stamps
 	*sym.Context
 	pkgCache map[string]*ast.Package
-	pkgDirs  map[string]string // map from directory to package name.
+	stamps   map[string]string // map from import path to import stamp.
 	stdout   *bufio.Writer
+
+	// platform names the target operating system
+	// and architecture of the context's build context.
+	platform string
+
+	// cacheDir holds the directory of the on-disk cache,
+	// or the empty string if it is not to be used.
+	cacheDir string
+
+	// platforms holds the contexts for all the target
+	// platforms (see platformContexts).
+	platforms []*context
+
 }
 
-func newContext() *context {
+// newContext returns a new context that finds packages with
+// the given build context. If imp is non-nil, it is used to
+// import packages instead, and the on-disk cache is not used,
+// because imp may supply sources that are not on disk.
+func newContext(bctxt *build.Context, imp sym.Importer) *context {
 	ctxt := &context{
-		pkgDirs: make(map[string]string),
-		stdout:  bufio.NewWriter(os.Stdout),
-		Context: sym.NewContext(),
+		stamps:   make(map[string]string),
+		stdout:   bufio.NewWriter(os.Stdout),
+		Context:  sym.NewContext(),
+		platform: bctxt.GOOS + "/" + bctxt.GOARCH,
 	}
-	ctxt.Logf = func(pos token.Pos, f string, a ...interface{}) {
-		if !*verbose {
-			return
-		}
-		log.Printf("%v: %s", ctxt.position(pos), fmt.Sprintf(f, a...))
+	ctxt.BuildContext = bctxt
+	ctxt.ImportTests = *tests
+	ctxt.Generated = *generated
+	ctxt.Importer = imp
+	ctxt.Panic = *failFast
+	ctxt.CollectStats = *printStats
+	ctxt.CountUnresolved = *maxUnresolved != ""
+	ctxt.platforms = []*context{ctxt}
+	// When symbols are counted, they must all be visited,
+	// so the cache is not used; nor is it when files are
+	// overlaid, as their contents are not on disk.
+	if !*noCache && imp == nil && *maxUnresolved == "" && overlayFiles == nil {
+		ctxt.cacheDir = defaultCacheDir()
 	}
+	ctxt.Warn = printWarning
 	return ctxt
 }
 
-func initGoPath() {
-	// take GOPATH, set types.GoPath to it if it's not empty.
-	p := os.Getenv("GOPATH")
-	if p == "" {
-		return
+// buildContexts returns a build context for each combination
+// of target operating system and architecture named by the
+// -os and -arch flags, satisfying the tags named by the -tags flag.
+func buildContexts() []*build.Context {
+	oses := splitList(*buildOS, build.Default.GOOS)
+	arches := splitList(*buildArch, build.Default.GOARCH)
+	tags := splitList(*buildTags, "")
+	var bctxts []*build.Context
+	for _, goos := range oses {
+		for _, goarch := range arches {
+			bctxt := build.Default
+			bctxt.GOOS = goos
+			bctxt.GOARCH = goarch
+			bctxt.BuildTags = tags
+			if ignore != nil {
+				bctxt.ReadDir = ignore.readDir
+			}
+			if overlayFiles != nil {
+				readDir := bctxt.ReadDir
+				if readDir == nil {
+					readDir = ioutil.ReadDir
+				}
+				bctxt.ReadDir = overlayFiles.readDirFunc(readDir)
+				bctxt.OpenFile = overlayFiles.openFile
+			}
+			if goos != build.Default.GOOS || goarch != build.Default.GOARCH {
+				bctxt.CgoEnabled = false
+			}
+			bctxts = append(bctxts, &bctxt)
+		}
+	}
+	return bctxts
+}
+
+// splitList splits a comma-separated list. If the list
+// is empty, it returns a list holding only def,
+// or no items if def is empty.
+func splitList(s, def string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 && def != "" {
+		items = []string{def}
+	}
+	return items
+}
+
+// platformContexts returns a context for each target platform,
+// the first of which is ctxt itself. All the contexts
+// share ctxt's standard output and warning handler.
+func (ctxt *context) platformContexts() []*context {
+	ctxts := []*context{ctxt}
+	for _, bctxt := range buildContexts()[1:] {
+		pctxt := newContext(bctxt, ctxt.Importer)
+		pctxt.stdout = ctxt.stdout
+		pctxt.Warn = ctxt.Warn
+		ctxts = append(ctxts, pctxt)
+	}
+	ctxt.platforms = ctxts
+	return ctxts
+}
+
+// predeclaredKinds maps the kinds accepted by the
+// -predeclared flag to the kinds of object they declare.
+var predeclaredKinds = map[string]ast.ObjKind{
+	"func":  ast.Fun,
+	"type":  ast.Typ,
+	"const": ast.Con,
+	"var":   ast.Var,
+}
+
+// declarePredeclared adds the identifiers in list, as given
+// by the -predeclared flag, to the predeclared identifiers.
+func declarePredeclared(list string) error {
+	if list == "" {
+		return nil
+	}
+	for _, id := range strings.Split(list, ",") {
+		kind, name := "func", id
+		if i := strings.Index(id, ":"); i >= 0 {
+			kind, name = id[0:i], id[i+1:]
+		}
+		k, ok := predeclaredKinds[kind]
+		if !ok {
+			return fmt.Errorf("unknown kind %q in predeclared identifier %q", kind, id)
+		}
+		if !isIdentifier(name) {
+			return fmt.Errorf("invalid predeclared identifier %q", id)
+		}
+		parser.DeclarePredeclared(k, name)
+	}
+	return nil
+}
+
+// isIdentifier reports whether name is a valid Go identifier.
+func isIdentifier(name string) bool {
+	if name == "" || token.Lookup([]byte(name)).IsKeyword() {
+		return false
 	}
-	gopath := strings.Split(p, ":")
-	for i, d := range gopath {
-		gopath[i] = filepath.Join(d, "src")
+	for i, r := range name {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// initGoPath sets types.GoPath from $GOPATH and $GOROOT.
+func initGoPath() {
+	types.GoPath = goPath(os.Getenv("GOPATH"), os.Getenv("GOROOT"))
+}
+
+// goPath returns the source directories named by the given
+// values of $GOPATH and $GOROOT, as used for types.GoPath.
+// Empty elements of gopath are ignored. If goroot is empty,
+// the root of the Go tree that gosym was built with is used.
+func goPath(gopath, goroot string) []string {
+	var dirs []string
+	for _, d := range filepath.SplitList(gopath) {
+		if d != "" {
+			dirs = append(dirs, filepath.Join(d, "src"))
+		}
 	}
-	r := os.Getenv("GOROOT")
-	if r != "" {
-		gopath = append(gopath, r+"/src/pkg")
+	if goroot == "" {
+		goroot = runtime.GOROOT()
 	}
-	types.GoPath = gopath
+	return append(dirs, filepath.Join(goroot, "src", "pkg"))
 }
 
-func (ctxt *context) positionToImportPath(p token.Position) string {
-	if p.Filename == "" {
-		panic("empty file name")
+// importPackages returns the package with the given import path
+// and, if external tests are being included, its external test
+// package. It returns nil if the package cannot be found.
+func (ctxt *context) importPackages(path string) []*ast.Package {
+	pkg := ctxt.Import(path)
+	if pkg == nil {
+		return nil
 	}
-	dir := filepath.Dir(p.Filename)
-	if pkg, ok := ctxt.pkgDirs[dir]; ok {
-		return pkg
+	pkgs := []*ast.Package{pkg}
+	if xpkg := ctxt.ImportXTest(path); xpkg != nil {
+		pkgs = append(pkgs, xpkg)
 	}
-	bpkg, err := build.Import(".", dir, build.FindOnly)
+	return pkgs
+}
+
+// positionToImportPath returns the import path of the
+// package containing the file at position p.
+func (ctxt *context) positionToImportPath(p token.Position) (string, error) {
+	path, err := ctxt.PackagePath(p)
 	if err != nil {
-		panic(fmt.Errorf("cannot reverse-map filename to package: %v", err))
+		return "", fmt.Errorf("cannot find package of %s: %v", p.Filename, err)
 	}
-	ctxt.pkgDirs[dir] = bpkg.ImportPath
-	return bpkg.ImportPath
+	return path, nil
 }
 
 func (ctxt *context) printf(f string, a ...interface{}) {
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"code.google.com/p/rog-go/exp/go/ast"
+	"code.google.com/p/rog-go/exp/go/token"
+	"code.google.com/p/rog-go/exp/go/types"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// methodSet holds a named type and its methods.
+type methodSet struct {
+	typ     *ast.Object
+	iface   bool
+	methods map[string]*ast.Object
+}
+
+// methodGroup holds a set of methods that must all
+// have the same name, and the interfaces that require it.
+type methodGroup struct {
+	methods []*ast.Object
+	ifaces  []*ast.Object
+}
+
+// addInterfaceMethods adds to c.globalReplace any methods
+// that must be renamed along with a method already there,
+// so that every type declared in the given packages or
+// in c.symPkgs continues to implement the interfaces
+// declared there that it implements now.
+func (c *writeCmd) addInterfaceMethods(pkgs []string) {
+	renamed := make([]*ast.Object, 0, len(c.globalReplace))
+	for obj := range c.globalReplace {
+		if obj.Kind == ast.Fun {
+			renamed = append(renamed, obj)
+		}
+	}
+	if len(renamed) == 0 {
+		return
+	}
+	paths := make(map[string]bool)
+	for path := range c.symPkgs {
+		paths[path] = true
+	}
+	for _, path := range pkgs {
+		paths[path] = true
+	}
+	sets, owners := c.methodSets(paths)
+
+	// Group together methods that implement the
+	// same interface method.
+	groups := make(map[*ast.Object]*methodGroup)
+	groupOf := func(m *ast.Object) *methodGroup {
+		g := groups[m]
+		if g == nil {
+			g = &methodGroup{methods: []*ast.Object{m}}
+			groups[m] = g
+		}
+		return g
+	}
+	merge := func(g0, g1 *methodGroup) *methodGroup {
+		if g0 == g1 {
+			return g0
+		}
+		g0.methods = append(g0.methods, g1.methods...)
+		g0.ifaces = append(g0.ifaces, g1.ifaces...)
+		for _, m := range g1.methods {
+			groups[m] = g0
+		}
+		return g0
+	}
+	for _, iface := range sets {
+		if !iface.iface {
+			continue
+		}
+		for _, t := range sets {
+			if t == iface || !c.implements(t, iface) {
+				continue
+			}
+			for name, im := range iface.methods {
+				g := merge(groupOf(im), groupOf(t.methods[name]))
+				if !containsObj(g.ifaces, iface.typ) {
+					g.ifaces = append(g.ifaces, iface.typ)
+				}
+			}
+		}
+	}
+
+	sort.Sort(objectsByPos{renamed, c})
+	for _, obj := range renamed {
+		g := groups[obj]
+		if g == nil {
+			continue
+		}
+		newName := c.globalReplace[obj]
+		var ifaces []string
+		for _, iface := range g.ifaces {
+			ifaces = append(ifaces, iface.Name)
+		}
+		sort.Strings(ifaces)
+		sort.Sort(objectsByPos{g.methods, c})
+		for _, m := range g.methods {
+			p := c.position(types.DeclPos(m))
+			p.Offset = 0
+			if old, ok := c.globalReplace[m]; ok {
+				if old != newName {
+					c.addConflict(p, "conflicting replacement for %s (%q vs %q); required by interface %s", methodName(m, owners), old, newName, strings.Join(ifaces, ", "))
+				}
+				continue
+			}
+			c.globalReplace[m] = newName
+			c.warnf(p, warnChange, "also renaming %s to %s; required by interface %s", methodName(m, owners), newName, strings.Join(ifaces, ", "))
+		}
+	}
+}
+
+// methodSets returns the method sets of all the named types
+// declared in the packages with the given paths. It also returns
+// a map from each method to the type that declares it.
+func (c *writeCmd) methodSets(paths map[string]bool) ([]*methodSet, map[*ast.Object]*ast.Object) {
+	var sets []*methodSet
+	owners := make(map[*ast.Object]*ast.Object)
+	seen := make(map[*ast.Package]bool)
+	for path := range paths {
+		for _, pkg := range c.importPackages(path) {
+			if seen[pkg] {
+				continue
+			}
+			seen[pkg] = true
+			for _, obj := range pkg.Scope.Objects {
+				if obj.Kind != ast.Typ {
+					continue
+				}
+				if set := c.methodSet(obj, owners); len(set.methods) > 0 {
+					sets = append(sets, set)
+				}
+			}
+		}
+	}
+	return sets, owners
+}
+
+// methodSet returns the method set of the named type with
+// the given object. Methods declared directly by the
+// type are recorded in owners.
+func (c *writeCmd) methodSet(obj *ast.Object, owners map[*ast.Object]*ast.Object) *methodSet {
+	t := types.Type{Node: &ast.Ident{Name: obj.Name, Obj: obj}, Kind: ast.Typ}
+	set := &methodSet{
+		typ:     obj,
+		methods: make(map[string]*ast.Object),
+	}
+	if it, ok := t.Underlying(true, c.Import).Node.(*ast.InterfaceType); ok {
+		set.iface = true
+		for _, f := range it.Methods.List {
+			for _, name := range f.Names {
+				owners[name.Obj] = obj
+			}
+		}
+	}
+	// Members are sent shallowest first, so the first
+	// member with a given name is the one that is used.
+	seen := make(map[string]bool)
+	for m := range t.Iter(c.Import) {
+		if seen[m.Name] {
+			continue
+		}
+		seen[m.Name] = true
+		if m.Kind != ast.Fun || funcType(m) == nil {
+			continue
+		}
+		set.methods[m.Name] = m
+		if fd, ok := m.Decl.(*ast.FuncDecl); ok && fd.Recv != nil {
+			if id, ok := depointer(fd.Recv.List[0].Type).(*ast.Ident); ok && id.Obj == obj {
+				owners[m] = obj
+			}
+		}
+	}
+	return set
+}
+
+// implements reports whether t has all the methods of iface,
+// with identical signatures.
+func (c *writeCmd) implements(t, iface *methodSet) bool {
+	for name, im := range iface.methods {
+		m := t.methods[name]
+		if m == nil || !c.sameSignature(funcType(m), funcType(im)) {
+			return false
+		}
+	}
+	return true
+}
+
+// funcType returns the type of the method with the given object,
+// or nil if it has none.
+func funcType(m *ast.Object) *ast.FuncType {
+	switch d := m.Decl.(type) {
+	case *ast.FuncDecl:
+		if d.Recv != nil {
+			return d.Type
+		}
+	case *ast.Field:
+		t, _ := d.Type.(*ast.FuncType)
+		return t
+	}
+	return nil
+}
+
+// sameSignature reports whether the two function types
+// have identical parameter and result types.
+func (c *writeCmd) sameSignature(t0, t1 *ast.FuncType) bool {
+	return c.sameFieldTypes(t0.Params, t1.Params) && c.sameFieldTypes(t0.Results, t1.Results)
+}
+
+func (c *writeCmd) sameFieldTypes(l0, l1 *ast.FieldList) bool {
+	ts0, ts1 := fieldTypes(l0), fieldTypes(l1)
+	if len(ts0) != len(ts1) {
+		return false
+	}
+	for i := range ts0 {
+		if !c.identical(ts0[i], ts1[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldTypes returns the type of each of the
+// entries in the given field list.
+func fieldTypes(l *ast.FieldList) []ast.Expr {
+	if l == nil {
+		return nil
+	}
+	var ts []ast.Expr
+	for _, f := range l.List {
+		n := len(f.Names)
+		if n == 0 {
+			n = 1
+		}
+		for ; n > 0; n-- {
+			ts = append(ts, f.Type)
+		}
+	}
+	return ts
+}
+
+// identical reports whether the type expressions e0 and e1,
+// which may be in different packages, denote identical types.
+// Named types are identical if they are declared by the same
+// object, however they are referred to.
+func (c *writeCmd) identical(e0, e1 ast.Expr) bool {
+	e0, e1 = c.resolveType(e0), c.resolveType(e1)
+	switch t0 := e0.(type) {
+	case *ast.Ident:
+		t1, ok := e1.(*ast.Ident)
+		if !ok {
+			return false
+		}
+		if t0.Obj == nil || t1.Obj == nil {
+			return t0.Obj == t1.Obj && t0.Name == t1.Name
+		}
+		return t0.Obj == t1.Obj
+
+	case *ast.SelectorExpr:
+		// A qualified name that cannot be resolved
+		// matches only the same qualified name.
+		t1, ok := e1.(*ast.SelectorExpr)
+		return ok && pretty(t0) == pretty(t1)
+
+	case *ast.StarExpr:
+		t1, ok := e1.(*ast.StarExpr)
+		return ok && c.identical(t0.X, t1.X)
+
+	case *ast.Ellipsis:
+		t1, ok := e1.(*ast.Ellipsis)
+		return ok && c.identical(t0.Elt, t1.Elt)
+
+	case *ast.ArrayType:
+		t1, ok := e1.(*ast.ArrayType)
+		if !ok || (t0.Len == nil) != (t1.Len == nil) {
+			return false
+		}
+		if t0.Len != nil {
+			n0, err0 := types.ConstValue(t0.Len, c.Import)
+			n1, err1 := types.ConstValue(t1.Len, c.Import)
+			if err0 != nil || err1 != nil || n0 != n1 {
+				return false
+			}
+		}
+		return c.identical(t0.Elt, t1.Elt)
+
+	case *ast.MapType:
+		t1, ok := e1.(*ast.MapType)
+		return ok && c.identical(t0.Key, t1.Key) && c.identical(t0.Value, t1.Value)
+
+	case *ast.ChanType:
+		t1, ok := e1.(*ast.ChanType)
+		return ok && t0.Dir == t1.Dir && c.identical(t0.Value, t1.Value)
+
+	case *ast.FuncType:
+		t1, ok := e1.(*ast.FuncType)
+		return ok && c.sameSignature(t0, t1)
+
+	case *ast.StructType:
+		t1, ok := e1.(*ast.StructType)
+		return ok && c.sameFields(t0.Fields, t1.Fields)
+
+	case *ast.InterfaceType:
+		if _, ok := e1.(*ast.InterfaceType); !ok {
+			return false
+		}
+		ms0, ms1 := c.interfaceMethods(t0), c.interfaceMethods(e1)
+		if len(ms0) != len(ms1) {
+			return false
+		}
+		for name, m0 := range ms0 {
+			m1 := ms1[name]
+			if m1 == nil || !c.sameSignature(m0, m1) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// resolveType returns the type denoted by the type
+// name e, or e itself if it is not a type name or
+// cannot be resolved. A named type is returned as an
+// identifier referring to its declaration; an alias
+// is returned as the type it stands for.
+func (c *writeCmd) resolveType(e ast.Expr) ast.Expr {
+	for {
+		p, ok := e.(*ast.ParenExpr)
+		if !ok {
+			break
+		}
+		e = p.X
+	}
+	switch e.(type) {
+	case *ast.Ident, *ast.SelectorExpr:
+		_, t := types.ExprType(e, c.Import)
+		if t.Kind != ast.Typ {
+			break
+		}
+		if te, ok := t.Node.(ast.Expr); ok {
+			return te
+		}
+	}
+	return e
+}
+
+// sameFields reports whether the two struct field lists
+// have the same field names, types and tags, in the same order.
+func (c *writeCmd) sameFields(l0, l1 *ast.FieldList) bool {
+	fs0, fs1 := structFields(l0), structFields(l1)
+	if len(fs0) != len(fs1) {
+		return false
+	}
+	for i, f0 := range fs0 {
+		f1 := fs1[i]
+		if f0.name != f1.name || f0.embedded != f1.embedded || f0.tag != f1.tag || !c.identical(f0.typ, f1.typ) {
+			return false
+		}
+	}
+	return true
+}
+
+// structField holds one field of a struct type.
+type structField struct {
+	name     string
+	embedded bool
+	typ      ast.Expr
+	tag      string
+}
+
+// structFields returns the fields in the given
+// struct field list, one for each field name.
+func structFields(l *ast.FieldList) []structField {
+	if l == nil {
+		return nil
+	}
+	var fs []structField
+	for _, f := range l.List {
+		tag := ""
+		if f.Tag != nil {
+			tag, _ = strconv.Unquote(f.Tag.Value)
+		}
+		if len(f.Names) == 0 {
+			var name string
+			if id := embeddedTypeName(f.Type); id != nil {
+				name = id.Name
+			}
+			fs = append(fs, structField{name, true, f.Type, tag})
+			continue
+		}
+		for _, name := range f.Names {
+			fs = append(fs, structField{name.Name, false, f.Type, tag})
+		}
+	}
+	return fs
+}
+
+// embeddedTypeName returns the identifier that names the
+// type of an embedded field, or nil if there is none.
+func embeddedTypeName(e ast.Expr) *ast.Ident {
+	switch e := depointer(e).(type) {
+	case *ast.Ident:
+		return e
+	case *ast.SelectorExpr:
+		return e.Sel
+	}
+	return nil
+}
+
+// interfaceMethods returns the type of each method in the method
+// set of the given interface type, including embedded methods.
+func (c *writeCmd) interfaceMethods(it ast.Expr) map[string]*ast.FuncType {
+	ms := make(map[string]*ast.FuncType)
+	t := types.Type{Node: it, Kind: ast.Typ}
+	for m := range t.Iter(c.Import) {
+		if ft := funcType(m); ft != nil && ms[m.Name] == nil {
+			ms[m.Name] = ft
+		}
+	}
+	return ms
+}
+
+// methodName returns the name of the given method,
+// qualified by the type that declares it if known.
+func methodName(m *ast.Object, owners map[*ast.Object]*ast.Object) string {
+	if t := owners[m]; t != nil {
+		return t.Name + "." + m.Name
+	}
+	return m.Name
+}
+
+func containsObj(objs []*ast.Object, obj *ast.Object) bool {
+	for _, o := range objs {
+		if o == obj {
+			return true
+		}
+	}
+	return false
+}
+
+// objectsByPos sorts objects by the position of their declarations.
+type objectsByPos struct {
+	objs []*ast.Object
+	c    *writeCmd
+}
+
+func (s objectsByPos) Len() int      { return len(s.objs) }
+func (s objectsByPos) Swap(i, j int) { s.objs[i], s.objs[j] = s.objs[j], s.objs[i] }
+func (s objectsByPos) Less(i, j int) bool {
+	return positionLess(s.c.position(types.DeclPos(s.objs[i])), s.c.position(types.DeclPos(s.objs[j])))
+}
+
+func positionLess(p0, p1 token.Position) bool {
+	if p0.Filename != p1.Filename {
+		return p0.Filename < p1.Filename
+	}
+	return p0.Offset < p1.Offset
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// overlay maps the absolute paths of source files to the
+// paths of the files whose contents are read in their place,
+// as given by the -overlay flag. A file mapped to the empty
+// string is treated as if it did not exist.
+type overlay map[string]string
+
+// readOverlay reads the overlay in the named file, which holds
+// a JSON object in the format used by the go tool's -overlay
+// flag, as in:
+//
+//	{"Replace": {"a.go": "/tmp/staged/a.go", "old.go": ""}}
+//
+// Relative paths are taken as relative to the current directory.
+func readOverlay(file string) (overlay, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var v struct {
+		Replace map[string]string
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("cannot parse overlay %s: %v", file, err)
+	}
+	ov := make(overlay)
+	for path, replacement := range v.Replace {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		if replacement != "" {
+			if replacement, err = filepath.Abs(replacement); err != nil {
+				return nil, err
+			}
+		}
+		ov[abs] = replacement
+	}
+	return ov, nil
+}
+
+// lookup returns the file read in place of the named one,
+// and whether there is any.
+func (ov overlay) lookup(name string) (string, bool) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", false
+	}
+	replacement, ok := ov[abs]
+	return replacement, ok
+}
+
+// openFile opens the named file, or the file that replaces
+// it. It is used as the OpenFile function of the build
+// contexts, and so to read all the source files parsed.
+func (ov overlay) openFile(name string) (io.ReadCloser, error) {
+	if replacement, ok := ov.lookup(name); ok {
+		if replacement == "" {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		return os.Open(replacement)
+	}
+	return os.Open(name)
+}
+
+// readFile is like ioutil.ReadFile, but reads the file
+// that replaces the named one, if any.
+func (ov overlay) readFile(name string) ([]byte, error) {
+	f, err := ov.openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// readDirFunc returns a function that reads a directory with
+// readDir and then applies the overlay to its entries: files
+// mapped to the empty string are omitted, and files that are
+// added by the overlay are included, with the size and
+// modification time of the files that replace them.
+func (ov overlay) readDirFunc(readDir func(string) ([]os.FileInfo, error)) func(string) ([]os.FileInfo, error) {
+	return func(dir string) ([]os.FileInfo, error) {
+		infos, err := readDir(dir)
+		if err != nil && !ov.hasDir(dir) {
+			return nil, err
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool)
+		kept := infos[:0]
+		for _, info := range infos {
+			seen[info.Name()] = true
+			if replacement, ok := ov[filepath.Join(abs, info.Name())]; ok {
+				if replacement == "" {
+					continue
+				}
+				rinfo, err := os.Stat(replacement)
+				if err != nil {
+					return nil, err
+				}
+				info = overlayFileInfo{rinfo, info.Name()}
+			}
+			kept = append(kept, info)
+		}
+		for path, replacement := range ov {
+			if filepath.Dir(path) != abs || seen[filepath.Base(path)] || replacement == "" {
+				continue
+			}
+			rinfo, err := os.Stat(replacement)
+			if err != nil {
+				return nil, err
+			}
+			kept = append(kept, overlayFileInfo{rinfo, filepath.Base(path)})
+		}
+		return kept, nil
+	}
+}
+
+// hasDir reports whether the overlay adds any
+// file to the given directory.
+func (ov overlay) hasDir(dir string) bool {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	for path, replacement := range ov {
+		if replacement != "" && filepath.Dir(path) == abs {
+			return true
+		}
+	}
+	return false
+}
+
+// overlayFileInfo describes a file that replaces another
+// one in an overlay, under the name of the file it replaces.
+type overlayFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (info overlayFileInfo) Name() string {
+	return info.name
+}
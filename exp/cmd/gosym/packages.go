@@ -0,0 +1,238 @@
+package main
+
+import (
+	"code.google.com/p/rog-go/exp/go/token"
+	"fmt"
+	"go/build"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// expandPackages returns the package paths named by args,
+// expanding any patterns containing "..." into the paths
+// of all matching packages. As with the go tool,
+// a pattern of "./..." matches all packages in or
+// below the current directory, and "pkg/..." matches pkg
+// and all packages below it.
+func (ctxt *context) expandPackages(args []string) []string {
+	var pkgs []string
+	seen := make(map[string]bool)
+	for _, a := range args {
+		if !strings.Contains(a, "...") {
+			if !seen[a] {
+				seen[a] = true
+				pkgs = append(pkgs, a)
+			}
+			continue
+		}
+		matched := false
+		for _, p := range matchPackages(a) {
+			matched = true
+			if !seen[p] {
+				seen[p] = true
+				pkgs = append(pkgs, p)
+			}
+		}
+		if !matched {
+			ctxt.warnf(token.Position{}, warnPackage, "%q matched no packages", a)
+		}
+	}
+	return pkgs
+}
+
+// matchPackages returns the paths of all packages matching
+// the given pattern.
+func matchPackages(pattern string) []string {
+	match := matchPattern(pattern)
+	dir, _ := path.Split(pattern[0:strings.Index(pattern, "...")])
+	if build.IsLocalImport(pattern) {
+		var pkgs []string
+		walkPackageDirs(filepath.FromSlash(path.Clean(dir)), *maxDepth, func(dir string) {
+			name := filepath.ToSlash(dir)
+			if name != "." && !build.IsLocalImport(name) {
+				name = "./" + name
+			}
+			if match(name) {
+				pkgs = append(pkgs, name)
+			}
+		})
+		return pkgs
+	}
+	var pkgs []string
+	for _, src := range build.Default.SrcDirs() {
+		walkPackageDirs(filepath.Join(src, filepath.FromSlash(dir)), *maxDepth, func(dir string) {
+			name, err := filepath.Rel(src, dir)
+			if err != nil {
+				return
+			}
+			if name = filepath.ToSlash(name); match(name) {
+				pkgs = append(pkgs, name)
+			}
+		})
+	}
+	return pkgs
+}
+
+// walkPackageDirs calls f for each directory at or below root
+// that contains Go source files buildable for any target platform.
+// Directories named vendor or testdata, those starting
+// with "." or "_", and those ignored (see ignorer), are skipped,
+// as are those more than depth levels below root, unless
+// depth is negative.
+func walkPackageDirs(root string, depth int, f func(dir string)) {
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if p != root {
+			name := info.Name()
+			if name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+				return filepath.SkipDir
+			}
+			if depth >= 0 && dirDepth(root, p) > depth {
+				return filepath.SkipDir
+			}
+		}
+		if ignore.ignored(p, true) {
+			return filepath.SkipDir
+		}
+		if hasGoFiles(p) {
+			f(p)
+		}
+		return nil
+	})
+}
+
+// dirDepth returns the number of directory levels
+// that the directory dir is below root.
+func dirDepth(root, dir string) int {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == "." {
+		return 0
+	}
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+// hasGoFiles reports whether the given directory holds
+// Go source files buildable for any of the target platforms.
+func hasGoFiles(dir string) bool {
+	for _, bctxt := range buildContexts() {
+		_, err := bctxt.ImportDir(dir, 0)
+		if _, ok := err.(*build.NoGoError); !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern returns a function that reports whether
+// a package path matches the given pattern, in which
+// "..." matches any string.
+func matchPattern(pattern string) func(name string) bool {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.Replace(re, `\.\.\.`, `.*`, -1)
+	// Special case: foo/... matches foo too.
+	if strings.HasSuffix(re, `/.*`) {
+		re = re[:len(re)-len(`/.*`)] + `(/.*)?`
+	}
+	return regexp.MustCompile(`^` + re + `$`).MatchString
+}
+
+// pathShortener shortens package paths as
+// specified by the list -short flag.
+type pathShortener struct {
+	// root holds the path that other paths
+	// are made relative to, if any.
+	root string
+
+	// n holds the number of path elements kept, if
+	// it is non-zero.
+	n int
+}
+
+// newPathShortener returns a pathShortener for the given
+// value of the -short flag: "." to make paths relative to the
+// package in the current directory, or the number of path
+// elements to keep.
+func newPathShortener(ctxt *context, short string) (pathShortener, error) {
+	if short == "." {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return pathShortener{}, err
+		}
+		// PackagePath takes the position of a file in
+		// the package directory; the file need not exist.
+		root, err := ctxt.PackagePath(token.Position{Filename: filepath.Join(cwd, "x.go")})
+		if err != nil {
+			return pathShortener{}, err
+		}
+		return pathShortener{root: root}, nil
+	}
+	n, err := strconv.Atoi(short)
+	if err != nil || n < 1 {
+		return pathShortener{}, fmt.Errorf("invalid -short value %q", short)
+	}
+	return pathShortener{n: n}, nil
+}
+
+// shorten returns the shortened form of the given package path.
+func (s pathShortener) shorten(path string) string {
+	switch {
+	case s.root != "" && path == s.root:
+		return "."
+	case s.root != "" && strings.HasPrefix(path, s.root+"/"):
+		return "./" + path[len(s.root)+1:]
+	case s.n > 0:
+		if elems := strings.Split(path, "/"); len(elems) > s.n {
+			return strings.Join(elems[len(elems)-s.n:], "/")
+		}
+	}
+	return path
+}
+
+// reportExcluded warns of each Go source file of the packages
+// with the given import paths that the build constraints leave
+// out for every target platform (see platformContexts), as
+// its symbols are neither visited nor changed.
+func (ctxt *context) reportExcluded(paths []string) {
+	cwd, _ := os.Getwd()
+	var platforms []string
+	for _, pctxt := range ctxt.platforms {
+		platforms = append(platforms, pctxt.platform)
+	}
+	for _, path := range paths {
+		// excluded holds the files left out for
+		// all the platforms so far.
+		var excluded map[string]bool
+		for _, pctxt := range ctxt.platforms {
+			bpkg, err := pctxt.FindPackage(path, cwd, 0)
+			if err != nil {
+				excluded = nil
+				break
+			}
+			ignored := make(map[string]bool)
+			for _, name := range bpkg.IgnoredGoFiles {
+				if ctxt.ImportTests || !strings.HasSuffix(name, "_test.go") {
+					name = filepath.Join(bpkg.Dir, name)
+					if excluded == nil || excluded[name] {
+						ignored[name] = true
+					}
+				}
+			}
+			excluded = ignored
+		}
+		names := make([]string, 0, len(excluded))
+		for name := range excluded {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ctxt.warnf(token.Position{}, warnExcluded, "%s is excluded by the build constraints for %s; its symbols are left out", name, strings.Join(platforms, ", "))
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"code.google.com/p/rog-go/exp/go/ast"
+	"code.google.com/p/rog-go/exp/go/sym"
+	"code.google.com/p/rog-go/exp/go/token"
+	"code.google.com/p/rog-go/exp/go/types"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// serve answers the queries read from rd, as described for the
+// -server flag, until the end of the input. References are
+// searched for in the packages pkgs, and only symbols of the
+// kinds in mask are printed.
+func (c *listCmd) serve(ctxt *context, rd io.Reader, pkgs []string, mask uint) error {
+	r := bufio.NewReader(rd)
+	for {
+		line, err := readLine(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := c.query(ctxt, line, pkgs, mask); err != nil {
+			ctxt.printf("error: %v\n", err)
+		}
+		// An empty line ends each response.
+		ctxt.printf("\n")
+		if err := ctxt.stdout.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// query answers a single query.
+func (c *listCmd) query(ctxt *context, q string, pkgs []string, mask uint) error {
+	f := strings.Fields(q)
+	if len(f) != 2 || f[0] != "def" && f[0] != "refs" {
+		return fmt.Errorf("invalid query %q", q)
+	}
+	obj, t, err := resolveTarget(ctxt, f[1])
+	if err != nil {
+		return err
+	}
+	if f[0] == "def" {
+		return c.printDeclOf(ctxt, obj, t)
+	}
+	p := ctxt.position(types.DeclPos(obj))
+	p.Offset = 0
+	c.refPos = map[token.Position]bool{p: true}
+	return c.listPackages(ctxt.stdout, pkgs, mask)
+}
+
+// resolveTarget returns the object named by target, which holds
+// either the position of an identifier that refers to it or
+// a name in any of the formats accepted by lookupDecl,
+// and its type.
+func resolveTarget(ctxt *context, target string) (*ast.Object, types.Type, error) {
+	p, err := parsePosition(target)
+	if err != nil {
+		return lookupDecl(ctxt, target)
+	}
+	lines := make(lineTables)
+	if *runes {
+		if p, err = lines.byteColumn(p); err != nil {
+			return nil, types.Type{}, err
+		}
+	}
+	if p, err = lines.resolve(p); err != nil {
+		return nil, types.Type{}, err
+	}
+	s, err := symbolAt(ctxt, p)
+	if err != nil {
+		return nil, types.Type{}, err
+	}
+	if s.Universe {
+		return nil, types.Type{}, fmt.Errorf("%s is predeclared", s.Name)
+	}
+	return s.ReferObj, s.ExprType, nil
+}
+
+// symbolAt returns the symbol whose identifier
+// contains the position p.
+func symbolAt(ctxt *context, p token.Position) (sym.Symbol, error) {
+	if abs, err := filepath.Abs(p.Filename); err == nil {
+		p.Filename = abs
+	}
+	path, err := ctxt.PackagePath(p)
+	if err != nil {
+		return sym.Symbol{}, err
+	}
+	var found *sym.Symbol
+	err = ctxt.WalkFiles(path, []string{p.Filename}, func(s sym.Symbol) bool {
+		sp := s.Position
+		if sp.Line == p.Line && sp.Column <= p.Column && p.Column < sp.Column+len(s.Ident.Name) {
+			found = &s
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return sym.Symbol{}, err
+	}
+	if found == nil {
+		return sym.Symbol{}, fmt.Errorf("no symbol found at %v", p)
+	}
+	return *found, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/rog-go/exp/go/ast"
+	"code.google.com/p/rog-go/exp/go/parser"
+	"code.google.com/p/rog-go/exp/go/sym"
+	"code.google.com/p/rog-go/exp/go/token"
+	"code.google.com/p/rog-go/exp/go/types"
+	"fmt"
+)
+
+// shadowFile holds a file of a package listed with the
+// -shadow flag, and the package that it belongs to.
+type shadowFile struct {
+	f   *ast.File
+	pkg *ast.Package
+}
+
+// shadowFiles returns the files of the package with the given
+// path, and of its external test package if any, by file name.
+func (c *listCmd) shadowFiles(path string) map[string]shadowFile {
+	files := make(map[string]shadowFile)
+	for _, pkg := range c.ctxt.importPackages(path) {
+		for _, f := range pkg.Files {
+			files[c.ctxt.position(f.Package).Filename] = shadowFile{f, pkg}
+		}
+	}
+	return files
+}
+
+// printShadow prints a line to buf if s declares a local symbol
+// that shadows a package imported by its file or a package-level
+// declaration, so that they cannot be referred to where the
+// local symbol is in scope. It is used for the -shadow flag.
+func (c *listCmd) printShadow(buf *bytes.Buffer, lines lineTables, files map[string]shadowFile, s sym.Symbol) error {
+	if !s.Local || !s.Decl || s.Ident.Name == "_" {
+		return nil
+	}
+	file, ok := files[s.Position.Filename]
+	if !ok {
+		return nil
+	}
+	name := s.Ident.Name
+	var msg string
+	var pos token.Position
+	for _, imp := range sym.FileImports(file.f) {
+		if c.importName(imp) == name {
+			msg = fmt.Sprintf("shadows import of %q at", importPath(imp))
+			pos = c.ctxt.position(imp.Pos())
+			break
+		}
+	}
+	if msg == "" {
+		obj := file.pkg.Scope.Lookup(name)
+		if obj == nil || obj.Kind == ast.Bad || obj.Kind == ast.Pkg {
+			// Package names in the package scope
+			// belong to the imports of other files.
+			return nil
+		}
+		msg = fmt.Sprintf("shadows package-level %s declared at", obj.Kind)
+		pos = c.ctxt.position(types.DeclPos(obj))
+	}
+	p := s.Position
+	if *runes && !c.offset {
+		var err error
+		if p, err = lines.runeColumn(p); err == nil {
+			pos, err = lines.runeColumn(pos)
+		}
+		if err != nil {
+			return fmt.Errorf("%v: cannot count columns in runes: %v", s.Position, err)
+		}
+	}
+	fmt.Fprintf(buf, "%s: %s %s %s\n", formatPosition(p, c.offset), name, msg, formatPosition(pos, c.offset))
+	return nil
+}
+
+// importName returns the name by which the package imported
+// by imp is referred to in its file, or the empty string if
+// it cannot be referred to by name. If the package cannot be
+// found, its name is guessed from the import path.
+func (c *listCmd) importName(imp *ast.ImportSpec) string {
+	if imp.Name != nil {
+		if imp.Name.Name == "_" || imp.Name.Name == "." {
+			return ""
+		}
+		return imp.Name.Name
+	}
+	if pkg := c.ctxt.Import(importPath(imp)); pkg != nil {
+		return pkg.Name
+	}
+	return parser.ImportPathToName(importPath(imp))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"code.google.com/p/rog-go/exp/go/sym"
+	"log"
+	"sort"
+	"time"
+)
+
+// printStats prints the statistics recorded by ctxt and by the
+// contexts for any other platforms, as requested by the -stats
+// flag; elapsed holds the time taken by the whole command.
+func (ctxt *context) printStats(elapsed time.Duration) {
+	var total sym.Stats
+	for _, c := range ctxt.platforms {
+		s := c.Stats()
+		total.Packages += s.Packages
+		total.CacheHits += s.CacheHits
+		total.CacheMisses += s.CacheMisses
+		total.ParseTime += s.ParseTime
+		total.ResolveTime += s.ResolveTime
+		total.Syms += s.Syms
+	}
+	percent := 0.0
+	if n := total.CacheHits + total.CacheMisses; n > 0 {
+		percent = 100 * float64(total.CacheHits) / float64(n)
+	}
+	log.Printf("gosym: %d packages parsed in %v", total.Packages, total.ParseTime)
+	log.Printf("gosym: %d symbols resolved in %v", total.Syms, total.ResolveTime)
+	log.Printf("gosym: %d of %d imports found in the package cache (%.1f%%)", total.CacheHits, total.CacheHits+total.CacheMisses, percent)
+	log.Printf("gosym: %v elapsed", elapsed)
+}
+
+// printSkipped prints the files that ctxt and the contexts for
+// any other platforms left out of their packages because they
+// could not be parsed, with the position of the first error
+// in each, unless the -v flag is false.
+func (ctxt *context) printSkipped() {
+	files := ctxt.skippedFiles()
+	if len(files) == 0 {
+		return
+	}
+	log.Printf("gosym: %d files skipped as they could not be parsed:", len(files))
+	for _, sf := range files {
+		log.Printf("gosym: \t%v", sf.Pos)
+	}
+}
+
+// skippedFiles returns the files skipped by ctxt and by the
+// contexts for any other platforms, sorted by file name.
+func (ctxt *context) skippedFiles() []sym.SkippedFile {
+	seen := make(map[string]bool)
+	var files []sym.SkippedFile
+	for _, c := range ctxt.platforms {
+		for _, sf := range c.SkippedFiles() {
+			if !seen[sf.Filename] {
+				seen[sf.Filename] = true
+				files = append(files, sf)
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Filename < files[j].Filename
+	})
+	return files
+}
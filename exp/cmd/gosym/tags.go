@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/rog-go/exp/go/ast"
+	"code.google.com/p/rog-go/exp/go/sym"
+	"strconv"
+	"strings"
+)
+
+// retagField changes any values in the tag of the struct field
+// declared by info that name the field by its old name,
+// so that they name it by newName instead.
+func (c *writeCmd) retagField(info *sym.Info, newName string) {
+	field, ok := info.ReferObj.Decl.(*ast.Field)
+	if !ok || field.Tag == nil || info.ReferObj.Kind != ast.Var {
+		return
+	}
+	tag, err := strconv.Unquote(field.Tag.Value)
+	if err != nil {
+		return
+	}
+	tag, changed := retag(tag, info.ReferObj.Name, newName)
+	if !changed {
+		return
+	}
+	if strings.HasPrefix(field.Tag.Value, "`") && !strings.Contains(tag, "`") {
+		tag = "`" + tag + "`"
+	} else {
+		tag = strconv.Quote(tag)
+	}
+	p := c.position(field.Tag.Pos())
+	p.Offset = 0
+	c.warnf(p, warnChange, "changing tag of %s from %s to %s", info.ReferObj.Name, field.Tag.Value, tag)
+	field.Tag.Value = tag
+}
+
+// retag returns the given struct tag with the name in
+// each value (the part before any comma) changed to newName
+// if it is oldName, and reports whether it has changed
+// anything. The tag is parsed as by reflect.StructTag.Get;
+// any malformed part of it is left unchanged.
+func retag(tag, oldName, newName string) (string, bool) {
+	var buf bytes.Buffer
+	changed := false
+	for tag != "" {
+		// Skip leading space.
+		i := 0
+		for i < len(tag) && tag[i] == ' ' {
+			i++
+		}
+		buf.WriteString(tag[:i])
+		tag = tag[i:]
+		if tag == "" {
+			break
+		}
+		// Scan to colon. A space, a quote or a control
+		// character is a syntax error.
+		i = 0
+		for i < len(tag) && tag[i] > ' ' && tag[i] != ':' && tag[i] != '"' && tag[i] != 0x7f {
+			i++
+		}
+		if i == 0 || i+1 >= len(tag) || tag[i] != ':' || tag[i+1] != '"' {
+			break
+		}
+		buf.WriteString(tag[:i+1])
+		tag = tag[i+1:]
+
+		// Scan quoted string to find value.
+		i = 1
+		for i < len(tag) && tag[i] != '"' {
+			if tag[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i >= len(tag) {
+			break
+		}
+		qvalue := tag[:i+1]
+		tag = tag[i+1:]
+		if value, err := strconv.Unquote(qvalue); err == nil {
+			name, opts := value, ""
+			if j := strings.Index(value, ","); j >= 0 {
+				name, opts = value[:j], value[j:]
+			}
+			if name == oldName {
+				qvalue = strconv.Quote(newName + opts)
+				changed = true
+			}
+		}
+		buf.WriteString(qvalue)
+	}
+	buf.WriteString(tag)
+	return buf.String(), changed
+}
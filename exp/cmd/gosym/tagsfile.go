@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/rog-go/exp/go/ast"
+	"code.google.com/p/rog-go/exp/go/sym"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// tagKinds holds the ctags kind letter for each bit
+// in a kind mask (see kindBit).
+var tagKinds = map[uint]string{
+	uint(ast.Con): "c",
+	uint(ast.Var): "v",
+	uint(ast.Fun): "f",
+	uint(ast.Pkg): "p",
+	interfaceBit:  "i",
+	structBit:     "s",
+	otherTypeBit:  "t",
+}
+
+// printTag prints the declaration s to buf as an entry in a
+// tags file in the format given by the -tags-format flag. The
+// entries are completed by tagsFile when all have been printed;
+// an etags entry is preceded by its file name and a tab, so
+// that the entries can be grouped by file.
+func (c *listCmd) printTag(buf *bytes.Buffer, lines lineTables, s sym.Symbol) error {
+	name := s.Ident.Name
+	p := s.Position
+	switch c.tagsFmt {
+	case "ctags":
+		kind := tagKinds[c.kindBit(s)]
+		var scope string
+		if i := strings.LastIndex(s.Name, "."); i >= 0 {
+			// A method, named as T.M, or as (*T).M
+			// if it has a pointer receiver.
+			scope = strings.TrimSuffix(strings.TrimPrefix(s.Name[0:i], "(*"), ")")
+		}
+		if _, ok := s.ReferObj.Decl.(*ast.Field); ok && !s.Local {
+			// A struct field or interface method.
+			kind, scope = "m", s.Enclosing
+		}
+		fmt.Fprintf(buf, "%s\t%s\t%d;\"\t%s", name, p.Filename, p.Line, kind)
+		if scope != "" {
+			fmt.Fprintf(buf, "\ttype:%s", scope)
+		}
+		buf.WriteByte('\n')
+	case "etags":
+		line, err := lines.line(p.Filename, p.Line)
+		if err != nil {
+			return fmt.Errorf("%v: cannot find source line: %v", p, err)
+		}
+		end := p.Column - 1 + len(name)
+		if end > len(line) {
+			return fmt.Errorf("%v: %s is beyond the end of its source line", p, name)
+		}
+		fmt.Fprintf(buf, "%s\t%s\x7f%s\x01%d,%d\n", p.Filename, line[0:end], name, p.Line, p.Offset-(p.Column-1))
+	}
+	return nil
+}
+
+// tagsFile returns the tags file holding the entries in data,
+// as printed by printTag in the given format. A ctags file is
+// sorted by name, and an etags file has a section for each
+// source file, in the order in which the files were first seen.
+func tagsFile(format string, data []byte) []byte {
+	entries := strings.SplitAfter(string(data), "\n")
+	if n := len(entries); entries[n-1] == "" {
+		entries = entries[0 : n-1]
+	}
+	var buf bytes.Buffer
+	if format == "ctags" {
+		sort.Strings(entries)
+		buf.WriteString("!_TAG_FILE_FORMAT\t2\t/extended format/\n")
+		buf.WriteString("!_TAG_FILE_SORTED\t1\t/0=unsorted, 1=sorted, 2=foldcase/\n")
+		buf.WriteString("!_TAG_PROGRAM_NAME\tgosym\t//\n")
+		for _, e := range entries {
+			buf.WriteString(e)
+		}
+		return buf.Bytes()
+	}
+	var files []string
+	sections := make(map[string]*bytes.Buffer)
+	for _, e := range entries {
+		i := strings.Index(e, "\t")
+		file := e[0:i]
+		section := sections[file]
+		if section == nil {
+			section = new(bytes.Buffer)
+			sections[file] = section
+			files = append(files, file)
+		}
+		section.WriteString(e[i+1:])
+	}
+	for _, file := range files {
+		fmt.Fprintf(&buf, "\x0c\n%s,%d\n", file, sections[file].Len())
+		buf.Write(sections[file].Bytes())
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// unresolvedLimit holds the limit set by the -maxunresolved flag.
+type unresolvedLimit struct {
+	n       float64
+	percent bool
+}
+
+// parseUnresolvedLimit parses the value of the -maxunresolved flag,
+// either a number of symbols or a percentage such as 5%.
+func parseUnresolvedLimit(s string) (*unresolvedLimit, error) {
+	limit := &unresolvedLimit{
+		percent: strings.HasSuffix(s, "%"),
+	}
+	n, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || n < 0 || !limit.percent && n != float64(int(n)) {
+		return nil, fmt.Errorf("invalid -maxunresolved value %q", s)
+	}
+	limit.n = n
+	return limit, nil
+}
+
+// exceeded reports whether unresolved symbols
+// out of syms is more than the limit allows.
+func (limit *unresolvedLimit) exceeded(syms, unresolved int) bool {
+	if !limit.percent {
+		return float64(unresolved) > limit.n
+	}
+	return syms > 0 && 100*float64(unresolved)/float64(syms) > limit.n
+}
+
+// checkUnresolved prints the number of symbols that could not be
+// resolved by ctxt and by the contexts for any other platforms,
+// and returns an error if that is more than limit allows.
+func (ctxt *context) checkUnresolved(limit *unresolvedLimit) error {
+	var syms, unresolved int
+	for _, c := range ctxt.platforms {
+		s, u := c.Unresolved()
+		syms += s
+		unresolved += u
+	}
+	percent := 0.0
+	if syms > 0 {
+		percent = 100 * float64(unresolved) / float64(syms)
+	}
+	log.Printf("gosym: %d of %d symbols unresolved (%.1f%%)", unresolved, syms, percent)
+	if limit.exceeded(syms, unresolved) {
+		return fmt.Errorf("too many unresolved symbols")
+	}
+	return nil
+}
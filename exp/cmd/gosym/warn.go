@@ -0,0 +1,88 @@
+package main
+
+import (
+	"code.google.com/p/rog-go/exp/go/sym"
+	"code.google.com/p/rog-go/exp/go/token"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// The categories of warning. Each warning
+// is reported with one of these.
+const (
+	warnSource    = sym.WarnSource // a package or symbol could not be found, parsed or resolved.
+	warnPackage   = "package"      // a named package could not be found or walked.
+	warnInput     = "input"        // an input line could not be read.
+	warnConflict  = "conflict"     // a requested change conflicts with another and is not made.
+	warnCollision = "collision"    // a change makes a symbol collide with another.
+	warnChange    = "change"       // a change is made besides those requested.
+	warnSkipped   = "skipped"      // a change is left unmade, leaving the renaming incomplete.
+	warnCache     = "cache"        // the on-disk cache could not be written.
+	warnExcluded  = "excluded"     // a file is left out by the build constraints for every target platform.
+)
+
+// warnHandlers holds the warning handler for
+// each value of the -warnings flag.
+var warnHandlers = map[string]func(w sym.Warning){
+	"text":  logWarning,
+	"json":  func(w sym.Warning) { writeJSONWarning(os.Stderr, w) },
+	"quiet": func(sym.Warning) {},
+}
+
+// logWarning prints w with log.Printf.
+func logWarning(w sym.Warning) {
+	log.Printf("gosym: %v", w)
+}
+
+// jsonWarning is the JSON representation of a
+// warning, as printed with -warnings=json.
+type jsonWarning struct {
+	Pos      *jsonPosition `json:"pos,omitempty"`
+	Category string        `json:"category"`
+	Msg      string        `json:"msg"`
+}
+
+// writeJSONWarning writes w to out as a JSON
+// object on a line of its own.
+func writeJSONWarning(out io.Writer, w sym.Warning) {
+	jw := jsonWarning{
+		Category: w.Category,
+		Msg:      w.Msg,
+	}
+	if w.Pos.IsValid() {
+		p := toJSONPosition(w.Pos)
+		jw.Pos = &p
+	}
+	data, err := json.Marshal(jw)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(out, "%s\n", data)
+}
+
+// printWarning is the warning handler of a new context.
+// It prints w as the -warnings flag specifies, unless w is
+// in the warnSource category and the -v flag is false.
+func printWarning(w sym.Warning) {
+	if w.Category == warnSource && !*verbose {
+		return
+	}
+	warnHandlers[*warnings](w)
+}
+
+// sourceWarnings reports whether warnings in the warnSource
+// category, and the files skipped as they could not be
+// parsed, are printed.
+func sourceWarnings() bool {
+	return *verbose && *warnings != "quiet"
+}
+
+// warnf reports a warning in the given category at
+// position p, which may be the zero Position.
+// See sym.Context.Warnf.
+func (ctxt *context) warnf(p token.Position, category string, f string, a ...interface{}) {
+	ctxt.Warnf(p, category, f, a...)
+}
@@ -1,18 +1,83 @@
 package main
 
 import (
+	"bytes"
 	"code.google.com/p/rog-go/exp/go/ast"
+	"code.google.com/p/rog-go/exp/go/parser"
 	"code.google.com/p/rog-go/exp/go/sym"
 	"code.google.com/p/rog-go/exp/go/token"
+	"code.google.com/p/rog-go/exp/go/types"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 )
 
 type writeCmd struct {
 	*context
 
-	// lines holds all input lines.
-	lines map[token.Position]*symLine
+	// dryRun specifies that the changes should be
+	// printed as a diff rather than written.
+	dryRun bool
+
+	// strict specifies that no files should be written
+	// if any conflicts are found.
+	strict bool
+
+	// fixImports specifies that imports left unused
+	// by the changes should be removed.
+	fixImports bool
+
+	// retag specifies that struct tag values naming
+	// a renamed field should be changed too.
+	retag bool
+
+	// ignoreCase specifies that an input line may name
+	// the identifier at its position regardless of case.
+	ignoreCase bool
+
+	// skipVendor specifies that vendored packages should
+	// be treated as external: symbols declared in them are
+	// not renamed, and their files are not changed.
+	skipVendor bool
+
+	// input holds the name of the file to read
+	// the input lines from instead of stdin.
+	input string
+
+	// renames holds the values of the -rename flag,
+	// in pkg.Name=NewName format.
+	renames fileList
+
+	// planOut holds the name of the file to write the
+	// changes to as input lines, instead of making them.
+	planOut string
+
+	// planIn holds the name of the file to read a plan
+	// written by -plan-out from. Only the identifiers
+	// at its lines are changed.
+	planIn string
+
+	// plan holds the changes recorded for -plan-out,
+	// keyed by their text so that a change made for
+	// several platforms is recorded once.
+	plan map[string]*symLine
+
+	// scope holds the directory below which packages that
+	// import the changed packages are changed too. If it is
+	// empty, the source roots of the changed packages are
+	// used (see sourceRoots).
+	scope string
+
+	// lines holds all input lines, keyed by lineKey of
+	// their positions. Several lines may address the same
+	// position if they name different identifiers.
+	lines map[token.Position][]*symLine
 
 	// symPkgs holds packages that are mentioned in input
 	// lines that request a change.
@@ -23,12 +88,39 @@ type writeCmd struct {
 	// of the object's symbol.
 	globalReplace map[*ast.Object]string
 
+	// fileLocal holds the objects in globalReplace that can
+	// be referred to only in the file that declares them:
+	// local symbols and package names.
+	fileLocal map[*ast.Object]bool
+
 	// changed holds all the files that have been modified.
 	changed map[*ast.File]bool
+
+	// pkgImports holds the existing imports of each package,
+	// and newImports the imports added to each package by the
+	// changes, as used to find import cycles.
+	pkgImports map[string][]string
+	newImports map[string]map[string]bool
+
+	// requalified holds the expressions in the file being
+	// changed that are to be replaced when a symbol moves to
+	// another package: unqualified references that become
+	// qualified, and qualified ones that no longer need to be.
+	requalified map[ast.Expr]ast.Expr
+
+	// conflicts holds all the conflicting changes found.
+	conflicts []conflict
+}
+
+// conflict describes a requested change that could
+// not be made because it conflicts with another.
+type conflict struct {
+	pos token.Position
+	msg string
 }
 
 var writeAbout = `
-gosym write [pkg...]
+gosym write [flags] [pkg...]
 
 The gosym command reads lines in short format (see the
 "short" subcommand) from its standard input
@@ -37,117 +129,1165 @@ named packages accordingly - that is, the identifier
 at each line's file-position (and all uses of it) is changed to the new-name
 field.
 
-If no packages are named, "." is used. No files outside the named packages
-will be changed. The names of any changed files will
-be printed.
+If the -i flag is given, the lines are read from the named
+file instead of the standard input, which is ignored.
+
+The -rename flag, which may be repeated, renames a symbol
+without any input lines: its value, as in
+	-rename example.com/foo.Bar=Baz
+names the symbol in pkg.Name, pkg.T.M or pkg.(*T).M format,
+as for list -decl, followed by its new name. The symbol is
+changed as if it were named by an input line at its
+declaration, along with all the references to it in the
+named packages and the package that declares it, which is
+changed even if it is not named. A name that does not
+resolve to exactly one symbol is reported as an error, and
+no files are changed. When -rename is given, the standard
+input is not read, but the lines in the file named by -i,
+if given, are applied too.
+
+A large change can be made in two steps. If the -plan-out flag
+is given, no files are changed; instead, the changes are
+written to the named file as input lines, one for each
+identifier changed, including every reference to a renamed
+symbol, sorted by position. When the plan has been reviewed,
+the -plan-in flag applies it: only the identifiers at its
+lines are changed, with no symbols resolved again, and only
+the packages holding them are read, so no packages may be
+named. A line whose identifier no longer has its name, as
+when the files have changed since the plan was made, is
+reported as a conflict. Flags that change other text, such
+as -fiximports and -retag, must be given again when the
+plan is applied. The -plan-out flag cannot be used with the
+-n flag, and the -plan-in flag cannot be used with the -i,
+-rename or -scope flags.
+
+A line that ends with the word local (see the short
+command) requests a change only to the function-local
+symbol at its file-position, and uses of it; if that
+symbol is not local, the change is reported as a conflict
+instead of being made.
+
+The parameters of a function literal, such as the i and j
+of a func(i, j int) bool passed to sort.Slice, and the
+locals declared in it, are local to the literal, so
+renaming one changes none of the same-named symbols of
+other functions. A new name collides with the locals
+declared in the literal, and with those declared outside
+it that the literal refers to, but not with those of the
+rest of the function containing it.
+
+Two lines may give the same file-position only if they
+name different symbols, in which case each applies only to
+the identifier with its name.
+
+If the new name is qualified by an import path (for
+instance example.com/foo.Bar), references to the symbol
+through a package qualifier are changed to refer to that
+package instead, and it is imported where necessary.
+Unqualified references to it are qualified by the package,
+and references within that package lose their qualifier.
+The symbol's declaration cannot be moved, and is left
+unchanged, with a warning, as are references that cannot
+be qualified, such as local symbols and method receivers.
+A change that would make a package
+import itself, directly or through the packages it imports
+(including imports added by other changes), is reported
+as a conflict, along with the cycle of imports, instead
+of being made.
+
+A package name (as printed by list -k package) may be
+changed too, which changes the name of the import that it
+refers to, and of all the references to it, in its file only.
+The import is given an explicit name unless the new name is
+the name of the package itself, in which case any explicit
+name is removed. A new name that is already used by another
+import in the file, by a package-level declaration or by a
+local declaration in a function that uses the package name
+is reported as a collision.
+
+If no packages are named, "." is used. Package patterns
+containing "..." are expanded as with the go tool.
+No files outside the named packages and the packages that
+import them (see below) will be changed. The names of any
+changed files will be printed.
+
+The packages that import the packages of the input lines,
+directly or through other packages, are changed too, so that
+all the references to a renamed exported symbol are changed
+along with its declaration. They are looked for below the root
+of the source tree holding each package of the input lines:
+the directory of its module or, outside modules, the src
+directory of its GOPATH entry. If the -scope flag is given,
+they are looked for at or below the given directory instead,
+and importing packages elsewhere are left unchanged.
+
+Generated files (see the list command) are not changed
+unless the gosym -generated flag is given; a warning is
+printed for each generated file that the changes would
+otherwise have reached, as the renaming is incomplete there.
+Nor are the files that the build constraints leave out
+for every target platform (see the gosym -os, -arch and
+-tags flags), each of which is reported with a warning.
+
+If the -skipvendor flag is given, vendored packages are
+treated as external: a line that names a symbol declared
+in one is reported as a conflict, and their files are not
+changed, with a warning for each that the changes would
+otherwise have reached.
+
+If the -n flag is given, no files are changed; instead
+a unified diff of the changes is printed.
+
+If the gosym -overlay flag is given, the source files are
+read as replaced by the overlay in the named file, which holds
+a JSON object in the format used by the go tool's -overlay
+flag, as in:
+ 	{"Replace": {"a.go": "/tmp/staged/a.go", "old.go": ""}}
+Each file named as a key is read from the file it maps to, or
+is treated as missing if that is empty, so that, for instance,
+a pre-commit hook can check the staged contents of the files
+without writing them out. As the files on disk are not those
+read, the -n flag must be given too, and the diff printed is
+between the overlaid contents and the changed ones.
+
+If any requested changes conflict with one another, the
+command fails after making the other changes; if the -strict
+flag is given, no files are changed at all. A change that
+would make a symbol collide with another symbol of the same
+name is reported as a warning, or as a conflict if -strict
+is given. A new name that is predeclared, such as len or
+error, counts as such a collision, as the symbol would hide
+the predeclared one; a new name that is a keyword is always
+reported as a conflict, as is a line that names the blank
+identifier, _, either as the symbol or as its new name.
+A file whose symbols cannot all be visited, because the
+command panics part way through it (see -failfast), is also
+reported as a conflict and left unchanged.
+
+Input lines that cannot be parsed are reported along with
+their line numbers, and the command fails after making the
+changes requested by the other lines, unless -strict is
+given, in which case no files are changed.
+
+Before any change is made, each input line is checked
+against the source. A line whose file-position holds no
+symbol, or holds an identifier other than the one the
+line names, is reported as a conflict and ignored, so
+that stale or hand-edited input cannot change the wrong
+identifiers; if -strict is given, no files are changed.
+A line may also be given as printed by list -json, with
+the new name added as its newExpr field; the symbol it
+addresses must then also have the line's kind, and the
+identifier be in its exprPkg package, which may be
+shortened as by list -short with a number.
+
+If the -ignorecase flag is given, a line also applies to an
+identifier whose name differs from the one it gives only in
+case, so that, for instance, the line
+	p.go:3:5: FOO Foo
+changes the identifier foo at that position to Foo, which can
+be used to enforce naming conventions. An identifier that
+already has the new name is left unchanged, and a change
+that would make it collide with another identifier is
+reported as for any other change.
+
+When a method is renamed, any methods that must change
+with it so that a type declared in the named packages (or
+the packages of the input lines) still implements an
+interface declared there are renamed too, and the interfaces
+involved are reported. Methods are matched by name and
+signature.
+
+If the -fiximports flag is given, imports that are no
+longer used in a changed file (for instance because
+the package qualifier of the only reference to them
+has changed) are removed from it.
+
+If the -retag flag is given, when a struct field is renamed,
+any values in its tag that name the field by its old name
+(for instance json:"Old,omitempty") are changed to name
+it by its new name.
+
+The changed files are written only when all of them have
+been formatted, and each is written to a temporary file
+that replaces the original only when all the others have
+been written too, so an error part way through leaves
+the files unchanged.
+Each file keeps its permissions and, if most of its lines
+end in CRLF, its line endings. A file that is a symbolic
+link stays one, and the file it links to is changed.
 
 As with gofix, writes are destructive - make sure your
 source files are backed up before using this command.
 `[1:]
 
 func init() {
-	register("write", &writeCmd{}, nil, writeAbout)
+	c := &writeCmd{}
+	fset := flag.NewFlagSet("gosym write", flag.ExitOnError)
+	fset.BoolVar(&c.dryRun, "n", false, "print a diff of the changes instead of writing them")
+	fset.BoolVar(&c.strict, "strict", false, "do not change any files if there are conflicts")
+	fset.BoolVar(&c.fixImports, "fiximports", false, "remove imports left unused by the changes")
+	fset.BoolVar(&c.retag, "retag", false, "change struct tag values that name a renamed field")
+	fset.StringVar(&c.input, "i", "", "read the input lines from this file instead of stdin")
+	fset.BoolVar(&c.ignoreCase, "ignorecase", false, "match the names in input lines to identifiers regardless of case")
+	fset.BoolVar(&c.skipVendor, "skipvendor", false, "treat vendored packages as external, leaving them unchanged")
+	fset.StringVar(&c.scope, "scope", "", "change only the importing packages at or below this directory")
+	fset.Var(&c.renames, "rename", "rename the symbol pkg.Name to NewName (pkg.Name=NewName); may be repeated")
+	fset.StringVar(&c.planOut, "plan-out", "", "write the changes to this file as input lines instead of making them")
+	fset.StringVar(&c.planIn, "plan-in", "", "change only the identifiers at the lines of the plan in this file")
+	register("write", c, fset, writeAbout)
 }
 
 func (c *writeCmd) run(ctxt *context, args []string) error {
-	c.context = ctxt
-	c.lines = make(map[token.Position]*symLine)
+	if overlayFiles != nil && !c.dryRun && c.planOut == "" {
+		return fmt.Errorf("cannot change files read through -overlay; use -n to print the changes instead")
+	}
+	if c.planOut != "" && (c.dryRun || c.planIn != "") {
+		return fmt.Errorf("-plan-out cannot be used with -n or -plan-in")
+	}
+	if c.planIn != "" {
+		if len(args) > 0 || c.input != "" || len(c.renames) > 0 || c.scope != "" {
+			return fmt.Errorf("-plan-in cannot be used with packages or with -i, -rename or -scope")
+		}
+		c.input = c.planIn
+	}
+	c.reset(ctxt)
+
+	pkgs := args
+	if len(pkgs) == 0 {
+		pkgs = []string{"."}
+	}
+	pkgs = ctxt.expandPackages(pkgs)
+	// Symbols that were read successfully are changed
+	// even if some lines could not be read.
+	var readErr error
+	if len(c.renames) == 0 || c.input != "" {
+		readErr = c.readSymbols()
+	}
+	if readErr != nil {
+		readErr = fmt.Errorf("failed to read symbols: %v", readErr)
+		if c.strict {
+			return fmt.Errorf("%v; no files changed", readErr)
+		}
+	}
+	renamePkgs, err := c.checkRenames()
+	if err != nil {
+		return err
+	}
+	if c.planIn != "" {
+		// The plan names every identifier to change,
+		// so only the packages holding them are visited.
+		pkgs = pkgs[:0]
+		for path := range c.symPkgs {
+			pkgs = append(pkgs, path)
+		}
+		sort.Strings(pkgs)
+	}
+	// The packages declaring the renamed symbols are
+	// changed even if they are not named.
+	named := make(map[*ast.Package]bool)
+	for _, path := range pkgs {
+		named[c.Import(path)] = true
+	}
+	for _, path := range renamePkgs {
+		if !named[c.Import(path)] {
+			pkgs = append(pkgs, path)
+		}
+	}
+	// When there are several target platforms, the changes are
+	// made for each one in turn, and each changed file is
+	// written once only, as changed for the first platform
+	// that includes it.
+	if c.planIn == "" {
+		scopes := []string{c.scope}
+		if c.scope == "" {
+			scopes = c.sourceRoots()
+		}
+		seen := make(map[string]bool)
+		for _, path := range pkgs {
+			seen[path] = true
+		}
+		for _, dir := range scopes {
+			importers, err := c.importers(dir)
+			if err != nil {
+				return err
+			}
+			for _, path := range importers {
+				if !seen[path] {
+					seen[path] = true
+					pkgs = append(pkgs, path)
+				}
+			}
+		}
+	}
+	ctxts := ctxt.platformContexts()
+	ctxt.reportExcluded(pkgs)
+	c.validateLines(ctxts)
+	if c.strict && len(c.conflicts) > 0 {
+		return withCode(exitWrite, fmt.Errorf("%v; no files changed", c.conflictError()))
+	}
+	for _, pctxt := range ctxts {
+		c.resetPlatform(pctxt)
+		if c.planIn == "" {
+			c.addGlobals()
+			c.addRenames()
+			c.addInterfaceMethods(pkgs)
+			c.checkCollisions()
+		}
+		c.replace(pkgs)
+		c.refuseFailedFiles()
+		if c.fixImports {
+			c.removeAllUnusedImports()
+		}
+	}
+	if c.strict && len(c.conflicts) > 0 {
+		return withCode(exitWrite, fmt.Errorf("%v; no files changed", c.conflictError()))
+	}
+	if c.planOut != "" {
+		if err := c.writePlan(); err != nil {
+			return withCode(exitWrite, err)
+		}
+		if err := c.conflictError(); err != nil {
+			return withCode(exitWrite, err)
+		}
+		return readErr
+	}
+	done := make(map[string]bool)
+	srcs := make(map[string][]byte)
+	for _, pctxt := range ctxts {
+		files := make(map[string]*ast.File)
+		for name, f := range pctxt.ChangedFiles {
+			if !done[name] {
+				done[name] = true
+				files[name] = f
+			}
+		}
+		if c.dryRun {
+			if err := pctxt.DiffFiles(pctxt.stdout, files); err != nil {
+				return withCode(exitWrite, err)
+			}
+			continue
+		}
+		// All the files are formatted before any is written,
+		// so that no file is changed if any cannot be.
+		psrcs, err := pctxt.FormatFiles(files)
+		if err != nil {
+			return withCode(exitWrite, err)
+		}
+		for name, src := range psrcs {
+			srcs[name] = src
+		}
+	}
+	if err := c.writeSources(srcs); err != nil {
+		return withCode(exitWrite, err)
+	}
+	if err := c.conflictError(); err != nil {
+		return withCode(exitWrite, err)
+	}
+	return readErr
+}
+
+// reset prepares c to make changes in ctxt,
+// with no input lines read yet.
+func (c *writeCmd) reset(ctxt *context) {
+	c.lines = make(map[token.Position][]*symLine)
 	c.symPkgs = make(map[string]bool)
+	c.plan = make(map[string]*symLine)
+	c.resetPlatform(ctxt)
+}
+
+// resetPlatform prepares c to make the changes requested
+// by its input lines for the target platform of ctxt.
+func (c *writeCmd) resetPlatform(ctxt *context) {
+	c.context = ctxt
 	c.globalReplace = make(map[*ast.Object]string)
+	c.pkgImports = make(map[string][]string)
+	c.newImports = make(map[string]map[string]bool)
+}
 
-	pkgs := args
-	if err := c.readSymbols(); err != nil {
-		return fmt.Errorf("failed to read symbols: %v", err)
+// addPlan records for -plan-out the change of the identifier
+// in info, at position p, to newExpr.
+func (c *writeCmd) addPlan(p token.Position, info *sym.Info, newExpr string) {
+	sl := &symLine{
+		pos:     p,
+		expr:    info.Ident.Name,
+		newExpr: newExpr,
+		local:   info.Local,
 	}
-	c.addGlobals()
-	c.replace(pkgs)
-	for name := range c.ChangedFiles {
-		c.printf("%s\n", name)
+	c.plan[sl.String()] = sl
+}
+
+// writePlan writes the changes recorded by addPlan to the
+// file named by -plan-out, one input line for each, sorted
+// by position.
+func (c *writeCmd) writePlan() error {
+	lines := make([]*symLine, 0, len(c.plan))
+	for _, sl := range c.plan {
+		lines = append(lines, sl)
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		pi, pj := lines[i].pos, lines[j].pos
+		if pi != pj {
+			return positions{pi, pj}.Less(0, 1)
+		}
+		return lines[i].expr < lines[j].expr
+	})
+	var buf bytes.Buffer
+	tables := make(lineTables)
+	for _, sl := range lines {
+		if *runes {
+			if err := sl.runeColumns(tables); err != nil {
+				return fmt.Errorf("cannot count columns in runes: %v", err)
+			}
+		}
+		fmt.Fprintf(&buf, "%s\n", sl)
+	}
+	return ioutil.WriteFile(c.planOut, buf.Bytes(), 0666)
+}
+
+// importers returns the import paths of the packages at or
+// below the directory dir that import any of the packages in
+// c.symPkgs, directly or through other packages, as they may
+// refer to the changed symbols through embedded fields or
+// the results of functions. The test files are included if
+// c.ImportTests is set.
+func (c *writeCmd) importers(dir string) ([]string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("-scope %s is not a directory", dir)
 	}
-	if err := c.WriteFiles(c.ChangedFiles); err != nil {
+	// importedBy maps each import path to the
+	// packages in scope that import it.
+	importedBy := make(map[string][]string)
+	walkPackageDirs(dir, -1, func(pdir string) {
+		path, err := c.PackagePath(token.Position{Filename: filepath.Join(pdir, "x.go")})
+		if err != nil {
+			c.warnf(token.Position{}, warnPackage, "%v", err)
+			return
+		}
+		bpkg, err := c.FindPackage(path, pdir, 0)
+		if err != nil {
+			c.warnf(token.Position{}, warnPackage, "cannot find package %q: %v", path, err)
+			return
+		}
+		imps := bpkg.Imports
+		if c.ImportTests {
+			imps = append(append(imps, bpkg.TestImports...), bpkg.XTestImports...)
+		}
+		for _, imp := range imps {
+			importedBy[imp] = append(importedBy[imp], path)
+		}
+	})
+	var found []string
+	seen := make(map[string]bool)
+	var add func(path string)
+	add = func(path string) {
+		for _, p := range importedBy[path] {
+			if !seen[p] {
+				seen[p] = true
+				if !c.symPkgs[p] {
+					found = append(found, p)
+				}
+				add(p)
+			}
+		}
+	}
+	for path := range c.symPkgs {
+		seen[path] = true
+	}
+	for path := range c.symPkgs {
+		add(path)
+	}
+	sort.Strings(found)
+	return found, nil
+}
+
+// sourceRoots returns the directories at the roots of the
+// source trees holding the packages in c.symPkgs, sorted,
+// as found by sym.Context.SourceRoot. Packages in GOROOT
+// are not changed, so they have none.
+func (c *writeCmd) sourceRoots() []string {
+	seen := make(map[string]bool)
+	var roots []string
+	for path := range c.symPkgs {
+		if root, ok := c.SourceRoot(path); ok && !seen[root] {
+			seen[root] = true
+			roots = append(roots, root)
+		}
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+// writeSources writes the new contents of the given files
+// and prints their names. If any file cannot be written,
+// none of them is changed.
+func (c *writeCmd) writeSources(srcs map[string][]byte) error {
+	if err := sym.WriteSources(srcs); err != nil {
 		return err
 	}
+	names := make([]string, 0, len(srcs))
+	for name := range srcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.printf("%s\n", name)
+	}
 	return nil
 }
 
-// readSymbols records all the symbols from stdin.
+// refuseFailedFiles reports as a conflict each file whose
+// identifiers could not all be visited because of a panic,
+// and leaves it unchanged, as it may have been changed
+// only in part.
+func (c *writeCmd) refuseFailedFiles() {
+	for _, p := range c.FailedFiles() {
+		delete(c.ChangedFiles, p.Filename)
+		for key, sl := range c.plan {
+			if sl.pos.Filename == p.Filename {
+				delete(c.plan, key)
+			}
+		}
+		c.addConflict(p, "cannot visit the rest of the file; not changing it")
+	}
+}
+
+// addConflict logs a conflict at the given position
+// and records it in c.conflicts.
+func (c *writeCmd) addConflict(p token.Position, f string, a ...interface{}) {
+	msg := fmt.Sprintf(f, a...)
+	for _, old := range c.conflicts {
+		if old.pos == p && old.msg == msg {
+			// Already found for another platform.
+			return
+		}
+	}
+	c.warnf(p, warnConflict, "%s", msg)
+	c.conflicts = append(c.conflicts, conflict{p, msg})
+}
+
+// conflictError returns an error summarizing c.conflicts,
+// or nil if there are none.
+func (c *writeCmd) conflictError() error {
+	if len(c.conflicts) == 0 {
+		return nil
+	}
+	files := make(map[string]bool)
+	for _, conflict := range c.conflicts {
+		files[conflict.pos.Filename] = true
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("found %d conflicts in %s", len(c.conflicts), strings.Join(names, ", "))
+}
+
+// readSymbols records all the symbols from stdin,
+// or from the file named by the -i flag.
 func (c *writeCmd) readSymbols() error {
-	readLines(func(sl *symLine) error {
-		if sl.long {
+	rd := io.Reader(os.Stdin)
+	if c.input != "" {
+		f, err := os.Open(c.input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rd = f
+	}
+	return c.readLinesFrom(rd, func(sl *symLine) error {
+		if sl.long && sl.newExpr == "" {
 			return fmt.Errorf("line is not in short format")
 		}
-		if sl.newExpr == sl.symName() {
+		if sl.newExpr == sl.symName() && !c.ignoreCase {
 			// Ignore line if it doesn't request a change.
+			// With -ignorecase, the identifier may differ
+			// from the line, so validateLines checks instead.
 			return nil
 		}
-		if old, ok := c.lines[sl.pos]; ok {
-			log.Printf("%v: duplicate symbol location; original at %v", sl.pos, old.pos)
-			return nil
+		path, err := c.positionToImportPath(sl.pos)
+		if err != nil {
+			return err
+		}
+		if c.addLine(sl) {
+			c.symPkgs[path] = true
 		}
-		c.lines[sl.pos] = sl
-		c.symPkgs[c.positionToImportPath(sl.pos)] = true
 		return nil
 	})
-	return nil
+}
+
+// checkRenames checks that each -rename flag value names
+// exactly one object and a valid new name, adds the packages
+// that declare the objects to c.symPkgs, and returns their
+// import paths.
+func (c *writeCmd) checkRenames() ([]string, error) {
+	var paths []string
+	for _, r := range c.renames {
+		name, _, err := splitRename(r)
+		if err != nil {
+			return nil, err
+		}
+		obj, _, err := lookupDecl(c.context, name)
+		if err != nil {
+			return nil, fmt.Errorf("cannot rename %s: %v", name, err)
+		}
+		path, err := c.positionToImportPath(c.position(types.DeclPos(obj)))
+		if err != nil {
+			return nil, err
+		}
+		// The external test package may declare
+		// a package-level symbol of the same name.
+		_, rest := splitDeclName(c.context, name)
+		if xpkg := c.ImportXTest(path); xpkg != nil && xpkg.Scope.Lookup(rest) != nil {
+			return nil, fmt.Errorf("cannot rename %s: it is also declared in the external test package of %s", name, path)
+		}
+		if !c.symPkgs[path] {
+			c.symPkgs[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// addRenames adds the objects named by the -rename flag
+// values to c.globalReplace. They are resolved again for
+// each platform, as each has its own objects; an object that
+// is not declared for the current platform is skipped.
+func (c *writeCmd) addRenames() {
+	for _, r := range c.renames {
+		name, newName, _ := splitRename(r)
+		obj, _, err := lookupDecl(c.context, name)
+		if err != nil {
+			continue
+		}
+		p := c.position(types.DeclPos(obj))
+		if c.skipVendor && isVendoredFile(p.Filename) {
+			c.addConflict(p, "%s is declared in a vendored package; not changing it to %s", name, newName)
+			continue
+		}
+		if old, ok := c.globalReplace[obj]; ok && old != newName {
+			c.addConflict(p, "conflicting replacement for %s", name)
+			continue
+		}
+		if newName != obj.Name {
+			c.globalReplace[obj] = newName
+		}
+	}
+}
+
+// splitRename splits a -rename flag value into the
+// name of the symbol and its new name.
+func splitRename(r string) (name, newName string, err error) {
+	i := strings.LastIndex(r, "=")
+	if i < 0 {
+		return "", "", fmt.Errorf("invalid -rename %q; want pkg.Name=NewName", r)
+	}
+	name, newName = r[0:i], r[i+1:]
+	if !isIdentifier(newName) || newName == "_" {
+		return "", "", fmt.Errorf("invalid -rename %q: %q is not a valid new name", r, newName)
+	}
+	return name, newName, nil
+}
+
+// addLine adds sl to c.lines, and reports whether it has done
+// so. A line for the same symbol at the same position as an
+// earlier line is reported as a conflict instead.
+func (c *writeCmd) addLine(sl *symLine) bool {
+	key := lineKey(sl.pos)
+	for _, old := range c.lines[key] {
+		if old.symName() == sl.symName() {
+			c.addConflict(sl.pos, "duplicate symbol location; original at %v", old.pos)
+			return false
+		}
+	}
+	c.lines[key] = append(c.lines[key], sl)
+	return true
+}
+
+// validateLines checks, before any change is made, that
+// each input line addresses an identifier with the name of
+// its symbol in the files of at least one of the given
+// contexts, and, for a line that gives them, with its kind
+// and in its package. Lines that do not are reported as
+// conflicts and removed from c.lines.
+func (c *writeCmd) validateLines(ctxts []*context) {
+	// found holds the name of the identifier
+	// addressed by each valid line, and mismatch
+	// why a line that names the identifier is not
+	// valid.
+	found := make(map[*symLine]string)
+	mismatch := make(map[*symLine]string)
+	seen := make(map[token.Position]string)
+	for _, pctxt := range ctxts {
+		for path := range c.symPkgs {
+			for _, pkg := range pctxt.importPackages(path) {
+				for _, f := range sym.SortedFiles(pkg) {
+					pctxt.IterateSyms(f, func(info *sym.Info) bool {
+						key := lineKey(pctxt.position(info.Pos))
+						if lines := c.lines[key]; lines != nil {
+							seen[key] = info.Ident.Name
+							for _, l := range lines {
+								name := l.symName()
+								if name != info.Ident.Name && !(c.ignoreCase && strings.EqualFold(name, info.Ident.Name)) {
+									continue
+								}
+								if msg := pctxt.lineMismatch(l, info); msg != "" {
+									mismatch[l] = msg
+								} else {
+									found[l] = info.Ident.Name
+								}
+							}
+						}
+						return true
+					})
+				}
+			}
+		}
+	}
+	keys := make(positions, 0, len(c.lines))
+	for key := range c.lines {
+		keys = append(keys, key)
+	}
+	sort.Sort(keys)
+	for _, key := range keys {
+		lines := c.lines[key]
+		valid := lines[:0]
+		for _, l := range lines {
+			switch name, ok := seen[key]; {
+			case found[l] != "":
+				if ident := found[l]; ident != l.symName() {
+					// The line names the identifier in another
+					// case, so make it name it as it is.
+					l.expr = l.expr[0:len(l.expr)-len(l.symName())] + ident
+				}
+				if _, newName := splitNewExpr(l.newExpr); token.Lookup([]byte(newName)).IsKeyword() {
+					c.addConflict(l.pos, "%s is a keyword; not changing %s to it", newName, l.expr)
+				} else if newName == "_" {
+					c.addConflict(l.pos, "not changing %s to the blank identifier", l.expr)
+				} else if l.newExpr != l.symName() {
+					valid = append(valid, l)
+				}
+				continue
+			case mismatch[l] != "":
+				c.addConflict(l.pos, "%s; not changing %s to %s", mismatch[l], l.expr, l.newExpr)
+			case l.symName() == "_":
+				// The blank identifier is never visited,
+				// as it declares nothing.
+				c.addConflict(l.pos, "the blank identifier cannot be renamed; not changing it to %s", l.newExpr)
+			case ok:
+				c.addConflict(l.pos, "identifier is %s, not %s; not changing it to %s", name, l.symName(), l.newExpr)
+			default:
+				c.addConflict(l.pos, "no symbol found; not changing %s to %s", l.expr, l.newExpr)
+			}
+		}
+		if len(valid) == 0 {
+			delete(c.lines, key)
+		} else {
+			c.lines[key] = valid
+		}
+	}
+}
+
+// lineMismatch returns why the input line l does not
+// describe the identifier in info, or "" if it does.
+// Only a line in long format gives the kind of its symbol
+// and its package, which may be shortened as by list -short.
+func (ctxt *context) lineMismatch(l *symLine, info *sym.Info) string {
+	if !l.long {
+		return ""
+	}
+	if l.kind != info.ReferObj.Kind {
+		return fmt.Sprintf("symbol is a %s, not a %s", info.ReferObj.Kind, l.kind)
+	}
+	path, err := ctxt.positionToImportPath(ctxt.position(info.Pos))
+	if err != nil {
+		return err.Error()
+	}
+	if path != l.exprPkg && !strings.HasSuffix(path, "/"+l.exprPkg) {
+		return fmt.Sprintf("identifier is in package %s, not %s", path, l.exprPkg)
+	}
+	return ""
+}
+
+// positions implements sort.Interface to sort
+// positions by file name, line and column.
+type positions []token.Position
+
+func (p positions) Len() int      { return len(p) }
+func (p positions) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p positions) Less(i, j int) bool {
+	a, b := p[i], p[j]
+	switch {
+	case a.Filename != b.Filename:
+		return a.Filename < b.Filename
+	case a.Line != b.Line:
+		return a.Line < b.Line
+	}
+	return a.Column < b.Column
 }
 
 // addGlobals adds any symbols to wctxt.globalReplace that
 // have a change requested by any input line.
 func (c *writeCmd) addGlobals() {
+	c.fileLocal = make(map[*ast.Object]bool)
 	// visitor adds a symbol to wctxt.globalReplace if necessary.
 	visitor := func(info *sym.Info) bool {
 		p := c.position(info.Pos)
 		p.Offset = 0
-		line, ok := c.lines[p]
-		if !ok {
+		line := c.line(p, info.Ident.Name)
+		if line == nil {
+			return true
+		}
+		if line.local && !info.Local {
+			c.addConflict(p, "%s is not local; not changing it to %s", line.expr, line.newExpr)
 			return true
 		}
-		sym := line.symName()
-		if sym != info.ReferObj.Name {
-			// name being changed does not match object.
-			log.Printf("gosym: %v: changing %q to %q; saw %q; p, ignoring", p, sym, line.newExpr, info.ReferObj.Name)
+		if c.skipVendor && isVendoredFile(c.position(info.ReferPos).Filename) {
+			c.addConflict(p, "%s is declared in a vendored package; not changing it to %s", line.expr, line.newExpr)
+			return true
 		}
 		if old, ok := c.globalReplace[info.ReferObj]; ok {
 			if old != line.newExpr {
-				log.Printf("gosym: %v: conflicting replacement for %s", p, line.expr)
+				c.addConflict(p, "conflicting replacement for %s", line.expr)
 				return true
 			}
 		}
 		c.globalReplace[info.ReferObj] = line.newExpr
+		if info.Local || info.ReferObj.Kind == ast.Pkg {
+			c.fileLocal[info.ReferObj] = true
+		}
 		return true
 	}
 
 	// Search for all symbols that need replacing.
+	files := c.lineFiles()
 	for path := range c.symPkgs {
-		pkg := c.Import(path)
-		if pkg == nil {
-			log.Printf("gosym: could not find package %q", path)
+		pkgs := c.importPackages(path)
+		if pkgs == nil {
+			c.warnf(token.Position{}, warnPackage, "could not find package %q", path)
+			setExitStatus(exitNotFound)
 			continue
 		}
-		for _, f := range pkg.Files {
-			// TODO don't bother if file isn't mentioned in input lines.
-			c.IterateSyms(f, visitor)
+		for _, pkg := range pkgs {
+			for _, f := range sym.SortedFiles(pkg) {
+				if files[lineKey(c.position(f.Package)).Filename] {
+					c.IterateSyms(f, visitor)
+				}
+			}
 		}
 	}
 }
 
-// replace replaces all symbols in files as directed by
-// the input lines.
-func (c *writeCmd) replace(pkgs []string) {
-	if len(pkgs) == 0 {
-		pkgs = []string{"."}
+// checkCollisions checks that none of the symbols in
+// c.globalReplace will collide with an existing symbol
+// when renamed.
+func (c *writeCmd) checkCollisions() {
+	checked := make(map[*ast.Object]bool)
+	for path := range c.symPkgs {
+		for _, pkg := range c.importPackages(path) {
+			for _, f := range sym.SortedFiles(pkg) {
+				c.checkFileCollisions(pkg, f, checked)
+			}
+		}
 	}
+}
+
+// checkFileCollisions checks for collisions caused by
+// renaming any of the symbols referred to in f.
+func (c *writeCmd) checkFileCollisions(pkg *ast.Package, f *ast.File, checked map[*ast.Object]bool) {
+	var infos []*sym.Info
+	locals := make(map[string][]token.Pos)       // local declarations by name.
+	localUses := make(map[string][]*sym.Info)    // uses of locals by name.
+	objUses := make(map[*ast.Object][]token.Pos) // uses of locals by object.
+	pkgUses := make(map[*ast.Object][]token.Pos) // uses of package names.
+	c.IterateSyms(f, func(info *sym.Info) bool {
+		if info.Local && info.ReferPos == info.Pos {
+			locals[info.ReferObj.Name] = append(locals[info.ReferObj.Name], info.Pos)
+		} else if info.Local {
+			localUses[info.ReferObj.Name] = append(localUses[info.ReferObj.Name], info)
+			objUses[info.ReferObj] = append(objUses[info.ReferObj], info.Pos)
+		}
+		if info.ReferObj.Kind == ast.Pkg {
+			pkgUses[info.ReferObj] = append(pkgUses[info.ReferObj], info.Pos)
+		}
+		if _, ok := c.globalReplace[info.ReferObj]; ok && !checked[info.ReferObj] {
+			infos = append(infos, info)
+		}
+		return true
+	})
+	for _, info := range infos {
+		if checked[info.ReferObj] {
+			continue
+		}
+		checked[info.ReferObj] = true
+		_, newName := splitNewExpr(c.globalReplace[info.ReferObj])
+		if e, ok := info.Expr.(*ast.SelectorExpr); ok {
+			// A field or method; look for a member with
+			// the new name in the type of the selector's operand.
+			_, xt := types.ExprType(e.X, c.Import)
+			if xt.Kind == ast.Pkg {
+				// Symbols in other packages are checked
+				// when that package is.
+				checked[info.ReferObj] = false
+				continue
+			}
+			if other := xt.Member(newName, c.Import); other != nil && c.globalReplace[other] == "" {
+				c.collision(info, newName, "member of %s declared at %v", pretty(depointer(xt.Node)), c.position(types.DeclPos(other)))
+			}
+			continue
+		}
+		// A new name that is predeclared is legal, but hides the
+		// predeclared symbol wherever the new name is in scope,
+		// which the name of a field or method never is.
+		member := !info.Local && info.ReferObj.Kind != ast.Pkg && pkg.Scope.Lookup(info.ReferObj.Name) != info.ReferObj
+		if obj := parser.Universe.Lookup(newName); obj != nil && !member {
+			c.collision(info, newName, "predeclared %s %s", obj.Kind, newName)
+		}
+		if info.ReferObj.Kind == ast.Pkg {
+			c.checkImportCollisions(pkg, f, info, newName, pkgUses[info.ReferObj], locals)
+			continue
+		}
+		if pkg.Scope.Lookup(info.ReferObj.Name) == info.ReferObj {
+			if other := c.existingObj(pkg.Scope, newName); other != nil {
+				c.collision(info, newName, "package-level declaration at %v", c.position(types.DeclPos(other)))
+			}
+			continue
+		}
+		scope := localScope(f, info.ReferPos)
+		if scope == nil {
+			// Not a local symbol; it will be checked
+			// when it is seen in a selector expression.
+			checked[info.ReferObj] = false
+			continue
+		}
+		// Look for locals with the new name in the same
+		// block, and in inner blocks where the symbol is
+		// used, and for those declared outside it that it
+		// refers to, which the new name would hide.
+		c.checkLocalCollisions(f, info, newName, scope, locals[newName], localUses[newName], objUses[info.ReferObj])
+		if other := c.existingObj(pkg.Scope, newName); other != nil {
+			c.collision(info, newName, "package-level declaration at %v", c.position(types.DeclPos(other)))
+		}
+	}
+}
+
+// checkImportCollisions checks for collisions caused by
+// renaming the package name referred to by info, which is
+// used at the given positions in f, to newName. The names of
+// other imports in f, package-level declarations and local
+// declarations in the functions that use the package name
+// are checked.
+func (c *writeCmd) checkImportCollisions(pkg *ast.Package, f *ast.File, info *sym.Info, newName string, uses []token.Pos, locals map[string][]token.Pos) {
+	for _, imp := range sym.FileImports(f) {
+		if imp != info.ReferObj.Decl && c.localName(imp) == newName {
+			c.collision(info, newName, "import of %q at %v", importPath(imp), c.position(imp.Pos()))
+			return
+		}
+	}
+	// Other files' imports are recorded in the package scope
+	// too, but they do not collide with those of f.
+	if other := c.existingObj(pkg.Scope, newName); other != nil && other.Kind != ast.Pkg {
+		c.collision(info, newName, "package-level declaration at %v", c.position(types.DeclPos(other)))
+		return
+	}
+	for _, use := range uses {
+		fd := enclosingFunc(f, use)
+		if fd == nil {
+			continue
+		}
+		for _, pos := range locals[newName] {
+			if fd.Pos() <= pos && pos < fd.End() {
+				c.collision(info, newName, "local declaration at %v", c.position(pos))
+				return
+			}
+		}
+	}
+}
+
+// checkLocalCollisions checks for collisions caused by renaming
+// the local symbol referred to by info, declared in scope, to
+// newName, given the positions of the local declarations named
+// newName in f, the uses of locals named newName and the uses
+// of the symbol itself.
+func (c *writeCmd) checkLocalCollisions(f *ast.File, info *sym.Info, newName string, scope ast.Node, decls []token.Pos, uses []*sym.Info, objUses []token.Pos) {
+	inScope := func(n ast.Node, pos token.Pos) bool {
+		return n.Pos() <= pos && pos < n.End()
+	}
+	for _, pos := range decls {
+		if !inScope(scope, pos) {
+			continue
+		}
+		// A local in the same block is redeclared; one in
+		// an inner block hides the symbol where it is
+		// used after it in that block.
+		declScope := localScope(f, pos)
+		if declScope == scope {
+			c.collision(info, newName, "local declaration at %v", c.position(pos))
+			return
+		}
+		for _, use := range objUses {
+			if inScope(declScope, use) && use > pos {
+				c.collision(info, newName, "local declaration at %v", c.position(pos))
+				return
+			}
+		}
+	}
+	for _, use := range uses {
+		if inScope(scope, use.Pos) && !inScope(scope, use.ReferPos) && use.Pos > info.ReferPos {
+			c.collision(info, newName, "local declaration at %v", c.position(use.ReferPos))
+			return
+		}
+	}
+}
+
+// existingObj returns the object with the given name in
+// the given scope, unless it is itself being renamed.
+func (c *writeCmd) existingObj(scope *ast.Scope, name string) *ast.Object {
+	obj := scope.Lookup(name)
+	if obj == nil || obj.Kind == ast.Bad || c.globalReplace[obj] != "" {
+		return nil
+	}
+	return obj
+}
+
+// collision reports that renaming the symbol referred to by info
+// to newName will collide with the symbol described by the
+// given message. This is a conflict only in strict mode.
+func (c *writeCmd) collision(info *sym.Info, newName string, f string, a ...interface{}) {
+	p := c.position(info.ReferPos)
+	p.Offset = 0
+	msg := fmt.Sprintf("renaming %s to %s collides with %s", info.ReferObj.Name, newName, fmt.Sprintf(f, a...))
+	if c.strict {
+		c.addConflict(p, "%s", msg)
+		return
+	}
+	c.warnf(p, warnCollision, "%s", msg)
+}
+
+// enclosingFunc returns the top level function
+// declaration in f that contains pos, or nil if there is none.
+func enclosingFunc(f *ast.File, pos token.Pos) *ast.FuncDecl {
+	for _, d := range f.Decls {
+		if fd, ok := d.(*ast.FuncDecl); ok && fd.Pos() <= pos && pos < fd.End() {
+			return fd
+		}
+	}
+	return nil
+}
+
+// localScope returns the node for the innermost block in f
+// that contains pos, or nil if pos is not in a function.
+// The block of a function, which holds its parameters and
+// the locals declared in its body, is represented by the
+// function declaration or literal; other blocks by the
+// statement or clause that makes them.
+func localScope(f *ast.File, pos token.Pos) ast.Node {
+	fd := enclosingFunc(f, pos)
+	if fd == nil {
+		return nil
+	}
+	var scope ast.Node = fd
+	if fd.Body == nil {
+		return scope
+	}
+	ast.Inspect(fd.Body, func(n ast.Node) bool {
+		if n == nil || pos < n.Pos() || n.End() <= pos {
+			return false
+		}
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			scope = n
+		case *ast.BlockStmt:
+			if n != funcBody(scope) {
+				scope = n
+			}
+		case *ast.IfStmt, *ast.ForStmt, *ast.RangeStmt, *ast.SwitchStmt,
+			*ast.TypeSwitchStmt, *ast.CaseClause, *ast.CommClause:
+			scope = n
+		}
+		return true
+	})
+	return scope
+}
+
+// funcBody returns the body of the function
+// declaration or literal n, or nil if n is neither.
+func funcBody(n ast.Node) *ast.BlockStmt {
+	switch n := n.(type) {
+	case *ast.FuncDecl:
+		return n.Body
+	case *ast.FuncLit:
+		return n.Body
+	}
+	return nil
+}
+
+// lineFiles returns the names of the files
+// mentioned in the input lines.
+func (c *writeCmd) lineFiles() map[string]bool {
+	files := make(map[string]bool)
+	for p := range c.lines {
+		files[p.Filename] = true
+	}
+	return files
+}
+
+// lineKey returns the key in writeCmd.lines for the position
+// p: p with an absolute file name and no offset, so that
+// positions are compared by file, line and column only.
+func lineKey(p token.Position) token.Position {
+	p.Offset = 0
+	if !filepath.IsAbs(p.Filename) {
+		if abs, err := filepath.Abs(p.Filename); err == nil {
+			p.Filename = abs
+		}
+	}
+	return p
+}
+
+// line returns the input line for the identifier with the
+// given name at position p, or nil if there is none. A line
+// applies only to an identifier with the name of its symbol,
+// so that a change is not made to the wrong identifier.
+func (c *writeCmd) line(p token.Position, name string) *symLine {
+	for _, l := range c.lines[lineKey(p)] {
+		if l.symName() == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// replace replaces all symbols in files in the given
+// packages as directed by the input lines.
+func (c *writeCmd) replace(pkgs []string) {
+	var file *ast.File // the file being visited.
 	visitor := func(info *sym.Info) bool {
 		globSym, globRepl := c.globalReplace[info.ReferObj]
 		p := c.position(info.Pos)
 		p.Offset = 0
-		line, lineRepl := c.lines[p]
+		line := c.line(p, info.Ident.Name)
+		lineRepl := line != nil
 		if !lineRepl && !globRepl {
 			return true
 		}
 		var newSym string
 		if lineRepl {
-			if newSym = line.symName(); newSym == info.ReferObj.Name {
+			newSym = line.symName()
+			if c.planIn != "" {
+				// A line of a plan changes only the
+				// identifier at its position.
+				newSym = line.newExpr
+			}
+			if newSym == info.ReferObj.Name {
 				// There is a line for this symbol, but the name is
 				// not changing, so ignore it.
 				lineRepl = false
@@ -157,24 +1297,236 @@ func (c *writeCmd) replace(pkgs []string) {
 			// N.B. global symbols are not recorded in globalReplace
 			// if they make no change.
 			if lineRepl && globSym != newSym {
-				log.Printf("gosym: %v: conflicting global/local change (%q vs %q)", p, globSym, newSym)
+				c.addConflict(p, "conflicting global/local change (%q vs %q)", globSym, newSym)
 				return true
 			}
 			newSym = globSym
 		}
+		newExpr := newSym
+		if path, name := splitNewExpr(newSym); path != "" {
+			if !c.requalify(file, info, path) {
+				return true
+			}
+			newSym = name
+		}
+		if c.planOut != "" {
+			c.addPlan(p, info, newExpr)
+		}
+		if info.DotImport {
+			c.warnf(p, warnSkipped, "renaming %q imported to .; leaving it unqualified", info.ReferObj.Name)
+		}
 		info.Ident.Name = newSym
+		if info.ReferObj.Kind == ast.Pkg {
+			c.renameImport(file, info.ReferObj, newSym)
+		}
+		if c.retag && info.ReferPos == info.Pos {
+			c.retagField(info, newSym)
+		}
 		return true
 	}
+	// Unless a change can reach other files, only
+	// the files mentioned in input lines need be visited.
+	files := c.lineFiles()
+	for obj := range c.globalReplace {
+		if !c.fileLocal[obj] {
+			files = nil
+			break
+		}
+	}
 	for _, path := range pkgs {
-		pkg := c.Import(path)
-		if pkg == nil {
-			log.Printf("gosym: could not find package %q", path)
+		ipkgs := c.importPackages(path)
+		if ipkgs == nil {
+			c.warnf(token.Position{}, warnPackage, "could not find package %q", path)
+			setExitStatus(exitNotFound)
 			continue
 		}
-		for _, f := range pkg.Files {
-			// TODO when no global replacements, don't bother if file
-			// isn't mentioned in input lines.
-			c.IterateSyms(f, visitor)
+		for _, pkg := range ipkgs {
+			for _, f := range sym.SortedFiles(pkg) {
+				if files != nil && !files[lineKey(c.position(f.Package)).Filename] {
+					continue
+				}
+				if !c.Generated && sym.IsGenerated(f) {
+					c.checkUnchanged(f, "generated")
+					continue
+				}
+				if c.skipVendor && isVendoredFile(c.position(f.Package).Filename) {
+					c.checkUnchanged(f, "vendored")
+					continue
+				}
+				file = f
+				c.requalified = make(map[ast.Expr]ast.Expr)
+				c.IterateSyms(f, visitor)
+				if len(c.requalified) > 0 {
+					replaceExprs(f, c.requalified)
+					c.ChangedFiles[c.position(f.Package).Filename] = f
+				}
+			}
+		}
+	}
+}
+
+// checkUnchanged warns if any identifier in f would be
+// renamed, as the file is not changed because it is of
+// the given kind (generated or vendored).
+func (c *writeCmd) checkUnchanged(f *ast.File, kind string) {
+	c.IterateSyms(f, func(info *sym.Info) bool {
+		newSym, ok := c.globalReplace[info.ReferObj]
+		if !ok {
+			p := c.position(info.Pos)
+			p.Offset = 0
+			if line := c.line(p, info.Ident.Name); line != nil {
+				newSym = line.symName()
+			}
+		}
+		if newSym == "" || newSym == info.ReferObj.Name {
+			return true
 		}
+		c.warnf(c.position(info.Pos), warnSkipped, "not changing %s file; renaming of %s is incomplete", kind, info.ReferObj.Name)
+		return false
+	})
+}
+
+// isVendoredFile reports whether the named
+// file is in a vendored package.
+func isVendoredFile(name string) bool {
+	return sym.IsVendored(filepath.ToSlash(filepath.Dir(name)))
+}
+
+// removeAllUnusedImports removes any unused imports
+// from all the files changed in the current context.
+func (c *writeCmd) removeAllUnusedImports() {
+	names := make([]string, 0, len(c.ChangedFiles))
+	for name := range c.ChangedFiles {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.removeUnusedImports(c.ChangedFiles[name])
+	}
+}
+
+// splitNewExpr splits a new name as given in an input line
+// into the import path of the package that the symbol
+// should be referred to in, if any, and the symbol's name.
+func splitNewExpr(newExpr string) (path, name string) {
+	if i := strings.LastIndex(newExpr, "."); i >= 0 {
+		return newExpr[0:i], newExpr[i+1:]
+	}
+	return "", newExpr
+}
+
+// requalify changes the reference to a symbol in info, which
+// is in f, so that it refers to the symbol in the package with
+// the given import path, importing the package into f if
+// necessary. A reference through a package qualifier has the
+// qualifier changed, or removed if f is in that package, and
+// an unqualified reference is qualified. It reports whether
+// the reference can refer to the package, so that the
+// symbol can be renamed.
+func (c *writeCmd) requalify(f *ast.File, info *sym.Info, path string) bool {
+	p := c.position(info.Pos)
+	p.Offset = 0
+	e, isSel := info.Expr.(*ast.SelectorExpr)
+	var x *ast.Ident
+	if isSel {
+		x, _ = e.X.(*ast.Ident)
+	}
+	switch {
+	case info.ReferPos == info.Pos:
+		c.warnf(p, warnSkipped, "cannot move the declaration of %s to %q; leaving it unchanged", info.ReferObj.Name, path)
+		return false
+	case !isSel && (info.Local || info.ReferObj.Kind == ast.Pkg):
+		c.warnf(p, warnSkipped, "%s is not declared at package level; leaving it unchanged", info.ReferObj.Name)
+		return false
+	case !isSel && isReceiver(f, info.Pos):
+		c.warnf(p, warnSkipped, "method receiver %s cannot refer to another package; leaving it unchanged", info.ReferObj.Name)
+		return false
+	case isSel && (x == nil || x.Obj == nil || x.Obj.Kind != ast.Pkg):
+		c.warnf(p, warnSkipped, "%s is not qualified by a package; leaving it unchanged", info.ReferObj.Name)
+		return false
+	}
+	// An external test package cannot be imported,
+	// so its imports cannot make a cycle.
+	var from string
+	if !strings.HasSuffix(f.Name.Name, "_test") {
+		var err error
+		if from, err = c.positionToImportPath(c.position(f.Package)); err != nil {
+			c.addConflict(p, "cannot change package of %s: %v", info.ReferObj.Name, err)
+			return false
+		}
+		if from == path {
+			// The reference is in the package itself.
+			if isSel {
+				c.requalified[e] = e.Sel
+			}
+			return true
+		}
+		if chain := c.importCycle(from, path); chain != nil {
+			c.addConflict(p, "cannot change package of %s: import cycle %s", info.ReferObj.Name, strings.Join(chain, " -> "))
+			return false
+		}
+	}
+	name, err := c.importName(f, path)
+	if err != nil {
+		c.addConflict(p, "cannot change package of %s: %v", info.ReferObj.Name, err)
+		return false
+	}
+	if from != "" {
+		c.addPackageImport(from, path)
+	}
+	switch {
+	case !isSel:
+		c.requalified[info.Ident] = &ast.SelectorExpr{
+			X:   &ast.Ident{NamePos: info.Ident.Pos(), Name: name},
+			Sel: info.Ident,
+		}
+	case x.Name != name:
+		x.Name = name
+		c.ChangedFiles[c.position(f.Package).Filename] = f
+	}
+	return true
+}
+
+// isReceiver reports whether pos is within the receiver
+// of a method declared in f.
+func isReceiver(f *ast.File, pos token.Pos) bool {
+	fd := enclosingFunc(f, pos)
+	return fd != nil && fd.Recv != nil && fd.Recv.Pos() <= pos && pos < fd.Recv.End()
+}
+
+// exprType is the type of the ast.Expr interface.
+var exprType = reflect.TypeOf((*ast.Expr)(nil)).Elem()
+
+// replaceExprs replaces each expression in f that is a key
+// in repl by its value. Only expressions held in fields of type
+// ast.Expr or []ast.Expr can be replaced, which includes all
+// references to symbols other than the selectors of selector
+// expressions.
+func replaceExprs(f *ast.File, repl map[ast.Expr]ast.Expr) {
+	replace := func(v reflect.Value) {
+		if v.IsNil() {
+			return
+		}
+		if r, ok := repl[v.Interface().(ast.Expr)]; ok {
+			v.Set(reflect.ValueOf(r))
+		}
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		v := reflect.ValueOf(n)
+		if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+			return true
+		}
+		v = v.Elem()
+		for i := 0; i < v.NumField(); i++ {
+			switch field := v.Field(i); {
+			case field.Type() == exprType:
+				replace(field)
+			case field.Kind() == reflect.Slice && field.Type().Elem() == exprType:
+				for j := 0; j < field.Len(); j++ {
+					replace(field.Index(j))
+				}
+			}
+		}
+		return true
+	})
 }
@@ -754,6 +754,11 @@ type (
 		Name    *Ident        // local package name (including "."); or nil
 		Path    *BasicLit     // import path
 		Comment *CommentGroup // line comments; or nil
+
+		// Resolved holds the import path of the package that
+		// Path refers to when it is different, as when the
+		// package is vendored; otherwise it is empty.
+		Resolved string
 	}
 
 	// A ValueSpec node represents a constant or variable declaration
@@ -771,6 +776,7 @@ type (
 	TypeSpec struct {
 		Doc     *CommentGroup // associated documentation; or nil
 		Name    *Ident        // type name
+		Assign  token.Pos     // position of '=', if the declaration is an alias
 		Type    Expr          // *Ident, *ParenExpr, *SelectorExpr, *StarExpr, or any of the *XxxTypes
 		Comment *CommentGroup // line comments; or nil
 	}
@@ -12,6 +12,7 @@ import (
 	"code.google.com/p/rog-go/exp/go/scanner"
 	"code.google.com/p/rog-go/exp/go/token"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -114,6 +115,13 @@ func ParseDeclList(fset *token.FileSet, filename string, src interface{}, scope
 	return p.parseDeclList(), p.parseEOF()
 }
 
+// Panic specifies whether a panic while parsing is passed on
+// to the caller of ParseFile. If it is false, the panic is
+// returned as an error holding the position reached, and
+// ParseFiles and ParseDir ignore the file, as they do files
+// with syntax errors.
+var Panic = true
+
 // ParseFile parses the source code of a single Go source file and returns
 // the corresponding ast.File node. The source code may be provided via
 // the filename of the source file, or via the src parameter.
@@ -134,13 +142,20 @@ func ParseDeclList(fset *token.FileSet, filename string, src interface{}, scope
 // representing the fragments of erroneous source code). Multiple errors
 // are returned via a scanner.ErrorList which is sorted by file position.
 //
-func ParseFile(fset *token.FileSet, filename string, src interface{}, mode uint, pkgScope *ast.Scope) (*ast.File, error) {
+func ParseFile(fset *token.FileSet, filename string, src interface{}, mode uint, pkgScope *ast.Scope) (f *ast.File, err error) {
 	data, err := readSource(filename, src)
 	if err != nil {
 		return nil, err
 	}
 
 	var p parser
+	if !Panic {
+		defer func() {
+			if e := recover(); e != nil {
+				f, err = nil, fmt.Errorf("%v: panic while parsing: %v", fset.Position(p.pos), e)
+			}
+		}()
+	}
 	p.init(fset, filename, data, mode, pkgScope)
 	p.pkgScope = p.topScope
 	p.openScope()
@@ -148,8 +163,8 @@ func ParseFile(fset *token.FileSet, filename string, src interface{}, mode uint,
 	return p.parseFile(), p.GetError(scanner.NoMultiples) // parseFile() reads to EOF
 }
 
-func parseFileInPkg(fset *token.FileSet, pkgs map[string]*ast.Package, filename string, mode uint) (err error) {
-	data, err := readSource(filename, nil)
+func parseFileInPkg(fset *token.FileSet, pkgs map[string]*ast.Package, filename string, mode uint, readFile func(string) ([]byte, error)) (err error) {
+	data, err := readFile(filename)
 	if err != nil {
 		return err
 	}
@@ -183,10 +198,29 @@ func parseFileInPkg(fset *token.FileSet, pkgs map[string]*ast.Package, filename
 // error encountered is returned.
 //
 func ParseFiles(fset *token.FileSet, filenames []string, mode uint) (pkgs map[string]*ast.Package, first error) {
+	pkgs, errs := ParseFilesFunc(fset, filenames, mode, ioutil.ReadFile)
+	for _, filename := range filenames {
+		if err := errs[filename]; err != nil {
+			return pkgs, err
+		}
+	}
+	return pkgs, nil
+}
+
+// ParseFilesFunc is like ParseFiles, but reads the source of
+// each file by calling readFile, so that the source may come
+// from somewhere other than the file system, and returns the
+// error for each file that could not be parsed, keyed by file
+// name, instead of the first error only.
+//
+func ParseFilesFunc(fset *token.FileSet, filenames []string, mode uint, readFile func(filename string) ([]byte, error)) (pkgs map[string]*ast.Package, errs map[string]error) {
 	pkgs = make(map[string]*ast.Package)
 	for _, filename := range filenames {
-		if err := parseFileInPkg(fset, pkgs, filename, mode); err != nil && first == nil {
-			first = err
+		if err := parseFileInPkg(fset, pkgs, filename, mode, readFile); err != nil {
+			if errs == nil {
+				errs = make(map[string]error)
+			}
+			errs[filename] = err
 		}
 	}
 	return
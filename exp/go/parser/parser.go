@@ -77,7 +77,7 @@ func scannerMode(mode uint) uint {
 
 func (p *parser) init(fset *token.FileSet, filename string, src []byte, mode uint, topScope *ast.Scope) {
 	p.fset = fset
-	p.file = fset.AddFile(filename, fset.Base(), len(src))
+	p.file = fset.AddFile(filename, -1, len(src)) // use FileSet.Base() atomically
 	p.scanner.Init(p.file, src, p, scannerMode(mode))
 
 	p.mode = mode
@@ -1961,7 +1961,7 @@ func parseImportSpec(p *parser, doc *ast.CommentGroup, decl *ast.GenDecl, _ int)
 	}
 	p.expectSemi() // call before accessing p.linecomment
 
-	spec := &ast.ImportSpec{doc, ident, path, p.lineComment}
+	spec := &ast.ImportSpec{doc, ident, path, p.lineComment, ""}
 	if declIdent != nil && declIdent.Name != "." {
 		p.declare(spec, p.topScope, ast.Pkg, declIdent)
 	}
@@ -1995,6 +1995,11 @@ func parseConstSpec(p *parser, doc *ast.CommentGroup, decl *ast.GenDecl, iota in
 	} else {
 		p.declare(spec, p.topScope, ast.Con, idents...)
 	}
+	for _, ident := range idents {
+		if ident.Obj != nil && ident.Obj.Kind == ast.Con {
+			ident.Obj.Data = iota
+		}
+	}
 
 	return spec
 }
@@ -2009,8 +2014,12 @@ func parseTypeSpec(p *parser, doc *ast.CommentGroup, decl *ast.GenDecl, _ int) a
 	// at the identifier in the TypeSpec and ends at the end of the innermost
 	// containing block.
 	// (Global identifiers are resolved in a separate phase after parsing.)
-	spec := &ast.TypeSpec{doc, ident, nil, p.lineComment}
+	spec := &ast.TypeSpec{doc, ident, token.NoPos, nil, p.lineComment}
 	p.declare(spec, p.topScope, ast.Typ, ident)
+	if p.tok == token.ASSIGN {
+		spec.Assign = p.pos
+		p.next()
+	}
 	typ := p.parseType()
 	p.expectSemi() // call before accessing p.linecomment
 	spec.Type = typ
@@ -2047,8 +2056,12 @@ func (p *parser) parseGenDecl(keyword token.Token, f parseSpecFunction) *ast.Gen
 		defer un(trace(p, "GenDecl("+keyword.String()+")"))
 	}
 
+	// Take the doc comment before expect advances past it;
+	// the order of evaluation within a composite literal
+	// is not specified.
+	doc := p.leadComment
 	decl := &ast.GenDecl{
-		Doc:    p.leadComment,
+		Doc:    doc,
 		TokPos: p.expect(keyword),
 		Tok:    keyword,
 	}
@@ -5,8 +5,10 @@
 package parser
 
 import (
+	"code.google.com/p/rog-go/exp/go/ast"
 	"code.google.com/p/rog-go/exp/go/token"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -51,6 +53,7 @@ var validPrograms = []interface{}{
 	`package p; func f() { switch ; {} };`,
 	`package p; func f() (int,) {}`,
         `package p; func _(x []int) { for range x {} }`,
+	`package p; type T = *int; type (A = T; B int)`,
 }
 
 func TestParseValidPrograms(t *testing.T) {
@@ -109,3 +112,16 @@ func TestParse4(t *testing.T) {
 		}
 	}
 }
+
+func TestParsePanic(t *testing.T) {
+	// A method with an invalid receiver type panics.
+	src := "package p\n\nfunc (x []int) M() {}\n"
+	Panic = false
+	defer func() {
+		Panic = true
+	}()
+	_, err := ParseFile(fset, "panic.go", src, 0, ast.NewScope(Universe))
+	if err == nil || !strings.Contains(err.Error(), "panic.go:3:") || !strings.Contains(err.Error(), "panic while parsing") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
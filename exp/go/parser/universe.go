@@ -2,11 +2,36 @@ package parser
 
 import "code.google.com/p/rog-go/exp/go/ast"
 
+// Universe holds the objects for the predeclared identifiers,
+// which are in scope in every package. By default it holds
+// the types bool, byte, complex64, complex128, error, float,
+// float32, float64, int, int8, int16, int32, int64, rune,
+// string, uint, uint8, uint16, uint32, uint64 and uintptr,
+// the constants true, false and iota, the variable nil, and the
+// functions append, cap, close, complex, copy, delete, imag, len,
+// make, new, panic, panicln, print, println, real and recover.
+// The zero value nil is counted as a variable rather than a
+// constant, as it has no constant value and cannot be declared
+// as a constant. More can be added with DeclarePredeclared.
 var Universe = ast.NewScope(nil)
 
-func declObj(kind ast.ObjKind, name string) {
+func declObj(kind ast.ObjKind, name string) *ast.Object {
 	// don't use Insert because it forbids adding to Universe
-	Universe.Objects[name] = ast.NewObj(kind, name)
+	obj := ast.NewObj(kind, name)
+	Universe.Objects[name] = obj
+	return obj
+}
+
+// DeclarePredeclared adds a predeclared identifier with the given
+// kind (ast.Con, ast.Typ, ast.Var or ast.Fun) and name to Universe,
+// replacing any with the same name, and returns its object. It
+// allows code that uses identifiers predeclared by a particular
+// compiler, such as intrinsic functions, to be resolved. As
+// identifiers are resolved when they are parsed, it should be
+// called before any source is parsed, and not concurrently with
+// parsing.
+func DeclarePredeclared(kind ast.ObjKind, name string) *ast.Object {
+	return declObj(kind, name)
 }
 
 func init() {
@@ -40,7 +65,9 @@ func init() {
 	declObj(ast.Con, "false")
 	declObj(ast.Con, "true")
 	declObj(ast.Con, "iota")
-	declObj(ast.Con, "nil")
+
+	// nil has no constant value; see Universe.
+	declObj(ast.Var, "nil")
 
 	// predeclared functions
 	// TODO(gri) provide "type"
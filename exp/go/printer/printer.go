@@ -14,6 +14,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"text/tabwriter"
 )
 
@@ -67,6 +68,11 @@ type printer struct {
 	mode    pmode       // current printer mode
 	lastTok token.Token // the last token printed (token.ILLEGAL if it's whitespace)
 
+	// impliedSemi is set if a linebreak written now would
+	// imply a semicolon, as it does after an identifier,
+	// a literal or a closing bracket.
+	impliedSemi bool
+
 	// Reused buffers
 	wsbuf  []whiteSpace // delayed white space
 	litbuf bytes.Buffer // for creation of escaped literals and comments
@@ -709,6 +715,7 @@ func (p *printer) print(args ...interface{}) {
 		next := p.pos // estimated position of next item
 		var data string
 		var tok token.Token
+		var impliedSemi bool
 
 		switch x := f.(type) {
 		case pmode:
@@ -731,12 +738,19 @@ func (p *printer) print(args ...interface{}) {
 			}
 			p.wsbuf = p.wsbuf[0 : i+1]
 			p.wsbuf[i] = x
+			if x == newline || x == formfeed {
+				// The pending linebreak ends the line,
+				// so no semicolon is implied any more.
+				p.impliedSemi = false
+			}
 		case *ast.Ident:
 			data = x.Name
 			tok = token.IDENT
+			impliedSemi = true
 		case *ast.BasicLit:
 			data = p.escape(x.Value)
 			tok = x.Kind
+			impliedSemi = true
 		case token.Token:
 			s := x.String()
 			if mayCombine(p.lastTok, s[0]) {
@@ -754,6 +768,11 @@ func (p *printer) print(args ...interface{}) {
 			}
 			data = s
 			tok = x
+			switch x {
+			case token.BREAK, token.CONTINUE, token.FALLTHROUGH, token.RETURN,
+				token.INC, token.DEC, token.RPAREN, token.RBRACK, token.RBRACE:
+				impliedSemi = true
+			}
 		case token.Pos:
 			if x.IsValid() {
 				next = p.fset.Position(x) // accurate position of next item
@@ -761,6 +780,7 @@ func (p *printer) print(args ...interface{}) {
 			tok = p.lastTok
 		case string:
 			data = x
+			impliedSemi = true
 		default:
 			fmt.Fprintf(os.Stderr, "print: unsupported argument type %T (%#v)\n", f, f)
 			panic("go/printer type")
@@ -778,15 +798,44 @@ func (p *printer) print(args ...interface{}) {
 			p.writeNewlines(next.Line-p.pos.Line, droppedFF)
 
 			p.writeItem(next, data)
+			p.impliedSemi = impliedSemi
 		}
 	}
 }
 
 // commentBefore returns true iff the current comment occurs
-// before the next position in the source code.
+// before the next position in the source code, and may be
+// written now. A comment that ends in a newline is not written
+// where that would imply a semicolon; this matters when the
+// printed position is ahead of the source, as it is after an
+// identifier that has been renamed to a longer name.
 //
 func (p *printer) commentBefore(next token.Position) bool {
-	return p.cindex < len(p.comments) && p.fset.Position(p.comments[p.cindex].List[0].Pos()).Offset < next.Offset
+	if p.cindex >= len(p.comments) {
+		return false
+	}
+	list := p.comments[p.cindex].List
+	if p.fset.Position(list[0].Pos()).Offset >= next.Offset {
+		return false
+	}
+	return !p.impliedSemi || !p.commentsHaveNewline(list)
+}
+
+// commentsHaveNewline reports whether the comments in list
+// span more than one line or end in a newline, as a //-style
+// comment does.
+//
+func (p *printer) commentsHaveNewline(list []*ast.Comment) bool {
+	line := p.fset.Position(list[0].Pos()).Line
+	for _, c := range list {
+		if p.fset.Position(c.Pos()).Line != line {
+			return true
+		}
+		if t := c.Text; len(t) >= 2 && (t[1] == '/' || strings.Contains(t, "\n")) {
+			return true
+		}
+	}
+	return false
 }
 
 // Flush prints any pending comments and whitespace occurring
@@ -980,6 +1029,7 @@ func (cfg *Config) fprint(output io.Writer, fset *token.FileSet, node interface{
 			p.errors <- fmt.Errorf("printer.Fprint: unsupported node type %T", n)
 			runtime.Goexit()
 		}
+		p.impliedSemi = false // EOF acts like a newline
 		p.flush(token.Position{Offset: infinity, Line: infinity}, token.EOF)
 		p.errors <- nil // no errors
 	}()
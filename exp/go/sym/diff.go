@@ -0,0 +1,227 @@
+package sym
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// diffContext holds the number of unchanged lines
+// printed around each change in a diff.
+const diffContext = 3
+
+// diffOp is a line of a diff: a line of the old file that is
+// deleted ('-'), one of the new file that is inserted ('+'),
+// or one that is in both (' ').
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diff returns a unified diff between b1 and b2, labelled
+// with the given file name, in the form printed by diff -u.
+func diff(name string, b1, b2 []byte) []byte {
+	ops := diffLines(splitLines(b1), splitLines(b2))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s.orig\n+++ %s\n", name, name)
+
+	// line1[i] and line2[i] hold the number of lines of
+	// each file before ops[i].
+	line1 := make([]int, len(ops)+1)
+	line2 := make([]int, len(ops)+1)
+	for i, op := range ops {
+		line1[i+1], line2[i+1] = line1[i], line2[i]
+		if op.kind != '+' {
+			line1[i+1]++
+		}
+		if op.kind != '-' {
+			line2[i+1]++
+		}
+	}
+	for i := 0; i < len(ops); {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+		// A hunk holds all the changes that are separated
+		// by no more than twice the context.
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				i = end
+				continue
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next == len(ops) || next-end > 2*diffContext {
+				break
+			}
+			end = next
+		}
+		end = i + diffContext
+		if end > len(ops) {
+			end = len(ops)
+		}
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n",
+			hunkRange(line1[start], line1[end]),
+			hunkRange(line2[start], line2[end]))
+		for _, op := range ops[start:end] {
+			buf.WriteByte(op.kind)
+			buf.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return buf.Bytes()
+}
+
+// hunkRange returns the range of lines from line
+// start up to end in the header of a hunk.
+func hunkRange(start, end int) string {
+	switch n := end - start; n {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprint(start + 1)
+	default:
+		return fmt.Sprintf("%d,%d", start+1, n)
+	}
+}
+
+// splitLines splits data into lines, each with its
+// newline, except perhaps for the last.
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n') + 1
+		if i == 0 {
+			i = len(data)
+		}
+		lines = append(lines, string(data[:i]))
+		data = data[i:]
+	}
+	return lines
+}
+
+// diffLines returns the shortest sequence of operations
+// that turns the lines a into the lines b, found with
+// Myers' algorithm. In each run of changes, the
+// deletions come before the insertions.
+func diffLines(a, b []string) []diffOp {
+	var prefix, suffix []diffOp
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		prefix = append(prefix, diffOp{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		suffix = append(suffix, diffOp{' ', a[len(a)-1]})
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	// v[max+k] holds the furthest x reached on diagonal k,
+	// where y = x-k; trace[d] holds v[max-d:max+d+1] after
+	// d changes.
+	n, m := len(a), len(b)
+	max := n + m
+	v := make([]int, 2*max+2)
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		done := false
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[max+k-1] < v[max+k+1]) {
+				x = v[max+k+1]
+			} else {
+				x = v[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[max+k] = x
+			if x >= n && y >= m {
+				done = true
+				break
+			}
+		}
+		trace = append(trace, append([]int(nil), v[max-d:max+d+1]...))
+		if done {
+			break
+		}
+	}
+
+	// Follow the trace back from the end.
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		k := x - y
+		var pk int
+		if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+			pk = k + 1
+		} else {
+			pk = k - 1
+		}
+		px := prev[pk+d-1]
+		py := px - pk
+		for x > px && y > py {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x, y = x-1, y-1
+		}
+		if x == px {
+			ops = append(ops, diffOp{'+', b[y-1]})
+			y--
+		} else {
+			ops = append(ops, diffOp{'-', a[x-1]})
+			x--
+		}
+	}
+	for x > 0 {
+		ops = append(ops, diffOp{' ', a[x-1]})
+		x--
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	orderChanges(ops)
+
+	for i, j := 0, len(suffix)-1; i < j; i, j = i+1, j-1 {
+		suffix[i], suffix[j] = suffix[j], suffix[i]
+	}
+	return append(append(prefix, ops...), suffix...)
+}
+
+// orderChanges moves the deletions in each run of
+// changes in ops before the insertions, keeping
+// their order otherwise.
+func orderChanges(ops []diffOp) {
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		j := i
+		var dels, ins []diffOp
+		for ; j < len(ops) && ops[j].kind != ' '; j++ {
+			if ops[j].kind == '-' {
+				dels = append(dels, ops[j])
+			} else {
+				ins = append(ins, ops[j])
+			}
+		}
+		copy(ops[i:], dels)
+		copy(ops[i+len(dels):], ins)
+		i = j
+	}
+}
@@ -0,0 +1,84 @@
+package sym
+
+import (
+	"code.google.com/p/rog-go/exp/go/ast"
+	"code.google.com/p/rog-go/exp/go/parser"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CommandLinePackage is the import path of the package made
+// by ImportFiles, named as the go tool names the package
+// made from source files named on its command line.
+const CommandLinePackage = "command-line-arguments"
+
+// ImportFiles parses the named files as a package of their
+// own, regardless of any other files in their directories or of
+// their build constraints, so that a file that is not part of
+// any package that can be imported, such as a script outside
+// GOPATH, can be walked as the package CommandLinePackage.
+// The files must all be in the same package.
+//
+// As the imports of such a file often cannot be found,
+// IterateSyms visits references to members of packages that
+// cannot be found in these files, instead of skipping them:
+// their ReferObj has kind ast.Bad and no type, and refers
+// to the import of the package, and Walk reports their
+// ReferPkg as "?".
+func (ctxt *Context) ImportFiles(filenames []string) (*ast.Package, error) {
+	files := make([]string, len(filenames))
+	for i, name := range filenames {
+		files[i] = absPath(name)
+	}
+	pkgs, errs := parser.ParseFilesFunc(ctxt.FileSet, files, parser.ParseComments, ctxt.readFile)
+	for _, name := range files {
+		if err := errs[name]; err != nil {
+			return nil, err
+		}
+	}
+	if len(pkgs) != 1 {
+		var names []string
+		for name := range pkgs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("files are in different packages (%s)", strings.Join(names, ", "))
+	}
+	var pkg *ast.Package
+	for _, p := range pkgs {
+		pkg = p
+	}
+	ctxt.pkgMutex.Lock()
+	defer ctxt.pkgMutex.Unlock()
+	ctxt.pkgCache[CommandLinePackage] = pkg
+	delete(ctxt.xtestCache, CommandLinePackage)
+	for _, name := range files {
+		ctxt.cmdFiles[name] = true
+	}
+	return pkg, nil
+}
+
+// isCommandLineFile reports whether f is one
+// of the files imported by ImportFiles.
+func (ctxt *Context) isCommandLineFile(f *ast.File) bool {
+	ctxt.pkgMutex.Lock()
+	defer ctxt.pkgMutex.Unlock()
+	return ctxt.cmdFiles[ctxt.filename(f)]
+}
+
+// unresolvedImport returns the import through which e
+// refers to a member of another package, or nil if e
+// is not a qualified identifier.
+func unresolvedImport(e ast.Expr) *ast.ImportSpec {
+	sel, ok := e.(*ast.SelectorExpr)
+	if !ok {
+		return nil
+	}
+	x, ok := sel.X.(*ast.Ident)
+	if !ok || x.Obj == nil || x.Obj.Kind != ast.Pkg {
+		return nil
+	}
+	spec, _ := x.Obj.Decl.(*ast.ImportSpec)
+	return spec
+}
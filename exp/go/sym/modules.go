@@ -0,0 +1,309 @@
+package sym
+
+import (
+	"bufio"
+	"bytes"
+	"code.google.com/p/rog-go/exp/go/token"
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// module holds the import path of a module and the
+// directory holding its source.
+type module struct {
+	path string
+	dir  string
+}
+
+// FindPackage returns details of the package with the given
+// import path, as BuildContext.Import does. If the current
+// directory is inside a module (and $GO111MODULE is not "off"),
+// packages in the main module and in the modules it requires,
+// as listed in its go.mod file, are found in the module's
+// directory or in the module cache, and a relative path to a
+// package in one of those modules is resolved to its full
+// import path.
+func (ctxt *Context) FindPackage(path, srcDir string, mode build.ImportMode) (*build.Package, error) {
+	mods := ctxt.modules()
+	if len(mods) == 0 {
+		return ctxt.BuildContext.Import(path, srcDir, mode)
+	}
+	if build.IsLocalImport(path) {
+		dir := path
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(srcDir, dir)
+		}
+		if p, ok := modulePath(mods, dir); ok {
+			path = p
+		}
+	}
+	dir, ok := moduleDir(mods, path)
+	if !ok {
+		return ctxt.BuildContext.Import(path, srcDir, mode)
+	}
+	bpkg, err := ctxt.BuildContext.ImportDir(dir, mode)
+	if bpkg != nil {
+		bpkg.ImportPath = path
+	}
+	return bpkg, err
+}
+
+// modules returns the modules found from the go.mod file of
+// the module containing the current directory, the main
+// module first, or nil if there is none.
+func (ctxt *Context) modules() []module {
+	ctxt.modOnce.Do(func() {
+		if os.Getenv("GO111MODULE") == "off" {
+			return
+		}
+		cwd, err := os.Getwd()
+		if err != nil {
+			return
+		}
+		gomod := findGoMod(cwd)
+		if gomod == "" {
+			return
+		}
+		mods, err := readGoMod(gomod, ctxt.modCacheDir())
+		if err != nil {
+			ctxt.logf(token.NoPos, "%v", err)
+			return
+		}
+		ctxt.mods = mods
+	})
+	return ctxt.mods
+}
+
+// modCacheDir returns the directory of the module cache.
+func (ctxt *Context) modCacheDir() string {
+	if dir := os.Getenv("GOMODCACHE"); dir != "" {
+		return dir
+	}
+	for _, dir := range filepath.SplitList(ctxt.BuildContext.GOPATH) {
+		if dir != "" {
+			return filepath.Join(dir, "pkg", "mod")
+		}
+	}
+	return ""
+}
+
+// findGoMod returns the path of the go.mod file in dir
+// or the nearest directory above it, or the empty string
+// if there is none.
+func findGoMod(dir string) string {
+	for {
+		gomod := filepath.Join(dir, "go.mod")
+		if info, err := os.Stat(gomod); err == nil && !info.IsDir() {
+			return gomod
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// readGoMod reads the go.mod file with the given path and returns
+// the main module that it declares, followed by the modules it
+// requires, found in the module cache in cacheDir unless they are
+// replaced by local directories.
+func readGoMod(gomod, cacheDir string) ([]module, error) {
+	data, err := ioutil.ReadFile(gomod)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(gomod)
+	var main string
+	var requires [][]string
+	replaces := make(map[string][]string)
+	block := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		fields, err := goModFields(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", gomod, n, err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if block != "" {
+			if fields[0] == ")" {
+				block = ""
+				continue
+			}
+			fields = append([]string{block}, fields...)
+		} else if len(fields) == 2 && fields[1] == "(" {
+			block = fields[0]
+			continue
+		}
+		switch fields[0] {
+		case "module":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%s:%d: invalid module directive", gomod, n)
+			}
+			main = fields[1]
+		case "require":
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("%s:%d: invalid require directive", gomod, n)
+			}
+			requires = append(requires, fields[1:])
+		case "replace":
+			// replace old [version] => new [version]
+			i := 0
+			for i < len(fields) && fields[i] != "=>" {
+				i++
+			}
+			if i < 2 || i > 3 || len(fields)-i < 2 || len(fields)-i > 3 {
+				return nil, fmt.Errorf("%s:%d: invalid replace directive", gomod, n)
+			}
+			replaces[fields[1]] = fields[i+1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if main == "" {
+		return nil, fmt.Errorf("%s: no module directive", gomod)
+	}
+	mods := []module{{main, dir}}
+	for _, req := range requires {
+		m := module{path: req[0]}
+		switch r := replaces[req[0]]; {
+		case len(r) == 1 && isLocalModule(r[0]):
+			m.dir = r[0]
+			if !filepath.IsAbs(m.dir) {
+				m.dir = filepath.Join(dir, m.dir)
+			}
+		case len(r) == 2:
+			m.dir = moduleCacheDir(cacheDir, r[0], r[1])
+		default:
+			m.dir = moduleCacheDir(cacheDir, req[0], req[1])
+		}
+		mods = append(mods, m)
+	}
+	return mods, nil
+}
+
+// goModFields returns the fields of a line in a go.mod file,
+// without any comment and with quoted fields unquoted.
+func goModFields(line string) ([]string, error) {
+	if i := strings.Index(line, "//"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	for i, f := range fields {
+		if !strings.HasPrefix(f, `"`) && !strings.HasPrefix(f, "`") {
+			continue
+		}
+		s, err := strconv.Unquote(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted string %s", f)
+		}
+		fields[i] = s
+	}
+	return fields, nil
+}
+
+// isLocalModule reports whether the replacement
+// path in a replace directive names a directory.
+func isLocalModule(path string) bool {
+	return filepath.IsAbs(path) || strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../")
+}
+
+// moduleCacheDir returns the directory in the module cache
+// in cacheDir that holds the given version of the module
+// with the given path. Upper case letters are escaped
+// as the go command escapes them.
+func moduleCacheDir(cacheDir, path, version string) string {
+	return filepath.Join(cacheDir, filepath.FromSlash(escapeModulePath(path)+"@"+escapeModulePath(version)))
+}
+
+func escapeModulePath(path string) string {
+	var buf bytes.Buffer
+	for _, r := range path {
+		if 'A' <= r && r <= 'Z' {
+			buf.WriteByte('!')
+			r += 'a' - 'A'
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// moduleDir returns the directory of the package with the
+// given import path in the module that contains it, or
+// false if it is in none of mods. When modules are nested,
+// the innermost module is chosen.
+func moduleDir(mods []module, path string) (string, bool) {
+	m := pathModule(mods, path)
+	if m == nil {
+		return "", false
+	}
+	return filepath.Join(m.dir, filepath.FromSlash(strings.TrimPrefix(path, m.path))), true
+}
+
+// pathModule returns the module in mods that contains the
+// package with the given import path, or nil if there is
+// none. When modules are nested, the innermost is chosen.
+func pathModule(mods []module, path string) *module {
+	var best *module
+	for i := range mods {
+		m := &mods[i]
+		if (path == m.path || strings.HasPrefix(path, m.path+"/")) && (best == nil || len(m.path) > len(best.path)) {
+			best = m
+		}
+	}
+	return best
+}
+
+// SourceRoot returns the directory at the root of the source
+// tree holding the package with the given import path: the
+// directory of the module that contains it or, outside modules,
+// the src directory of the GOPATH entry that holds it. It
+// returns false if the package cannot be found or is in GOROOT.
+func (ctxt *Context) SourceRoot(path string) (string, bool) {
+	if m := pathModule(ctxt.modules(), path); m != nil {
+		return m.dir, true
+	}
+	bpkg, err := ctxt.BuildContext.Import(path, "", build.FindOnly)
+	if err != nil || bpkg.Goroot || bpkg.SrcRoot == "" {
+		return "", false
+	}
+	return bpkg.SrcRoot, true
+}
+
+// modulePath returns the import path of the package in
+// the given directory, or false if it is in none of mods.
+// When module directories are nested, the innermost
+// module is chosen.
+func modulePath(mods []module, dir string) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	var best *module
+	var bestRel string
+	for i := range mods {
+		m := &mods[i]
+		rel, err := filepath.Rel(m.dir, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if best == nil || len(m.dir) > len(best.dir) {
+			best, bestRel = m, rel
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	if bestRel == "." {
+		return best.path, true
+	}
+	return best.path + "/" + filepath.ToSlash(bestRel), true
+}
@@ -7,49 +7,201 @@ import (
 	"code.google.com/p/rog-go/exp/go/ast"
 	"code.google.com/p/rog-go/exp/go/parser"
 	"code.google.com/p/rog-go/exp/go/printer"
+	"code.google.com/p/rog-go/exp/go/scanner"
 	"code.google.com/p/rog-go/exp/go/token"
 	"code.google.com/p/rog-go/exp/go/types"
 	"fmt"
 	"go/build"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // Info holds information about an identifier.
 type Info struct {
-	Pos      token.Pos   // position of symbol.
-	Expr     ast.Expr    // expression for symbol (*ast.Ident or *ast.SelectorExpr)
-	Ident    *ast.Ident  // identifier in parse tree (changing ident.Name changes the parse tree)
-	ExprType types.Type  // type of expression.
-	ReferPos token.Pos   // position of referred-to symbol.
-	ReferObj *ast.Object // object referred to. 
-	Local    bool        // whether referred-to object is function-local.
-	Universe bool        // whether referred-to object is in universe.
+	Pos       token.Pos   // position of symbol.
+	Expr      ast.Expr    // expression for symbol (*ast.Ident or *ast.SelectorExpr)
+	Ident     *ast.Ident  // identifier in parse tree (changing ident.Name changes the parse tree)
+	ExprType  types.Type  // type of expression.
+	ReferPos  token.Pos   // position of referred-to symbol.
+	ReferObj  *ast.Object // object referred to.
+	Local     bool        // whether referred-to object is function-local.
+	Captured  bool        // whether referred-to object is local to a function enclosing the one containing the symbol.
+	Universe  bool        // whether referred-to object is in universe.
+	DotImport bool        // whether the identifier was resolved through an import to ".".
+	Enclosing string      // name of the top-level function or type declaration containing the symbol, if any.
+
+	exprTypes exprTypes // types found by the walk that visited the symbol.
+	member    string    // type declaring the field or interface method declared by the symbol, if any.
+}
+
+// Importer is the interface implemented by a source of
+// parsed packages.
+type Importer interface {
+	// Import returns the package with the given import
+	// path, or nil if it cannot be found.
+	Import(path string) *ast.Package
 }
 
 // Context holds the context for IterateSyms.
 type Context struct {
-	pkgMutex     sync.Mutex
-	pkgCache     map[string]*ast.Package
-	importer     types.Importer
+	pkgMutex   sync.Mutex
+	pkgCache   map[string]*ast.Package
+	xtestCache map[string]*ast.Package
+	pkgDirs    map[string]string // map from directory to import path.
+	cmdFiles   map[string]bool   // files of the package made by ImportFiles.
+	importer   types.Importer
+
+	// modOnce guards mods, which holds the modules
+	// used by FindPackage.
+	modOnce sync.Once
+	mods    []module
+
+	// mu guards ChangedFiles, dotIdents, resolved, stats, skipped and failed,
+	// so that IterateSyms may be called concurrently.
+	mu           sync.Mutex
+	dotIdents    map[*ast.Ident]bool
 	ChangedFiles map[string]*ast.File
 
+	// resolved records whether each identifier visited
+	// by IterateSyms was resolved, by its position,
+	// if CountUnresolved is true.
+	resolved map[token.Pos]bool
+
+	// stats holds the statistics returned by Stats.
+	stats Stats
+
+	// skipped holds the files returned by SkippedFiles,
+	// by file name.
+	skipped map[string]SkippedFile
+
+	// failed holds the positions returned by FailedFiles,
+	// by file name.
+	failed map[string]token.Position
+
+	// ImportTests specifies whether the external test
+	// package (files in package foo_test) is parsed along
+	// with each imported package. Test files in the
+	// package itself are always included.
+	ImportTests bool
+
+	// Generated specifies whether Walk and WalkFiles visit
+	// generated files (see IsGenerated). If it is false,
+	// they are skipped unless named explicitly.
+	Generated bool
+
 	// FileSet holds the fileset used when importing packages.
 	FileSet *token.FileSet
 
-	// Logf is used to print warning messages.
-	// If it is nil, no warning messages will be printed.
+	// BuildContext holds the build context used to find
+	// packages and select their source files. If its
+	// OpenFile function is set, it is also used to read
+	// the source files that are parsed.
+	BuildContext *build.Context
+
+	// Importer, if non-nil, is used to import packages
+	// instead of finding them with BuildContext and parsing
+	// them from disk, for instance to use the contents of
+	// unsaved editor buffers. Any files it parses should
+	// be added to FileSet. The packages it returns are
+	// cached by the Context, and no external test packages
+	// are imported.
+	Importer Importer
+
+	// Warn, if non-nil, is called with each warning that
+	// the Context reports, in the WarnSource category, and
+	// with each reported by Warnf. Calls of it are serialized.
+	Warn func(w Warning)
+
+	// Logf is used to print warning messages if Warn is nil.
+	// If it is nil too, no warning messages will be printed.
 	Logf func(pos token.Pos, f string, a ...interface{})
+
+	// Panic specifies whether a panic while visiting the
+	// identifiers in a file is passed on to the caller of
+	// IterateSyms. If it is false, the panic is logged with the
+	// position reached, and the rest of the file is skipped.
+	Panic bool
+
+	// CountUnresolved specifies whether IterateSyms records
+	// whether each identifier it visits is resolved, for
+	// Unresolved. It is off by default, as that takes an
+	// entry in a map for each identifier.
+	CountUnresolved bool
+
+	// CollectStats specifies whether the time spent parsing
+	// packages and visiting identifiers is recorded for Stats.
+	// The counts are recorded regardless.
+	CollectStats bool
+}
+
+// Stats holds statistics on the work done by a Context.
+// The times are summed over all goroutines, so they may
+// exceed the time elapsed if IterateSyms is called concurrently.
+type Stats struct {
+	// Packages holds the number of packages parsed.
+	Packages int
+
+	// CacheHits and CacheMisses hold the number of imports
+	// found in the cache of parsed packages, and the number
+	// of those that were not.
+	CacheHits, CacheMisses int
+
+	// ParseTime holds the time spent parsing packages.
+	ParseTime time.Duration
+
+	// ResolveTime holds the time spent in IterateSyms,
+	// less any time spent parsing the packages imported
+	// meanwhile.
+	ResolveTime time.Duration
+
+	// Syms holds the number of identifiers visited by IterateSyms.
+	Syms int
+}
+
+// Stats returns the statistics recorded by the context so far.
+// The times are zero unless ctxt.CollectStats is true.
+func (ctxt *Context) Stats() Stats {
+	ctxt.mu.Lock()
+	defer ctxt.mu.Unlock()
+	return ctxt.stats
+}
+
+// startTimer returns the time now, if the context is
+// collecting statistics.
+func (ctxt *Context) startTimer() time.Time {
+	if !ctxt.CollectStats {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// addStats calls f to update the statistics
+// while holding the context's lock.
+func (ctxt *Context) addStats(f func(s *Stats)) {
+	ctxt.mu.Lock()
+	defer ctxt.mu.Unlock()
+	f(&ctxt.stats)
 }
 
 func NewContext() *Context {
 	ctxt := &Context{
 		pkgCache:     make(map[string]*ast.Package),
+		xtestCache:   make(map[string]*ast.Package),
+		pkgDirs:      make(map[string]string),
+		cmdFiles:     make(map[string]bool),
+		dotIdents:    make(map[*ast.Ident]bool),
+		resolved:     make(map[token.Pos]bool),
 		FileSet:      token.NewFileSet(),
+		BuildContext: &build.Default,
 		ChangedFiles: make(map[string]*ast.File),
+		Panic:        true,
 	}
 	ctxt.importer = ctxt.importerFunc()
 	return ctxt
@@ -62,131 +214,505 @@ func (ctxt *Context) Import(path string) *ast.Package {
 	return ctxt.importer(path)
 }
 
+// ImportXTest returns the external test package for the package
+// with the given path. It returns nil if there is no such
+// package or ctxt.ImportTests is false.
+func (ctxt *Context) ImportXTest(path string) *ast.Package {
+	if !ctxt.ImportTests || ctxt.Import(path) == nil {
+		return nil
+	}
+	ctxt.pkgMutex.Lock()
+	defer ctxt.pkgMutex.Unlock()
+	return ctxt.xtestCache[path]
+}
+
 func (ctxt *Context) importerFunc() types.Importer {
 	return func(path string) *ast.Package {
-		ctxt.pkgMutex.Lock()
-		defer ctxt.pkgMutex.Unlock()
-		if pkg := ctxt.pkgCache[path]; pkg != nil {
+		if pkg := ctxt.cachedPackage(path, path); pkg != nil {
+			ctxt.addStats(func(s *Stats) { s.CacheHits++ })
 			return pkg
 		}
+		if ctxt.Importer != nil {
+			return ctxt.importFrom(ctxt.Importer, path)
+		}
 		cwd, _ := os.Getwd() // TODO put this into Context?
-		bpkg, err := build.Import(path, cwd, 0)
+		bpkg, err := ctxt.FindPackage(path, cwd, 0)
 		if err != nil {
 			ctxt.logf(token.NoPos, "cannot find %q: %v", path, err)
 			return nil
 		}
 		// Relative paths can have several names
-		if pkg := ctxt.pkgCache[bpkg.ImportPath]; pkg != nil {
-			ctxt.pkgCache[path] = pkg
+		if pkg := ctxt.cachedPackage(path, bpkg.ImportPath); pkg != nil {
+			ctxt.addStats(func(s *Stats) { s.CacheHits++ })
 			return pkg
 		}
-		var files []string
-		files = append(files, bpkg.GoFiles...)
-		files = append(files, bpkg.CgoFiles...)
-		files = append(files, bpkg.TestGoFiles...)
-		for i, f := range files {
-			files[i] = filepath.Join(bpkg.Dir, f)
+		// The package is parsed without holding the lock so that
+		// several packages can be parsed concurrently. If another
+		// goroutine parses the same package first, its result
+		// is used instead.
+		start := ctxt.startTimer()
+		pkg := ctxt.parsePackage(path, bpkg)
+		var xpkg *ast.Package
+		if pkg != nil && ctxt.ImportTests && len(bpkg.XTestGoFiles) > 0 {
+			xpkg = ctxt.parseXTest(bpkg)
 		}
-		pkgs, err := parser.ParseFiles(ctxt.FileSet, files, parser.ParseComments)
-		if len(pkgs) == 0 {
-			ctxt.logf(token.NoPos, "cannot parse package %q: %v", path, err)
+		ctxt.resolveVendored(pkg, bpkg)
+		ctxt.resolveVendored(xpkg, bpkg)
+		ctxt.addParseStats(start, pkg != nil)
+		if pkg == nil {
 			return nil
 		}
-		delete(pkgs, "documentation")
-		for _, pkg := range pkgs {
-			if ctxt.pkgCache[path] == nil {
-				ctxt.pkgCache[path] = pkg
-				if path != bpkg.ImportPath {
-					ctxt.pkgCache[bpkg.ImportPath] = pkg
-				}
-			} else {
-				ctxt.logf(token.NoPos, "unexpected extra package %q in %q", pkg.Name, path)
+		ctxt.pkgMutex.Lock()
+		defer ctxt.pkgMutex.Unlock()
+		if p := ctxt.pkgCache[bpkg.ImportPath]; p != nil {
+			pkg, xpkg = p, ctxt.xtestCache[bpkg.ImportPath]
+		}
+		for _, name := range []string{path, bpkg.ImportPath} {
+			ctxt.pkgCache[name] = pkg
+			if xpkg != nil {
+				ctxt.xtestCache[name] = xpkg
 			}
 		}
-		return ctxt.pkgCache[path]
+		return pkg
 	}
 }
 
-func (ctxt *Context) logf(pos token.Pos, f string, a ...interface{}) {
-	if ctxt.Logf == nil {
-		return
+// importFrom imports the package with the given path
+// using imp, and caches the result.
+func (ctxt *Context) importFrom(imp Importer, path string) *ast.Package {
+	start := ctxt.startTimer()
+	pkg := imp.Import(path)
+	ctxt.addParseStats(start, pkg != nil)
+	if pkg == nil {
+		ctxt.logf(token.NoPos, "cannot find %q", path)
+		return nil
 	}
-	ctxt.Logf(pos, f, a...)
+	ctxt.pkgMutex.Lock()
+	defer ctxt.pkgMutex.Unlock()
+	if p := ctxt.pkgCache[path]; p != nil {
+		return p
+	}
+	ctxt.pkgCache[path] = pkg
+	return pkg
+}
+
+// addParseStats records an attempt to parse a package that
+// started at the given time (see startTimer), and whether
+// it succeeded.
+func (ctxt *Context) addParseStats(start time.Time, ok bool) {
+	var d time.Duration
+	if ctxt.CollectStats {
+		d = time.Since(start)
+	}
+	ctxt.addStats(func(s *Stats) {
+		s.CacheMisses++
+		s.ParseTime += d
+		if ok {
+			s.Packages++
+		}
+	})
+}
+
+// cachedPackage returns the cached package with the given
+// import path, recording it under path too, or nil
+// if it has not yet been imported.
+func (ctxt *Context) cachedPackage(path, importPath string) *ast.Package {
+	ctxt.pkgMutex.Lock()
+	defer ctxt.pkgMutex.Unlock()
+	pkg := ctxt.pkgCache[importPath]
+	if pkg != nil && path != importPath {
+		ctxt.pkgCache[path] = pkg
+		if xpkg := ctxt.xtestCache[importPath]; xpkg != nil {
+			ctxt.xtestCache[path] = xpkg
+		}
+	}
+	return pkg
+}
+
+// readFile returns the contents of the named file, read
+// with the OpenFile function of ctxt.BuildContext if it is set.
+func (ctxt *Context) readFile(name string) ([]byte, error) {
+	if ctxt.BuildContext.OpenFile == nil {
+		return ioutil.ReadFile(name)
+	}
+	f, err := ctxt.BuildContext.OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// parsePackage parses the files of the given package,
+// including its internal test files.
+func (ctxt *Context) parsePackage(path string, bpkg *build.Package) *ast.Package {
+	var files []string
+	files = append(files, bpkg.GoFiles...)
+	files = append(files, bpkg.CgoFiles...)
+	files = append(files, bpkg.TestGoFiles...)
+	for i, f := range files {
+		files[i] = filepath.Join(bpkg.Dir, f)
+	}
+	pkgs, errs := parser.ParseFilesFunc(ctxt.FileSet, files, parser.ParseComments, ctxt.readFile)
+	skipped := ctxt.addSkipped(files, errs)
+	if len(pkgs) == 0 {
+		var err error
+		if len(skipped) > 0 {
+			err = skipped[0].Err
+		}
+		ctxt.logf(token.NoPos, "cannot parse package %q: %v", path, err)
+		return nil
+	}
+	// Files that cannot be parsed are left out.
+	for _, sf := range skipped {
+		pos, msg := ctxt.skipMessage(sf)
+		ctxt.logf(pos, "skipping file in package %q: %s", path, msg)
+	}
+	delete(pkgs, "documentation")
+	var pkg *ast.Package
+	for _, p := range pkgs {
+		if pkg == nil {
+			pkg = p
+		} else {
+			ctxt.logf(token.NoPos, "unexpected extra package %q in %q", p.Name, path)
+		}
+	}
+	return pkg
+}
+
+// parseXTest parses the external test files of the given package.
+func (ctxt *Context) parseXTest(bpkg *build.Package) *ast.Package {
+	files := make([]string, len(bpkg.XTestGoFiles))
+	for i, f := range bpkg.XTestGoFiles {
+		files[i] = filepath.Join(bpkg.Dir, f)
+	}
+	pkgs, errs := parser.ParseFilesFunc(ctxt.FileSet, files, parser.ParseComments, ctxt.readFile)
+	skipped := ctxt.addSkipped(files, errs)
+	if pkg := pkgs[bpkg.Name+"_test"]; pkg != nil {
+		for _, sf := range skipped {
+			pos, msg := ctxt.skipMessage(sf)
+			ctxt.logf(pos, "skipping file in external tests for %q: %s", bpkg.ImportPath, msg)
+		}
+		return pkg
+	}
+	var err error
+	if len(skipped) > 0 {
+		err = skipped[0].Err
+	}
+	ctxt.logf(token.NoPos, "cannot parse external tests for %q: %v", bpkg.ImportPath, err)
+	return nil
+}
+
+// SkippedFile describes a source file that was left out
+// of its package because it could not be parsed.
+type SkippedFile struct {
+	// Filename holds the name of the file.
+	Filename string
+
+	// Pos holds the position of the first parse error
+	// in the file, or just the file name if there is no
+	// such position, as when the file cannot be read.
+	Pos token.Position
+
+	// Err holds the error.
+	Err error
+}
+
+// SkippedFiles returns the files that have been left out of
+// the packages imported so far because they could not be
+// parsed, sorted by file name.
+func (ctxt *Context) SkippedFiles() []SkippedFile {
+	ctxt.mu.Lock()
+	defer ctxt.mu.Unlock()
+	files := make([]SkippedFile, 0, len(ctxt.skipped))
+	for _, sf := range ctxt.skipped {
+		files = append(files, sf)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Filename < files[j].Filename
+	})
+	return files
+}
+
+// addSkipped records the files that could not be parsed,
+// with their errors as returned by parser.ParseFilesFunc,
+// and returns them in the order of files.
+func (ctxt *Context) addSkipped(files []string, errs map[string]error) []SkippedFile {
+	if len(errs) == 0 {
+		return nil
+	}
+	var skipped []SkippedFile
+	for _, name := range files {
+		err := errs[name]
+		if err == nil {
+			continue
+		}
+		sf := SkippedFile{
+			Filename: name,
+			Pos:      token.Position{Filename: name},
+			Err:      err,
+		}
+		if list, ok := err.(scanner.ErrorList); ok && len(list) > 0 {
+			sf.Pos = list[0].Pos
+		}
+		skipped = append(skipped, sf)
+	}
+	ctxt.mu.Lock()
+	defer ctxt.mu.Unlock()
+	if ctxt.skipped == nil {
+		ctxt.skipped = make(map[string]SkippedFile)
+	}
+	for _, sf := range skipped {
+		ctxt.skipped[sf.Filename] = sf
+	}
+	return skipped
+}
+
+// skipMessage returns the position in ctxt.FileSet of the first
+// parse error in the skipped file sf and the message to log
+// for it, which includes the position only if it is not in
+// the file set.
+func (ctxt *Context) skipMessage(sf SkippedFile) (token.Pos, string) {
+	list, ok := sf.Err.(scanner.ErrorList)
+	if !ok || len(list) == 0 {
+		return token.NoPos, sf.Err.Error()
+	}
+	// The file is added to the set once for each time it is
+	// parsed; the last is parsed in full, so its lines are
+	// known up to the error.
+	pos := token.NoPos
+	ctxt.FileSet.Iterate(func(f *token.File) bool {
+		if f.Name() == sf.Pos.Filename && sf.Pos.Offset <= f.Size() {
+			pos = f.Pos(sf.Pos.Offset)
+		}
+		return true
+	})
+	if pos == token.NoPos {
+		return pos, sf.Err.Error()
+	}
+	msg := list[0].Msg
+	if len(list) > 1 {
+		msg = fmt.Sprintf("%s (and %d more errors)", msg, len(list)-1)
+	}
+	return pos, msg
 }
 
 // IterateSyms calls visitf for each identifier in the given file.  If
 // visitf returns false, the iteration stops.  If visitf changes
 // info.Ident.Name, the file is added to ctxt.ChangedFiles.
+// It is safe to call IterateSyms concurrently on different files
+// as long as visitf does not change any identifiers.
+// See Context.Panic for what happens if the iteration panics.
 func (ctxt *Context) IterateSyms(f *ast.File, visitf func(info *Info) bool) {
 	var visit astVisitor
 	ok := true
-	local := false // TODO set to true inside function body
+	pos := f.Package
+	defer ctxt.recoverPanic(f, &pos)
+	locals := localRanges(f)
+	// exprTypes holds the types found in f, so that the
+	// type of each expression is found once only.
+	exprTypes := make(exprTypes)
+	// enclosing holds the name of the top-level
+	// declaration being visited, and typeSpec the
+	// type declaration, if it is one.
+	enclosing := ""
+	var typeSpec *ast.TypeSpec
+	// members holds the name of the type declaring each
+	// field or interface method name, or "_" if the type
+	// is a literal.
+	members := make(map[*ast.Ident]string)
+	addMembers := func(t ast.Expr, fields *ast.FieldList) {
+		owner := "_"
+		if typeSpec != nil && typeSpec.Type == t {
+			owner = typeSpec.Name.Name
+		}
+		for _, field := range fields.List {
+			for _, name := range field.Names {
+				members[name] = owner
+			}
+			if id := embeddedName(field); id != nil {
+				members[id] = owner
+			}
+		}
+	}
+	visitSym := visitf
+	nsyms := 0
+	visitf = func(info *Info) bool {
+		nsyms++
+		info.Enclosing = enclosing
+		info.member = members[info.Ident]
+		return visitSym(info)
+	}
+	start := ctxt.startTimer()
+	parseTime := ctxt.Stats().ParseTime
+	defer func() {
+		var d time.Duration
+		if ctxt.CollectStats {
+			d = time.Since(start)
+		}
+		ctxt.addStats(func(s *Stats) {
+			s.Syms += nsyms
+			// Packages imported while visiting the identifiers
+			// are parsed meanwhile.
+			if d -= s.ParseTime - parseTime; d > 0 {
+				s.ResolveTime += d
+			}
+		})
+	}()
+	// funcs holds the functions enclosing the current node,
+	// innermost last.
+	var funcs posRanges
+	visitFunc := func(n ast.Node, walk func()) {
+		funcs = append(funcs, posRange{n.Pos(), n.End()})
+		walk()
+		funcs = funcs[0 : len(funcs)-1]
+	}
+	visitExpr := func(e ast.Expr) bool {
+		var fn posRange
+		if len(funcs) > 0 {
+			fn = funcs[len(funcs)-1]
+		}
+		return ctxt.visitExpr(f, e, exprTypes, locals, fn, visitf)
+	}
+	// visitLit visits the composite literal n. If its type
+	// is elided, x holds an expression of the same type,
+	// or nil if there is none. The keys of a struct literal
+	// are its fields, and are visited as if selected from
+	// the literal; those of an array or map literal are
+	// ordinary expressions. If the type of the literal
+	// cannot be determined, its keys are not visited.
+	var visitLit func(n *ast.CompositeLit, x ast.Expr)
+	visitLit = func(n *ast.CompositeLit, x ast.Expr) {
+		if n.Type != nil {
+			ast.Walk(visit, n.Type)
+			x = n
+		}
+		var t types.Type
+		if x != nil {
+			_, t = ctxt.exprType(exprTypes, x)
+		}
+		_, isStruct := t.Deref(ctxt.importer).Underlying(true, ctxt.importer).Node.(*ast.StructType)
+		for _, e := range n.Elts {
+			if !ok {
+				return
+			}
+			if kv, isKV := e.(*ast.KeyValueExpr); isKV {
+				if id, isIdent := kv.Key.(*ast.Ident); isStruct && isIdent {
+					ok = visitExpr(&ast.SelectorExpr{X: x, Sel: id})
+				} else if t.Kind != ast.Bad && !isStruct {
+					ast.Walk(visit, kv.Key)
+				}
+				e = kv.Value
+			}
+			// The type of an element literal may be elided
+			// in an array, slice or map literal.
+			if lit, isLit := e.(*ast.CompositeLit); isLit && lit.Type == nil && x != nil {
+				visitLit(lit, &ast.IndexExpr{X: x, Index: &ast.BasicLit{Kind: token.INT, Value: "0"}})
+			} else {
+				ast.Walk(visit, e)
+			}
+		}
+	}
 	visit = func(n ast.Node) bool {
 		if !ok {
 			return false
 		}
+		if n != nil {
+			pos = n.Pos()
+		}
 		switch n := n.(type) {
 		case *ast.ImportSpec:
-			// If the file imports a package to ".", abort
-			// because we don't support that (yet).
 			if n.Name != nil && n.Name.Name == "." {
-				ctxt.logf(n.Pos(), "import to . not supported")
-				ok = false
+				ctxt.resolveDotImport(f, n)
 				return false
 			}
 			return true
 
 		case *ast.FuncDecl:
-			// add object for init functions
-			if n.Recv == nil && n.Name.Name == "init" {
+			// Add an object for init functions. There may be
+			// several init functions in a package, so each
+			// gets its own object, declared by its FuncDecl.
+			if n.Recv == nil && n.Name.Name == "init" && n.Name.Obj == nil {
 				n.Name.Obj = ast.NewObj(ast.Fun, "init")
+				n.Name.Obj.Decl = n
 			}
-			if n.Recv != nil {
-				ast.Walk(visit, n.Recv)
+			if n.Recv != nil && len(n.Recv.List) != 1 {
+				ctxt.logf(n.Pos(), "expected one receiver only!")
+				return true
 			}
-			var e ast.Expr = n.Name
-			if n.Recv != nil {
-				// It's a method, so we need to synthesise a
-				// selector expression so that visitExpr doesn't
-				// just see a blank name.
-				if len(n.Recv.List) != 1 {
-					ctxt.logf(n.Pos(), "expected one receiver only!")
-					return true
+			visitFunc(n, func() {
+				if n.Recv != nil {
+					ast.Walk(visit, n.Recv)
 				}
-				e = &ast.SelectorExpr{
-					X:   n.Recv.List[0].Type,
-					Sel: n.Name,
+				var e ast.Expr = n.Name
+				if n.Recv != nil {
+					// It's a method, so we need to synthesise a
+					// selector expression so that visitExpr doesn't
+					// just see a blank name.
+					e = &ast.SelectorExpr{
+						X:   n.Recv.List[0].Type,
+						Sel: n.Name,
+					}
 				}
-			}
-			ok = ctxt.visitExpr(f, e, false, visitf)
-			local = true
-			ast.Walk(visit, n.Type)
-			if n.Body != nil {
+				ok = visitExpr(e)
+				ast.Walk(visit, n.Type)
+				if n.Body != nil {
+					ast.Walk(visit, n.Body)
+				}
+			})
+			return false
+
+		case *ast.FuncLit:
+			// A function literal's parameters and results, and
+			// the variables it declares, are local to it; any
+			// other local variables it refers to are captured
+			// from the functions enclosing it.
+			visitFunc(n, func() {
+				ast.Walk(visit, n.Type)
 				ast.Walk(visit, n.Body)
-			}
-			local = false
+			})
 			return false
 
 		case *ast.Ident:
-			ok = ctxt.visitExpr(f, n, local, visitf)
+			ok = visitExpr(n)
 			return false
 
-		case *ast.KeyValueExpr:
-			// don't try to resolve the key part of a key-value
-			// because it might be a map key which doesn't
-			// need resolving, and we can't tell without being
-			// complicated with types.
-			ast.Walk(visit, n.Value)
+		case *ast.CompositeLit:
+			visitLit(n, nil)
 			return false
 
+		case *ast.StructType:
+			addMembers(n, n.Fields)
+			return true
+
+		case *ast.InterfaceType:
+			addMembers(n, n.Methods)
+			return true
+
 		case *ast.SelectorExpr:
 			ast.Walk(visit, n.X)
-			ok = ctxt.visitExpr(f, n, local, visitf)
+			ok = visitExpr(n)
 			return false
 
 		case *ast.File:
 			for _, d := range n.Decls {
+				switch d := d.(type) {
+				case *ast.FuncDecl:
+					enclosing = funcDeclName(d)
+				case *ast.GenDecl:
+					if d.Tok == token.TYPE {
+						// Each type is its own declaration.
+						for _, spec := range d.Specs {
+							typeSpec = spec.(*ast.TypeSpec)
+							enclosing = typeSpec.Name.Name
+							ast.Walk(visit, spec)
+						}
+						enclosing, typeSpec = "", nil
+						continue
+					}
+				}
 				ast.Walk(visit, d)
+				enclosing = ""
 			}
 			return false
 		}
@@ -196,13 +722,225 @@ func (ctxt *Context) IterateSyms(f *ast.File, visitf func(info *Info) bool) {
 	ast.Walk(visit, f)
 }
 
+// embeddedName returns the identifier that declares the
+// embedded field f, or nil if f is not an embedded field.
+func embeddedName(f *ast.Field) *ast.Ident {
+	if len(f.Names) > 0 {
+		return nil
+	}
+	t := f.Type
+	if st, ok := t.(*ast.StarExpr); ok {
+		t = st.X
+	}
+	if se, ok := t.(*ast.SelectorExpr); ok {
+		t = se.Sel
+	}
+	// The parser declares the field with an object
+	// of its own, as it does a named field.
+	if id, ok := t.(*ast.Ident); ok && id.Obj != nil && id.Obj.Kind == ast.Var {
+		return id
+	}
+	return nil
+}
+
+// funcDeclName returns the name of the function declared by d,
+// in T.M or (*T).M format if it is a method.
+func funcDeclName(d *ast.FuncDecl) string {
+	if d.Recv == nil || len(d.Recv.List) != 1 {
+		return d.Name.Name
+	}
+	recv := pretty(d.Recv.List[0].Type)
+	if strings.HasPrefix(recv, "*") {
+		recv = "(" + recv + ")"
+	}
+	return recv + "." + d.Name.Name
+}
+
+// setResolved records whether the identifier at pos was resolved,
+// if ctxt.CountUnresolved is true.
+func (ctxt *Context) setResolved(pos token.Pos, resolved bool) {
+	if !ctxt.CountUnresolved {
+		return
+	}
+	ctxt.mu.Lock()
+	defer ctxt.mu.Unlock()
+	ctxt.resolved[pos] = resolved
+}
+
+// Unresolved returns the number of identifiers that IterateSyms
+// has visited, and the number of those that it could not resolve
+// to a declaration. Each identifier is counted once, however
+// many times it has been visited. Both are zero unless
+// ctxt.CountUnresolved is true.
+func (ctxt *Context) Unresolved() (syms, unresolved int) {
+	ctxt.mu.Lock()
+	defer ctxt.mu.Unlock()
+	for _, ok := range ctxt.resolved {
+		if !ok {
+			unresolved++
+		}
+	}
+	return len(ctxt.resolved), unresolved
+}
+
+// resolveDotImport points any identifiers in f that the
+// parser could not resolve to the objects exported by
+// the package imported by imp, which imports to ".".
+func (ctxt *Context) resolveDotImport(f *ast.File, imp *ast.ImportSpec) {
+	path := types.ImportPath(imp)
+	pkg := ctxt.importer(path)
+	if pkg == nil {
+		ctxt.logf(imp.Pos(), "cannot resolve symbols imported to . from %q", path)
+		return
+	}
+	ast.Walk(astVisitor(func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok || id.Obj == nil || id.Obj.Kind != ast.Bad || !ast.IsExported(id.Name) {
+			return true
+		}
+		if obj := pkg.Scope.Lookup(id.Name); obj != nil && obj.Kind != ast.Bad {
+			id.Obj = obj
+			ctxt.mu.Lock()
+			ctxt.dotIdents[id] = true
+			ctxt.mu.Unlock()
+		}
+		return true
+	}), f)
+}
+
 func (ctxt *Context) filename(f *ast.File) string {
 	return ctxt.FileSet.Position(f.Package).Filename
 }
 
-func (ctxt *Context) visitExpr(f *ast.File, e ast.Expr, local bool, visitf func(*Info) bool) bool {
+// exprTypes maps expressions to their types, as
+// found by Context.exprType.
+type exprTypes map[ast.Expr]exprTypeResult
+
+type exprTypeResult struct {
+	obj *ast.Object
+	typ types.Type
+}
+
+// exprType is like types.ExprType, but records the type
+// of e and of the expressions it is found from in known,
+// and uses those already recorded there, so that in a chain
+// of selectors each expression's type is found once only.
+// If known is nil, nothing is recorded.
+func (ctxt *Context) exprType(known exprTypes, e ast.Expr) (*ast.Object, types.Type) {
+	if r, ok := known[e]; ok {
+		return r.obj, r.typ
+	}
+	var r exprTypeResult
+	if se, ok := e.(*ast.SelectorExpr); ok {
+		_, xt := ctxt.exprType(known, se.X)
+		r.obj, r.typ = types.SelectorType(se, xt, ctxt.importer)
+	} else {
+		r.obj, r.typ = types.ExprType(e, ctxt.importer)
+	}
+	if known != nil {
+		known[e] = r
+	}
+	return r.obj, r.typ
+}
+
+// ambiguousMembers returns the candidate members for the
+// selector expression e if its selector is ambiguous,
+// or nil otherwise.
+func (ctxt *Context) ambiguousMembers(known exprTypes, e ast.Expr) []*ast.Object {
+	se, ok := e.(*ast.SelectorExpr)
+	if !ok {
+		return nil
+	}
+	_, t := ctxt.exprType(known, se.X)
+	if objs := t.Members(se.Sel.Name, ctxt.importer); len(objs) > 1 {
+		return objs
+	}
+	return nil
+}
+
+// posRange holds the positions from start up to but not including end.
+type posRange struct {
+	start, end token.Pos
+}
+
+// posRanges holds a set of position ranges.
+type posRanges []posRange
+
+// contains reports whether any of the ranges contains pos.
+func (rs posRanges) contains(pos token.Pos) bool {
+	for _, r := range rs {
+		if r.start <= pos && pos < r.end {
+			return true
+		}
+	}
+	return false
+}
+
+// localRegions holds the parts of a file in which function-local
+// objects are declared (in), except for the parts within
+// those in which the objects declared are not local (out).
+type localRegions struct {
+	in, out posRanges
+}
+
+// contains reports whether an object declared
+// at pos is function-local.
+func (r localRegions) contains(pos token.Pos) bool {
+	return r.in.contains(pos) && !r.out.contains(pos)
+}
+
+// localRanges returns the parts of f in which function-local
+// objects are declared: the receivers, parameters, results
+// and bodies of its functions, and its function literals.
+// The fields and methods of struct and interface types
+// in the functions' signatures are not local, because
+// they can be used by the functions' callers.
+func localRanges(f *ast.File) localRegions {
+	var r localRegions
+	addTypes := func(t *ast.FuncType) {
+		ast.Inspect(t, func(n ast.Node) bool {
+			switch n.(type) {
+			case *ast.StructType, *ast.InterfaceType:
+				r.out = append(r.out, posRange{n.Pos(), n.End()})
+				return false
+			}
+			return true
+		})
+	}
+	for _, d := range f.Decls {
+		ast.Inspect(d, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncDecl:
+				if n.Recv != nil {
+					r.in = append(r.in, posRange{n.Recv.Pos(), n.Recv.End()})
+				}
+				// The function's name comes between
+				// its receiver and its parameters.
+				end := n.Type.End()
+				if n.Body != nil {
+					end = n.Body.End()
+				}
+				r.in = append(r.in, posRange{n.Type.Params.Pos(), end})
+				addTypes(n.Type)
+				return false
+			case *ast.FuncLit:
+				r.in = append(r.in, posRange{n.Pos(), n.End()})
+				addTypes(n.Type)
+				return false
+			}
+			return true
+		})
+	}
+	return r
+}
+
+// visitExpr calls visitf for the symbol e, found in the
+// function fn, or outside any function if fn is empty.
+// The types found are recorded in known.
+func (ctxt *Context) visitExpr(f *ast.File, e ast.Expr, known exprTypes, locals localRegions, fn posRange, visitf func(*Info) bool) bool {
 	var info Info
 	info.Expr = e
+	info.exprTypes = known
 	switch e := e.(type) {
 	case *ast.Ident:
 		if e.Name == "_" {
@@ -214,51 +952,252 @@ func (ctxt *Context) visitExpr(f *ast.File, e ast.Expr, local bool, visitf func(
 		info.Pos = e.Sel.Pos()
 		info.Ident = e.Sel
 	}
-	obj, t := types.ExprType(e, ctxt.importer)
+	obj, t := ctxt.exprType(known, e)
 	if obj == nil {
-		ctxt.logf(e.Pos(), "no object for %s", pretty(e))
-		return true
+		if objs := ctxt.ambiguousMembers(known, e); objs != nil {
+			var decls []string
+			for _, o := range objs {
+				decls = append(decls, ctxt.FileSet.Position(types.DeclPos(o)).String())
+			}
+			ctxt.logf(e.Pos(), "ambiguous selector %s; candidates declared at %s", pretty(e), strings.Join(decls, ", "))
+			ctxt.setResolved(info.Pos, false)
+			return true
+		}
+		ctxt.setResolved(info.Pos, false)
+		spec := unresolvedImport(e)
+		if spec == nil || !ctxt.isCommandLineFile(f) {
+			ctxt.logf(e.Pos(), "no object for %s", pretty(e))
+			return true
+		}
+		// See ImportFiles.
+		info.ExprType = types.Type{}
+		info.ReferObj = &ast.Object{Kind: ast.Bad, Name: info.Ident.Name, Decl: spec}
+		info.ReferPos = types.DeclPos(info.ReferObj)
+		return visitf(&info)
 	}
 	info.ExprType = t
 	info.ReferObj = obj
 	if parser.Universe.Lookup(obj.Name) != obj {
 		info.ReferPos = types.DeclPos(obj)
 		if info.ReferPos == token.NoPos {
-			name := pretty(e)
-			if name != "init" {
-				ctxt.logf(e.Pos(), "no declaration for %s", pretty(e))
-			}
+			ctxt.logf(e.Pos(), "no declaration for %s", pretty(e))
+			ctxt.setResolved(info.Pos, false)
 			return true
 		}
 	} else {
 		info.Universe = true
 	}
-	info.Local = local
+	// An object is local if it is declared inside a function.
+	// The declarations of local objects are always in f.
+	info.Local = !info.Universe && locals.contains(info.ReferPos)
+	info.Captured = info.Local && fn != (posRange{}) && !posRanges{fn}.contains(info.ReferPos)
+	ctxt.mu.Lock()
+	info.DotImport = ctxt.dotIdents[info.Ident]
+	if ctxt.CountUnresolved {
+		ctxt.resolved[info.Pos] = true
+	}
+	ctxt.mu.Unlock()
 	oldName := info.Ident.Name
 	more := visitf(&info)
 	if info.Ident.Name != oldName {
+		// Members are found by name, so the types
+		// recorded may no longer be found the same way.
+		for e := range known {
+			delete(known, e)
+		}
+		ctxt.mu.Lock()
 		ctxt.ChangedFiles[ctxt.filename(f)] = f
+		ctxt.mu.Unlock()
 	}
 	return more
 }
 
+// recoverPanic recovers from any panic in progress unless
+// ctxt.Panic is true, logging it at the position *pos
+// and recording f as failed. It must be deferred.
+func (ctxt *Context) recoverPanic(f *ast.File, pos *token.Pos) {
+	if ctxt.Panic {
+		return
+	}
+	if err := recover(); err != nil {
+		ctxt.logf(*pos, "panic: %v; skipping rest of file", err)
+		ctxt.mu.Lock()
+		defer ctxt.mu.Unlock()
+		if ctxt.failed == nil {
+			ctxt.failed = make(map[string]token.Position)
+		}
+		ctxt.failed[ctxt.filename(f)] = ctxt.FileSet.Position(*pos)
+	}
+}
+
+// FailedFiles returns the position reached in each file in
+// which IterateSyms recovered from a panic (see Context.Panic),
+// sorted by file name. The rest of each such file was not
+// visited, so any changes made to it are incomplete.
+func (ctxt *Context) FailedFiles() []token.Position {
+	ctxt.mu.Lock()
+	defer ctxt.mu.Unlock()
+	files := make([]token.Position, 0, len(ctxt.failed))
+	for _, p := range ctxt.failed {
+		files = append(files, p)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Filename < files[j].Filename
+	})
+	return files
+}
+
 // WriteFiles writes the given files, formatted as with gofmt.
+// If any of the files cannot be formatted or written,
+// none of them is changed (see WriteSources).
 func (ctxt *Context) WriteFiles(files map[string]*ast.File) error {
-	// TODO should we try to continue changing files even after an error?
+	srcs, err := ctxt.FormatFiles(files)
+	if err != nil {
+		return err
+	}
+	return WriteSources(srcs)
+}
+
+// FormatFiles returns the contents of each of the given files,
+// formatted as with gofmt, indexed by filename.
+func (ctxt *Context) FormatFiles(files map[string]*ast.File) (map[string][]byte, error) {
+	srcs := make(map[string][]byte)
 	for _, f := range files {
 		name := ctxt.filename(f)
-		newSrc, err := ctxt.gofmtFile(f)
+		src, err := ctxt.gofmtFile(f)
 		if err != nil {
-			return fmt.Errorf("cannot format %q: %v", name, err)
+			return nil, fmt.Errorf("cannot format %q: %v", name, err)
+		}
+		srcs[name] = src
+	}
+	return srcs, nil
+}
+
+// WriteSources writes the given contents to each of the named
+// files. Each file is first written to a temporary file in the
+// same directory, and the temporary files are renamed into
+// place only when all of them have been written, so a failure
+// to write any file leaves all the files unchanged. A file that
+// is a symbolic link is left in place, and the file it links
+// to is written instead.
+func WriteSources(srcs map[string][]byte) error {
+	var names []string
+	for name := range srcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	targets := make(map[string]string)
+	temps := make(map[string]string)
+	defer func() {
+		for _, temp := range temps {
+			os.Remove(temp)
+		}
+	}()
+	for _, name := range names {
+		target, err := linkTarget(name)
+		if err != nil {
+			return fmt.Errorf("cannot write %q: %v", name, err)
 		}
-		err = ioutil.WriteFile(name, newSrc, 0666)
+		targets[name] = target
+		temp, err := writeTemp(target, srcs[name])
 		if err != nil {
 			return fmt.Errorf("cannot write %q: %v", name, err)
 		}
+		temps[name] = temp
+	}
+	for i, name := range names {
+		if err := os.Rename(temps[name], targets[name]); err != nil {
+			if i > 0 {
+				return fmt.Errorf("cannot write %q: %v (%s already written)", name, err, strings.Join(names[0:i], ", "))
+			}
+			return fmt.Errorf("cannot write %q: %v", name, err)
+		}
+		delete(temps, name)
 	}
 	return nil
 }
 
+// linkTarget returns the file that the named file links to,
+// following any symbolic links, or the name itself if
+// the file does not exist.
+func linkTarget(name string) (string, error) {
+	target, err := filepath.EvalSymlinks(name)
+	if os.IsNotExist(err) {
+		return name, nil
+	}
+	return target, err
+}
+
+// writeTemp writes src to a new temporary file in the same
+// directory as the named file, with the same permissions,
+// and returns the name of the temporary file.
+func writeTemp(name string, src []byte) (string, error) {
+	perm := os.FileMode(0666)
+	if info, err := os.Stat(name); err == nil {
+		perm = info.Mode().Perm()
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".gosym")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// DiffFiles writes to w a unified diff between the current
+// contents of each of the given files and the contents that
+// WriteFiles would write. Files that would not change
+// are omitted.
+func (ctxt *Context) DiffFiles(w io.Writer, files map[string]*ast.File) error {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		oldSrc, err := ctxt.readFile(name)
+		if err != nil {
+			return fmt.Errorf("cannot read %q: %v", name, err)
+		}
+		newSrc, err := ctxt.gofmtFile(files[name])
+		if err != nil {
+			return fmt.Errorf("cannot format %q: %v", name, err)
+		}
+		if bytes.Equal(oldSrc, newSrc) {
+			continue
+		}
+		if _, err := w.Write(diff(diffLabel(name), oldSrc, newSrc)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffLabel returns the name used for the given file in a diff.
+// Files within the current directory are named relative to it,
+// so that the diff can be applied with patch -p0.
+func diffLabel(name string) string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return name
+	}
+	rel, err := filepath.Rel(cwd, name)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return name
+	}
+	return rel
+}
+
 // litToString converts from a string literal to a regular string.
 func litToString(lit *ast.BasicLit) (v string) {
 	if lit.Kind != token.STRING {
@@ -293,11 +1232,27 @@ var printConfig = &printer.Config{
 	Tabwidth: 8,
 }
 
+// gofmtFile returns the contents of f, formatted as with gofmt.
+// If most of the lines of the file as it stands end in CRLF,
+// so do all of those returned, so that rewriting the file
+// does not change the ending of every line.
 func (ctxt *Context) gofmtFile(f *ast.File) ([]byte, error) {
 	var buf bytes.Buffer
 	_, err := printConfig.Fprint(&buf, ctxt.FileSet, f)
 	if err != nil {
 		return nil, err
 	}
-	return buf.Bytes(), nil
+	// Comments and raw strings keep any carriage
+	// returns from the source, so remove them first.
+	src := bytes.Replace(buf.Bytes(), []byte("\r\n"), []byte("\n"), -1)
+	if old, err := ctxt.readFile(ctxt.filename(f)); err == nil && isCRLF(old) {
+		src = bytes.Replace(src, []byte("\n"), []byte("\r\n"), -1)
+	}
+	return src, nil
+}
+
+// isCRLF reports whether most of the lines in src end in CRLF.
+func isCRLF(src []byte) bool {
+	crlf := bytes.Count(src, []byte("\r\n"))
+	return crlf > bytes.Count(src, []byte("\n"))-crlf
 }
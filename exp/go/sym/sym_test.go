@@ -0,0 +1,686 @@
+package sym
+
+import (
+	"bytes"
+	"code.google.com/p/rog-go/exp/go/ast"
+	"code.google.com/p/rog-go/exp/go/parser"
+	"code.google.com/p/rog-go/exp/go/printer"
+	"code.google.com/p/rog-go/exp/go/token"
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type suite struct{}
+
+var _ = Suite(suite{})
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+var diffTests = []struct {
+	about  string
+	b1, b2 string
+	diff   string
+}{{
+	about: "no change",
+	b1:    "a\nb\n",
+	b2:    "a\nb\n",
+	diff: `--- f.go.orig
++++ f.go
+`,
+}, {
+	about: "a line changed, with context on each side",
+	b1:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+	b2:    "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+	diff: `--- f.go.orig
++++ f.go
+@@ -2,7 +2,7 @@
+ 2
+ 3
+ 4
+-5
++five
+ 6
+ 7
+ 8
+`,
+}, {
+	about: "changes close together share a hunk",
+	b1:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+	b2:    "one\n2\n3\n4\n5\n6\n7\neight\n9\n",
+	diff: `--- f.go.orig
++++ f.go
+@@ -1,9 +1,9 @@
+-1
++one
+ 2
+ 3
+ 4
+ 5
+ 6
+ 7
+-8
++eight
+ 9
+`,
+}, {
+	about: "changes far apart are in separate hunks",
+	b1:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n",
+	b2:    "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\neleven\n",
+	diff: `--- f.go.orig
++++ f.go
+@@ -1,4 +1,4 @@
+-1
++one
+ 2
+ 3
+ 4
+@@ -8,4 +8,4 @@
+ 8
+ 9
+ 10
+-11
++eleven
+`,
+}, {
+	about: "lines inserted and deleted",
+	b1:    "a\nb\nc\n",
+	b2:    "a\nx\ny\nc\n",
+	diff: `--- f.go.orig
++++ f.go
+@@ -1,3 +1,4 @@
+ a
+-b
++x
++y
+ c
+`,
+}, {
+	about: "an empty file",
+	b1:    "",
+	b2:    "a\n",
+	diff: `--- f.go.orig
++++ f.go
+@@ -0,0 +1 @@
++a
+`,
+}, {
+	about: "no newline at the end",
+	b1:    "a\nb",
+	b2:    "a\nc",
+	diff: `--- f.go.orig
++++ f.go
+@@ -1,2 +1,2 @@
+ a
+-b
+\ No newline at end of file
++c
+\ No newline at end of file
+`,
+}}
+
+func (suite) TestDiff(c *C) {
+	for i, test := range diffTests {
+		c.Logf("test %d: %s", i, test.about)
+		c.Assert(string(diff("f.go", []byte(test.b1), []byte(test.b2))), Equals, test.diff)
+	}
+}
+
+var walkSource = `package p
+
+type T struct{ f int }
+
+func (t *T) M() {}
+
+func (T) V() {}
+
+func F(t *T) { t.M(); _ = t.f }
+`
+
+func (suite) TestWalk(c *C) {
+	dir := filepath.Join(c.MkDir(), "p")
+	err := os.Mkdir(dir, 0777)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "p.go"), []byte(walkSource), 0666)
+	c.Assert(err, IsNil)
+	// Import paths of local packages must be relative.
+	cwd, err := os.Getwd()
+	c.Assert(err, IsNil)
+	path, err := filepath.Rel(cwd, dir)
+	c.Assert(err, IsNil)
+	var got []string
+	err = Walk(path, func(s Symbol) bool {
+		if s.Universe {
+			c.Check(s.ReferPkg, Equals, "universe")
+			return true
+		}
+		c.Check(s.Pkg, Equals, s.ReferPkg)
+		c.Check(s.Position.Filename, Equals, filepath.Join(dir, "p.go"))
+		got = append(got, fmt.Sprintf("%d:%d %s %v %v", s.Position.Line, s.Position.Column, s.Name, s.Kind, s.Decl))
+		return true
+	})
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, []string{
+		"3:6 T type true",
+		"3:16 T.f var true",
+		"5:7 t var true",
+		"5:10 T type false",
+		"5:13 (*T).M func true",
+		"7:7 T type false",
+		"7:10 T.V func true",
+		"9:6 F func true",
+		"9:8 t var true",
+		"9:11 T type false",
+		"9:16 t var false",
+		"9:18 (*T).M func false",
+		"9:27 t var false",
+		"9:29 T.f var false",
+	})
+
+	// The walk stops when fn returns false.
+	n := 0
+	err = Walk(path, func(s Symbol) bool {
+		n++
+		return s.Name != "F"
+	})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 9)
+
+	err = Walk(path+"/nonexistent", func(Symbol) bool { return true })
+	c.Assert(err, ErrorMatches, `cannot import ".*nonexistent"`)
+}
+
+var isGeneratedTests = []struct {
+	src       string
+	generated bool
+}{
+	{"// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage p\n", true},
+	{"// Copyright 2020.\n\n// Code generated by stringer; DO NOT EDIT.\n\n// Package p does things.\npackage p\n", true},
+	{"/* Code generated by hand. DO NOT EDIT. */\npackage p\n", false},
+	{"// Code generated by hand. DO NOT EDIT\npackage p\n", false},
+	{"// This comment says Code generated ... DO NOT EDIT.\npackage p\n", false},
+	{"package p\n\n// Code generated by stringer; DO NOT EDIT.\n", false},
+}
+
+func (suite) TestIsGenerated(c *C) {
+	for _, test := range isGeneratedTests {
+		f, err := parser.ParseFile(token.NewFileSet(), "p.go", test.src, parser.ParseComments, ast.NewScope(parser.Universe))
+		c.Assert(err, IsNil)
+		if IsGenerated(f) != test.generated {
+			c.Errorf("IsGenerated(%q) = %v; want %v", test.src, !test.generated, test.generated)
+		}
+	}
+}
+
+func (suite) TestWalkGenerated(c *C) {
+	dir := filepath.Join(c.MkDir(), "p")
+	err := os.Mkdir(dir, 0777)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "p.go"), []byte("package p\n\nvar X = Y\n"), 0666)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "p.pb.go"), []byte("// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage p\n\nvar Y = 1\n"), 0666)
+	c.Assert(err, IsNil)
+	cwd, err := os.Getwd()
+	c.Assert(err, IsNil)
+	path, err := filepath.Rel(cwd, dir)
+	c.Assert(err, IsNil)
+	walk := func(ctxt *Context, files ...string) []string {
+		var got []string
+		err := ctxt.WalkFiles(path, files, func(s Symbol) bool {
+			got = append(got, fmt.Sprintf("%s:%d:%d %s", filepath.Base(s.Position.Filename), s.Position.Line, s.Position.Column, s.Name))
+			return true
+		})
+		c.Assert(err, IsNil)
+		return got
+	}
+
+	// The generated file is skipped by default, but
+	// references to its declarations are still resolved.
+	c.Assert(walk(NewContext()), DeepEquals, []string{
+		"p.go:3:5 X",
+		"p.go:3:9 Y",
+	})
+	ctxt := NewContext()
+	ctxt.Generated = true
+	c.Assert(walk(ctxt), DeepEquals, []string{
+		"p.go:3:5 X",
+		"p.go:3:9 Y",
+		"p.pb.go:5:5 Y",
+	})
+	// A generated file is visited when named explicitly.
+	c.Assert(walk(NewContext(), filepath.Join(dir, "p.pb.go")), DeepEquals, []string{
+		"p.pb.go:5:5 Y",
+	})
+}
+
+var aliasSource = `package p
+
+type T struct{ F int }
+
+type (
+	P = *T
+	Q = P
+	A = T
+	N *T
+)
+
+var (
+	p  P
+	q  Q
+	pa *A
+	pq *Q
+	n  N
+)
+
+func f() int {
+	return p.F + q.F + pa.F + pq.F + n.F
+}
+`
+
+func (suite) TestWalkAlias(c *C) {
+	dir := filepath.Join(c.MkDir(), "p")
+	err := os.Mkdir(dir, 0777)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "p.go"), []byte(aliasSource), 0666)
+	c.Assert(err, IsNil)
+	cwd, err := os.Getwd()
+	c.Assert(err, IsNil)
+	path, err := filepath.Rel(cwd, dir)
+	c.Assert(err, IsNil)
+
+	// Selectors are named by the type that declares
+	// the member, whatever pointers and aliases
+	// lie in between.
+	var got []string
+	err = Walk(path, func(s Symbol) bool {
+		if s.Position.Line == 21 && s.Kind == ast.Var && !s.Decl {
+			got = append(got, fmt.Sprintf("%d:%d %s %d:%d", s.Position.Line, s.Position.Column, s.Name, s.ReferPosition.Line, s.ReferPosition.Column))
+		}
+		return true
+	})
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, []string{
+		"21:9 p 13:2",
+		"21:11 T.F 3:16",
+		"21:15 q 14:2",
+		"21:17 T.F 3:16",
+		"21:21 pa 15:2",
+		"21:24 T.F 3:16",
+		"21:28 pq 16:2",
+		"21:31 T.F 3:16",
+		"21:35 n 17:2",
+		"21:37 T.F 3:16",
+	})
+}
+
+var chainSourceQ = `package q
+
+type Inner struct{ N int }
+
+func (Inner) M() int { return 0 }
+
+func (*Inner) PM() int { return 0 }
+
+type I interface{ IM() int }
+
+type Outer struct {
+	In Inner
+	P  *Inner
+	I  I
+}
+
+var V Outer
+`
+
+var chainSourceP = `package p
+
+import "q"
+
+func f() int {
+	return q.V.In.M() + q.V.P.PM() + q.V.I.IM() + q.V.In.N
+}
+`
+
+func (suite) TestWalkSelectorChain(c *C) {
+	gopath := c.MkDir()
+	for path, src := range map[string]string{"q": chainSourceQ, "p": chainSourceP} {
+		dir := filepath.Join(gopath, "src", path)
+		err := os.MkdirAll(dir, 0777)
+		c.Assert(err, IsNil)
+		err = ioutil.WriteFile(filepath.Join(dir, path+".go"), []byte(src), 0666)
+		c.Assert(err, IsNil)
+	}
+	bctxt := build.Default
+	bctxt.GOPATH = gopath
+	ctxt := NewContext()
+	ctxt.BuildContext = &bctxt
+
+	// Each selector in a chain starting with a package
+	// is named by the type of the expression it selects
+	// from, not by the package or variable at its start,
+	// and a method by its receiver type.
+	var got []string
+	err := ctxt.WalkFiles("p", nil, func(s Symbol) bool {
+		if s.Position.Line == 6 {
+			got = append(got, fmt.Sprintf("%d:%d %s %s %s %d:%d", s.Position.Line, s.Position.Column, s.Kind, s.Name, s.ReferPkg, s.ReferPosition.Line, s.ReferPosition.Column))
+		}
+		return true
+	})
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, []string{
+		"6:9 package q p 3:8",
+		"6:11 var V q 17:5",
+		"6:13 var Outer.In q 12:2",
+		"6:16 func Inner.M q 5:14",
+		"6:22 package q p 3:8",
+		"6:24 var V q 17:5",
+		"6:26 var Outer.P q 13:2",
+		"6:28 func (*Inner).PM q 7:15",
+		"6:35 package q p 3:8",
+		"6:37 var V q 17:5",
+		"6:39 var Outer.I q 14:2",
+		"6:41 func I.IM q 9:19",
+		"6:48 package q p 3:8",
+		"6:50 var V q 17:5",
+		"6:52 var Outer.In q 12:2",
+		"6:55 var Inner.N q 3:20",
+	})
+}
+
+// BenchmarkWalkSelectorChains measures walking a file
+// holding many long chains of selectors, each of whose
+// expressions has its type found once only.
+func (suite) BenchmarkWalkSelectorChains(c *C) {
+	gopath := c.MkDir()
+	dir := filepath.Join(gopath, "src", "p")
+	err := os.MkdirAll(dir, 0777)
+	c.Assert(err, IsNil)
+	var src bytes.Buffer
+	src.WriteString("package p\n\ntype T struct {\n\tN *T\n\tX int\n}\n\nfunc F(t *T) {\n")
+	for i := 0; i < 500; i++ {
+		src.WriteString("\t_ = t" + strings.Repeat(".N", 20) + ".X\n")
+	}
+	src.WriteString("}\n")
+	err = ioutil.WriteFile(filepath.Join(dir, "p.go"), src.Bytes(), 0666)
+	c.Assert(err, IsNil)
+	bctxt := build.Default
+	bctxt.GOPATH = gopath
+	ctxt := NewContext()
+	ctxt.BuildContext = &bctxt
+	c.Assert(ctxt.Import("p"), NotNil)
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		err := ctxt.WalkFiles("p", nil, func(Symbol) bool {
+			return true
+		})
+		c.Assert(err, IsNil)
+	}
+}
+
+func (suite) TestWalkFiles(c *C) {
+	dir := filepath.Join(c.MkDir(), "p")
+	err := os.Mkdir(dir, 0777)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "p.go"), []byte(walkSource), 0666)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "q.go"), []byte("package p\n\nvar X = F(new(T))\n"), 0666)
+	c.Assert(err, IsNil)
+	cwd, err := os.Getwd()
+	c.Assert(err, IsNil)
+	path, err := filepath.Rel(cwd, dir)
+	c.Assert(err, IsNil)
+
+	// Only q.go is visited, but its references to
+	// declarations in p.go are still resolved.
+	var got []string
+	err = NewContext().WalkFiles(path, []string{filepath.Join(path, "q.go")}, func(s Symbol) bool {
+		if s.Universe {
+			return true
+		}
+		got = append(got, fmt.Sprintf("%s:%d:%d %s %s:%d:%d", filepath.Base(s.Position.Filename), s.Position.Line, s.Position.Column, s.Name, filepath.Base(s.ReferPosition.Filename), s.ReferPosition.Line, s.ReferPosition.Column))
+		return true
+	})
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, []string{
+		"q.go:3:5 X q.go:3:5",
+		"q.go:3:9 F p.go:9:6",
+		"q.go:3:15 T p.go:3:6",
+	})
+}
+
+var localSource = `package p
+
+var x = 1
+
+var f = func(y int) int { return y + x }
+
+func (t T) F(x int) int {
+	{
+		x := x + 1
+		_ = x
+	}
+	return x + f(x)
+}
+
+type T int
+`
+
+func (suite) TestIterateSymsLocal(c *C) {
+	ctxt := NewContext()
+	f, err := parser.ParseFile(ctxt.FileSet, "p.go", localSource, 0, ast.NewScope(parser.Universe))
+	c.Assert(err, IsNil)
+	var got []string
+	ctxt.IterateSyms(f, func(info *Info) bool {
+		if info.Universe {
+			return true
+		}
+		p := ctxt.FileSet.Position(info.Pos)
+		refer := ctxt.FileSet.Position(info.ReferPos)
+		got = append(got, fmt.Sprintf("%d:%d %s %d:%d %v", p.Line, p.Column, info.Ident.Name, refer.Line, refer.Column, info.Local))
+		return true
+	})
+	c.Assert(got, DeepEquals, []string{
+		"3:5 x 3:5 false",
+		"5:5 f 5:5 false",
+		"5:14 y 5:14 true",
+		"5:34 y 5:14 true",
+		"5:38 x 3:5 false",
+		"7:7 t 7:7 true",
+		"7:9 T 15:6 false",
+		"7:12 F 7:12 false",
+		"7:14 x 7:14 true",
+		"9:3 x 9:3 true",
+		"9:8 x 7:14 true",
+		"10:7 x 9:3 true",
+		"12:9 x 7:14 true",
+		"12:13 f 5:5 false",
+		"12:15 x 7:14 true",
+		"15:6 T 15:6 false",
+	})
+}
+
+var closureSource = `package p
+
+func F(a int) func(int) int {
+	b := a
+	return func(a int) int {
+		g := func() int {
+			b := b + a
+			return b
+		}
+		return g() + b
+	}
+}
+`
+
+func (suite) TestIterateSymsClosure(c *C) {
+	ctxt := NewContext()
+	f, err := parser.ParseFile(ctxt.FileSet, "p.go", closureSource, 0, ast.NewScope(parser.Universe))
+	c.Assert(err, IsNil)
+	var got []string
+	ctxt.IterateSyms(f, func(info *Info) bool {
+		if info.Universe {
+			return true
+		}
+		p := ctxt.FileSet.Position(info.Pos)
+		refer := ctxt.FileSet.Position(info.ReferPos)
+		got = append(got, fmt.Sprintf("%d:%d %s %d:%d %v %v", p.Line, p.Column, info.Ident.Name, refer.Line, refer.Column, info.Local, info.Captured))
+		return true
+	})
+	// The parameters and variables of each function literal are
+	// local to it, shadowing those of the same name outside it;
+	// the variables it uses from enclosing functions are captured.
+	c.Assert(got, DeepEquals, []string{
+		"3:6 F 3:6 false false",
+		"3:8 a 3:8 true false",
+		"4:2 b 4:2 true false",
+		"4:7 a 3:8 true false",
+		"5:14 a 5:14 true false",
+		"6:3 g 6:3 true false",
+		"7:4 b 7:4 true false",
+		"7:9 b 4:2 true true",
+		"7:13 a 5:14 true true",
+		"8:11 b 7:4 true false",
+		"10:10 g 6:3 true false",
+		"10:16 b 4:2 true true",
+	})
+}
+
+var anonymousSource = `package p
+
+var v struct{ A struct{ B int } }
+
+func f() interface{ M() } { return nil }
+
+func g(p *struct{ C int }) {
+	s := []struct{ D int }{}
+	_ = v.A.B + p.C + s[0].D
+	f().M()
+}
+`
+
+func (suite) TestIterateSymsAnonymous(c *C) {
+	ctxt := NewContext()
+	f, err := parser.ParseFile(ctxt.FileSet, "p.go", anonymousSource, 0, ast.NewScope(parser.Universe))
+	c.Assert(err, IsNil)
+	var got []string
+	ctxt.IterateSyms(f, func(info *Info) bool {
+		if _, ok := info.Expr.(*ast.SelectorExpr); !ok || info.Universe {
+			return true
+		}
+		p := ctxt.FileSet.Position(info.Pos)
+		refer := ctxt.FileSet.Position(info.ReferPos)
+		got = append(got, fmt.Sprintf("%d:%d %s %d:%d %v", p.Line, p.Column, info.Ident.Name, refer.Line, refer.Column, info.Local))
+		return true
+	})
+	// Fields and methods of anonymous types in function
+	// signatures are not local, unlike those of anonymous
+	// types declared inside functions.
+	c.Assert(got, DeepEquals, []string{
+		"9:8 A 3:15 false",
+		"9:10 B 3:25 false",
+		"9:16 C 7:19 false",
+		"9:25 D 8:17 true",
+		"10:6 M 5:21 false",
+	})
+}
+
+var compositeSource = `package p
+
+type T struct{ A, B int }
+
+type U struct {
+	T T
+	P *T
+}
+
+var k = 1
+
+var m = map[string]T{"x": {A: 1}}
+var s = []*T{{B: 2}}
+var u = U{T: T{A: 3}, P: &T{B: k}}
+var a = [...]int{k: 4}
+var x = struct{ k int }{k: 5}
+`
+
+func (suite) TestIterateSymsCompositeLit(c *C) {
+	ctxt := NewContext()
+	f, err := parser.ParseFile(ctxt.FileSet, "p.go", compositeSource, 0, ast.NewScope(parser.Universe))
+	c.Assert(err, IsNil)
+	var got []string
+	ctxt.IterateSyms(f, func(info *Info) bool {
+		p := ctxt.FileSet.Position(info.Pos)
+		if info.Universe || p.Line < 12 {
+			return true
+		}
+		refer := ctxt.FileSet.Position(info.ReferPos)
+		got = append(got, fmt.Sprintf("%d:%d %s %d:%d", p.Line, p.Column, info.Ident.Name, refer.Line, refer.Column))
+		if refer.Line == 3 && refer.Column == 16 {
+			info.Ident.Name = "Z"
+		}
+		return true
+	})
+	// The keys of struct literals are fields, even when
+	// the type of the literal is elided; those of other
+	// literals are expressions.
+	c.Assert(got, DeepEquals, []string{
+		"12:5 m 12:5",
+		"12:20 T 3:6",
+		"12:28 A 3:16",
+		"13:5 s 13:5",
+		"13:12 T 3:6",
+		"13:15 B 3:19",
+		"14:5 u 14:5",
+		"14:9 U 5:6",
+		"14:11 T 6:2",
+		"14:14 T 3:6",
+		"14:16 A 3:16",
+		"14:23 P 7:2",
+		"14:27 T 3:6",
+		"14:29 B 3:19",
+		"14:32 k 10:5",
+		"15:5 a 15:5",
+		"15:18 k 10:5",
+		"16:5 x 16:5",
+		"16:17 k 16:17",
+		"16:25 k 16:17",
+	})
+	var buf bytes.Buffer
+	err = printer.Fprint(&buf, ctxt.FileSet, f)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Count(buf.String(), "Z:"), Equals, 2)
+}
+
+func (suite) TestIterateSymsPanic(c *C) {
+	ctxt := NewContext()
+	f, err := parser.ParseFile(ctxt.FileSet, "p.go", "package p\n\nvar A, B, C int\n", 0, ast.NewScope(parser.Universe))
+	c.Assert(err, IsNil)
+	var names []string
+	visitf := func(info *Info) bool {
+		if info.Ident.Name == "B" {
+			panic("cannot visit B")
+		}
+		names = append(names, info.Ident.Name)
+		return true
+	}
+	// By default, the panic is passed on.
+	c.Assert(func() { ctxt.IterateSyms(f, visitf) }, PanicMatches, "cannot visit B")
+
+	// Otherwise it is logged and the rest of the file is skipped.
+	var logged []string
+	ctxt.Panic = false
+	ctxt.Logf = func(pos token.Pos, f string, a ...interface{}) {
+		logged = append(logged, fmt.Sprintf("%v: %s", ctxt.FileSet.Position(pos), fmt.Sprintf(f, a...)))
+	}
+	names = nil
+	ctxt.IterateSyms(f, visitf)
+	c.Assert(names, DeepEquals, []string{"A"})
+	c.Assert(logged, DeepEquals, []string{"p.go:3:8: panic: cannot visit B; skipping rest of file"})
+}
@@ -0,0 +1,74 @@
+package sym
+
+import (
+	"code.google.com/p/rog-go/exp/go/ast"
+	"go/build"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resolveVendored sets the Resolved field of each import in
+// pkg, which was found as bpkg, that refers to a vendored
+// package, so that the package is imported by its full import
+// path. Imports are resolved as the go tool does in GOPATH
+// mode: a package in a vendor directory is found in preference
+// to one elsewhere if the vendor directory is in the importing
+// package's directory or any directory above it. Vendor
+// directories are ignored inside modules.
+func (ctxt *Context) resolveVendored(pkg *ast.Package, bpkg *build.Package) {
+	if pkg == nil || len(ctxt.modules()) > 0 || !ctxt.hasVendor(bpkg) {
+		return
+	}
+	for _, f := range pkg.Files {
+		for _, imp := range FileImports(f) {
+			path := litToString(imp.Path)
+			if build.IsLocalImport(path) {
+				continue
+			}
+			vpkg, err := ctxt.BuildContext.Import(path, bpkg.Dir, build.FindOnly)
+			if err == nil && vpkg.ImportPath != path && IsVendored(vpkg.ImportPath) {
+				imp.Resolved = vpkg.ImportPath
+			}
+		}
+	}
+}
+
+// hasVendor reports whether there is a vendor directory in the
+// directory of bpkg or any directory above it within its
+// source root, so that its imports may refer to vendored
+// packages.
+func (ctxt *Context) hasVendor(bpkg *build.Package) bool {
+	if bpkg.SrcRoot == "" {
+		return false
+	}
+	isDir := ctxt.BuildContext.IsDir
+	if isDir == nil {
+		isDir = func(path string) bool {
+			info, err := os.Stat(path)
+			return err == nil && info.IsDir()
+		}
+	}
+	for dir := bpkg.Dir; len(dir) > len(bpkg.SrcRoot); dir = filepath.Dir(dir) {
+		if isDir(filepath.Join(dir, "vendor")) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsVendored reports whether the package with the
+// given import path is in a vendor directory.
+func IsVendored(path string) bool {
+	return strings.HasPrefix(path, "vendor/") || strings.Contains(path, "/vendor/")
+}
+
+// VendorlessPath returns the path by which the package with the
+// given import path is imported in source code, which omits
+// any vendor directory and the directories above it.
+func VendorlessPath(path string) string {
+	if i := strings.LastIndex(path, "/vendor/"); i >= 0 {
+		return path[i+len("/vendor/"):]
+	}
+	return strings.TrimPrefix(path, "vendor/")
+}
@@ -0,0 +1,268 @@
+package sym
+
+import (
+	"code.google.com/p/rog-go/exp/go/ast"
+	"code.google.com/p/rog-go/exp/go/token"
+	"fmt"
+	"go/build"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// Symbol holds information about a symbol found by Walk.
+type Symbol struct {
+	*Info
+
+	// Position and ReferPosition hold the positions of
+	// the identifier and of the definition it refers to.
+	Position      token.Position
+	ReferPosition token.Position
+
+	// Pkg holds the import path of the package containing
+	// the identifier, and ReferPkg that of the package where
+	// the symbol is defined, or "universe" for a symbol
+	// in the universe scope, or "?" for a reference that
+	// cannot be resolved (see ImportFiles).
+	Pkg      string
+	ReferPkg string
+
+	// Name holds the name of the symbol, in X.Y format if it
+	// is defined as a member of another type X. A method is
+	// named by its receiver type, as in T.M or (*T).M, both
+	// where it is declared and where it is used, and a field
+	// or interface method by the type that declares it, or _
+	// if that is a type literal, as in T.F or _.F; a use of
+	// one promoted from an embedded type is named by the type
+	// it is selected from. Name is empty if the type of X
+	// cannot be found.
+	Name string
+
+	// Kind holds the kind of the symbol.
+	Kind ast.ObjKind
+
+	// Decl reports whether the identifier is the
+	// definition of the symbol.
+	Decl bool
+}
+
+// Walk calls fn for each identifier in the package with the given
+// import path, and in its external test package if
+// ctxt.ImportTests is true, using a new Context.
+// See Context.Walk.
+func Walk(importPath string, fn func(Symbol) bool) error {
+	return NewContext().Walk(importPath, fn)
+}
+
+// Walk calls fn for each identifier in the package with the given
+// import path, and in its external test package if ctxt.ImportTests
+// is true. The files are visited in order of their names, and the
+// identifiers in each in order of their position. If fn returns
+// false, the walk stops.
+func (ctxt *Context) Walk(importPath string, fn func(Symbol) bool) error {
+	return ctxt.WalkFiles(importPath, nil, fn)
+}
+
+// WalkFiles is like Walk except that, if files is not empty, only
+// the identifiers in the named files of the package are visited.
+// The whole package is still imported, so that references
+// between its files are resolved.
+func (ctxt *Context) WalkFiles(importPath string, files []string, fn func(Symbol) bool) error {
+	var only map[string]bool
+	if len(files) > 0 {
+		only = make(map[string]bool)
+		for _, f := range files {
+			only[absPath(f)] = true
+		}
+	}
+	pkg := ctxt.Import(importPath)
+	if pkg == nil {
+		return fmt.Errorf("cannot import %q", importPath)
+	}
+	pkgs := []*ast.Package{pkg}
+	if xpkg := ctxt.ImportXTest(importPath); xpkg != nil {
+		pkgs = append(pkgs, xpkg)
+	}
+	var err error
+	visitf := func(info *Info) bool {
+		var s Symbol
+		if s, err = ctxt.symbol(info); err != nil {
+			return false
+		}
+		return fn(s)
+	}
+	for _, pkg := range pkgs {
+		for _, f := range SortedFiles(pkg) {
+			if only != nil && !only[absPath(ctxt.FileSet.Position(f.Package).Filename)] {
+				continue
+			}
+			if only == nil && !ctxt.Generated && IsGenerated(f) {
+				continue
+			}
+			ctxt.IterateSyms(f, visitf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// symbol returns the Symbol for the identifier in info.
+func (ctxt *Context) symbol(info *Info) (Symbol, error) {
+	s := Symbol{
+		Info:          info,
+		Position:      ctxt.FileSet.Position(info.Pos),
+		ReferPosition: ctxt.FileSet.Position(info.ReferPos),
+		Kind:          info.ReferObj.Kind,
+		Decl:          info.ReferPos == info.Pos,
+		Name:          ctxt.symbolName(info),
+	}
+	var err error
+	if s.Pkg, err = ctxt.PackagePath(s.Position); err != nil {
+		return Symbol{}, err
+	}
+	if info.Universe {
+		s.ReferPkg = "universe"
+	} else if info.ReferObj.Kind == ast.Bad {
+		// An unresolved reference (see ImportFiles).
+		s.ReferPkg = "?"
+	} else if s.ReferPkg, err = ctxt.PackagePath(s.ReferPosition); err != nil {
+		return Symbol{}, err
+	}
+	return s, nil
+}
+
+// symbolName returns the name of the symbol in info, as
+// described for Symbol.Name.
+func (ctxt *Context) symbolName(info *Info) string {
+	name := info.Ident.Name
+	if recv := methodReceiver(info); recv != "" {
+		// A method is named by its receiver type, so
+		// that pointer and value methods can be
+		// told apart.
+		return recv + "." + name
+	}
+	if info.member != "" {
+		return info.member + "." + name
+	}
+	e, ok := info.Expr.(*ast.SelectorExpr)
+	if !ok {
+		return name
+	}
+	_, xt := ctxt.exprType(info.exprTypes, e.X)
+	switch xn := xt.Deref(ctxt.importer).Node.(type) {
+	case nil:
+		return ""
+	case *ast.Ident:
+		return xn.Name + "." + name
+	case *ast.ImportSpec:
+		// don't qualify with package identifier
+		return name
+	}
+	// literal struct or interface expression.
+	return "_." + name
+}
+
+// PackagePath returns the import path of the package
+// in the directory containing the file at the given position.
+func (ctxt *Context) PackagePath(p token.Position) (string, error) {
+	if p.Filename == "" {
+		return "", fmt.Errorf("no file name for position")
+	}
+	dir := filepath.Dir(p.Filename)
+	ctxt.pkgMutex.Lock()
+	defer ctxt.pkgMutex.Unlock()
+	if ctxt.cmdFiles[p.Filename] {
+		return CommandLinePackage, nil
+	}
+	if path, ok := ctxt.pkgDirs[dir]; ok {
+		return path, nil
+	}
+	if path, ok := modulePath(ctxt.modules(), dir); ok {
+		ctxt.pkgDirs[dir] = path
+		return path, nil
+	}
+	bpkg, err := ctxt.BuildContext.Import(".", dir, build.FindOnly)
+	if err != nil {
+		return "", fmt.Errorf("cannot reverse-map filename to package: %v", err)
+	}
+	ctxt.pkgDirs[dir] = bpkg.ImportPath
+	return bpkg.ImportPath, nil
+}
+
+// methodReceiver returns the receiver type of the method
+// referred to by the identifier in info, as T or (*T), or
+// the empty string if it does not refer to a method.
+func methodReceiver(info *Info) string {
+	fd, ok := info.ReferObj.Decl.(*ast.FuncDecl)
+	if !ok || info.ReferObj.Kind != ast.Fun || fd.Recv == nil || len(fd.Recv.List) != 1 {
+		return ""
+	}
+	t := fd.Recv.List[0].Type
+	if st, ok := t.(*ast.StarExpr); ok {
+		return "(*" + pretty(st.X) + ")"
+	}
+	return pretty(t)
+}
+
+// generatedPat matches the comment that marks a file as
+// generated, following the convention of the Go tools.
+var generatedPat = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+// IsGenerated reports whether f was generated by a tool, as
+// marked by a line comment "// Code generated ... DO NOT EDIT."
+// before its package clause.
+func IsGenerated(f *ast.File) bool {
+	for _, g := range f.Comments {
+		if g.Pos() >= f.Package {
+			break
+		}
+		for _, c := range g.List {
+			if generatedPat.MatchString(c.Text) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// absPath returns the absolute form of the given
+// file path, or the path itself if it has none.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// SortedFiles returns the files in pkg sorted by name.
+func SortedFiles(pkg *ast.Package) []*ast.File {
+	names := make([]string, 0, len(pkg.Files))
+	for name := range pkg.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make([]*ast.File, len(names))
+	for i, name := range names {
+		files[i] = pkg.Files[name]
+	}
+	return files
+}
+
+// FileImports returns all the imports in f. The parser
+// does not fill in f.Imports, so they are found from
+// the import declarations.
+func FileImports(f *ast.File) []*ast.ImportSpec {
+	var imps []*ast.ImportSpec
+	for _, d := range f.Decls {
+		d, ok := d.(*ast.GenDecl)
+		if !ok || d.Tok != token.IMPORT {
+			continue
+		}
+		for _, spec := range d.Specs {
+			imps = append(imps, spec.(*ast.ImportSpec))
+		}
+	}
+	return imps
+}
@@ -0,0 +1,74 @@
+package sym
+
+import (
+	"code.google.com/p/rog-go/exp/go/token"
+	"fmt"
+	"sync"
+)
+
+// WarnSource is the category of the warnings that a
+// Context reports itself: a package or symbol could not
+// be found, parsed or resolved.
+const WarnSource = "source"
+
+// Warning describes a problem that is reported
+// without failing.
+type Warning struct {
+	// Pos holds the position the warning is about,
+	// or the zero Position if there is none.
+	Pos token.Position
+
+	// Category holds the category of the warning,
+	// such as WarnSource.
+	Category string
+
+	// Msg holds the text of the warning.
+	Msg string
+}
+
+func (w Warning) String() string {
+	if !w.Pos.IsValid() {
+		return w.Msg
+	}
+	return fmt.Sprintf("%v: %s", w.Pos, w.Msg)
+}
+
+// warnMu serializes the calls of the warning handlers,
+// so that they need not be safe for concurrent use.
+var warnMu sync.Mutex
+
+// Warnf reports a warning in the given category at position
+// p, which may be the zero Position, to ctxt.Warn. If that is
+// nil, the warning is printed with ctxt.Logf instead, if that
+// is not nil.
+func (ctxt *Context) Warnf(p token.Position, category string, f string, a ...interface{}) {
+	w := Warning{
+		Pos:      p,
+		Category: category,
+		Msg:      fmt.Sprintf(f, a...),
+	}
+	warnMu.Lock()
+	defer warnMu.Unlock()
+	switch {
+	case ctxt.Warn != nil:
+		ctxt.Warn(w)
+	case ctxt.Logf != nil:
+		ctxt.Logf(token.NoPos, "%v", w)
+	}
+}
+
+// logf reports a warning in the WarnSource category
+// at pos, which may be token.NoPos.
+func (ctxt *Context) logf(pos token.Pos, f string, a ...interface{}) {
+	if ctxt.Warn == nil {
+		if ctxt.Logf != nil {
+			ctxt.Logf(pos, f, a...)
+		}
+		return
+	}
+	var p token.Position
+	if pos.IsValid() {
+		p = ctxt.FileSet.Position(pos)
+	}
+	ctxt.Warnf(p, WarnSource, f, a...)
+}
@@ -0,0 +1,55 @@
+package types
+
+import (
+	"sync"
+
+	"code.google.com/p/rog-go/exp/go/ast"
+	"code.google.com/p/rog-go/exp/go/parser"
+)
+
+// builtinSource holds the signatures of the predeclared
+// functions, written as in the documentation of package
+// builtin. The type names standing for arbitrary types
+// (Type, Type1, IntegerType, FloatType and ComplexType)
+// are deliberately left undeclared.
+const builtinSource = `
+func append(slice []Type, elems ...Type) []Type
+func cap(v Type) int
+func close(c chan<- Type)
+func complex(r, i FloatType) ComplexType
+func copy(dst, src []Type) int
+func delete(m map[Type]Type1, key Type)
+func imag(c ComplexType) FloatType
+func len(v Type) int
+func make(t Type, size ...IntegerType) Type
+func new(Type) *Type
+func panic(v interface{})
+func panicln(args ...interface{})
+func print(args ...Type)
+func println(args ...Type)
+func real(c ComplexType) FloatType
+func recover() interface{}
+`
+
+var builtinOnce sync.Once
+
+// builtinTypes maps each predeclared function
+// object to its signature.
+var builtinTypes map[*ast.Object]*ast.FuncType
+
+// builtinType returns the signature of the predeclared
+// function obj, or nil if obj is not one.
+func builtinType(obj *ast.Object) *ast.FuncType {
+	builtinOnce.Do(func() {
+		decls, err := parser.ParseDeclList(FileSet, "builtin.go", builtinSource, ast.NewScope(parser.Universe))
+		if err != nil {
+			panic("cannot parse builtin signatures: " + err.Error())
+		}
+		builtinTypes = make(map[*ast.Object]*ast.FuncType)
+		for _, d := range decls {
+			fd := d.(*ast.FuncDecl)
+			builtinTypes[parser.Universe.Lookup(fd.Name.Name)] = fd.Type
+		}
+	})
+	return builtinTypes[obj]
+}
@@ -0,0 +1,364 @@
+package types
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"code.google.com/p/rog-go/exp/go/ast"
+	"code.google.com/p/rog-go/exp/go/parser"
+	"code.google.com/p/rog-go/exp/go/token"
+)
+
+// maxShift is the largest shift count allowed
+// when evaluating a constant expression.
+const maxShift = 1024
+
+var lenIdent = predecl("len")
+
+// ConstValue returns the value of the constant expression e,
+// formatted as a Go literal: integers and runes in decimal,
+// strings quoted and booleans as true or false. Constants
+// declared with iota, or in terms of other constants, are
+// evaluated too. An error is returned if e is not constant,
+// or if its value cannot be evaluated, as for floating
+// point and complex constants.
+func ConstValue(e ast.Expr, importer Importer) (string, error) {
+	return defaultContext().constValueWith(e, importer)
+}
+
+// ConstValue is like the ConstValue function, using ctxt
+// to import packages.
+func (ctxt *Context) ConstValue(e ast.Expr) (string, error) {
+	return ctxt.constValueWith(e, ctxt.Import)
+}
+
+func (ctxt *Context) constValueWith(e ast.Expr, importer Importer) (v string, err error) {
+	defer func() {
+		if ctxt.Panic {
+			return
+		}
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cannot evaluate %v: %v", pretty{e}, r)
+		}
+	}()
+	ev := &evaluator{
+		importer: importer,
+		active:   make(map[*ast.Object]bool),
+	}
+	x, err := ev.eval(e, -1)
+	if err != nil {
+		return "", err
+	}
+	switch x := x.(type) {
+	case *big.Int:
+		return x.String(), nil
+	case string:
+		return strconv.Quote(x), nil
+	}
+	return strconv.FormatBool(x.(bool)), nil
+}
+
+// evaluator evaluates constant expressions. Values
+// are represented as *big.Int, string or bool.
+type evaluator struct {
+	importer Importer
+
+	// active holds the constants being evaluated,
+	// so that a definition loop can be detected.
+	active map[*ast.Object]bool
+}
+
+// eval returns the value of the expression e. The iota argument
+// holds the value of iota in e, or -1 if e is not part of a
+// constant declaration.
+func (ev *evaluator) eval(e ast.Expr, iota int) (interface{}, error) {
+	switch e := e.(type) {
+	case *ast.ParenExpr:
+		return ev.eval(e.X, iota)
+
+	case *ast.BasicLit:
+		return litValue(e)
+
+	case *ast.Ident:
+		switch e.Obj {
+		case iotaIdent.Obj:
+			if iota < 0 {
+				return nil, fmt.Errorf("iota outside constant declaration")
+			}
+			return big.NewInt(int64(iota)), nil
+		case trueIdent.Obj:
+			return true, nil
+		case falseIdent.Obj:
+			return false, nil
+		}
+		return ev.objValue(e.Obj, e)
+
+	case *ast.SelectorExpr:
+		obj, _ := exprType(e, false, "", ev.importer)
+		return ev.objValue(obj, e)
+
+	case *ast.UnaryExpr:
+		x, err := ev.eval(e.X, iota)
+		if err != nil {
+			return nil, err
+		}
+		return ev.unary(e, x)
+
+	case *ast.BinaryExpr:
+		x, err := ev.eval(e.X, iota)
+		if err != nil {
+			return nil, err
+		}
+		y, err := ev.eval(e.Y, iota)
+		if err != nil {
+			return nil, err
+		}
+		return binary(e, x, y)
+
+	case *ast.CallExpr:
+		if len(e.Args) != 1 {
+			break
+		}
+		x, err := ev.eval(e.Args[0], iota)
+		if err != nil {
+			return nil, err
+		}
+		return ev.call(e, x)
+	}
+	return nil, fmt.Errorf("%v is not constant", pretty{e})
+}
+
+// objValue returns the value of the constant obj,
+// referred to by the expression e.
+func (ev *evaluator) objValue(obj *ast.Object, e ast.Expr) (interface{}, error) {
+	if obj == nil || obj.Kind != ast.Con {
+		return nil, fmt.Errorf("%v is not constant", pretty{e})
+	}
+	if ev.active[obj] {
+		return nil, fmt.Errorf("constant definition loop at %s", obj.Name)
+	}
+	ev.active[obj] = true
+	defer delete(ev.active, obj)
+	id, _ := e.(*ast.Ident)
+	expr, _ := splitDecl(obj, id)
+	x, ok := expr.(ast.Expr)
+	if !ok {
+		return nil, fmt.Errorf("no value found for constant %s", obj.Name)
+	}
+	iota, ok := obj.Data.(int)
+	if !ok {
+		iota = -1
+	}
+	return ev.eval(x, iota)
+}
+
+// litValue returns the value of a literal.
+func litValue(lit *ast.BasicLit) (interface{}, error) {
+	switch lit.Kind {
+	case token.INT:
+		if x, ok := new(big.Int).SetString(lit.Value, 0); ok {
+			return x, nil
+		}
+	case token.CHAR:
+		// Unquote would turn an escape such as '\x80',
+		// which is not valid UTF-8, into U+FFFD.
+		if n := len(lit.Value); n >= 3 && lit.Value[0] == '\'' && lit.Value[n-1] == '\'' {
+			r, _, tail, err := strconv.UnquoteChar(lit.Value[1:n-1], '\'')
+			if err == nil && tail == "" {
+				return big.NewInt(int64(r)), nil
+			}
+		}
+	case token.STRING:
+		if s, err := strconv.Unquote(lit.Value); err == nil {
+			return s, nil
+		}
+	default:
+		return nil, fmt.Errorf("cannot evaluate %v constant %s", lit.Kind, lit.Value)
+	}
+	return nil, fmt.Errorf("invalid literal %s", lit.Value)
+}
+
+func (ev *evaluator) unary(e *ast.UnaryExpr, x interface{}) (interface{}, error) {
+	switch x := x.(type) {
+	case *big.Int:
+		switch e.Op {
+		case token.ADD:
+			return x, nil
+		case token.SUB:
+			return new(big.Int).Neg(x), nil
+		case token.XOR:
+			// For unsigned types, the mask has all
+			// the bits of the type set.
+			if bits := ev.unsignedBits(e); bits > 0 {
+				mask := new(big.Int).Lsh(big.NewInt(1), bits)
+				return new(big.Int).Xor(x, mask.Sub(mask, big.NewInt(1))), nil
+			}
+			return new(big.Int).Not(x), nil
+		}
+	case bool:
+		if e.Op == token.NOT {
+			return !x, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid constant operation %v", pretty{e})
+}
+
+func binary(e *ast.BinaryExpr, x, y interface{}) (interface{}, error) {
+	switch e.Op {
+	case token.SHL, token.SHR:
+		x, ok1 := x.(*big.Int)
+		y, ok2 := y.(*big.Int)
+		if !ok1 || !ok2 || y.Sign() < 0 || y.Cmp(big.NewInt(maxShift)) > 0 {
+			break
+		}
+		if e.Op == token.SHL {
+			return new(big.Int).Lsh(x, uint(y.Int64())), nil
+		}
+		return new(big.Int).Rsh(x, uint(y.Int64())), nil
+	}
+	switch x := x.(type) {
+	case *big.Int:
+		y, ok := y.(*big.Int)
+		if !ok {
+			break
+		}
+		switch e.Op {
+		case token.ADD:
+			return new(big.Int).Add(x, y), nil
+		case token.SUB:
+			return new(big.Int).Sub(x, y), nil
+		case token.MUL:
+			return new(big.Int).Mul(x, y), nil
+		case token.QUO, token.REM:
+			if y.Sign() == 0 {
+				return nil, fmt.Errorf("division by zero in %v", pretty{e})
+			}
+			if e.Op == token.QUO {
+				return new(big.Int).Quo(x, y), nil
+			}
+			return new(big.Int).Rem(x, y), nil
+		case token.AND:
+			return new(big.Int).And(x, y), nil
+		case token.OR:
+			return new(big.Int).Or(x, y), nil
+		case token.XOR:
+			return new(big.Int).Xor(x, y), nil
+		case token.AND_NOT:
+			return new(big.Int).AndNot(x, y), nil
+		}
+		return compare(e.Op, x.Cmp(y))
+
+	case string:
+		y, ok := y.(string)
+		if !ok {
+			break
+		}
+		if e.Op == token.ADD {
+			return x + y, nil
+		}
+		switch {
+		case x < y:
+			return compare(e.Op, -1)
+		case x > y:
+			return compare(e.Op, 1)
+		}
+		return compare(e.Op, 0)
+
+	case bool:
+		y, ok := y.(bool)
+		if !ok {
+			break
+		}
+		switch e.Op {
+		case token.LAND:
+			return x && y, nil
+		case token.LOR:
+			return x || y, nil
+		case token.EQL:
+			return x == y, nil
+		case token.NEQ:
+			return x != y, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid constant operation %v", pretty{e})
+}
+
+// compare returns the result of the comparison op
+// between two values that compare as cmp does.
+func compare(op token.Token, cmp int) (interface{}, error) {
+	switch op {
+	case token.EQL:
+		return cmp == 0, nil
+	case token.NEQ:
+		return cmp != 0, nil
+	case token.LSS:
+		return cmp < 0, nil
+	case token.LEQ:
+		return cmp <= 0, nil
+	case token.GTR:
+		return cmp > 0, nil
+	case token.GEQ:
+		return cmp >= 0, nil
+	}
+	return nil, fmt.Errorf("invalid constant operation %v", op)
+}
+
+// call returns the value of the call e with the single
+// argument x, which must be a conversion or a call
+// of len on a string.
+func (ev *evaluator) call(e *ast.CallExpr, x interface{}) (interface{}, error) {
+	if exprName(e.Fun) == lenIdent.Obj {
+		if s, ok := x.(string); ok {
+			return big.NewInt(int64(len(s))), nil
+		}
+		return nil, fmt.Errorf("%v is not constant", pretty{e})
+	}
+	_, t := exprType(e.Fun, false, "", ev.importer)
+	if t.Kind != ast.Typ {
+		return nil, fmt.Errorf("%v is not constant", pretty{e})
+	}
+	if n, ok := x.(*big.Int); ok && basicTypeName(t, ev.importer) == "string" {
+		// Conversion of an integer to a string
+		// yields the UTF-8 encoding of the rune.
+		r := rune(0xFFFD)
+		if n.IsInt64() && n.Int64() >= 0 && n.Int64() <= 0x10FFFF {
+			r = rune(n.Int64())
+		}
+		return string(r), nil
+	}
+	return x, nil
+}
+
+// unsignedBits returns the size in bits of the type of e
+// if it is an unsigned integer type, or 0 otherwise.
+func (ev *evaluator) unsignedBits(e ast.Expr) uint {
+	_, t := exprType(e, false, "", ev.importer)
+	switch basicTypeName(t, ev.importer) {
+	case "uint8", "byte":
+		return 8
+	case "uint16":
+		return 16
+	case "uint32":
+		return 32
+	case "uint64", "uint", "uintptr":
+		return 64
+	}
+	return 0
+}
+
+// basicTypeName returns the name of the predeclared
+// type underlying t, or the empty string if there is none.
+func basicTypeName(t Type, importer Importer) string {
+	for t.Kind != ast.Bad {
+		id, ok := t.Node.(*ast.Ident)
+		if !ok || id.Obj == nil {
+			break
+		}
+		if parser.Universe.Lookup(id.Name) == id.Obj {
+			return id.Name
+		}
+		t = t.Underlying(false, importer)
+	}
+	return ""
+}
@@ -13,6 +13,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 
 	"code.google.com/p/rog-go/exp/go/ast"
 	"code.google.com/p/rog-go/exp/go/parser"
@@ -54,9 +55,11 @@ var badType = Type{Kind: ast.Bad}
 
 var makeIdent = predecl("make")
 var newIdent = predecl("new")
+var appendIdent = predecl("append")
 var falseIdent = predecl("false")
 var trueIdent = predecl("true")
 var iotaIdent = predecl("iota")
+var nilIdent = predecl("nil")
 var boolIdent = predecl("bool")
 var intIdent = predecl("int")
 var floatIdent = predecl("float")
@@ -74,14 +77,98 @@ var FileSet = token.NewFileSet()
 // GoPath is used by DefaultImporter to find packages.
 var GoPath = []string{filepath.Join(os.Getenv("GOROOT"), "src", "pkg")}
 
+// Context holds the state used when importing packages
+// and inferring types. Unlike the package-level functions,
+// which share FileSet, GoPath and Panic, each Context is
+// independent of any other, and its methods may be called
+// concurrently.
+type Context struct {
+	// FileSet holds the positions of all the files
+	// parsed by Import.
+	FileSet *token.FileSet
+
+	// GoPath holds source directories that are searched
+	// by Import for packages that go/build cannot find.
+	GoPath []string
+
+	// Panic specifies whether a panic while inferring a
+	// type is passed on to the caller. If it is false, the
+	// panic is logged and the type is treated as unknown.
+	Panic bool
+
+	mu   sync.Mutex
+	pkgs map[string]*ast.Package
+}
+
+// NewContext returns a new Context with its own FileSet
+// that caches every package it imports.
+func NewContext() *Context {
+	return &Context{
+		FileSet: token.NewFileSet(),
+		GoPath:  []string{filepath.Join(os.Getenv("GOROOT"), "src", "pkg")},
+		Panic:   true,
+		pkgs:    make(map[string]*ast.Package),
+	}
+}
+
+// defaultContext returns a Context that uses the package-level
+// variables FileSet, GoPath and Panic. It does not cache
+// imported packages.
+func defaultContext() *Context {
+	return &Context{
+		FileSet: FileSet,
+		GoPath:  GoPath,
+		Panic:   Panic,
+	}
+}
+
 // DefaultGetPackage looks for the package; if it finds it,
 // it parses and returns it. If no package was found, it returns nil.
 func DefaultImporter(path string) *ast.Package {
+	return defaultContext().Import(path)
+}
+
+// Import looks for the package with the given import path;
+// if it finds it, it parses and returns it. If no package was
+// found, it returns nil. Packages imported by a Context
+// made with NewContext are parsed once only.
+func (ctxt *Context) Import(path string) *ast.Package {
+	ctxt.mu.Lock()
+	pkg, ok := ctxt.pkgs[path]
+	ctxt.mu.Unlock()
+	if ok {
+		return pkg
+	}
+	pkg = ctxt.importPackage(path)
+	if ctxt.pkgs != nil {
+		ctxt.mu.Lock()
+		// Another goroutine may have imported the
+		// package in the meantime; use the first one
+		// so that all callers see the same objects.
+		if p, ok := ctxt.pkgs[path]; ok {
+			pkg = p
+		} else {
+			ctxt.pkgs[path] = pkg
+		}
+		ctxt.mu.Unlock()
+	}
+	return pkg
+}
+
+func (ctxt *Context) importPackage(path string) *ast.Package {
 	bpkg, err := build.Default.Import(path, "", 0)
 	if err != nil {
-		return nil
+		for _, dir := range ctxt.GoPath {
+			bpkg, err = build.Default.ImportDir(filepath.Join(dir, filepath.FromSlash(path)), 0)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil
+		}
 	}
-	pkgs, err := parser.ParseDir(FileSet, bpkg.Dir, isGoFile, 0)
+	pkgs, err := parser.ParseDir(ctxt.FileSet, bpkg.Dir, isGoFile, 0)
 	if err != nil {
 		if Debug {
 			switch err := err.(type) {
@@ -124,37 +211,108 @@ func (t Type) String() string {
 	return fmt.Sprintf("Type{%v %q %T %v}", t.Kind, t.Pkg, t.Node, pretty{t.Node})
 }
 
+// Panic is used as the Panic field of the Context
+// used by the package-level functions.
 var Panic = true
 
+// recoverPanic recovers from any panic in progress
+// unless ctxt.Panic is true. It must be deferred.
+func (ctxt *Context) recoverPanic() {
+	if ctxt.Panic {
+		return
+	}
+	if err := recover(); err != nil {
+		log.Printf("panic: %v", err)
+	}
+}
+
 // Member looks for a member with the given name inside
 // the type. For packages, the member can be any exported
 // top level declaration inside the package.
-func (t Type) Member(name string, importer Importer) *ast.Object {
+// If the name is ambiguous (see Members), Member returns nil.
+func (t Type) Member(name string, importer Importer) (m *ast.Object) {
+	defer defaultContext().recoverPanic()
+	return t.member(name, importer)
+}
+
+// Member is like Type.Member, using ctxt to import packages.
+func (ctxt *Context) Member(t Type, name string) (m *ast.Object) {
+	defer ctxt.recoverPanic()
+	return t.member(name, ctxt.Import)
+}
+
+func (t Type) member(name string, importer Importer) *ast.Object {
 	debugp("member %v '%s' {", t, name)
+	var m *ast.Object
+	if objs := t.members(name, importer); len(objs) == 1 {
+		m = objs[0]
+	}
+	debugp("} -> %v", m)
+	return m
+}
+
+// Members returns all the members with the given name
+// at the shallowest depth at which any such member is found.
+// More than one member is returned only when the
+// name is ambiguous - for instance when a struct embeds
+// two types that both have a field with the name.
+func (t Type) Members(name string, importer Importer) (objs []*ast.Object) {
+	defer defaultContext().recoverPanic()
+	return t.members(name, importer)
+}
+
+// Members is like Type.Members, using ctxt to import packages.
+func (ctxt *Context) Members(t Type, name string) (objs []*ast.Object) {
+	defer ctxt.recoverPanic()
+	return t.members(name, ctxt.Import)
+}
+
+// membersResult holds the result of a member search.
+type membersResult struct {
+	objs  []*ast.Object
+	panic interface{}
+}
+
+func (t Type) members(name string, importer Importer) []*ast.Object {
 	if t.Pkg != "" && !ast.IsExported(name) {
 		return nil
 	}
-	c := make(chan *ast.Object)
+	c := make(chan membersResult)
 	go func() {
-		if !Panic {
-			defer func() {
-				if err := recover(); err != nil {
-					log.Printf("panic: %v", err)
-					c <- nil
-				}
-			}()
-		}
-		doMembers(t, name, importer, func(obj *ast.Object) {
-			if obj.Name == name {
-				c <- obj
+		// Pass any panic back to the calling goroutine,
+		// where it can be recovered.
+		defer func() {
+			if err := recover(); err != nil {
+				c <- membersResult{panic: err}
+			}
+		}()
+		var objs []*ast.Object
+		found := -1
+		doMembers(t, name, importer, func(obj *ast.Object, depth int) {
+			if found >= 0 && depth > found {
+				// Members at a deeper level are hidden
+				// by the ones already found.
+				c <- membersResult{objs: objs}
 				runtime.Goexit()
 			}
+			if obj.Name != name {
+				return
+			}
+			for _, o := range objs {
+				if o == obj {
+					return
+				}
+			}
+			objs = append(objs, obj)
+			found = depth
 		})
-		c <- nil
+		c <- membersResult{objs: objs}
 	}()
-	m := <-c
-	debugp("} -> %v", m)
-	return m
+	r := <-c
+	if r.panic != nil {
+		panic(r.panic)
+	}
+	return r.objs
 }
 
 // Iter returns a channel, sends on it
@@ -167,7 +325,7 @@ func (t Type) Iter(importer Importer) <-chan *ast.Object {
 	c := make(chan *ast.Object)
 	go func() {
 		internal := t.Pkg == ""
-		doMembers(t, "", importer, func(obj *ast.Object) {
+		doMembers(t, "", importer, func(obj *ast.Object, depth int) {
 			if internal || ast.IsExported(obj.Name) {
 				c <- obj
 			}
@@ -185,6 +343,17 @@ func (t Type) Iter(importer Importer) <-chan *ast.Object {
 // the source location of the definition of the object.
 //
 func ExprType(e ast.Expr, importer Importer) (obj *ast.Object, typ Type) {
+	return defaultContext().exprTypeWith(e, importer)
+}
+
+// ExprType is like the ExprType function, using ctxt
+// to import packages.
+func (ctxt *Context) ExprType(e ast.Expr) (obj *ast.Object, typ Type) {
+	return ctxt.exprTypeWith(e, ctxt.Import)
+}
+
+func (ctxt *Context) exprTypeWith(e ast.Expr, importer Importer) (obj *ast.Object, typ Type) {
+	defer ctxt.recoverPanic()
 	return exprType(e, false, "", importer)
 }
 
@@ -200,6 +369,14 @@ func exprType(n ast.Node, expectTuple bool, pkg string, importer Importer) (xobj
 		if obj == nil || obj.Kind == ast.Bad {
 			break
 		}
+		// A type alias represents the type it stands for,
+		// unless it is declared in terms of itself.
+		if ts, ok := obj.Decl.(*ast.TypeSpec); ok && ts.Assign.IsValid() {
+			if aliasCycle(obj) {
+				return obj, badType
+			}
+			return obj, certify(ts.Type, ast.Typ, pkg, importer)
+		}
 		// A type object represents itself.
 		if obj.Kind == ast.Typ {
 			// Objects in the universal scope don't live
@@ -233,6 +410,9 @@ func exprType(n ast.Node, expectTuple bool, pkg string, importer Importer) (xobj
 			case iotaIdent.Obj:
 				return obj, Type{intIdent, ast.Con, ""}
 			default:
+				if fn := builtinType(obj); fn != nil {
+					return obj, Type{fn, ast.Fun, ""}
+				}
 				return obj, Type{}
 			}
 		}
@@ -253,40 +433,22 @@ func exprType(n ast.Node, expectTuple bool, pkg string, importer Importer) (xobj
 
 	case *ast.SelectorExpr:
 		_, t := exprType(n.X, false, pkg, importer)
-		// TODO: method expressions. when t.Kind == ast.Typ,
-		// 	mutate a method declaration into a function with
-		//	the receiver as first argument
-		if t.Kind == ast.Bad {
-			break
-		}
-		obj := t.Member(n.Sel.Name, importer)
-		if obj == nil {
-			return nil, badType
-		}
-		if t.Kind == ast.Pkg {
-			eobj, et := exprType(&ast.Ident{Name: obj.Name, Obj: obj}, false, t.Pkg, importer)
-			et.Pkg = litToString(t.Node.(*ast.ImportSpec).Path)
-			return eobj, et
-		}
-		// a method turns into a function type;
-		// the number of formal arguments depends
-		// on the class of the receiver expression.
-		if fd, ismethod := obj.Decl.(*ast.FuncDecl); ismethod {
-			if t.Kind == ast.Typ {
-				return obj, certify(methodExpr(fd), ast.Fun, t.Pkg, importer)
-			}
-			return obj, certify(fd.Type, ast.Fun, t.Pkg, importer)
-		} else if obj.Kind == ast.Typ {
-			return obj, certify(&ast.Ident{Name: obj.Name, Obj: obj}, ast.Typ, t.Pkg, importer)
-		}
-		_, typ := splitDecl(obj, nil)
-		return obj, certify(typ, obj.Kind, t.Pkg, importer)
+		return selectorType(n, t, importer)
 
 	case *ast.FuncDecl:
-		return nil, certify(methodExpr(n), ast.Fun, pkg, importer)
+		if n.Recv == nil {
+			return nil, certify(n.Type, ast.Fun, pkg, importer)
+		}
+		return nil, certify(methodExpr(n.Recv.List[0].Type, n), ast.Fun, pkg, importer)
 
 	case *ast.IndexExpr:
+		// A pointer to an array may be indexed
+		// as the array itself.
 		_, t0 := exprType(n.X, false, pkg, importer)
+		t0 = t0.Deref(importer)
+		if isString(t0, importer) {
+			return nil, Type{predecl("byte"), ast.Var, ""}
+		}
 		t := t0.Underlying(true, importer)
 		switch n := t.Node.(type) {
 		case *ast.ArrayType:
@@ -316,6 +478,16 @@ func exprType(n ast.Node, expectTuple bool, pkg string, importer Importer) (xobj
 					return nil, Type{&ast.StarExpr{n.Pos(), t.Node.(ast.Expr)}, ast.Var, t.Pkg}
 				}
 			}
+		case appendIdent.Obj:
+			// The generic signature of append says
+			// only that it returns its first argument's type.
+			if len(n.Args) > 0 {
+				_, t := exprType(n.Args[0], false, pkg, importer)
+				if t.Kind != ast.Bad {
+					t.Kind = ast.Var
+				}
+				return nil, t
+			}
 		default:
 			if _, fntype := exprType(n.Fun, false, pkg, importer); fntype.Kind != ast.Bad {
 				// A type cast transforms a type expression
@@ -409,7 +581,7 @@ func exprType(n ast.Node, expectTuple bool, pkg string, importer Importer) (xobj
 			}
 			return nil, Type{predecl("bool"), t.Kind, ""}
 
-		case token.ADD, token.SUB, token.MUL, token.QUO, token.REM, token.AND, token.AND_NOT, token.XOR:
+		case token.ADD, token.SUB, token.MUL, token.QUO, token.REM, token.AND, token.OR, token.AND_NOT, token.XOR:
 			_, tx := exprType(n.X, false, pkg, importer)
 			_, ty := exprType(n.Y, false, pkg, importer)
 			switch {
@@ -474,6 +646,56 @@ func exprType(n ast.Node, expectTuple bool, pkg string, importer Importer) (xobj
 	return nil, badType
 }
 
+// SelectorType is like ExprType for the selector expression e,
+// given the type of e.X as returned by ExprType. It allows
+// the types of the expressions in a chain of selectors,
+// such as a.b.c, each to be found only once.
+func SelectorType(e *ast.SelectorExpr, xt Type, importer Importer) (obj *ast.Object, typ Type) {
+	defer defaultContext().recoverPanic()
+	return selectorType(e, xt, importer)
+}
+
+// selectorType returns the type of the selector expression
+// n, given the type t of n.X.
+func selectorType(n *ast.SelectorExpr, t Type, importer Importer) (*ast.Object, Type) {
+	if t.Kind == ast.Bad {
+		return nil, badType
+	}
+	obj := t.member(n.Sel.Name, importer)
+	if obj == nil {
+		return nil, badType
+	}
+	if t.Kind == ast.Pkg {
+		eobj, et := exprType(&ast.Ident{Name: obj.Name, Obj: obj}, false, t.Pkg, importer)
+		et.Pkg = ImportPath(t.Node.(*ast.ImportSpec))
+		return eobj, et
+	}
+	// a method turns into a function type;
+	// the number of formal arguments depends
+	// on the class of the receiver expression:
+	// in a method expression such as T.M or (*T).M,
+	// the receiver is the first argument.
+	if fd, ismethod := obj.Decl.(*ast.FuncDecl); ismethod {
+		if t.Kind == ast.Typ {
+			return obj, certify(methodExpr(t.Node.(ast.Expr), fd), ast.Fun, t.Pkg, importer)
+		}
+		return obj, certify(fd.Type, ast.Fun, t.Pkg, importer)
+	} else if obj.Kind == ast.Typ {
+		return obj, certify(&ast.Ident{Name: obj.Name, Obj: obj}, ast.Typ, t.Pkg, importer)
+	}
+	_, typ := splitDecl(obj, nil)
+	return obj, certify(typ, obj.Kind, t.Pkg, importer)
+}
+
+// ImportPath returns the import path of the package
+// imported by spec, which is spec.Resolved if set.
+func ImportPath(spec *ast.ImportSpec) string {
+	if spec.Resolved != "" {
+		return spec.Resolved
+	}
+	return litToString(spec.Path)
+}
+
 // litToString converts from a string literal to a regular string.
 func litToString(lit *ast.BasicLit) (v string) {
 	if lit.Kind != token.STRING {
@@ -487,39 +709,41 @@ func litToString(lit *ast.BasicLit) (v string) {
 }
 
 // doMembers iterates through a type's members, calling
-// fn for each member. If name is non-empty, it looks
+// fn for each member with the depth at which it was found
+// (0 for members of the type itself, 1 for members of its
+// embedded types, and so on). If name is non-empty, it looks
 // directly for members with that name when possible.
 // It uses the list q as a queue to perform breadth-first
 // traversal, as per the Go specification.
-func doMembers(typ Type, name string, importer Importer, fn func(*ast.Object)) {
+func doMembers(typ Type, name string, importer Importer, fn func(obj *ast.Object, depth int)) {
 	switch t := typ.Node.(type) {
 	case nil:
 		return
 
 	case *ast.ImportSpec:
-		path := litToString(t.Path)
+		path := ImportPath(t)
 		if pkg := importer(path); pkg != nil {
-			doScope(pkg.Scope, name, fn, path)
+			doScope(pkg.Scope, name, func(obj *ast.Object) { fn(obj, 0) }, path)
 		}
 		return
 	}
 
 	q := list.New()
 	q.PushBack(typ)
-	for e := q.Front(); e != nil; e = q.Front() {
-		doTypeMembers(e.Value.(Type), name, importer, fn, q)
-		q.Remove(e)
+	for depth := 0; q.Len() > 0; depth++ {
+		next := list.New()
+		for e := q.Front(); e != nil; e = e.Next() {
+			doTypeMembers(e.Value.(Type), name, importer, func(obj *ast.Object) { fn(obj, depth) }, next)
+		}
+		q = next
 	}
 }
 
 // doTypeMembers calls fn for each member of the given type,
 // at one level only. Unnamed members are pushed onto the queue.
 func doTypeMembers(t Type, name string, importer Importer, fn func(*ast.Object), q *list.List) {
-	// strip off single indirection
 	// TODO: eliminate methods disallowed when indirected.
-	if u, ok := t.Node.(*ast.StarExpr); ok {
-		_, t = exprType(u.X, false, t.Pkg, importer)
-	}
+	t = t.Deref(importer)
 	if id, _ := t.Node.(*ast.Ident); id != nil && id.Obj != nil {
 		if scope, ok := id.Obj.Type.(*ast.Scope); ok {
 			doScope(scope, name, fn, t.Pkg)
@@ -629,11 +853,18 @@ func doScope(s *ast.Scope, name string, fn func(*ast.Object), pkg string) {
 // it repeats this process until the type is not
 // a named type.
 func (typ Type) Underlying(all bool, importer Importer) Type {
+	var seen []*ast.Object
 	for {
 		id, _ := typ.Node.(*ast.Ident)
 		if id == nil || id.Obj == nil {
 			break
 		}
+		if containsObj(seen, id.Obj) {
+			// A type defined in terms of itself,
+			// as in type A B; type B A, is invalid.
+			return badType
+		}
+		seen = append(seen, id.Obj)
 		_, typNode := splitDecl(id.Obj, id)
 		_, t := exprType(typNode, false, typ.Pkg, importer)
 		if t.Kind != ast.Typ {
@@ -648,6 +879,84 @@ func (typ Type) Underlying(all bool, importer Importer) Type {
 	return typ
 }
 
+// Deref returns typ with all levels of pointer indirection
+// removed, including those of named pointer types, as in
+// type P *T, which have the fields of the type they point to.
+func (typ Type) Deref(importer Importer) Type {
+	var seen []*ast.Object
+	for {
+		switch n := typ.Node.(type) {
+		case *ast.StarExpr:
+			_, typ = exprType(n.X, false, typ.Pkg, importer)
+			continue
+		case *ast.Ident:
+			u := typ.Underlying(false, importer)
+			if _, ok := u.Node.(*ast.StarExpr); ok && !containsObj(seen, n.Obj) {
+				// A pointer type may be named
+				// in terms of itself, as in type P *P.
+				seen = append(seen, n.Obj)
+				typ = u
+				continue
+			}
+		}
+		return typ
+	}
+}
+
+// isString reports whether typ is the predeclared type
+// string or a type defined in terms of it.
+func isString(typ Type, importer Importer) bool {
+	var seen []*ast.Object
+	for {
+		id, _ := typ.Node.(*ast.Ident)
+		if id == nil || id.Obj == nil || containsObj(seen, id.Obj) {
+			return false
+		}
+		if id.Obj == stringIdent.Obj {
+			return true
+		}
+		seen = append(seen, id.Obj)
+		typ = typ.Underlying(false, importer)
+	}
+}
+
+// aliasCycle reports whether the type that the alias obj
+// stands for refers to obj, directly or through other
+// aliases, as in type A = *A or type A = B; type B = A.
+// Such a declaration is invalid, and resolving it would
+// never finish.
+func aliasCycle(obj *ast.Object) bool {
+	var seen []*ast.Object
+	var refers func(n ast.Node) bool
+	refers = func(n ast.Node) bool {
+		found := false
+		ast.Inspect(n, func(n ast.Node) bool {
+			id, ok := n.(*ast.Ident)
+			if found || !ok || id.Obj == nil {
+				return !found
+			}
+			if id.Obj == obj {
+				found = true
+			} else if ts, ok := id.Obj.Decl.(*ast.TypeSpec); ok && ts.Assign.IsValid() && !containsObj(seen, id.Obj) {
+				seen = append(seen, id.Obj)
+				found = refers(ts.Type)
+			}
+			return !found
+		})
+		return found
+	}
+	return refers(obj.Decl.(*ast.TypeSpec).Type)
+}
+
+func containsObj(objs []*ast.Object, obj *ast.Object) bool {
+	for _, o := range objs {
+		if o == obj {
+			return true
+		}
+	}
+	return false
+}
+
 func noParens(typ interface{}) interface{} {
 	for {
 		if n, ok := typ.(*ast.ParenExpr); ok {
@@ -738,7 +1047,11 @@ func splitDecl(obj *ast.Object, id *ast.Ident) (expr, typ ast.Node) {
 			tcase := stmt.(*ast.CaseClause)
 			for _, stmt := range tcase.Body {
 				if containsNode(stmt, id) {
-					if len(tcase.List) == 1 {
+					// A clause listing exactly one type narrows
+					// the variable to that type, unless the type
+					// is nil, in which case it keeps the type of
+					// the guard expression.
+					if len(tcase.List) == 1 && exprName(tcase.List[0]) != nilIdent.Obj {
 						return expr, tcase.List[0]
 					}
 					return expr, nil
@@ -864,9 +1177,30 @@ func fields2type(fields *ast.FieldList) ast.Node {
 	return MultiValue{elist}
 }
 
-// TODO
-func methodExpr(fd *ast.FuncDecl) *ast.FuncType {
-	return fd.Type
+// methodExpr returns the type of the method expression
+// selecting the method declared by fd from the type recv:
+// a function that takes a value of type recv as its first
+// argument, followed by the arguments of the method.
+// The parameters are unnamed, as they would otherwise mix
+// named and unnamed parameters.
+func methodExpr(recv ast.Expr, fd *ast.FuncDecl) *ast.FuncType {
+	params := []*ast.Field{{Type: recv}}
+	if fd.Type.Params != nil {
+		for _, f := range fd.Type.Params.List {
+			n := len(f.Names)
+			if n == 0 {
+				n = 1
+			}
+			for ; n > 0; n-- {
+				params = append(params, &ast.Field{Type: f.Type})
+			}
+		}
+	}
+	return &ast.FuncType{
+		Func:    fd.Type.Func,
+		Params:  &ast.FieldList{List: params},
+		Results: fd.Type.Results,
+	}
 }
 
 // XXX  the following stuff is for debugging - remove later.
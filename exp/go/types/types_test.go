@@ -2,6 +2,7 @@ package types
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -169,6 +170,885 @@ func TestCompile(t *testing.T) {
 	}
 }
 
+var membersCode = `
+package p
+
+type A struct {
+	X, Y int
+}
+
+type B struct {
+	X int
+}
+
+type Both struct {
+	A
+	*B
+}
+
+type Shadow struct {
+	A
+	X string
+}
+`
+
+var membersTests = []struct {
+	typ  string
+	name string
+	decl []string
+}{
+	{"Both", "X", []string{"A", "B"}},
+	{"Both", "Y", []string{"A"}},
+	{"Shadow", "X", []string{"Shadow"}},
+	{"Shadow", "Y", []string{"A"}},
+	{"Both", "Z", nil},
+}
+
+func TestMembers(t *testing.T) {
+	scope := ast.NewScope(parser.Universe)
+	f, err := parser.ParseFile(FileSet, "members.go", membersCode, 0, scope)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	// declType returns the name of the type declaring the field obj.
+	declType := func(obj *ast.Object) string {
+		pos := DeclPos(obj)
+		for _, d := range f.Decls {
+			if d.Pos() <= pos && pos < d.End() {
+				return d.(*ast.GenDecl).Specs[0].(*ast.TypeSpec).Name.Name
+			}
+		}
+		return "?"
+	}
+	for i, test := range membersTests {
+		obj := scope.Lookup(test.typ)
+		typ := Type{Node: &ast.Ident{Name: obj.Name, Obj: obj}, Kind: ast.Typ}
+		var decl []string
+		for _, m := range typ.Members(test.name, DefaultImporter) {
+			decl = append(decl, declType(m))
+		}
+		if strings.Join(decl, " ") != strings.Join(test.decl, " ") {
+			t.Errorf("test %d: %s.%s: got members from %v; want %v", i, test.typ, test.name, decl, test.decl)
+		}
+		m := typ.Member(test.name, DefaultImporter)
+		if (m != nil) != (len(test.decl) == 1) {
+			t.Errorf("test %d: %s.%s: unexpected member %v", i, test.typ, test.name, m)
+		}
+	}
+}
+
+func TestContextImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "types-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pkgDir := filepath.Join(dir, "ctxtpkg")
+	if err := os.Mkdir(pkgDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(pkgDir, "p.go"), []byte("package ctxtpkg\n\ntype T struct{ X int }\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctxt := NewContext()
+	ctxt.GoPath = []string{dir}
+	pkgs := make(chan *ast.Package)
+	for i := 0; i < 4; i++ {
+		go func() {
+			pkgs <- ctxt.Import("ctxtpkg")
+		}()
+	}
+	pkg := <-pkgs
+	for i := 1; i < 4; i++ {
+		if p := <-pkgs; p != pkg {
+			t.Errorf("import %d returned a different package", i)
+		}
+	}
+	if pkg == nil {
+		t.Fatalf("package not found")
+	}
+	obj := pkg.Scope.Lookup("T")
+	if obj == nil {
+		t.Fatalf("T not found in package")
+	}
+	if pos := ctxt.FileSet.Position(DeclPos(obj)); pos.Line != 3 {
+		t.Errorf("T declared at %v; want line 3", pos)
+	}
+	typ := Type{Node: &ast.Ident{Name: obj.Name, Obj: obj}, Kind: ast.Typ, Pkg: "ctxtpkg"}
+	if m := ctxt.Member(typ, "X"); m == nil || m.Kind != ast.Var {
+		t.Errorf("unexpected member %v", m)
+	}
+	if pkg := ctxt.Import("nonexistent"); pkg != nil {
+		t.Errorf("unexpected package %v", pkg)
+	}
+}
+
+// embedPkgs holds packages in which interface methods
+// are promoted through two levels of embedding.
+var embedPkgs = map[string]string{
+	"embeda": `package embeda
+
+type Reader interface {
+	Read(p []byte) (int, error)
+}
+`,
+	"embedb": `package embedb
+
+import "embeda"
+
+type ReadCloser interface {
+	embeda.Reader
+	Close() error
+}
+`,
+	"embedc": `package embedc
+
+import "embedb"
+
+type Rd interface {
+	embedb.ReadCloser
+	Extra()
+}
+
+func F(r Rd, rc embedb.ReadCloser) {
+	r.Read(nil)
+	r.Close()
+	rc.Read(nil)
+	r.Extra()
+}
+`,
+}
+
+// TestEmbeddedInterfaceMethod checks that a method promoted
+// from an interface embedded in another package resolves
+// to the method's declaration there.
+func TestEmbeddedInterfaceMethod(t *testing.T) {
+	dir, err := ioutil.TempDir("", "types-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for path, src := range embedPkgs {
+		pkgDir := filepath.Join(dir, path)
+		if err := os.Mkdir(pkgDir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(pkgDir, path+".go"), []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctxt := NewContext()
+	ctxt.GoPath = []string{dir}
+	pkg := ctxt.Import("embedc")
+	if pkg == nil {
+		t.Fatalf("package not found")
+	}
+	f := pkg.Files[filepath.Join(dir, "embedc", "embedc.go")]
+	if f == nil {
+		t.Fatalf("file not found")
+	}
+	body := f.Decls[len(f.Decls)-1].(*ast.FuncDecl).Body
+	for i, want := range []struct {
+		name, file string
+		line       int
+	}{
+		{"Read", "embeda", 4},
+		{"Close", "embedb", 7},
+		{"Read", "embeda", 4},
+		{"Extra", "embedc", 7},
+	} {
+		sel := body.List[i].(*ast.ExprStmt).X.(*ast.CallExpr).Fun.(*ast.SelectorExpr)
+		obj, typ := ExprType(sel, ctxt.Import)
+		if obj == nil || obj.Name != want.name || typ.Kind != ast.Fun {
+			t.Errorf("%s: got %v of kind %v; want method %s", pretty{sel}, obj, typ.Kind, want.name)
+			continue
+		}
+		pos := ctxt.FileSet.Position(DeclPos(obj))
+		if pos.Filename != filepath.Join(dir, want.file, want.file+".go") || pos.Line != want.line {
+			t.Errorf("%s: declared at %v; want %s.go line %d", pretty{sel}, pos, want.file, want.line)
+		}
+	}
+}
+
+// exprTypes parses the Go source src as the named file and
+// returns the type and object of each expression in the body
+// of its last declaration, a function, keyed by the source
+// text of the expression. Expressions of unknown type are
+// omitted.
+func exprTypes(t *testing.T, filename, src string) (types map[string]string, objs map[string]*ast.Object) {
+	f, err := parser.ParseFile(FileSet, filename, src, 0, ast.NewScope(parser.Universe))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	types = make(map[string]string)
+	objs = make(map[string]*ast.Object)
+	body := f.Decls[len(f.Decls)-1].(*ast.FuncDecl).Body
+	ast.Walk(astVisitor(func(n ast.Node) bool {
+		if e, ok := n.(ast.Expr); ok {
+			obj, typ := ExprType(e, DefaultImporter)
+			if typ.Kind != ast.Bad {
+				types[pretty{e}.String()] = pretty{typ.Node}.String()
+				objs[pretty{e}.String()] = obj
+			}
+		}
+		return true
+	}), body)
+	return types, objs
+}
+
+var chanCode = `package chans
+
+type S struct {
+	Send chan<- int
+	Recv <-chan int
+	Both chan int
+	Nest chan<- <-chan int
+}
+
+func F(send chan<- int, recv <-chan int, both chan int, nest <-chan chan<- int) {
+	var s S
+	_ = s.Send
+	_ = s.Recv
+	_ = s.Both
+	_ = s.Nest
+	_ = <-nest
+	_ = (<-chan int)(both)
+	_, _ = send, recv
+}
+`
+
+var chanTests = []struct {
+	expr string
+	typ  string
+}{
+	{"send", "chan<- int"},
+	{"recv", "<-chan int"},
+	{"both", "chan int"},
+	{"nest", "<-chan chan<- int"},
+	{"s.Send", "chan<- int"},
+	{"s.Recv", "<-chan int"},
+	{"s.Both", "chan int"},
+	{"s.Nest", "chan<- <-chan int"},
+	{"<-nest", "chan<- int"},
+	{"(<-chan int)(both)", "<-chan int"},
+}
+
+func TestChanDirection(t *testing.T) {
+	types, _ := exprTypes(t, "chans.go", chanCode)
+	for i, test := range chanTests {
+		if got := types[test.expr]; got != test.typ {
+			t.Errorf("test %d: type of %s: got %q; want %q", i, test.expr, got, test.typ)
+		}
+	}
+}
+
+var methodExprCode = `package methods
+
+type T struct{}
+
+func (T) Val(x, y int) int { return x }
+
+func (*T) Ptr(s string, a ...bool) {}
+
+func F() {
+	var t T
+	_ = T.Val
+	_ = (*T).Ptr
+	_ = (*T).Val
+	_ = t.Val
+	_ = T.Val(t, 1, 2)
+}
+`
+
+var methodExprTests = []struct {
+	expr string
+	typ  string
+}{
+	{"T.Val", "func(T, int, int) int"},
+	{"(*T).Ptr", "func(*T, string, ...bool)"},
+	{"(*T).Val", "func(*T, int, int) int"},
+	{"t.Val", "func(x, y int) int"},
+	{"T.Val(t, 1, 2)", "int"},
+}
+
+func TestMethodExpr(t *testing.T) {
+	types, objs := exprTypes(t, "methods.go", methodExprCode)
+	for i, test := range methodExprTests {
+		if got := types[test.expr]; got != test.typ {
+			t.Errorf("test %d: type of %s: got %q; want %q", i, test.expr, got, test.typ)
+		}
+	}
+	// A method expression refers to the method itself.
+	val := objs["t.Val"]
+	if val == nil || val.Kind != ast.Fun || objs["T.Val"] != val || objs["(*T).Val"] != val {
+		t.Errorf("method expressions do not refer to method Val")
+	}
+}
+
+var variadicCode = `package variadic
+
+import "fmt"
+
+type T struct{ N int }
+
+func V(xs ...int) *T { return nil }
+
+func (t *T) M(f string, args ...interface{}) (string, error) { return f, nil }
+
+func F(s []int, a []interface{}, t *T) {
+	var f func(...string) []bool
+	ss := []string{}
+	_ = V()
+	_ = V(1, 2)
+	_ = V(s...)
+	_ = V(s...).N
+	_ = V(append(s, 1)...)
+	p, q := t.M("x", 1, 2)
+	r, err := t.M("x", a...)
+	_, _, _, _ = p, q, r, err
+	_ = f(ss...)[0]
+	_ = fmt.Sprintf("%d", 1)
+	_ = fmt.Sprintf("%d", a...)
+	_ = append(s, s...)
+}
+`
+
+var variadicTests = []struct {
+	expr string
+	typ  string
+}{
+	{"V", "func(xs ...int) *T"},
+	{"V()", "*T"},
+	{"V(1, 2)", "*T"},
+	{"V(s...)", "*T"},
+	{"V(s...).N", "int"},
+	{"V(append(s, 1)...)", "*T"},
+	{"t.M", "func(f string, args ...interface{}) (string, error)"},
+	{"p", "string"},
+	{"q", "error"},
+	{"r", "string"},
+	{"err", "error"},
+	{"f(ss...)", "[]bool"},
+	{"f(ss...)[0]", "bool"},
+	{`fmt.Sprintf("%d", 1)`, "string"},
+	{`fmt.Sprintf("%d", a...)`, "string"},
+	{"append(s, s...)", "[]int"},
+}
+
+// TestVariadicCall checks that calls of variadic functions
+// have the same type whether their final argument is a
+// list of values or a slice followed by "...".
+func TestVariadicCall(t *testing.T) {
+	types, objs := exprTypes(t, "variadic.go", variadicCode)
+	for i, test := range variadicTests {
+		if got := types[test.expr]; got != test.typ {
+			t.Errorf("test %d: type of %s: got %q; want %q", i, test.expr, got, test.typ)
+		}
+	}
+	if v := objs["V"]; v == nil || v.Kind != ast.Fun || v.Name != "V" {
+		t.Errorf("V does not refer to function V")
+	}
+	if sprintf := objs["fmt.Sprintf"]; sprintf == nil || sprintf.Kind != ast.Fun || sprintf.Name != "Sprintf" {
+		t.Errorf("fmt.Sprintf does not refer to function Sprintf")
+	}
+}
+
+var anonCode = `package anon
+
+var v struct {
+	A struct{ B int }
+}
+
+func F(p *struct{ C string }) interface {
+	M() int
+} {
+	s := []struct{ D bool }{}
+	_ = v.A.B
+	_ = p.C
+	_ = s[0].D
+	_ = F(nil).M
+	return nil
+}
+`
+
+var anonTests = []struct {
+	expr string
+	kind ast.ObjKind
+	typ  string
+	pos  string
+}{
+	{"v.A", ast.Var, "struct{ B int }", "anon.go:4:2"},
+	{"v.A.B", ast.Var, "int", "anon.go:4:12"},
+	{"p.C", ast.Var, "string", "anon.go:7:19"},
+	{"s[0].D", ast.Var, "bool", "anon.go:10:17"},
+	{"F(nil).M", ast.Fun, "func() int", "anon.go:8:2"},
+}
+
+func TestAnonymousMembers(t *testing.T) {
+	types, objs := exprTypes(t, "anon.go", anonCode)
+	// The members of anonymous struct and interface types
+	// resolve to their declarations in the type literals.
+	for i, test := range anonTests {
+		obj := objs[test.expr]
+		if obj == nil {
+			t.Errorf("test %d: no object for %s", i, test.expr)
+			continue
+		}
+		if obj.Kind != test.kind {
+			t.Errorf("test %d: kind of %s: got %v; want %v", i, test.expr, obj.Kind, test.kind)
+		}
+		if got := types[test.expr]; got != test.typ {
+			t.Errorf("test %d: type of %s: got %q; want %q", i, test.expr, got, test.typ)
+		}
+		if got := FileSet.Position(DeclPos(obj)).String(); got != test.pos {
+			t.Errorf("test %d: declaration of %s: got %s; want %s", i, test.expr, got, test.pos)
+		}
+	}
+}
+
+var indexCode = `package index
+
+type T struct{ F int }
+
+func (T) M() string { return "" }
+
+type L []T
+
+func F(m map[string]T, mp map[int]*T, s []T, l L, a [2]T, pa *[2]T, str string) {
+	_ = m["k"]
+	_ = m["k"].F
+	_ = mp[0].F
+	_ = s[0].F
+	_ = s[0].M()
+	_ = s[1:][0].F
+	_ = l[0].F
+	_ = a[0].F
+	_ = pa[0].F
+	_ = str[0]
+	_ = m["k"].M()[0]
+}
+`
+
+var indexTests = []struct {
+	expr string
+	typ  string
+}{
+	{`m["k"]`, "T"},
+	{`m["k"].F`, "int"},
+	{"mp[0]", "*T"},
+	{"mp[0].F", "int"},
+	{"s[0]", "T"},
+	{"s[0].F", "int"},
+	{"s[0].M", "func() string"},
+	{"s[0].M()", "string"},
+	{"s[1:][0].F", "int"},
+	{"l[0].F", "int"},
+	{"a[0].F", "int"},
+	{"pa[0]", "T"},
+	{"pa[0].F", "int"},
+	{"str[0]", "byte"},
+	{`m["k"].M()[0]`, "byte"},
+}
+
+// TestIndexExpr checks that the elements of maps, slices,
+// arrays and strings have their element types, so that
+// selectors on them resolve.
+func TestIndexExpr(t *testing.T) {
+	types, objs := exprTypes(t, "index.go", indexCode)
+	for i, test := range indexTests {
+		if got := types[test.expr]; got != test.typ {
+			t.Errorf("test %d: type of %s: got %q; want %q", i, test.expr, got, test.typ)
+		}
+	}
+	for _, e := range []string{`m["k"].F`, "mp[0].F", "s[0].F", "l[0].F", "a[0].F", "pa[0].F"} {
+		if obj := objs[e]; obj == nil || obj.Kind != ast.Var || obj.Name != "F" {
+			t.Errorf("%s does not refer to field F", e)
+		}
+	}
+	if obj := objs["s[0].M"]; obj == nil || obj.Kind != ast.Fun || obj.Name != "M" {
+		t.Errorf("s[0].M does not refer to method M")
+	}
+}
+
+var typeAssertCode = `package asserts
+
+type T struct{ F int }
+
+func F(x interface{}) {
+	_ = x.(T)
+	_ = x.(*T)
+	_ = x.(T).F
+	t, ok := x.(T)
+	_, _ = t, ok
+}
+`
+
+// TestTypeAssert checks that the type operand of a type
+// assertion refers to the asserted type, and that the
+// assertion has that type.
+func TestTypeAssert(t *testing.T) {
+	f, err := parser.ParseFile(FileSet, "asserts.go", typeAssertCode, 0, ast.NewScope(parser.Universe))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	var asserts []*ast.TypeAssertExpr
+	body := f.Decls[len(f.Decls)-1].(*ast.FuncDecl).Body
+	ast.Walk(astVisitor(func(n ast.Node) bool {
+		if e, ok := n.(*ast.TypeAssertExpr); ok {
+			asserts = append(asserts, e)
+		}
+		return true
+	}), body)
+	if len(asserts) != 4 {
+		t.Fatalf("found %d type assertions; want 4", len(asserts))
+	}
+	for _, e := range asserts {
+		typeExpr := e.Type
+		if star, ok := typeExpr.(*ast.StarExpr); ok {
+			typeExpr = star.X
+		}
+		obj, typ := ExprType(typeExpr, DefaultImporter)
+		if obj == nil || obj.Kind != ast.Typ || obj.Name != "T" || typ.Kind != ast.Typ {
+			t.Errorf("type operand of %s: got %v of kind %v; want type T", pretty{e}, obj, typ.Kind)
+		}
+		_, typ = ExprType(e, DefaultImporter)
+		got, want := pretty{typ.Node}.String(), pretty{e.Type}.String()
+		if got != want || typ.Kind != ast.Var {
+			t.Errorf("type of %s: got %s of kind %v; want value of type %s", pretty{e}, got, typ.Kind, want)
+		}
+	}
+	obj, typ := ExprType(body.List[2].(*ast.AssignStmt).Rhs[0], DefaultImporter)
+	got := pretty{typ.Node}.String()
+	if obj == nil || obj.Name != "F" || got != "int" {
+		t.Errorf("x.(T).F: got %v of type %s; want field F of type int", obj, got)
+	}
+	obj, typ = ExprType(body.List[3].(*ast.AssignStmt).Lhs[0], DefaultImporter)
+	got = pretty{typ.Node}.String()
+	if obj == nil || obj.Name != "t" || got != "T" {
+		t.Errorf("t: got %v of type %s; want variable t of type T", obj, got)
+	}
+}
+
+var signatureCode = `package sigs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+func F(r *bufio.Reader) {
+	_ = fmt.Printf
+	_ = fmt.Sprint
+	_ = io.Copy
+	_ = io.ReadFull
+	_ = tabwriter.NewWriter
+	_ = r.ReadLine
+	_ = append
+	_ = copy
+	_ = len
+	_ = recover
+	_ = append([]string{}, "x")
+	_ = len("x")
+}
+`
+
+// builtinSignatures holds the types expected for the
+// expressions in signatureCode that involve predeclared
+// functions, which have no source to compare against.
+var builtinSignatures = map[string]string{
+	"append":                  "func(slice []Type, elems ...Type) []Type",
+	"copy":                    "func(dst, src []Type) int",
+	"len":                     "func(v Type) int",
+	"recover":                 "func() interface{}",
+	`append([]string{}, "x")`: "[]string",
+	`len("x")`:                "int",
+}
+
+func TestSignature(t *testing.T) {
+	f, err := parser.ParseFile(FileSet, "sigs.go", signatureCode, 0, ast.NewScope(parser.Universe))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	body := f.Decls[len(f.Decls)-1].(*ast.FuncDecl).Body
+	for _, stmt := range body.List {
+		e := stmt.(*ast.AssignStmt).Rhs[0]
+		obj, typ := ExprType(e, DefaultImporter)
+		if typ.Kind == ast.Bad {
+			t.Errorf("no type found for %v", pretty{e})
+			continue
+		}
+		got := pretty{typ.Node}.String()
+		want, ok := builtinSignatures[pretty{e}.String()]
+		if !ok {
+			// The signature should print as it
+			// appears in the function's source.
+			fd, ok := obj.Decl.(*ast.FuncDecl)
+			if !ok {
+				t.Errorf("%v does not refer to a function declaration", pretty{e})
+				continue
+			}
+			want = "func" + sourceText(t, fd.Type.Params.Pos(), fd.Type.End())
+		}
+		if got != want {
+			t.Errorf("type of %v: got %q; want %q", pretty{e}, got, want)
+		}
+	}
+}
+
+// sourceText returns the source text between
+// the positions start and end in FileSet.
+func sourceText(t *testing.T, start, end token.Pos) string {
+	p0, p1 := FileSet.Position(start), FileSet.Position(end)
+	data, err := ioutil.ReadFile(p0.Filename)
+	if err != nil {
+		t.Fatalf("cannot read source: %v", err)
+	}
+	return string(data[p0.Offset:p1.Offset])
+}
+
+var derefCode = `package deref
+
+type T struct{ F int }
+
+type (
+	P = *T
+	A = T
+	N *T
+	R *R
+)
+
+func F(p P, pa *A, pp **T, n N, r R) {
+	_, _, _, _, _ = p, pa, pp, n, r
+}
+`
+
+var derefTests = []struct {
+	expr  string
+	typ   string
+	deref string
+}{
+	{"p", "*T", "T"},
+	{"pa", "*T", "T"},
+	{"pp", "**T", "T"},
+	{"n", "N", "T"},
+	{"r", "R", "R"},
+}
+
+func TestDeref(t *testing.T) {
+	f, err := parser.ParseFile(FileSet, "deref.go", derefCode, 0, ast.NewScope(parser.Universe))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	stmt := f.Decls[len(f.Decls)-1].(*ast.FuncDecl).Body.List[0].(*ast.AssignStmt)
+	for i, test := range derefTests {
+		e := stmt.Rhs[i]
+		_, typ := ExprType(e, DefaultImporter)
+		got := pretty{typ.Node}.String()
+		deref := pretty{typ.Deref(DefaultImporter).Node}.String()
+		if got != test.typ || deref != test.deref {
+			t.Errorf("type of %v: got %q, dereferenced %q; want %q, %q", pretty{e}, got, deref, test.typ, test.deref)
+		}
+	}
+}
+
+var aliasCycleCode = `package cycles
+
+type (
+	A = B
+	B = A
+	C = A
+	P = *P
+	S = struct{ Next *S }
+	T struct{ Next *T }
+	U = T
+)
+
+func F(a A, b B, c C, p P, s S, u U) {
+	_, _, _, _, _, _ = a, b, c, p, s, u
+}
+`
+
+// TestAliasCycle checks that an alias declared in terms
+// of itself, which is invalid, has no type, and that
+// aliases of valid recursive types are not affected.
+func TestAliasCycle(t *testing.T) {
+	f, err := parser.ParseFile(FileSet, "cycles.go", aliasCycleCode, 0, ast.NewScope(parser.Universe))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	stmt := f.Decls[len(f.Decls)-1].(*ast.FuncDecl).Body.List[0].(*ast.AssignStmt)
+	for i, want := range []string{"", "", "", "", "", "T"} {
+		e := stmt.Rhs[i]
+		_, typ := ExprType(e, DefaultImporter)
+		got := ""
+		if typ.Kind != ast.Bad {
+			got = pretty{typ.Node}.String()
+		}
+		if got != want {
+			t.Errorf("type of %v: got %q; want %q", pretty{e}, got, want)
+		}
+		// Neither of these must loop forever.
+		typ.Deref(DefaultImporter)
+		typ.Underlying(true, DefaultImporter)
+	}
+}
+
+var underlyingCycleCode = `package cycles
+
+type (
+	A B
+	B A
+	C A
+	T struct{ Next *T }
+	U T
+)
+
+func F(a A, b B, c C, u U) {
+	_, _, _, _ = a, b, c, u
+}
+`
+
+// TestUnderlyingCycle checks that a type defined in terms
+// of itself, which is invalid, has no underlying type.
+func TestUnderlyingCycle(t *testing.T) {
+	f, err := parser.ParseFile(FileSet, "cycles.go", underlyingCycleCode, 0, ast.NewScope(parser.Universe))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	stmt := f.Decls[len(f.Decls)-1].(*ast.FuncDecl).Body.List[0].(*ast.AssignStmt)
+	for i, want := range []string{"", "", "", "struct{ Next *T }"} {
+		e := stmt.Rhs[i]
+		_, typ := ExprType(e, DefaultImporter)
+		u := typ.Underlying(true, DefaultImporter)
+		got := ""
+		if u.Kind != ast.Bad {
+			got = pretty{u.Node}.String()
+		}
+		if got != want {
+			t.Errorf("underlying type of %v: got %q; want %q", pretty{e}, got, want)
+		}
+	}
+}
+
+var constCode = `package consts
+
+type Kind uint8
+
+const (
+	A Kind = iota
+	B
+	C
+	_
+	E
+)
+
+const (
+	KB = 1 << (10 * (iota + 1))
+	MB
+)
+
+const (
+	S    = "hello"
+	T    = S + ", world"
+	N    = len(T)
+	R    = 'x'
+	Z    = string(R)
+	Max  = ^Kind(0)
+	Neg  = ^1
+	Flag = B | E
+	Eq   = S == "hello" && !(N < 3)
+	F    = 1.5
+	Div  = 1 / (A - A)
+)
+
+var V = 1
+
+const Bad = V
+`
+
+var constTests = []struct {
+	name  string
+	value string
+	err   string
+}{
+	{"A", "0", ""},
+	{"C", "2", ""},
+	{"E", "4", ""},
+	{"KB", "1024", ""},
+	{"MB", "1048576", ""},
+	{"T", `"hello, world"`, ""},
+	{"N", "12", ""},
+	{"R", "120", ""},
+	{"Z", `"x"`, ""},
+	{"Max", "255", ""},
+	{"Neg", "-2", ""},
+	{"Flag", "5", ""},
+	{"Eq", "true", ""},
+	{"F", "", "cannot evaluate FLOAT constant 1.5"},
+	{"Div", "", "division by zero in 1 / (A - A)"},
+	{"Bad", "", "V is not constant"},
+}
+
+func TestConstValue(t *testing.T) {
+	scope := ast.NewScope(parser.Universe)
+	_, err := parser.ParseFile(FileSet, "consts.go", constCode, 0, scope)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	for i, test := range constTests {
+		obj := scope.Lookup(test.name)
+		if obj == nil {
+			t.Fatalf("test %d: no object for %s", i, test.name)
+		}
+		value, err := ConstValue(&ast.Ident{Name: test.name, Obj: obj}, DefaultImporter)
+		errStr := ""
+		if err != nil {
+			errStr = err.Error()
+		}
+		if value != test.value || errStr != test.err {
+			t.Errorf("test %d: value of %s: got %q, %q; want %q, %q", i, test.name, value, errStr, test.value, test.err)
+		}
+	}
+}
+
+var litValueTests = []struct {
+	kind  token.Token
+	lit   string
+	value string
+	err   string
+}{
+	{token.CHAR, `'x'`, "120", ""},
+	{token.CHAR, `'\n'`, "10", ""},
+	{token.CHAR, `'\''`, "39", ""},
+	{token.CHAR, `'\x80'`, "128", ""},
+	{token.CHAR, `'\377'`, "255", ""},
+	{token.CHAR, `'\u00e9'`, "233", ""},
+	{token.CHAR, `'世'`, "19990", ""},
+	{token.CHAR, `''`, "", "invalid literal ''"},
+	{token.CHAR, `'ab'`, "", "invalid literal 'ab'"},
+	{token.INT, `0x10`, "16", ""},
+	{token.STRING, `"\x80"`, "\x80", ""},
+	{token.FLOAT, `1.5`, "", "cannot evaluate FLOAT constant 1.5"},
+}
+
+func TestLitValue(t *testing.T) {
+	for i, test := range litValueTests {
+		v, err := litValue(&ast.BasicLit{Kind: test.kind, Value: test.lit})
+		value, errStr := "", ""
+		if err != nil {
+			errStr = err.Error()
+		} else {
+			value = fmt.Sprint(v)
+		}
+		if value != test.value || errStr != test.err {
+			t.Errorf("test %d: value of %s: got %q, %q; want %q, %q", i, test.lit, value, errStr, test.value, test.err)
+		}
+	}
+}
+
 func TestOneFile(t *testing.T) {
 	code, offsetMap := translateSymbols(testCode)
 	//fmt.Printf("------------------- {%s}\n", code)
@@ -439,6 +1319,8 @@ func main() {
 		xx_i.xx_value#i()
 	case xx_other:
 		xx_i.xx_value#x()
+	case nil:
+		xx_i.xx_value#i()
 	}
 	var xx_iembed@v xx_interfaceEmbed
 	xx_iembed.xx_value#i()